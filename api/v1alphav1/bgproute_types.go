@@ -21,25 +21,85 @@ import (
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 )
 
+// NeverMatchLabelKey is the label key of the default ServiceSelector. It is not a valid label key, so the default
+// selector never selects any service
+const NeverMatchLabelKey = "__never_match__"
+
+// Annotations of the advertised services overriding the RouteAttributes of the BGPRoute, each of them in the format of
+// the corresponding field with lists given as comma separated values. An empty annotation unsets the attribute
+const (
+	CommunitiesAnnotation         = "bgp.routebird.dev/communities"
+	LargeCommunitiesAnnotation    = "bgp.routebird.dev/large-communities"
+	ExtendedCommunitiesAnnotation = "bgp.routebird.dev/extended-communities"
+	LocalPreferenceAnnotation     = "bgp.routebird.dev/local-preference"
+	MEDAnnotation                 = "bgp.routebird.dev/med"
+	ASPathPrependAnnotation       = "bgp.routebird.dev/as-path-prepend"
+	NextHopsAnnotation            = "bgp.routebird.dev/next-hops"
+)
+
 // BGPRouteSpec defines the desired state of BGPRoute.
+// +kubebuilder:validation:XValidation:rule="has(self.bgpPeers) || has(self.nodePeers) || has(self.listenRanges)",message="at least one of bgpPeers, nodePeers or listenRanges must be set"
+// +kubebuilder:validation:XValidation:rule="has(self.localASN) || has(self.localASNRange)",message="at least one of localASN or localASNRange must be set"
 type BGPRouteSpec struct {
 	// ServiceSelector defines which labels should be contained by services in order to be monitored and advertised
 	// +kubebuilder:default:={"matchLabels":{"__never_match__":"true"}}
 	ServiceSelector metav1.LabelSelector `json:"serviceSelector"`
 
-	// LocalASN of the node where the route is advertised
+	// LocalASN of the node where the route is advertised, either a 2-octet or a 4-octet ASN. Nodes getting their ASN
+	// from LocalASNFrom or LocalASNRange use it as a fallback
 	// +kubebuilder:validation:Minimum=1
-	LocalASN uint32 `json:"localASN"`
+	// +kubebuilder:validation:Maximum=4294967294
+	// +kubebuilder:validation:XValidation:rule="self != 23456 && self != 65535",message="AS numbers 23456 (AS_TRANS) and 65535 are reserved"
+	LocalASN uint32 `json:"localASN,omitempty"`
+
+	// LocalASNFrom reads the local ASN of each node from a label or an annotation of the node, so that every node or
+	// rack runs in its own AS (RFC 7938). Nodes without a valid ASN in it fall back to LocalASNRange and LocalASN
+	LocalASNFrom *NodeMetadataSource `json:"localASNFrom,omitempty"`
+
+	// LocalASNRange allocates a distinct local ASN to every node without one from LocalASNFrom, such as 65000-65999.
+	// Allocations are recorded in the status so that nodes keep their ASN while they exist
+	LocalASNRange *ASNRange `json:"localASNRange,omitempty"`
+
+	// RequireFourOctetAS rejects the sessions with peers not supporting 4-octet AS numbers (RFC 6793) on the nodes
+	// whose local ASN does not fit in 2 octets. Such peers see AS_TRANS in place of the local ASN otherwise
+	RequireFourOctetAS bool `json:"requireFourOctetAS,omitempty"`
+
+	// RouterIDFrom reads the router ID of each node from a label or an annotation of the node. The router ID defaults
+	// to the first IPv4 InternalIP of the node, or is derived from the local address of each session otherwise
+	RouterIDFrom *NodeMetadataSource `json:"routerIDFrom,omitempty"`
 
 	// BGPLocalPort is the port used by the BGP agent to listen for incoming BGP connections
 	// +kubebuilder:validation:Minimum=1
 	BGPLocalPort int32 `json:"bgpLocalPort"`
 
+	// GracefulRestart enables the BGP Graceful Restart capability, so that peers keep forwarding traffic to the routes
+	// of an agent while it restarts to apply new BGP speaker settings. When set, sessions supporting it are closed
+	// without withdrawing the routes on such restarts, while they are still drained when the agent stops
+	GracefulRestart *GracefulRestart `json:"gracefulRestart,omitempty"`
+
+	// Attributes are the path attributes attached to the routes of the selected services, unless overridden by the
+	// annotations of the service
+	Attributes RouteAttributes `json:"attributes,omitempty"`
+
 	// Peers to which the route should be advertised
 	// todo: think on whether might make sense to have 0 peers, since this is a P2P protocol
-	// +kubebuilder:validation:MinItems=1
 	Peers []BGPPeer `json:"bgpPeers,omitempty"`
 
+	// NodePeers are peers only established by the agents of the nodes matching their node selector, such as the top
+	// of rack switches of each rack
+	NodePeers []NodePeerGroup `json:"nodePeers,omitempty"`
+
+	// ListenRanges accept the sessions initiated by any peer within their prefixes on BGPLocalPort, such as route
+	// servers establishing sessions with the nodes as they appear and disappear with autoscaling
+	ListenRanges []ListenRange `json:"listenRanges,omitempty"`
+
+	// PrefixLists are the named lists of prefixes matched by the policies
+	PrefixLists []PrefixList `json:"prefixLists,omitempty"`
+
+	// Policies are the named route policies that filter and modify the routes advertised to the peers referencing
+	// them in their ExportPolicy, and the routes received from the peers referencing them in their ImportPolicy
+	Policies []Policy `json:"policies,omitempty"`
+
 	// Filtering capabilities for the route advertisement
 	NodeSelector map[string]string   `json:"nodeSelector,omitempty"`
 	Tolerations  []corev1.Toleration `json:"tolerations,omitempty"`
@@ -48,13 +108,355 @@ type BGPRouteSpec struct {
 	Agent Agent `json:"agent,omitempty"`
 }
 
+// ASNRange is an inclusive range of ASNs
+// +kubebuilder:validation:XValidation:rule="self.first <= self.last",message="first must not be greater than last"
+type ASNRange struct {
+	// First ASN of the range
+	// +kubebuilder:validation:Minimum=1
+	// +kubebuilder:validation:Maximum=4294967294
+	First uint32 `json:"first"`
+	// Last ASN of the range
+	// +kubebuilder:validation:Minimum=1
+	// +kubebuilder:validation:Maximum=4294967294
+	Last uint32 `json:"last"`
+}
+
+// GracefulRestart configures the BGP Graceful Restart capability (RFC 4724)
+type GracefulRestart struct {
+	// RestartTimeSeconds is the time peers retain the routes of an agent after losing its session, waiting for it to
+	// come back
+	// +kubebuilder:default=120
+	// +kubebuilder:validation:Minimum=1
+	// +kubebuilder:validation:Maximum=4095
+	RestartTimeSeconds int32 `json:"restartTimeSeconds"`
+}
+
+// RouteAttributes are the path attributes attached to the advertised routes
+type RouteAttributes struct {
+	// Communities attached to the routes (RFC 1997), either as ASN:value or as one of the well-known names
+	// no-export, no-advertise, no-export-subconfed, no-peer, blackhole and graceful-shutdown
+	// +kubebuilder:validation:items:Pattern=`^([0-9]+:[0-9]+|no-export|no-advertise|no-export-subconfed|no-peer|blackhole|graceful-shutdown)$`
+	Communities []string `json:"communities,omitempty"`
+
+	// LargeCommunities attached to the routes (RFC 8092), as globalAdministrator:localData1:localData2
+	// +kubebuilder:validation:items:Pattern=`^[0-9]+:[0-9]+:[0-9]+$`
+	LargeCommunities []string `json:"largeCommunities,omitempty"`
+
+	// ExtendedCommunities attached to the routes (RFC 4360), as route targets or route origins in the rt:admin:value
+	// and soo:admin:value formats, where the administrator is either an ASN or an IPv4 address
+	// +kubebuilder:validation:items:Pattern=`^(rt|soo):[0-9a-fA-F.]+:[0-9]+$`
+	ExtendedCommunities []string `json:"extendedCommunities,omitempty"`
+
+	// LocalPreference is the LOCAL_PREF of the routes advertised to internal peers, 100 when not set
+	// +kubebuilder:validation:Minimum=0
+	// +kubebuilder:validation:Maximum=4294967295
+	LocalPreference *uint32 `json:"localPreference,omitempty"`
+
+	// MED is the MULTI_EXIT_DISC of the routes, which is not sent when not set
+	// +kubebuilder:validation:Minimum=0
+	// +kubebuilder:validation:Maximum=4294967295
+	MED *uint32 `json:"med,omitempty"`
+
+	// ASPathPrepend is the number of additional times the local ASN is prepended to the AS_PATH of the routes
+	// advertised to external peers, making them less preferred
+	// +kubebuilder:validation:Minimum=0
+	// +kubebuilder:validation:Maximum=16
+	ASPathPrepend int32 `json:"asPathPrepend,omitempty"`
+
+	// NextHops override the next hop of the routes, at most one IPv4 and one IPv6 address. Routes of address
+	// families without next hop use the address of the node in the session with the peer
+	// +kubebuilder:validation:MaxItems=2
+	NextHops []string `json:"nextHops,omitempty"`
+}
+
+// PrefixList is a named list of prefixes, matching a route when any of its entries matches it
+type PrefixList struct {
+	Name string `json:"name"`
+	// +kubebuilder:validation:MinItems=1
+	Entries []PrefixListEntry `json:"entries"`
+}
+
+// PrefixListEntry matches the routes contained in Prefix whose length is within the range given by GE and LE. Without
+// GE nor LE only Prefix itself is matched, with only GE the range ends at the maximum length of the address family and
+// with only LE the range starts at the length of Prefix
+type PrefixListEntry struct {
+	// Prefix in CIDR notation containing the matched routes
+	Prefix string `json:"prefix"`
+	// GE is the minimum length of the matched routes
+	// +kubebuilder:validation:Minimum=0
+	// +kubebuilder:validation:Maximum=128
+	GE int32 `json:"ge,omitempty"`
+	// LE is the maximum length of the matched routes
+	// +kubebuilder:validation:Minimum=0
+	// +kubebuilder:validation:Maximum=128
+	LE int32 `json:"le,omitempty"`
+}
+
+// PolicyAction decides whether a route is advertised to or accepted from a peer
+// +kubebuilder:validation:Enum=Accept;Reject
+type PolicyAction string
+
+const (
+	PolicyActionAccept PolicyAction = "Accept"
+	PolicyActionReject PolicyAction = "Reject"
+)
+
+// Policy is a named route policy. Its statements are evaluated in order and the first one matching a route decides
+// whether the route is advertised and how its attributes are modified
+type Policy struct {
+	Name       string            `json:"name"`
+	Statements []PolicyStatement `json:"statements,omitempty"`
+	// DefaultAction applies to the routes not matched by any statement
+	// +kubebuilder:default=Reject
+	DefaultAction PolicyAction `json:"defaultAction,omitempty"`
+}
+
+// PolicyStatement applies its action to the routes matching all the conditions of Match
+type PolicyStatement struct {
+	// Match contains the conditions of the statement, an empty match matches every route
+	Match PolicyMatch `json:"match,omitempty"`
+	// +kubebuilder:default=Accept
+	Action PolicyAction `json:"action,omitempty"`
+	// Set modifies the attributes of the accepted routes
+	Set *PolicySet `json:"set,omitempty"`
+}
+
+// PolicyMatch contains the conditions of a policy statement, all of which must be met by a route
+type PolicyMatch struct {
+	// PrefixLists are the names of the prefix lists matched by the route, any of them is enough
+	PrefixLists []string `json:"prefixLists,omitempty"`
+	// PrefixLength is the range of lengths of the route
+	PrefixLength *PrefixLengthRange `json:"prefixLength,omitempty"`
+	// ServiceNamespaces are the namespaces of the service advertised by the route, any of them is enough
+	ServiceNamespaces []string `json:"serviceNamespaces,omitempty"`
+	// ServiceSelector selects the service advertised by the route by its labels
+	ServiceSelector *metav1.LabelSelector `json:"serviceSelector,omitempty"`
+}
+
+// PrefixLengthRange is an inclusive range of prefix lengths
+type PrefixLengthRange struct {
+	// +kubebuilder:validation:Minimum=0
+	// +kubebuilder:validation:Maximum=128
+	Min int32 `json:"min,omitempty"`
+	// +kubebuilder:validation:Minimum=0
+	// +kubebuilder:validation:Maximum=128
+	Max int32 `json:"max"`
+}
+
+// PolicySet modifies the attributes of a route. Communities are added to the ones of the route, while the rest of the
+// attributes replace the ones of the route when set
+type PolicySet struct {
+	AddCommunities         []string `json:"addCommunities,omitempty"`
+	AddLargeCommunities    []string `json:"addLargeCommunities,omitempty"`
+	AddExtendedCommunities []string `json:"addExtendedCommunities,omitempty"`
+
+	// +kubebuilder:validation:Minimum=0
+	// +kubebuilder:validation:Maximum=4294967295
+	LocalPreference *uint32 `json:"localPreference,omitempty"`
+	// +kubebuilder:validation:Minimum=0
+	// +kubebuilder:validation:Maximum=4294967295
+	MED *uint32 `json:"med,omitempty"`
+	// +kubebuilder:validation:Minimum=0
+	// +kubebuilder:validation:Maximum=16
+	ASPathPrepend *int32 `json:"asPathPrepend,omitempty"`
+	// +kubebuilder:validation:MaxItems=2
+	NextHops []string `json:"nextHops,omitempty"`
+}
+
+// +kubebuilder:validation:XValidation:rule="[has(self.address), has(self.addressFrom), has(self.interface)].filter(x, x).size() == 1",message="exactly one of address, addressFrom or interface must be set"
+// +kubebuilder:validation:XValidation:rule="!has(self.interface) || (!has(self.bfd) && !has(self.sourceAddress))",message="bfd and sourceAddress are not supported with interface"
 type BGPPeer struct {
 	// todo: add options for DNS resolution
 	// Address of the remote peer receiving BGP updates
 	// +kubebuilder:validation:Pattern=`^([0-9a-fA-F:.]+)$`
-	Address string `json:"address"`
-	// ASN of the remote peer receiving BGP updates
+	Address string `json:"address,omitempty"`
+	// AddressFrom reads the address of the peer from a label or an annotation of each node instead, so that every
+	// node establishes a session with its own peer. The value may contain several comma separated addresses, each of
+	// them being a different peer. Nodes without the label or annotation do not establish any session with the peer
+	AddressFrom *NodeMetadataSource `json:"addressFrom,omitempty"`
+	// Interface is the name of the network interface connecting the node with the peer, for unnumbered sessions over
+	// IPv6 link-local addresses. The address of the peer is discovered from the IPv6 router advertisements it sends
+	// over the interface, and IPv4 routes are advertised with IPv6 next hops to it (RFC 8950)
+	// +kubebuilder:validation:Pattern=`^[^/:\s]{1,15}$`
+	Interface string `json:"interface,omitempty"`
+	// ASN of the remote peer receiving BGP updates, either a 2-octet or a 4-octet ASN
+	// +kubebuilder:validation:Minimum=1
+	// +kubebuilder:validation:Maximum=4294967294
+	// +kubebuilder:validation:XValidation:rule="self != 23456 && self != 65535",message="AS numbers 23456 (AS_TRANS) and 65535 are reserved"
 	ASN uint32 `json:"asn"`
+
+	// PasswordSecretRef references the key of a secret, in the namespace of the BGPRoute, containing the password
+	// used to sign the TCP segments of the session with the peer (TCP MD5, RFC 2385)
+	PasswordSecretRef *corev1.SecretKeySelector `json:"passwordSecretRef,omitempty"`
+
+	// HoldTimeSeconds is the hold time proposed to the peer, the session uses the lowest of both proposals. Zero
+	// disables the hold timer and the keepalives. Defaults to 90 seconds
+	// +kubebuilder:validation:Minimum=0
+	// +kubebuilder:validation:Maximum=65535
+	HoldTimeSeconds *int32 `json:"holdTimeSeconds,omitempty"`
+
+	// KeepaliveTimeSeconds is the interval between KEEPALIVE messages, capped to a third of the negotiated hold time.
+	// Defaults to a third of the negotiated hold time
+	// +kubebuilder:validation:Minimum=1
+	// +kubebuilder:validation:Maximum=21845
+	KeepaliveTimeSeconds *int32 `json:"keepaliveTimeSeconds,omitempty"`
+
+	// ConnectRetryTimeSeconds is the time waited between connection attempts to the peer. Defaults to 30 seconds
+	// +kubebuilder:validation:Minimum=1
+	ConnectRetryTimeSeconds int32 `json:"connectRetryTimeSeconds,omitempty"`
+
+	// Passive makes the agent wait for the peer to connect on BGPLocalPort instead of connecting to it
+	Passive bool `json:"passive,omitempty"`
+
+	// EBGPMultihopTTL is the TTL of the packets sent to an external peer that is not directly connected. External
+	// peers are expected to be directly connected by default, so their packets are sent with a TTL of 1
+	// +kubebuilder:validation:Minimum=1
+	// +kubebuilder:validation:Maximum=255
+	EBGPMultihopTTL int32 `json:"ebgpMultihopTTL,omitempty"`
+
+	// GTSM enables the Generalized TTL Security Mechanism (RFC 5082). Packets are sent with a TTL of 255 and only
+	// packets from peers at most EBGPMultihopTTL hops away, one by default, are accepted
+	GTSM bool `json:"gtsm,omitempty"`
+
+	// SourceAddress is the local address from which the connections to the peer are initiated
+	// +kubebuilder:validation:Pattern=`^([0-9a-fA-F:.]+)$`
+	SourceAddress string `json:"sourceAddress,omitempty"`
+
+	// ExportPolicy is the name of the policy applied to the routes advertised to the peer. Every route is advertised
+	// unmodified when not set
+	ExportPolicy string `json:"exportPolicy,omitempty"`
+
+	// ImportPolicy is the name of the policy applied to the routes received from the peer. Every route is rejected when
+	// not set. Received routes have no service, so they never match the service conditions of the policy
+	ImportPolicy string `json:"importPolicy,omitempty"`
+
+	// MaxPrefixes limits the number of routes received from the peer
+	MaxPrefixes *MaxPrefixes `json:"maxPrefixes,omitempty"`
+
+	// BFD enables Bidirectional Forwarding Detection with the peer, so that the BGP session is torn down as soon as
+	// the forwarding path to the peer fails instead of waiting for the hold timer to expire
+	BFD *BFD `json:"bfd,omitempty"`
+}
+
+// NodeMetadataSource references a label or an annotation of a node
+// +kubebuilder:validation:XValidation:rule="has(self.label) != has(self.annotation)",message="exactly one of label or annotation must be set"
+type NodeMetadataSource struct {
+	// Label is the key of the node label containing the value
+	Label string `json:"label,omitempty"`
+	// Annotation is the key of the node annotation containing the value
+	Annotation string `json:"annotation,omitempty"`
+}
+
+// NodePeerGroup contains the peers of the nodes matching its node selector
+type NodePeerGroup struct {
+	// NodeSelector selects the nodes establishing sessions with the peers, an empty selector selects every node
+	NodeSelector metav1.LabelSelector `json:"nodeSelector,omitempty"`
+	// Peers established by the selected nodes
+	// +kubebuilder:validation:MinItems=1
+	Peers []BGPPeer `json:"bgpPeers"`
+}
+
+// ListenRange accepts the sessions of the peers connecting from any address within its prefix. The peers are never
+// dialed and their ASN is learned from their OPEN message, which must be within PeerASNs. Configured peers take
+// precedence over the listen ranges for the connections from their address
+type ListenRange struct {
+	// Prefix in CIDR notation containing the addresses of the accepted peers
+	// +kubebuilder:validation:Pattern=`^([0-9a-fA-F:.]+)/[0-9]+$`
+	Prefix string `json:"prefix"`
+
+	// PeerASNs are the ranges of ASNs the accepted peers may use, sessions of peers with any other ASN are rejected
+	// +kubebuilder:validation:MinItems=1
+	PeerASNs []ASNRange `json:"peerASNs"`
+
+	// MaxPeers limits the number of sessions accepted from the range at the same time, unlimited when not set
+	// +kubebuilder:validation:Minimum=1
+	MaxPeers int32 `json:"maxPeers,omitempty"`
+
+	// HoldTimeSeconds is the hold time proposed to the accepted peers. Defaults to 90 seconds
+	// +kubebuilder:validation:Minimum=0
+	// +kubebuilder:validation:Maximum=65535
+	HoldTimeSeconds *int32 `json:"holdTimeSeconds,omitempty"`
+
+	// KeepaliveTimeSeconds is the interval between KEEPALIVE messages, capped to a third of the negotiated hold time
+	// +kubebuilder:validation:Minimum=1
+	// +kubebuilder:validation:Maximum=21845
+	KeepaliveTimeSeconds *int32 `json:"keepaliveTimeSeconds,omitempty"`
+
+	// EBGPMultihopTTL is the TTL of the packets sent to the accepted peers. As their ASN is unknown when they connect,
+	// the accepted peers are expected to be directly connected unless it is set, whether they are external or not.
+	// Ranges whose PeerASNs only contain the local ASN of the node accept internal peers, whose TTL is not limited
+	// +kubebuilder:validation:Minimum=1
+	// +kubebuilder:validation:Maximum=255
+	EBGPMultihopTTL int32 `json:"ebgpMultihopTTL,omitempty"`
+
+	// GTSM enables the Generalized TTL Security Mechanism (RFC 5082) with the accepted peers
+	GTSM bool `json:"gtsm,omitempty"`
+
+	// ExportPolicy is the name of the policy applied to the routes advertised to the accepted peers. Every route is
+	// advertised unmodified when not set
+	ExportPolicy string `json:"exportPolicy,omitempty"`
+
+	// ImportPolicy is the name of the policy applied to the routes received from the accepted peers. Every route is
+	// rejected when not set
+	ImportPolicy string `json:"importPolicy,omitempty"`
+
+	// MaxPrefixes limits the number of routes received from each of the accepted peers
+	MaxPrefixes *MaxPrefixes `json:"maxPrefixes,omitempty"`
+}
+
+// BFD configures a single-hop BFD session with a BGP peer (RFC 5880, RFC 5881)
+type BFD struct {
+	// TransmitIntervalMilliseconds is the desired minimum interval between BFD control packets sent to the peer
+	// +kubebuilder:default=300
+	// +kubebuilder:validation:Minimum=10
+	TransmitIntervalMilliseconds int32 `json:"transmitIntervalMilliseconds"`
+
+	// ReceiveIntervalMilliseconds is the minimum interval between BFD control packets received from the peer
+	// +kubebuilder:default=300
+	// +kubebuilder:validation:Minimum=10
+	ReceiveIntervalMilliseconds int32 `json:"receiveIntervalMilliseconds"`
+
+	// DetectMultiplier is the number of control packets that can be missed before the peer is declared down
+	// +kubebuilder:default=3
+	// +kubebuilder:validation:Minimum=1
+	// +kubebuilder:validation:Maximum=255
+	DetectMultiplier int32 `json:"detectMultiplier"`
+}
+
+// MaxPrefixesAction is taken when a peer exceeds its maximum number of prefixes
+// +kubebuilder:validation:Enum=Log;Teardown;Restart
+type MaxPrefixesAction string
+
+const (
+	// MaxPrefixesActionLog logs an error and keeps accepting the routes of the peer
+	MaxPrefixesActionLog MaxPrefixesAction = "Log"
+	// MaxPrefixesActionTeardown closes the session, which is not established again until the agent restarts
+	MaxPrefixesActionTeardown MaxPrefixesAction = "Teardown"
+	// MaxPrefixesActionRestart closes the session, which is established again after the restart interval
+	MaxPrefixesActionRestart MaxPrefixesAction = "Restart"
+)
+
+// MaxPrefixes limits the number of routes received from a peer, which are counted before its import policy applies so
+// that routes rejected by the policy count as well
+type MaxPrefixes struct {
+	// Limit is the maximum number of routes received from the peer
+	// +kubebuilder:validation:Minimum=1
+	Limit int32 `json:"limit"`
+
+	// WarningThresholdPercent is the percentage of the limit from which a warning is logged
+	// +kubebuilder:default=75
+	// +kubebuilder:validation:Minimum=1
+	// +kubebuilder:validation:Maximum=100
+	WarningThresholdPercent int32 `json:"warningThresholdPercent,omitempty"`
+
+	// Action is taken once the peer exceeds the limit
+	// +kubebuilder:default=Teardown
+	Action MaxPrefixesAction `json:"action,omitempty"`
+
+	// RestartIntervalSeconds is the time waited before establishing the session again with the Restart action
+	// +kubebuilder:default=60
+	// +kubebuilder:validation:Minimum=1
+	RestartIntervalSeconds int32 `json:"restartIntervalSeconds,omitempty"`
 }
 
 type Agent struct {
@@ -71,11 +473,20 @@ type Agent struct {
 
 	// +kubebuilder:default="routebird-agent-sa"
 	ServiceAccountName string `json:"serviceAccountName"`
+
+	// DrainIntervalSeconds is the time the agent keeps its BGP sessions up after withdrawing its routes on shutdown,
+	// so that peers can move traffic away before the sessions are closed
+	// +kubebuilder:default=10
+	// +kubebuilder:validation:Minimum=0
+	DrainIntervalSeconds int32 `json:"drainIntervalSeconds"`
 }
 
 // BGPRouteStatus defines the observed state of BGPRoute.
 type BGPRouteStatus struct {
 	Conditions []metav1.Condition `json:"conditions,omitempty"`
+
+	// NodeASNs contains the local ASNs allocated to the nodes from LocalASNRange, indexed by node name
+	NodeASNs map[string]uint32 `json:"nodeASNs,omitempty"`
 }
 
 // +kubebuilder:object:root=true
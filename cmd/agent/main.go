@@ -2,35 +2,40 @@ package main
 
 import (
 	"context"
-	"fmt"
+	"flag"
 	"log"
 	"log/slog"
 	"os"
-	"time"
-
-	"k8s.io/client-go/tools/cache"
-
-	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
-	"k8s.io/client-go/informers"
-
-	corev1 "k8s.io/api/core/v1"
-	discoveryv1 "k8s.io/api/discovery/v1"
+	"os/signal"
+	"syscall"
 
 	"github.com/go-logr/logr"
-	"github.com/yago-123/routebird/internal/agent/k8s"
 	"k8s.io/client-go/kubernetes"
 	"k8s.io/client-go/rest"
-)
 
-const (
-	// todo(): set from config or env
-	InformerResyncInterval = 1 * time.Minute
+	"github.com/yago-123/routebird/internal/agent"
+	"github.com/yago-123/routebird/internal/agent/config"
+	"github.com/yago-123/routebird/internal/common"
 )
 
 func main() {
+	configPath := flag.String("config", "", "path to the agent configuration file")
+	flag.Parse()
+
 	slogLogger := slog.New(slog.NewJSONHandler(os.Stdout, nil))
 	logger := logr.FromSlogHandler(slogLogger.Handler())
 
+	// The node name is injected through the downward API by the controller
+	nodeName := os.Getenv(common.NodeNameEnvVar)
+	if nodeName == "" {
+		log.Fatalf("Environment variable %s is not set", common.NodeNameEnvVar)
+	}
+
+	agentCfg, err := config.Load(*configPath)
+	if err != nil {
+		log.Fatalf("Failed to load agent config: %v", err)
+	}
+
 	cfg, err := rest.InClusterConfig()
 	if err != nil {
 		log.Fatalf("Failed to get in-cluster config: %v", err)
@@ -41,76 +46,18 @@ func main() {
 		log.Fatalf("Failed to create k8s client: %v", err)
 	}
 
-	// nodeName := os.Getenv("NODE_NAME")
-	nodeName := "minikube"
-	eventCh := make(chan k8s.Event, 100)
-
-	informerFactory := informers.NewSharedInformerFactoryWithOptions(
-		clientset,
-		InformerResyncInterval,
-		informers.WithNamespace(metav1.NamespaceAll),
-	)
-
-	svcInformer := informerFactory.Core().V1().Services().Informer()
-	epsInformer := informerFactory.Discovery().V1().EndpointSlices().Informer()
-
-	epsInformer.AddIndexers(cache.Indexers{
-		"by-service": func(obj interface{}) ([]string, error) {
-			// custom indexing logic
-
-			return []string{}, nil
-		},
-	})
-
-	ctx, cancel := context.WithCancel(context.Background())
-	defer cancel()
-
-	informerFactory.Start(ctx.Done())
-
-	if !cache.WaitForCacheSync(ctx.Done(), svcInformer.HasSynced, epsInformer.HasSynced) {
-		logger.Error(fmt.Errorf("Failed to sync caches"), "svcInformer", svcInformer, "epsInformer", epsInformer)
-		return
+	runtime, err := agent.NewRuntime(agentCfg, *configPath, clientset, nodeName, logger.WithValues("node", nodeName))
+	if err != nil {
+		log.Fatalf("Failed to create agent runtime: %v", err)
 	}
 
-	watcher := k8s.NewWatcher(informerFactory, eventCh, nodeName, logger)
-	controlLoop := k8s.NewControlLoop(informerFactory, nodeName, logger)
-
-	go func() {
-		if errWatch := watcher.Watch(ctx); errWatch != nil {
-			logger.Error(errWatch, "Failed to watch resources")
-		}
-	}()
-
-	go func() {
-		for {
-			controlLoop.Resync(context.Background())
-			time.Sleep(10 * time.Second)
-		}
-	}()
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGTERM, os.Interrupt)
+	defer stop()
 
-	// Event processing loop
-	for evt := range eventCh {
-		// Print the event and the concrete type of Obj
-		fmt.Printf("Got event %s for %T (key=%q)\n", evt.Type, evt.Obj, evt.Key)
-
-		// If you need to drill in on specific fields:
-		switch o := evt.Obj.(type) {
-		case *corev1.Service:
-			fmt.Printf("  Service: %s/%s, Type=%s, Selector=%v\n",
-				o.Namespace, o.Name, o.Spec.Type, o.Spec.Selector)
-		case *corev1.Endpoints:
-			fmt.Printf("  Endpoints: %s/%s, Addresses=%v\n",
-				o.Namespace, o.Name, o.Subsets)
-		case *discoveryv1.EndpointSlice:
-			// Collect all addresses across all Endpoint entries
-			var addrs []string
-			for _, ep := range o.Endpoints {
-				addrs = append(addrs, ep.Addresses...)
-			}
-			fmt.Printf("  EndpointSlice: %s/%s, Addresses=%v\n",
-				o.Namespace, o.Name, addrs)
-		default:
-			fmt.Printf("  Unknown object type: %T\n", o)
-		}
+	if err = runtime.Run(ctx); err != nil {
+		logger.Error(err, "Agent runtime failed")
+		os.Exit(1)
 	}
+
+	logger.Info("Agent stopped")
 }
@@ -0,0 +1,238 @@
+package bfd
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand/v2"
+	"net"
+	"net/netip"
+	"sync"
+
+	"github.com/go-logr/logr"
+	"golang.org/x/net/ipv4"
+	"golang.org/x/net/ipv6"
+)
+
+const (
+	// ControlPort is the UDP port in which single-hop BFD control packets are received (RFC 5881)
+	ControlPort = 3784
+
+	// Source ports of the control packets must be in this range (RFC 5881 section 4)
+	minSourcePort = 49152
+	maxSourcePort = 65535
+	// sourcePortAttempts is the number of random source ports tried before giving up
+	sourcePortAttempts = 16
+
+	// ttl is the TTL of the control packets sent and the only TTL accepted in received ones, so that packets
+	// forged from outside the link are discarded (RFC 5881 section 5)
+	ttl = 255
+)
+
+// Listener receives the control packets of every BFD session and delivers them to the session they belong to
+type Listener struct {
+	// sessions contains the registered sessions, indexed by local discriminator
+	sessions map[uint32]*Session
+	// byRemote contains the registered sessions, indexed by peer address, for packets without your discriminator
+	byRemote map[netip.Addr]*Session
+	lock     sync.RWMutex
+
+	port   int
+	logger logr.Logger
+}
+
+func NewListener(logger logr.Logger) *Listener {
+	return &Listener{
+		sessions: make(map[uint32]*Session),
+		byRemote: make(map[netip.Addr]*Session),
+		port:     ControlPort,
+		logger:   logger,
+	}
+}
+
+// NewSession registers a BFD session with the peer, which must be run with Session.Run
+func (l *Listener) NewSession(config SessionConfig, logger logr.Logger) (*Session, error) {
+	config.Remote = config.Remote.Unmap()
+	remote := netip.AddrPortFrom(config.Remote, uint16(l.port))
+
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	if _, exists := l.byRemote[config.Remote]; exists {
+		return nil, fmt.Errorf("BFD session with %s already exists", config.Remote)
+	}
+
+	// Local discriminators must be unique and non-zero
+	var localDiscr uint32
+	for localDiscr == 0 || l.sessions[localDiscr] != nil {
+		localDiscr = rand.Uint32()
+	}
+
+	s, err := newSession(config, localDiscr, func() (sender, error) { return dialUDP(remote) }, logger)
+	if err != nil {
+		return nil, err
+	}
+
+	l.sessions[localDiscr] = s
+	l.byRemote[config.Remote] = s
+
+	return s, nil
+}
+
+// RemoveSession unregisters a session created with NewSession once it is no longer run, so that a new session with its
+// peer can be created
+func (l *Listener) RemoveSession(s *Session) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	delete(l.sessions, s.localDiscr)
+	if l.byRemote[s.config.Remote] == s {
+		delete(l.byRemote, s.config.Remote)
+	}
+}
+
+// Run receives control packets on IPv4 and IPv6 until the context is cancelled
+func (l *Listener) Run(ctx context.Context) error {
+	conn4, err := net.ListenPacket("udp4", fmt.Sprintf("0.0.0.0:%d", l.port))
+	if err != nil {
+		return fmt.Errorf("failed to listen for BFD control packets on IPv4: %w", err)
+	}
+	conn6, err := net.ListenPacket("udp6", fmt.Sprintf("[::]:%d", l.port))
+	if err != nil {
+		_ = conn4.Close()
+		return fmt.Errorf("failed to listen for BFD control packets on IPv6: %w", err)
+	}
+
+	packetConn4, packetConn6 := ipv4.NewPacketConn(conn4), ipv6.NewPacketConn(conn6)
+	if err = packetConn4.SetControlMessage(ipv4.FlagTTL, true); err != nil {
+		err = fmt.Errorf("failed to enable TTL control messages: %w", err)
+	} else if err = packetConn6.SetControlMessage(ipv6.FlagHopLimit, true); err != nil {
+		err = fmt.Errorf("failed to enable hop limit control messages: %w", err)
+	}
+	if err != nil {
+		_ = conn4.Close()
+		_ = conn6.Close()
+		return err
+	}
+
+	go func() {
+		<-ctx.Done()
+		_ = conn4.Close()
+		_ = conn6.Close()
+	}()
+
+	errCh := make(chan error, 2)
+	go func() {
+		errCh <- l.readLoop(func(buf []byte) (int, int, net.Addr, error) {
+			n, cm, src, errRead := packetConn4.ReadFrom(buf)
+			if cm == nil {
+				return n, 0, src, errRead
+			}
+			return n, cm.TTL, src, errRead
+		})
+	}()
+	go func() {
+		errCh <- l.readLoop(func(buf []byte) (int, int, net.Addr, error) {
+			n, cm, src, errRead := packetConn6.ReadFrom(buf)
+			if cm == nil {
+				return n, 0, src, errRead
+			}
+			return n, cm.HopLimit, src, errRead
+		})
+	}()
+
+	err = errors.Join(<-errCh, <-errCh)
+	if ctx.Err() != nil {
+		return nil
+	}
+
+	return err
+}
+
+// readLoop reads control packets with the provided function, which returns the TTL of the packet together with its
+// source, until reading fails
+func (l *Listener) readLoop(read func(buf []byte) (int, int, net.Addr, error)) error {
+	buf := make([]byte, 1500)
+	for {
+		n, packetTTL, src, err := read(buf)
+		if err != nil {
+			return err
+		}
+
+		udpAddr, ok := src.(*net.UDPAddr)
+		if !ok {
+			continue
+		}
+		l.dispatch(buf[:n], packetTTL, udpAddr.AddrPort().Addr().Unmap())
+	}
+}
+
+// dispatch delivers a control packet to its session, discarding invalid packets and packets of unknown sessions
+func (l *Listener) dispatch(data []byte, packetTTL int, src netip.Addr) {
+	if packetTTL != ttl {
+		l.logger.V(1).Info("Discarding BFD control packet with invalid TTL", "source", src, "ttl", packetTTL)
+		return
+	}
+
+	packet, err := Unmarshal(data)
+	if err != nil {
+		l.logger.V(1).Info("Discarding BFD control packet", "source", src, "error", err.Error())
+		return
+	}
+
+	l.lock.RLock()
+	s := l.byRemote[src]
+	if packet.YourDiscriminator != 0 {
+		s = l.sessions[packet.YourDiscriminator]
+	}
+	l.lock.RUnlock()
+
+	if s == nil || s.config.Remote != src {
+		l.logger.V(1).Info("Discarding BFD control packet of unknown session", "source", src, "discriminator", packet.YourDiscriminator)
+		return
+	}
+
+	s.deliver(packet)
+}
+
+// udpSender sends control packets from a UDP socket connected to the peer
+type udpSender struct {
+	conn *net.UDPConn
+}
+
+func (u *udpSender) Send(packet *ControlPacket) error {
+	_, err := u.conn.Write(packet.Marshal())
+	return err
+}
+
+func (u *udpSender) Close() error {
+	return u.conn.Close()
+}
+
+// dialUDP creates the socket used to send control packets to the peer, bound to a random source port of the range
+// required by RFC 5881 and with the TTL set to 255
+func dialUDP(remote netip.AddrPort) (*udpSender, error) {
+	var conn *net.UDPConn
+	var err error
+	for range sourcePortAttempts {
+		local := &net.UDPAddr{Port: minSourcePort + rand.IntN(maxSourcePort-minSourcePort+1)}
+		if conn, err = net.DialUDP("udp", local, net.UDPAddrFromAddrPort(remote)); err == nil {
+			break
+		}
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to bind source port: %w", err)
+	}
+
+	if remote.Addr().Is4() {
+		err = ipv4.NewConn(conn).SetTTL(ttl)
+	} else {
+		err = ipv6.NewConn(conn).SetHopLimit(ttl)
+	}
+	if err != nil {
+		_ = conn.Close()
+		return nil, fmt.Errorf("failed to set TTL: %w", err)
+	}
+
+	return &udpSender{conn: conn}, nil
+}
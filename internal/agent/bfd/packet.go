@@ -0,0 +1,167 @@
+// Package bfd implements single-hop Bidirectional Forwarding Detection over UDP, as defined in RFC 5880 and RFC 5881,
+// in asynchronous mode and without authentication. It is used by the agent to detect failures of the forwarding path
+// to its BGP peers much faster than the BGP hold timer.
+package bfd
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"time"
+)
+
+const (
+	// ControlPacketLen is the length of a BFD control packet without authentication section
+	ControlPacketLen = 24
+
+	bfdVersion = 1
+
+	flagPoll                    = 0x20
+	flagFinal                   = 0x10
+	flagControlPlaneIndependent = 0x08
+	flagAuthenticationPresent   = 0x04
+	flagDemand                  = 0x02
+	flagMultipoint              = 0x01
+)
+
+// ErrInvalidPacket is returned when a received control packet must be discarded, as required by RFC 5880 section 6.8.6
+var ErrInvalidPacket = errors.New("invalid BFD control packet")
+
+// State is the state of a BFD session as defined in RFC 5880 section 6.2
+type State uint8
+
+const (
+	StateAdminDown State = 0
+	StateDown      State = 1
+	StateInit      State = 2
+	StateUp        State = 3
+)
+
+func (s State) String() string {
+	switch s {
+	case StateAdminDown:
+		return "AdminDown"
+	case StateDown:
+		return "Down"
+	case StateInit:
+		return "Init"
+	case StateUp:
+		return "Up"
+	default:
+		return fmt.Sprintf("State(%d)", uint8(s))
+	}
+}
+
+// Diagnostic specifies the reason of the last change of the local session state, as defined in RFC 5880 section 4.1
+type Diagnostic uint8
+
+const (
+	DiagNone                        Diagnostic = 0
+	DiagControlDetectionTimeExpired Diagnostic = 1
+	DiagEchoFunctionFailed          Diagnostic = 2
+	DiagNeighborSignaledSessionDown Diagnostic = 3
+	DiagForwardingPlaneReset        Diagnostic = 4
+	DiagPathDown                    Diagnostic = 5
+	DiagConcatenatedPathDown        Diagnostic = 6
+	DiagAdministrativelyDown        Diagnostic = 7
+	DiagReverseConcatenatedPathDown Diagnostic = 8
+)
+
+// ControlPacket is a BFD control packet (RFC 5880 section 4.1). Intervals are carried in microseconds on the wire
+type ControlPacket struct {
+	Diagnostic Diagnostic
+	State      State
+
+	Poll                    bool
+	Final                   bool
+	ControlPlaneIndependent bool
+	Demand                  bool
+
+	DetectMultiplier  uint8
+	MyDiscriminator   uint32
+	YourDiscriminator uint32
+
+	DesiredMinTxInterval      time.Duration
+	RequiredMinRxInterval     time.Duration
+	RequiredMinEchoRxInterval time.Duration
+}
+
+// Marshal encodes the control packet
+func (p *ControlPacket) Marshal() []byte {
+	var flags uint8
+	if p.Poll {
+		flags |= flagPoll
+	}
+	if p.Final {
+		flags |= flagFinal
+	}
+	if p.ControlPlaneIndependent {
+		flags |= flagControlPlaneIndependent
+	}
+	if p.Demand {
+		flags |= flagDemand
+	}
+
+	data := make([]byte, 0, ControlPacketLen)
+	data = append(data, bfdVersion<<5|uint8(p.Diagnostic)&0x1f, uint8(p.State)<<6|flags, p.DetectMultiplier, ControlPacketLen)
+	data = binary.BigEndian.AppendUint32(data, p.MyDiscriminator)
+	data = binary.BigEndian.AppendUint32(data, p.YourDiscriminator)
+	data = binary.BigEndian.AppendUint32(data, microseconds(p.DesiredMinTxInterval))
+	data = binary.BigEndian.AppendUint32(data, microseconds(p.RequiredMinRxInterval))
+
+	return binary.BigEndian.AppendUint32(data, microseconds(p.RequiredMinEchoRxInterval))
+}
+
+// Unmarshal decodes a control packet, applying the checks of RFC 5880 section 6.8.6 that do not depend on the state
+// of the session. Packets carrying an authentication section are rejected, as authentication is not supported
+func Unmarshal(data []byte) (*ControlPacket, error) {
+	if len(data) < ControlPacketLen {
+		return nil, fmt.Errorf("%w: packet too short (%d bytes)", ErrInvalidPacket, len(data))
+	}
+
+	if version := data[0] >> 5; version != bfdVersion {
+		return nil, fmt.Errorf("%w: unsupported version %d", ErrInvalidPacket, version)
+	}
+	if length := int(data[3]); length < ControlPacketLen || length > len(data) {
+		return nil, fmt.Errorf("%w: invalid length %d", ErrInvalidPacket, length)
+	}
+
+	flags := data[1] & 0x3f
+	packet := &ControlPacket{
+		Diagnostic:                Diagnostic(data[0] & 0x1f),
+		State:                     State(data[1] >> 6),
+		Poll:                      flags&flagPoll != 0,
+		Final:                     flags&flagFinal != 0,
+		ControlPlaneIndependent:   flags&flagControlPlaneIndependent != 0,
+		Demand:                    flags&flagDemand != 0,
+		DetectMultiplier:          data[2],
+		MyDiscriminator:           binary.BigEndian.Uint32(data[4:8]),
+		YourDiscriminator:         binary.BigEndian.Uint32(data[8:12]),
+		DesiredMinTxInterval:      fromMicroseconds(binary.BigEndian.Uint32(data[12:16])),
+		RequiredMinRxInterval:     fromMicroseconds(binary.BigEndian.Uint32(data[16:20])),
+		RequiredMinEchoRxInterval: fromMicroseconds(binary.BigEndian.Uint32(data[20:24])),
+	}
+
+	switch {
+	case flags&flagAuthenticationPresent != 0:
+		return nil, fmt.Errorf("%w: authentication is not supported", ErrInvalidPacket)
+	case flags&flagMultipoint != 0:
+		return nil, fmt.Errorf("%w: multipoint bit set", ErrInvalidPacket)
+	case packet.DetectMultiplier == 0:
+		return nil, fmt.Errorf("%w: zero detect multiplier", ErrInvalidPacket)
+	case packet.MyDiscriminator == 0:
+		return nil, fmt.Errorf("%w: zero discriminator", ErrInvalidPacket)
+	case packet.YourDiscriminator == 0 && packet.State != StateDown && packet.State != StateAdminDown:
+		return nil, fmt.Errorf("%w: missing discriminator in state %s", ErrInvalidPacket, packet.State)
+	}
+
+	return packet, nil
+}
+
+func microseconds(d time.Duration) uint32 {
+	return uint32(min(d.Microseconds(), 0xffffffff))
+}
+
+func fromMicroseconds(us uint32) time.Duration {
+	return time.Duration(us) * time.Microsecond
+}
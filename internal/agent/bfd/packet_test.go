@@ -0,0 +1,64 @@
+package bfd
+
+import (
+	"bytes"
+	"encoding/hex"
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestControlPacketRoundTrip(t *testing.T) {
+	packet := &ControlPacket{
+		Diagnostic:            DiagControlDetectionTimeExpired,
+		State:                 StateUp,
+		Poll:                  true,
+		DetectMultiplier:      3,
+		MyDiscriminator:       0x01020304,
+		YourDiscriminator:     0x0a0b0c0d,
+		DesiredMinTxInterval:  300 * time.Millisecond,
+		RequiredMinRxInterval: 250 * time.Millisecond,
+	}
+	golden, _ := hex.DecodeString("21e0031801020304" + "0a0b0c0d" + "000493e0" + "0003d090" + "00000000")
+
+	if encoded := packet.Marshal(); !bytes.Equal(encoded, golden) {
+		t.Fatalf("unexpected encoding:\n got: %x\nwant: %x", encoded, golden)
+	}
+
+	decoded, err := Unmarshal(golden)
+	if err != nil {
+		t.Fatalf("failed to unmarshal: %v", err)
+	}
+	if !reflect.DeepEqual(decoded, packet) {
+		t.Fatalf("unexpected decoded packet:\n got: %#v\nwant: %#v", decoded, packet)
+	}
+}
+
+func TestUnmarshalInvalidPackets(t *testing.T) {
+	valid := (&ControlPacket{State: StateDown, DetectMultiplier: 3, MyDiscriminator: 1}).Marshal()
+	modified := func(offset int, value byte) []byte {
+		data := bytes.Clone(valid)
+		data[offset] = value
+		return data
+	}
+
+	tests := map[string][]byte{
+		"too short":                 valid[:20],
+		"unsupported version":       modified(0, 2<<5),
+		"length beyond packet":      modified(3, 32),
+		"authentication present":    modified(1, uint8(StateDown)<<6|flagAuthenticationPresent),
+		"multipoint":                modified(1, uint8(StateDown)<<6|flagMultipoint),
+		"zero detect multiplier":    modified(2, 0),
+		"zero discriminator":        modified(7, 0),
+		"up without discriminators": modified(1, uint8(StateUp)<<6),
+	}
+
+	for name, data := range tests {
+		t.Run(name, func(t *testing.T) {
+			if _, err := Unmarshal(data); !errors.Is(err, ErrInvalidPacket) {
+				t.Fatalf("expected ErrInvalidPacket, got %v", err)
+			}
+		})
+	}
+}
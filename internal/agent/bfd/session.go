@@ -0,0 +1,261 @@
+package bfd
+
+import (
+	"context"
+	"fmt"
+	"math/rand/v2"
+	"net/netip"
+	"sync/atomic"
+	"time"
+
+	"github.com/go-logr/logr"
+)
+
+const (
+	// slowTxInterval is the minimum interval between control packets while the session is not up, as required by
+	// RFC 5880 section 6.8.3
+	slowTxInterval = time.Second
+
+	// rxQueueLen is the number of received control packets buffered for a session, further packets are dropped
+	rxQueueLen = 16
+)
+
+// SessionConfig contains the parameters of a BFD session
+type SessionConfig struct {
+	// Remote is the address of the BFD peer
+	Remote netip.Addr
+	// DesiredMinTxInterval is the minimum interval between control packets sent to the peer
+	DesiredMinTxInterval time.Duration
+	// RequiredMinRxInterval is the minimum interval between control packets that the agent is able to receive
+	RequiredMinRxInterval time.Duration
+	// DetectMultiplier is the number of control packets that can be missed before the session is declared down
+	DetectMultiplier uint8
+}
+
+// sender sends control packets to the peer of a session
+type sender interface {
+	Send(packet *ControlPacket) error
+	Close() error
+}
+
+// Session is an asynchronous mode BFD session with a single peer. Control packets received from the peer are
+// delivered to the session by the Listener it was created from
+type Session struct {
+	config     SessionConfig
+	localDiscr uint32
+	dial       func() (sender, error)
+
+	// rxCh receives the control packets of the peer, demultiplexed by the listener
+	rxCh chan *ControlPacket
+	// downCh is signaled whenever the session goes down after having been up
+	downCh chan struct{}
+
+	state atomic.Uint32
+
+	// The following fields are only accessed by the goroutine running the session
+	conn             sender
+	diag             Diagnostic
+	remoteDiscr      uint32
+	remoteMinRx      time.Duration
+	remoteMinTx      time.Duration
+	remoteDetectMult uint8
+	// pollActive is set while a Poll Sequence announcing new timer parameters waits for the Final bit of the peer
+	pollActive bool
+	// slowTxInterval is the transmission interval used while the session is not up
+	slowTxInterval time.Duration
+
+	txTimer     *time.Timer
+	detectTimer *time.Timer
+
+	logger logr.Logger
+}
+
+func newSession(config SessionConfig, localDiscr uint32, dial func() (sender, error), logger logr.Logger) (*Session, error) {
+	if config.DetectMultiplier == 0 {
+		return nil, fmt.Errorf("detect multiplier must be greater than zero")
+	}
+	if config.DesiredMinTxInterval <= 0 || config.RequiredMinRxInterval <= 0 {
+		return nil, fmt.Errorf("intervals must be greater than zero")
+	}
+
+	s := &Session{
+		config:         config,
+		localDiscr:     localDiscr,
+		dial:           dial,
+		rxCh:           make(chan *ControlPacket, rxQueueLen),
+		downCh:         make(chan struct{}, 1),
+		remoteMinRx:    time.Microsecond,
+		slowTxInterval: slowTxInterval,
+		logger:         logger,
+	}
+	s.state.Store(uint32(StateDown))
+
+	return s, nil
+}
+
+// State returns the current state of the session
+func (s *Session) State() State {
+	return State(s.state.Load())
+}
+
+// Down returns a channel signaled whenever the session goes down after having been up. Signals are collapsed, so
+// the state of the session must be checked when receiving one
+func (s *Session) Down() <-chan struct{} {
+	return s.downCh
+}
+
+// Run sends control packets to the peer and processes the ones received until the context is cancelled, in which
+// case the peer is told that the session is administratively down
+func (s *Session) Run(ctx context.Context) error {
+	conn, err := s.dial()
+	if err != nil {
+		return fmt.Errorf("failed to create BFD socket for %s: %w", s.config.Remote, err)
+	}
+	s.conn = conn
+	defer func() { _ = s.conn.Close() }()
+
+	s.txTimer = time.NewTimer(0)
+	defer s.txTimer.Stop()
+	s.detectTimer = time.NewTimer(0)
+	s.detectTimer.Stop()
+	defer s.detectTimer.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			s.setState(StateAdminDown, DiagAdministrativelyDown)
+			s.send(false)
+			return nil
+		case packet := <-s.rxCh:
+			s.receive(packet)
+		case <-s.txTimer.C:
+			// Periodic transmission stops when the peer does not want to receive control packets
+			if s.remoteMinRx > 0 {
+				s.send(false)
+			}
+			s.txTimer.Reset(s.txInterval())
+		case <-s.detectTimer.C:
+			s.remoteDiscr = 0
+			if state := s.State(); state == StateInit || state == StateUp {
+				s.setState(StateDown, DiagControlDetectionTimeExpired)
+				s.send(false)
+			}
+		}
+	}
+}
+
+// deliver queues a control packet received from the peer. It never blocks, packets are dropped if the session does
+// not keep up with them
+func (s *Session) deliver(packet *ControlPacket) {
+	select {
+	case s.rxCh <- packet:
+	default:
+	}
+}
+
+// receive processes a control packet of the peer according to RFC 5880 section 6.8.6
+func (s *Session) receive(packet *ControlPacket) {
+	if packet.YourDiscriminator != 0 && packet.YourDiscriminator != s.localDiscr {
+		return
+	}
+
+	s.remoteDiscr = packet.MyDiscriminator
+	s.remoteMinRx = packet.RequiredMinRxInterval
+	s.remoteMinTx = packet.DesiredMinTxInterval
+	s.remoteDetectMult = packet.DetectMultiplier
+	if packet.Final {
+		s.pollActive = false
+	}
+
+	s.detectTimer.Reset(s.detectionTime())
+
+	switch state := s.State(); {
+	case state == StateAdminDown:
+		return
+	case packet.State == StateAdminDown:
+		if state != StateDown {
+			s.setState(StateDown, DiagNeighborSignaledSessionDown)
+			s.send(false)
+		}
+	case state == StateDown && packet.State == StateDown:
+		s.setState(StateInit, DiagNone)
+		s.send(false)
+	case state == StateDown && packet.State == StateInit,
+		state == StateInit && (packet.State == StateInit || packet.State == StateUp):
+		s.setState(StateUp, DiagNone)
+		// The peer is told about the faster transmission interval used from now on with a Poll Sequence
+		s.pollActive = true
+		s.send(false)
+	case state == StateUp && packet.State == StateDown:
+		s.setState(StateDown, DiagNeighborSignaledSessionDown)
+		s.send(false)
+	}
+
+	if packet.Poll {
+		s.send(true)
+	}
+}
+
+func (s *Session) setState(state State, diag Diagnostic) {
+	old := State(s.state.Swap(uint32(state)))
+	if old == state {
+		return
+	}
+
+	s.diag = diag
+	s.logger.Info("BFD session state changed", "from", old, "to", state, "diagnostic", diag)
+
+	if old == StateUp && state == StateDown {
+		select {
+		case s.downCh <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// send transmits a control packet with the current state of the session. Final packets answer a Poll Sequence of
+// the peer and never carry the Poll bit
+func (s *Session) send(final bool) {
+	packet := &ControlPacket{
+		Diagnostic:            s.diag,
+		State:                 s.State(),
+		Poll:                  s.pollActive && !final,
+		Final:                 final,
+		DetectMultiplier:      s.config.DetectMultiplier,
+		MyDiscriminator:       s.localDiscr,
+		YourDiscriminator:     s.remoteDiscr,
+		DesiredMinTxInterval:  s.desiredMinTx(),
+		RequiredMinRxInterval: s.config.RequiredMinRxInterval,
+	}
+
+	if err := s.conn.Send(packet); err != nil {
+		s.logger.V(1).Info("Failed to send BFD control packet", "error", err.Error())
+	}
+}
+
+// desiredMinTx returns the minimum transmission interval advertised to the peer, which must not be lower than one
+// second while the session is not up
+func (s *Session) desiredMinTx() time.Duration {
+	if s.State() != StateUp {
+		return max(s.config.DesiredMinTxInterval, s.slowTxInterval)
+	}
+	return s.config.DesiredMinTxInterval
+}
+
+// txInterval returns the interval until the next periodic control packet, reduced by a random jitter of up to 25% as
+// required by RFC 5880 section 6.8.7
+func (s *Session) txInterval() time.Duration {
+	interval := max(s.desiredMinTx(), s.remoteMinRx)
+
+	jitter := 0.75 + rand.Float64()*0.25
+	if s.config.DetectMultiplier == 1 {
+		jitter = 0.75 + rand.Float64()*0.15
+	}
+
+	return time.Duration(float64(interval) * jitter)
+}
+
+// detectionTime returns the time without control packets of the peer after which the session is declared down
+func (s *Session) detectionTime() time.Duration {
+	return time.Duration(s.remoteDetectMult) * max(s.config.RequiredMinRxInterval, s.remoteMinTx)
+}
@@ -0,0 +1,108 @@
+package bfd
+
+import (
+	"context"
+	"net/netip"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/go-logr/logr"
+)
+
+// pipeSender delivers the control packets straight to the session of the peer, unless the link is cut
+type pipeSender struct {
+	peer *Session
+	cut  *sync.Mutex
+	down *bool
+}
+
+func (p *pipeSender) Send(packet *ControlPacket) error {
+	p.cut.Lock()
+	defer p.cut.Unlock()
+
+	if !*p.down {
+		p.peer.deliver(packet)
+	}
+	return nil
+}
+
+func (p *pipeSender) Close() error {
+	return nil
+}
+
+func newTestSession(t *testing.T, remote string, localDiscr uint32) *Session {
+	t.Helper()
+
+	s, err := newSession(SessionConfig{
+		Remote:                netip.MustParseAddr(remote),
+		DesiredMinTxInterval:  10 * time.Millisecond,
+		RequiredMinRxInterval: 10 * time.Millisecond,
+		DetectMultiplier:      3,
+	}, localDiscr, nil, logr.Discard())
+	if err != nil {
+		t.Fatalf("failed to create session: %v", err)
+	}
+	s.slowTxInterval = 20 * time.Millisecond
+
+	return s
+}
+
+func waitForState(t *testing.T, s *Session, state State) {
+	t.Helper()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for s.State() != state {
+		if time.Now().After(deadline) {
+			t.Fatalf("expected session to be %s, got %s", state, s.State())
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestSessionUpAndDetectionTimeout(t *testing.T) {
+	a, b := newTestSession(t, "192.0.2.2", 1), newTestSession(t, "192.0.2.1", 2)
+
+	var lock sync.Mutex
+	linkDown := false
+	a.dial = func() (sender, error) { return &pipeSender{peer: b, cut: &lock, down: &linkDown}, nil }
+	b.dial = func() (sender, error) { return &pipeSender{peer: a, cut: &lock, down: &linkDown}, nil }
+
+	ctxA, cancelA := context.WithCancel(context.Background())
+	defer cancelA()
+	ctxB, cancelB := context.WithCancel(context.Background())
+	defer cancelB()
+
+	go func() { _ = a.Run(ctxA) }()
+	go func() { _ = b.Run(ctxB) }()
+
+	waitForState(t, a, StateUp)
+	waitForState(t, b, StateUp)
+
+	// Losing the control packets brings the session down once the detection time expires
+	lock.Lock()
+	linkDown = true
+	lock.Unlock()
+
+	select {
+	case <-a.Down():
+	case <-time.After(5 * time.Second):
+		t.Fatalf("expected session to go down")
+	}
+	waitForState(t, a, StateDown)
+
+	lock.Lock()
+	linkDown = false
+	lock.Unlock()
+	waitForState(t, a, StateUp)
+	waitForState(t, b, StateUp)
+
+	// A peer administratively shutting down its session brings ours down as well
+	cancelB()
+	waitForState(t, a, StateDown)
+	select {
+	case <-a.Down():
+	case <-time.After(5 * time.Second):
+		t.Fatalf("expected session to go down")
+	}
+}
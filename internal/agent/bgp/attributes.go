@@ -0,0 +1,338 @@
+package bgp
+
+import (
+	"bytes"
+	"cmp"
+	"encoding/binary"
+	"fmt"
+	"maps"
+	"net/netip"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/yago-123/routebird/api/v1alphav1"
+	"github.com/yago-123/routebird/internal/agent/bgp/packet"
+)
+
+// wellKnownCommunities maps the names accepted in place of well-known communities to their values
+var wellKnownCommunities = map[string]uint32{
+	"no-export":           packet.CommunityNoExport,
+	"no-advertise":        packet.CommunityNoAdvertise,
+	"no-export-subconfed": packet.CommunityNoExportSubconfed,
+	"no-peer":             packet.CommunityNoPeer,
+	"blackhole":           packet.CommunityBlackhole,
+	"graceful-shutdown":   packet.CommunityGracefulShutdown,
+}
+
+// maxASPathPrepend is the maximum number of times the local AS can be prepended to the AS_PATH
+const maxASPathPrepend = 16
+
+// RouteAttributes are the configurable path attributes of an advertised route. Communities are kept sorted and without
+// duplicates, so that equal sets of attributes compare equal
+type RouteAttributes struct {
+	Communities         []uint32
+	LargeCommunities    []packet.LargeCommunity
+	ExtendedCommunities []packet.ExtendedCommunity
+
+	// LocalPref is the LOCAL_PREF sent to internal peers, nil sends the default one
+	LocalPref *uint32
+	// MED is the MULTI_EXIT_DISC of the routes, nil does not send the attribute
+	MED *uint32
+	// ASPathPrepend is the number of additional times the local AS is prepended to the AS_PATH sent to external peers
+	ASPathPrepend int
+	// NextHopIPv4 and NextHopIPv6 override the next hop of the routes of each address family, the local address of
+	// the session is used when invalid
+	NextHopIPv4 netip.Addr
+	NextHopIPv6 netip.Addr
+
+	// ServiceNamespace and ServiceLabels identify the service advertised by the route. They are not sent to the peers
+	// but matched by the export policies
+	ServiceNamespace string
+	ServiceLabels    map[string]string
+}
+
+// ParseRouteAttributes parses the path attributes configured in a BGPRoute
+func ParseRouteAttributes(attrs v1alphav1.RouteAttributes) (RouteAttributes, error) {
+	var parsed RouteAttributes
+	var err error
+
+	if parsed.Communities, err = ParseCommunities(attrs.Communities); err != nil {
+		return RouteAttributes{}, err
+	}
+	if parsed.LargeCommunities, err = ParseLargeCommunities(attrs.LargeCommunities); err != nil {
+		return RouteAttributes{}, err
+	}
+	if parsed.ExtendedCommunities, err = ParseExtendedCommunities(attrs.ExtendedCommunities); err != nil {
+		return RouteAttributes{}, err
+	}
+
+	parsed.LocalPref, parsed.MED = attrs.LocalPreference, attrs.MED
+	parsed.ASPathPrepend = int(attrs.ASPathPrepend)
+	if err = validateASPathPrepend(parsed.ASPathPrepend); err != nil {
+		return RouteAttributes{}, err
+	}
+	if parsed.NextHopIPv4, parsed.NextHopIPv6, err = ParseNextHops(attrs.NextHops); err != nil {
+		return RouteAttributes{}, err
+	}
+
+	return parsed, nil
+}
+
+// ParseASPathPrepend parses the number of additional times the local AS is prepended to the AS_PATH
+func ParseASPathPrepend(value string) (int, error) {
+	prepend, err := strconv.Atoi(strings.TrimSpace(value))
+	if err != nil {
+		return 0, fmt.Errorf("invalid AS path prepend %q: %w", value, err)
+	}
+
+	return prepend, validateASPathPrepend(prepend)
+}
+
+func validateASPathPrepend(prepend int) error {
+	if prepend < 0 || prepend > maxASPathPrepend {
+		return fmt.Errorf("AS path prepend %d out of range [0, %d]", prepend, maxASPathPrepend)
+	}
+
+	return nil
+}
+
+// ParseUint32 parses a 32-bit attribute value such as LOCAL_PREF or MULTI_EXIT_DISC
+func ParseUint32(value string) (*uint32, error) {
+	parsed, err := strconv.ParseUint(strings.TrimSpace(value), 10, 32)
+	if err != nil {
+		return nil, fmt.Errorf("invalid value %q: %w", value, err)
+	}
+
+	result := uint32(parsed)
+	return &result, nil
+}
+
+// ParseNextHops parses the next hops of the routes, at most one per address family, and returns the IPv4 and the IPv6
+// one. Families without next hop get an invalid address
+func ParseNextHops(values []string) (netip.Addr, netip.Addr, error) {
+	var nextHopIPv4, nextHopIPv6 netip.Addr
+	for _, value := range values {
+		addr, err := netip.ParseAddr(strings.TrimSpace(value))
+		if err != nil {
+			return netip.Addr{}, netip.Addr{}, fmt.Errorf("invalid next hop %q: %w", value, err)
+		}
+
+		addr = addr.Unmap()
+		if addr.IsUnspecified() || addr.IsMulticast() || addr.Zone() != "" {
+			return netip.Addr{}, netip.Addr{}, fmt.Errorf("invalid next hop %s", addr)
+		}
+
+		nextHop := &nextHopIPv6
+		if addr.Is4() {
+			nextHop = &nextHopIPv4
+		}
+		if nextHop.IsValid() {
+			return netip.Addr{}, netip.Addr{}, fmt.Errorf("more than one next hop for the address family of %s", addr)
+		}
+		*nextHop = addr
+	}
+
+	return nextHopIPv4, nextHopIPv6, nil
+}
+
+// ParseCommunities parses communities in the ASN:value format or given by their well-known name
+func ParseCommunities(values []string) ([]uint32, error) {
+	var communities []uint32
+	for _, value := range values {
+		value = strings.TrimSpace(value)
+		if community, ok := wellKnownCommunities[value]; ok {
+			communities = append(communities, community)
+			continue
+		}
+
+		parts, err := parseUints(value, 2, 16)
+		if err != nil {
+			return nil, fmt.Errorf("invalid community %q: %w", value, err)
+		}
+		communities = append(communities, uint32(parts[0])<<16|uint32(parts[1]))
+	}
+
+	slices.SortFunc(communities, compareCommunities)
+	return slices.Compact(communities), nil
+}
+
+// ParseLargeCommunities parses large communities in the globalAdministrator:localData1:localData2 format
+func ParseLargeCommunities(values []string) ([]packet.LargeCommunity, error) {
+	var communities []packet.LargeCommunity
+	for _, value := range values {
+		value = strings.TrimSpace(value)
+		parts, err := parseUints(value, 3, 32)
+		if err != nil {
+			return nil, fmt.Errorf("invalid large community %q: %w", value, err)
+		}
+		communities = append(communities, packet.LargeCommunity{
+			GlobalAdministrator: uint32(parts[0]),
+			LocalData1:          uint32(parts[1]),
+			LocalData2:          uint32(parts[2]),
+		})
+	}
+
+	slices.SortFunc(communities, compareLargeCommunities)
+	return slices.Compact(communities), nil
+}
+
+// ParseExtendedCommunities parses route target and route origin extended communities in the rt:admin:value and
+// soo:admin:value formats. The administrator is either an IPv4 address or an ASN, which is encoded as a 2-octet or
+// 4-octet AS specific extended community depending on its value
+func ParseExtendedCommunities(values []string) ([]packet.ExtendedCommunity, error) {
+	var communities []packet.ExtendedCommunity
+	for _, value := range values {
+		value = strings.TrimSpace(value)
+		community, err := parseExtendedCommunity(value)
+		if err != nil {
+			return nil, fmt.Errorf("invalid extended community %q: %w", value, err)
+		}
+		communities = append(communities, community)
+	}
+
+	slices.SortFunc(communities, compareExtendedCommunities)
+	return slices.Compact(communities), nil
+}
+
+func parseExtendedCommunity(value string) (packet.ExtendedCommunity, error) {
+	var community packet.ExtendedCommunity
+
+	kind, rest, _ := strings.Cut(value, ":")
+	switch kind {
+	case "rt":
+		community[1] = packet.ExtCommunitySubtypeRouteTarget
+	case "soo":
+		community[1] = packet.ExtCommunitySubtypeRouteOrigin
+	default:
+		return community, fmt.Errorf("unknown type %q, expected rt or soo", kind)
+	}
+
+	admin, local, ok := strings.Cut(rest, ":")
+	if !ok {
+		return community, fmt.Errorf("expected admin:value")
+	}
+
+	if addr, err := netip.ParseAddr(admin); err == nil {
+		if !addr.Is4() {
+			return community, fmt.Errorf("administrator %s is not an IPv4 address", addr)
+		}
+		localValue, errLocal := strconv.ParseUint(local, 10, 16)
+		if errLocal != nil {
+			return community, fmt.Errorf("invalid local value: %w", errLocal)
+		}
+		community[0] = packet.ExtCommunityTypeIPv4Address
+		ip := addr.As4()
+		copy(community[2:6], ip[:])
+		binary.BigEndian.PutUint16(community[6:], uint16(localValue))
+		return community, nil
+	}
+
+	asn, err := strconv.ParseUint(admin, 10, 32)
+	if err != nil {
+		return community, fmt.Errorf("invalid administrator: %w", err)
+	}
+
+	if asn <= maxTwoOctetASN {
+		localValue, errLocal := strconv.ParseUint(local, 10, 32)
+		if errLocal != nil {
+			return community, fmt.Errorf("invalid local value: %w", errLocal)
+		}
+		community[0] = packet.ExtCommunityTypeTwoOctetAS
+		binary.BigEndian.PutUint16(community[2:4], uint16(asn))
+		binary.BigEndian.PutUint32(community[4:], uint32(localValue))
+		return community, nil
+	}
+
+	localValue, err := strconv.ParseUint(local, 10, 16)
+	if err != nil {
+		return community, fmt.Errorf("invalid local value of 4-octet AS specific community: %w", err)
+	}
+	community[0] = packet.ExtCommunityTypeFourOctetAS
+	binary.BigEndian.PutUint32(community[2:6], uint32(asn))
+	binary.BigEndian.PutUint16(community[6:], uint16(localValue))
+
+	return community, nil
+}
+
+func compareCommunities(a, b uint32) int {
+	return cmp.Compare(a, b)
+}
+
+func compareLargeCommunities(a, b packet.LargeCommunity) int {
+	return cmp.Or(
+		cmp.Compare(a.GlobalAdministrator, b.GlobalAdministrator),
+		cmp.Compare(a.LocalData1, b.LocalData1),
+		cmp.Compare(a.LocalData2, b.LocalData2),
+	)
+}
+
+func compareExtendedCommunities(a, b packet.ExtendedCommunity) int {
+	return bytes.Compare(a[:], b[:])
+}
+
+// parseUints parses a value made of count colon separated unsigned integers of bitSize bits
+func parseUints(value string, count, bitSize int) ([]uint64, error) {
+	fields := strings.Split(value, ":")
+	if len(fields) != count {
+		return nil, fmt.Errorf("expected %d colon separated numbers", count)
+	}
+
+	parts := make([]uint64, count)
+	for i, field := range fields {
+		part, err := strconv.ParseUint(field, 10, bitSize)
+		if err != nil {
+			return nil, err
+		}
+		parts[i] = part
+	}
+
+	return parts, nil
+}
+
+// Equal reports whether both sets of attributes are the same, including the service advertised by the routes
+func (a RouteAttributes) Equal(b RouteAttributes) bool {
+	return a.wireEqual(b) &&
+		a.ServiceNamespace == b.ServiceNamespace &&
+		maps.Equal(a.ServiceLabels, b.ServiceLabels)
+}
+
+// wireEqual reports whether both sets of attributes are sent the same to the peers. The service advertised by the
+// routes is ignored, as it is only matched by the export policies
+func (a RouteAttributes) wireEqual(b RouteAttributes) bool {
+	return slices.Equal(a.Communities, b.Communities) &&
+		slices.Equal(a.LargeCommunities, b.LargeCommunities) &&
+		slices.Equal(a.ExtendedCommunities, b.ExtendedCommunities) &&
+		equalValues(a.LocalPref, b.LocalPref) &&
+		equalValues(a.MED, b.MED) &&
+		a.ASPathPrepend == b.ASPathPrepend &&
+		a.NextHopIPv4 == b.NextHopIPv4 &&
+		a.NextHopIPv6 == b.NextHopIPv6
+}
+
+// equalValues reports whether both pointers are nil or point to equal values
+func equalValues[T comparable](a, b *T) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+	return *a == *b
+}
+
+// pathAttributes returns the path attributes carrying the attributes in UPDATE messages
+func (a RouteAttributes) pathAttributes() []packet.PathAttribute {
+	var attrs []packet.PathAttribute
+	if a.MED != nil {
+		attrs = append(attrs, &packet.MultiExitDisc{Value: *a.MED})
+	}
+	if len(a.Communities) > 0 {
+		attrs = append(attrs, &packet.Communities{Values: a.Communities})
+	}
+	if len(a.ExtendedCommunities) > 0 {
+		attrs = append(attrs, &packet.ExtendedCommunities{Values: a.ExtendedCommunities})
+	}
+	if len(a.LargeCommunities) > 0 {
+		attrs = append(attrs, &packet.LargeCommunities{Values: a.LargeCommunities})
+	}
+
+	return attrs
+}
@@ -0,0 +1,73 @@
+package bgp
+
+import (
+	"net/netip"
+	"reflect"
+	"testing"
+
+	"github.com/yago-123/routebird/api/v1alphav1"
+	"github.com/yago-123/routebird/internal/agent/bgp/packet"
+)
+
+func TestParseRouteAttributes(t *testing.T) {
+	attrs, err := ParseRouteAttributes(v1alphav1.RouteAttributes{
+		Communities:         []string{"no-export", "65000:100", "65000:100"},
+		LargeCommunities:    []string{"4200000000:1:2"},
+		ExtendedCommunities: []string{"soo:192.0.2.1:10", "rt:65000:100", "rt:4200000000:100"},
+	})
+	if err != nil {
+		t.Fatalf("failed to parse attributes: %v", err)
+	}
+
+	expected := RouteAttributes{
+		Communities:      []uint32{65000<<16 | 100, packet.CommunityNoExport},
+		LargeCommunities: []packet.LargeCommunity{{GlobalAdministrator: 4200000000, LocalData1: 1, LocalData2: 2}},
+		ExtendedCommunities: []packet.ExtendedCommunity{
+			{packet.ExtCommunityTypeTwoOctetAS, packet.ExtCommunitySubtypeRouteTarget, 0xfd, 0xe8, 0, 0, 0, 100},
+			{packet.ExtCommunityTypeIPv4Address, packet.ExtCommunitySubtypeRouteOrigin, 192, 0, 2, 1, 0, 10},
+			{packet.ExtCommunityTypeFourOctetAS, packet.ExtCommunitySubtypeRouteTarget, 0xfa, 0x56, 0xea, 0x00, 0, 100},
+		},
+	}
+	if !reflect.DeepEqual(attrs, expected) {
+		t.Fatalf("unexpected attributes:\n got: %+v\nwant: %+v", attrs, expected)
+	}
+
+	for _, invalid := range []v1alphav1.RouteAttributes{
+		{Communities: []string{"65536:1"}},
+		{Communities: []string{"no-such-community"}},
+		{LargeCommunities: []string{"1:2"}},
+		{ExtendedCommunities: []string{"rt:4200000000:65536"}},
+		{ExtendedCommunities: []string{"rt:2001:db8::1:1"}},
+		{ExtendedCommunities: []string{"color:1:1"}},
+	} {
+		if _, err = ParseRouteAttributes(invalid); err == nil {
+			t.Errorf("expected attributes %+v to be rejected", invalid)
+		}
+	}
+}
+
+func TestRouteAttributesWireEqual(t *testing.T) {
+	med := uint32(10)
+	a := RouteAttributes{Communities: []uint32{1}, MED: &med, ServiceNamespace: "a", ServiceLabels: map[string]string{"app": "a"}}
+	b := RouteAttributes{Communities: []uint32{1}, MED: &med, ServiceNamespace: "b", ServiceLabels: map[string]string{"app": "b"}}
+
+	if a.Equal(b) {
+		t.Fatalf("expected attributes of different services not to be equal")
+	}
+	if !a.wireEqual(b) {
+		t.Fatalf("expected attributes of different services to be sent the same")
+	}
+
+	// Routes of different services sent with the same attributes are packed in the same UPDATE message
+	groups := addToGroup(nil, netip.MustParsePrefix("10.0.0.1/32"), a)
+	groups = addToGroup(groups, netip.MustParsePrefix("10.0.0.2/32"), b)
+	if len(groups) != 1 || len(groups[0].prefixes) != 2 {
+		t.Fatalf("expected a single group with both prefixes, got %+v", groups)
+	}
+
+	other := med + 1
+	b.MED = &other
+	if a.wireEqual(b) {
+		t.Fatalf("expected attributes with different MED not to be sent the same")
+	}
+}
@@ -0,0 +1,38 @@
+package bgp
+
+// State represents the state of a BGP session as defined by the finite state machine in RFC 4271 section 8
+type State int32
+
+const (
+	// StateIdle is the initial state, no resources are allocated to the peer
+	StateIdle State = iota
+	// StateConnect waits for the TCP connection to the peer to be completed
+	StateConnect
+	// StateActive waits for the connect retry timer to expire after a failed TCP connection attempt
+	StateActive
+	// StateOpenSent waits for an OPEN message from the peer after having sent ours
+	StateOpenSent
+	// StateOpenConfirm waits for a KEEPALIVE message confirming the OPEN negotiation
+	StateOpenConfirm
+	// StateEstablished exchanges UPDATE, NOTIFICATION and KEEPALIVE messages with the peer
+	StateEstablished
+)
+
+func (s State) String() string {
+	switch s {
+	case StateIdle:
+		return "Idle"
+	case StateConnect:
+		return "Connect"
+	case StateActive:
+		return "Active"
+	case StateOpenSent:
+		return "OpenSent"
+	case StateOpenConfirm:
+		return "OpenConfirm"
+	case StateEstablished:
+		return "Established"
+	default:
+		return "Unknown"
+	}
+}
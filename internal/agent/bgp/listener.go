@@ -0,0 +1,456 @@
+package bgp
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/netip"
+	"slices"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/go-logr/logr"
+	"github.com/yago-123/routebird/api/v1alphav1"
+)
+
+const (
+	// passwordRefreshInterval is the interval between reloads of the TCP MD5 keys set on the listening socket, as
+	// kubelet updates the projected password files in place when their secrets change
+	passwordRefreshInterval = 30 * time.Second
+
+	// listenRetryInterval is the time waited before listening again once the listener fails, doubled after every
+	// failure up to maxListenRetryInterval
+	listenRetryInterval    = time.Second
+	maxListenRetryInterval = DefaultConnectRetryTime
+)
+
+// listenRange accepts the connections from any address of its prefix, creating a dynamic peer for each of them
+type listenRange struct {
+	config v1alphav1.ListenRange
+	prefix netip.Prefix
+	// maxPeers limits the number of dynamic peers of the range, zero when unlimited
+	maxPeers int
+	// peerCfg contains the settings of the dynamic peers, its address is replaced with the one of each peer
+	peerCfg  v1alphav1.BGPPeer
+	peerASNs []v1alphav1.ASNRange
+
+	speaker      speakerConfig
+	routes       func() map[netip.Prefix]RouteAttributes
+	selectRoutes func(prefixes []netip.Prefix)
+
+	// The rest of the fields are guarded by the peersLock of the manager
+	exportPolicy *policy
+	importPolicy *policy
+	// sessions contains the dynamic peers of the range whose sessions are up, together with the function closing each
+	// of them
+	sessions map[*peer]context.CancelFunc
+	// removed reports whether the range was removed from the manager, which no longer accepts connections from it
+	removed bool
+	// established contains the addresses of the dynamic peers that established a session with the manager
+	established map[netip.Addr]struct{}
+	// blocked contains the addresses of the dynamic peers that exceeded their maximum number of prefixes, whose
+	// connections are rejected until the given time or, when zero, until the agent restarts
+	blocked map[netip.Addr]time.Time
+}
+
+func newListenRange(
+	rangeCfg v1alphav1.ListenRange,
+	speaker speakerConfig,
+	routes func() map[netip.Prefix]RouteAttributes,
+	selectRoutes func(prefixes []netip.Prefix),
+) (*listenRange, error) {
+	prefix, err := netip.ParsePrefix(rangeCfg.Prefix)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse prefix %q: %w", rangeCfg.Prefix, err)
+	}
+
+	if len(rangeCfg.PeerASNs) == 0 {
+		return nil, errors.New("no peer ASNs")
+	}
+	for _, asns := range rangeCfg.PeerASNs {
+		if asns.First == 0 || asns.First > asns.Last {
+			return nil, fmt.Errorf("invalid peer ASN range %d-%d", asns.First, asns.Last)
+		}
+	}
+	if rangeCfg.MaxPeers < 0 {
+		return nil, fmt.Errorf("invalid maximum number of peers %d", rangeCfg.MaxPeers)
+	}
+
+	r := &listenRange{
+		config:       rangeCfg,
+		prefix:       prefix.Masked(),
+		maxPeers:     int(rangeCfg.MaxPeers),
+		peerCfg:      rangePeer(rangeCfg),
+		peerASNs:     slices.Clone(rangeCfg.PeerASNs),
+		speaker:      speaker,
+		routes:       routes,
+		selectRoutes: selectRoutes,
+		sessions:     make(map[*peer]context.CancelFunc),
+		established:  make(map[netip.Addr]struct{}),
+		blocked:      make(map[netip.Addr]time.Time),
+	}
+
+	// Ranges only accepting the local ASN have internal peers, whose TTL is not limited to directly connected peers as
+	// it is for external ones
+	if !slices.ContainsFunc(r.peerASNs, func(asns v1alphav1.ASNRange) bool {
+		return asns.First != speaker.localASN || asns.Last != speaker.localASN
+	}) {
+		r.peerCfg.ASN = speaker.localASN
+	}
+
+	// The settings shared by the dynamic peers are validated upfront, so that connections are never rejected for them
+	if _, err = r.newPeer(r.prefix.Addr(), logr.Discard()); err != nil {
+		return nil, err
+	}
+
+	return r, nil
+}
+
+// rangePeer returns the settings of the dynamic peers of the listen range, named after its prefix
+func rangePeer(rangeCfg v1alphav1.ListenRange) v1alphav1.BGPPeer {
+	return v1alphav1.BGPPeer{
+		Address:              rangeCfg.Prefix,
+		Passive:              true,
+		HoldTimeSeconds:      rangeCfg.HoldTimeSeconds,
+		KeepaliveTimeSeconds: rangeCfg.KeepaliveTimeSeconds,
+		EBGPMultihopTTL:      rangeCfg.EBGPMultihopTTL,
+		GTSM:                 rangeCfg.GTSM,
+		ExportPolicy:         rangeCfg.ExportPolicy,
+		ImportPolicy:         rangeCfg.ImportPolicy,
+		MaxPrefixes:          rangeCfg.MaxPrefixes,
+	}
+}
+
+// newPeer creates the dynamic peer connecting from the address, whose ASN is learned from its OPEN message
+func (r *listenRange) newPeer(remote netip.Addr, logger logr.Logger) (*peer, error) {
+	peerCfg := r.peerCfg
+	peerCfg.Address = remote.String()
+
+	p, err := newPeer(peerCfg, r.speaker, r.routes, r.selectRoutes, logger)
+	if err != nil {
+		return nil, err
+	}
+	p.peerASNs = r.peerASNs
+
+	return p, nil
+}
+
+// listen accepts the connections of the passive peers and the listen ranges on the local BGP port until the context
+// is cancelled, handing each of them to the session of its peer. The sessions of the dynamic peers are added to the
+// wait group. Failures to listen or to accept connections are retried with exponential backoff
+func (m *manager) listen(ctx context.Context, wg *sync.WaitGroup) {
+	retryInterval := listenRetryInterval
+	for {
+		err := m.serve(ctx, wg)
+		if ctx.Err() != nil {
+			return
+		}
+
+		m.logger.Error(err, "BGP listener failed, retrying", "retryInterval", retryInterval)
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(retryInterval):
+		}
+		retryInterval = min(2*retryInterval, maxListenRetryInterval)
+	}
+}
+
+// serve listens on the local BGP port and accepts connections until the context is cancelled or the listener fails
+func (m *manager) serve(ctx context.Context, wg *sync.WaitGroup) error {
+	// The listener is closed once it fails, while the sessions of the accepted peers keep running with ctx
+	listenCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	// Keys of the listening socket are inherited by the accepted connections, which must be signed from the very first
+	// segment. Peers whose password cannot be read are left out, so that they do not prevent the rest from connecting,
+	// until their password is reloaded
+	opts := socketOptions{md5Keys: make(map[netip.Addr]string)}
+	for _, p := range m.listenerPeers() {
+		password, err := p.password()
+		if err != nil {
+			p.logger.Error(err, "Failed to set TCP MD5 key of BGP listener, connections of the peer are not accepted until it can be read")
+			continue
+		}
+		opts.md5Keys[p.remote.Addr()] = password
+	}
+
+	var network string
+	listenConfig := net.ListenConfig{
+		Control: func(nw, address string, c syscall.RawConn) error {
+			network = nw
+			if opts.isZero() {
+				return nil
+			}
+			return opts.control(nw, address, c)
+		},
+	}
+
+	listener, err := listenConfig.Listen(ctx, "tcp", fmt.Sprintf(":%d", m.localPort))
+	if err != nil {
+		return fmt.Errorf("failed to listen for BGP connections on port %d: %w", m.localPort, err)
+	}
+
+	go func() {
+		<-listenCtx.Done()
+		_ = listener.Close()
+	}()
+
+	rawConn, err := listener.(*net.TCPListener).SyscallConn()
+	if err != nil {
+		return fmt.Errorf("failed to access BGP listener socket: %w", err)
+	}
+	go m.refreshListenerKeys(listenCtx, rawConn, network, opts.md5Keys)
+
+	for {
+		conn, errAccept := listener.Accept()
+		if errAccept != nil {
+			if ctx.Err() != nil {
+				return nil
+			}
+			return fmt.Errorf("failed to accept BGP connection: %w", errAccept)
+		}
+
+		m.accept(ctx, wg, conn, network)
+	}
+}
+
+// listenerPeers returns the passive peers whose sessions are signed with TCP MD5, whose keys are set on the listening
+// socket
+func (m *manager) listenerPeers() []*peer {
+	var peers []*peer
+	for _, p := range m.configuredPeers() {
+		if p.passive && p.passwordFile != "" {
+			peers = append(peers, p)
+		}
+	}
+	return peers
+}
+
+// refreshListenerKeys reloads the TCP MD5 keys of the passive peers every passwordRefreshInterval, and whenever the
+// peers change, until the context is cancelled, so that password changes apply to the following connections without
+// restarting the agent
+func (m *manager) refreshListenerKeys(ctx context.Context, rawConn syscall.RawConn, network string, keys map[netip.Addr]string) {
+	ticker := time.NewTicker(passwordRefreshInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		case <-m.listenerKeysC:
+		}
+
+		m.updateListenerKeys(rawConn, network, keys)
+	}
+}
+
+// updateListenerKeys sets the keys of the passive peers whose password changed on the listening socket, updating the
+// keys currently set, and deletes the keys of the peers that were removed. Keys whose password cannot be read are kept,
+// so that established sessions are never affected by a missing password file
+func (m *manager) updateListenerKeys(rawConn syscall.RawConn, network string, keys map[netip.Addr]string) {
+	changed := make(map[netip.Addr]string)
+	current := make(map[netip.Addr]struct{})
+	for _, p := range m.listenerPeers() {
+		current[p.remote.Addr()] = struct{}{}
+		password, err := p.password()
+		if err != nil {
+			p.logger.Error(err, "Failed to reload TCP MD5 key of BGP listener")
+			continue
+		}
+		if key, ok := keys[p.remote.Addr()]; !ok || key != password {
+			changed[p.remote.Addr()] = password
+		}
+	}
+	// Empty keys delete the ones set for their addresses
+	for addr := range keys {
+		if _, ok := current[addr]; !ok {
+			changed[addr] = ""
+		}
+	}
+	if len(changed) == 0 {
+		return
+	}
+
+	if err := (socketOptions{md5Keys: changed}).control(network, "", rawConn); err != nil {
+		m.logger.Error(err, "Failed to update TCP MD5 keys of BGP listener")
+		return
+	}
+	for addr, key := range changed {
+		if _, ok := current[addr]; ok {
+			keys[addr] = key
+		} else {
+			delete(keys, addr)
+		}
+	}
+	m.logger.Info("Updated TCP MD5 keys of BGP listener", "peers", len(changed))
+}
+
+// accept hands an incoming connection to its passive peer or, when it comes from a listen range, to a new dynamic
+// peer. The connection is closed when it does not belong to any of them or the session of the peer is already in
+// progress
+func (m *manager) accept(ctx context.Context, wg *sync.WaitGroup, conn net.Conn, network string) {
+	remote := conn.RemoteAddr().(*net.TCPAddr).AddrPort().Addr().Unmap()
+
+	peers := m.configuredPeers()
+	idx := slices.IndexFunc(peers, func(p *peer) bool { return p.passive && p.accepts(remote) })
+	if idx < 0 {
+		// Connections from the configured peers are never accepted from the listen ranges
+		if r := m.rangeOf(remote); r != nil && !slices.ContainsFunc(peers, func(p *peer) bool { return p.accepts(remote) }) {
+			m.acceptDynamic(ctx, wg, r, conn, network, remote)
+			return
+		}
+
+		m.logger.V(1).Info("Rejecting BGP connection of unknown peer", "remote", remote)
+		_ = conn.Close()
+		return
+	}
+	p := peers[idx]
+
+	if err := setSocketOptions(p, conn, network); err != nil {
+		p.logger.Error(err, "Failed to set socket options of BGP connection")
+		_ = conn.Close()
+		return
+	}
+
+	select {
+	case p.acceptCh <- conn:
+	default:
+		p.logger.V(1).Info("Rejecting BGP connection, session already in progress")
+		_ = conn.Close()
+	}
+}
+
+// acceptDynamic runs the session of a new dynamic peer of the listen range over the incoming connection until it is
+// closed or the range is removed, removing the peer afterwards
+func (m *manager) acceptDynamic(
+	ctx context.Context,
+	wg *sync.WaitGroup,
+	r *listenRange,
+	conn net.Conn,
+	network string,
+	remote netip.Addr,
+) {
+	sessionCtx, cancel := context.WithCancel(ctx)
+	p, err := m.addDynamicPeer(r, remote, cancel)
+	if err != nil {
+		cancel()
+		m.logger.V(1).Info("Rejecting BGP connection from listen range", "remote", remote, "prefix", r.prefix, "error", err.Error())
+		_ = conn.Close()
+		return
+	}
+
+	if err = setSocketOptions(p, conn, network); err != nil {
+		p.logger.Error(err, "Failed to set socket options of BGP connection")
+		_ = conn.Close()
+		m.removeDynamicPeer(p, nil)
+		return
+	}
+
+	p.logger.Info("Accepted BGP connection from listen range", "prefix", r.prefix)
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+
+		err := p.runSession(sessionCtx, conn)
+		m.removeDynamicPeer(p, err)
+		if sessionCtx.Err() == nil {
+			p.logger.Error(err, "Dynamic BGP session closed")
+		}
+	}()
+}
+
+// rangeOf returns the first listen range containing the address, nil when none of them contains it
+func (m *manager) rangeOf(remote netip.Addr) *listenRange {
+	m.peersLock.RLock()
+	defer m.peersLock.RUnlock()
+
+	// Prefixes never contain zoned addresses
+	addr := remote.WithZone("")
+	idx := slices.IndexFunc(m.listenRanges, func(r *listenRange) bool { return r.prefix.Contains(addr) })
+	if idx < 0 {
+		return nil
+	}
+	return m.listenRanges[idx]
+}
+
+// addDynamicPeer creates the dynamic peer of the listen range connecting from the address, whose session is closed
+// with the cancel function, unless the range was removed or reached its maximum number of peers, the address already
+// has a session in progress or it is blocked
+func (m *manager) addDynamicPeer(r *listenRange, remote netip.Addr, cancel context.CancelFunc) (*peer, error) {
+	m.peersLock.Lock()
+	defer m.peersLock.Unlock()
+
+	if r.removed {
+		return nil, errors.New("listen range removed")
+	}
+	if until, blocked := r.blocked[remote]; blocked {
+		if until.IsZero() || time.Now().Before(until) {
+			return nil, errors.New("peer exceeded its maximum number of prefixes")
+		}
+		delete(r.blocked, remote)
+	}
+	for p := range m.dynamicPeers {
+		if p.accepts(remote) {
+			return nil, errors.New("session already in progress")
+		}
+	}
+	if r.maxPeers > 0 && len(r.sessions) >= r.maxPeers {
+		return nil, fmt.Errorf("maximum number of %d peers reached", r.maxPeers)
+	}
+
+	p, err := r.newPeer(remote, m.logger.WithValues("peer", remote))
+	if err != nil {
+		return nil, err
+	}
+	_, p.hasEstablished = r.established[remote]
+	p.exportPolicy.Store(r.exportPolicy)
+	p.importPolicy.Store(r.importPolicy)
+
+	m.dynamicPeers[p] = r
+	r.sessions[p] = cancel
+
+	return p, nil
+}
+
+// removeDynamicPeer removes the dynamic peer once its session is closed with the given error. Peers that exceeded
+// their maximum number of prefixes are not accepted again until the agent restarts, or until their restart interval
+// elapses with the Restart action
+func (m *manager) removeDynamicPeer(p *peer, err error) {
+	m.peersLock.Lock()
+	defer m.peersLock.Unlock()
+
+	r := m.dynamicPeers[p]
+	delete(m.dynamicPeers, p)
+	r.sessions[p]()
+	delete(r.sessions, p)
+
+	addr := p.remote.Addr()
+	if p.hasEstablished {
+		r.established[addr] = struct{}{}
+	}
+	if errors.Is(err, errMaxPrefixesReached) {
+		var until time.Time
+		if p.maxPrefixes.action == v1alphav1.MaxPrefixesActionRestart {
+			until = time.Now().Add(p.maxPrefixes.restartInterval)
+		}
+		r.blocked[addr] = until
+	}
+}
+
+// setSocketOptions applies the TTL settings of the peer to its accepted connection
+func setSocketOptions(p *peer, conn net.Conn, network string) error {
+	opts := socketOptions{ttl: p.ttl, minTTL: p.minTTL}
+	if opts.isZero() {
+		return nil
+	}
+
+	rawConn, err := conn.(*net.TCPConn).SyscallConn()
+	if err != nil {
+		return err
+	}
+	return opts.control(network, "", rawConn)
+}
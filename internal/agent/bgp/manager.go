@@ -1,36 +1,772 @@
 package bgp
 
 import (
+	"context"
+	"errors"
+	"fmt"
+	"maps"
+	"net/netip"
+	"reflect"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
 	"github.com/go-logr/logr"
 	"github.com/yago-123/routebird/api/v1alphav1"
+	"github.com/yago-123/routebird/internal/agent/bfd"
+	"github.com/yago-123/routebird/internal/agent/bgp/packet"
+	"github.com/yago-123/routebird/internal/agent/ndp"
+	cfg "github.com/yago-123/routebird/internal/common"
 	"k8s.io/client-go/kubernetes"
 )
 
-// todo: handle BGP peers and route announcements
+const maxTwoOctetASN = 65535
+
+// ErrRestart is the cause with which the context of Run is cancelled when the agent restarts to apply new BGP speaker
+// settings. Established sessions that negotiated graceful restart are then closed without withdrawing their routes,
+// so that the peers retain them until the manager replacing this one establishes its sessions
+var ErrRestart = errors.New("BGP speaker restarting")
 
 type Manager interface {
-	AnnounceRoute(route string)
-	WithdrawRoute(route string)
+	// Run establishes and maintains a BGP session with every configured peer until the provided context is cancelled.
+	// Routes announced through the manager are advertised to every peer as soon as its session is established. Once
+	// the context is cancelled, the routes are withdrawn from every established session and the sessions are closed
+	// after the drain interval, unless it is cancelled with ErrRestart and the session negotiated graceful restart. Run
+	// returns when all of them are closed.
+	Run(ctx context.Context) error
+
+	// AnnounceRoute advertises the given route to all peers with the provided path attributes. The route can be either
+	// a prefix in CIDR notation or a single IP address, which is advertised as a host route. Announcing a route again
+	// with different attributes replaces the attributes advertised to the peers.
+	AnnounceRoute(route string, attrs RouteAttributes) error
+
+	// WithdrawRoute withdraws a previously announced route from all peers.
+	WithdrawRoute(route string) error
+
+	// Routes returns the routes currently announced through the manager, as prefixes in CIDR notation, together with
+	// their path attributes.
+	Routes() map[string]RouteAttributes
+
+	// AdjRIBIn returns the routes received from each peer and accepted by its import policy, indexed by the address of
+	// the peer or the interface of unnumbered peers. Dynamic peers accepted from the listen ranges are included while
+	// their sessions are up.
+	AdjRIBIn() map[string][]Route
+
+	// LocRIB returns the route selected for each prefix among the routes announced through the manager and the ones
+	// received from the peers. Routes whose AS path contains the local AS are never selected.
+	LocRIB() []Route
+
+	// AdjRIBOut returns the routes advertised to each peer, indexed by the address of the peer or the interface of
+	// unnumbered peers.
+	AdjRIBOut() map[string][]Route
+
+	// LookupRoute returns the route of the Loc-RIB with the longest prefix containing the given IP address.
+	LookupRoute(addr string) (Route, bool, error)
+
+	// UpdatePeers replaces the peers and the listen ranges with the ones of the given configuration, leaving their
+	// policies to UpdatePolicies. Sessions with the peers whose settings did not change are kept, the rest of the peers
+	// and the dynamic peers of the listen ranges that changed are drained and stopped, and the new peers started with
+	// the policies of the configuration. It returns once the peers are replaced, and applies none of them if any is
+	// invalid. The settings of the local BGP speaker in the configuration, such as the local ASN, are ignored.
+	UpdatePeers(config cfg.Config) error
+
+	// UpdatePolicies replaces the prefix lists and the import and export policies of the peers and the listen ranges
+	// with the ones of the given configuration, which must contain the same peers and listen ranges in the same order.
+	// Established sessions advertise their routes again through the new export policies and request the peers to
+	// advertise theirs again, so that the new policies apply without resetting the sessions.
+	UpdatePolicies(config cfg.Config) error
 }
 
 type manager struct {
-	peers  []v1alphav1.BGPPeer
+	// speaker contains the settings shared by the sessions with every peer, including the peers added later
+	speaker speakerConfig
+
+	// peers and listenRanges are replaced by UpdatePeers, never modified in place, with both the updateLock and the
+	// peersLock held
+	peers []*peer
+	// localPort is the port in which the connections of the passive peers and the listen ranges are accepted
+	localPort int
+	// listenRanges accept the connections of dynamic peers from their prefixes
+	listenRanges []*listenRange
+	// dynamicPeers contains the peers accepted from the listen ranges while their sessions are up, together with the
+	// range of each of them
+	dynamicPeers map[*peer]*listenRange
+	peersLock    sync.RWMutex
+	// updateLock serializes the updates of the peers and their policies
+	updateLock sync.Mutex
+	// bfdListener receives the BFD control packets of the peers with BFD enabled, nil when none has it enabled
+	bfdListener *bfd.Listener
+	// discovery discovers the neighbors of the unnumbered peers, nil when there are none
+	discovery *ndp.Discovery
+	// listenerKeysC is signaled when the peers change, so that the TCP MD5 keys of the listener are updated right away
+	listenerKeysC chan struct{}
+
+	// runCtx and runWG are the context and the wait group of Run while it runs, so that the peers and the services
+	// needed by them are started and waited for by Run even when added later. Both are nil once its context is
+	// cancelled. stops contains a function stopping each configured peer started by Run, which returns once it
+	// stopped, and the rest of the fields report the services that were started. All of them are guarded by runLock
+	runCtx             context.Context
+	runWG              *sync.WaitGroup
+	stops              map[*peer]func()
+	bfdListenerStarted bool
+	discoveryStarted   bool
+	listenerStarted    bool
+	runLock            sync.Mutex
+
+	// routes contains the prefixes that must be advertised to the peers, together with their path attributes
+	routes map[netip.Prefix]RouteAttributes
+	lock   sync.RWMutex
+	// locRIB contains the route selected for each prefix, selectLock serializes the decision process so that the
+	// selected routes are never replaced with stale ones
+	locRIB     table
+	selectLock sync.Mutex
+
 	client kubernetes.Interface
 	logger logr.Logger
 }
 
-func NewManager(peers []v1alphav1.BGPPeer, client kubernetes.Interface, logger logr.Logger) Manager {
-	return &manager{
-		peers:  peers,
-		client: client,
-		logger: logger,
+func NewManager(config cfg.Config, nodeName string, client kubernetes.Interface, logger logr.Logger) (Manager, error) {
+	return newManager(config, nodeName, false, client, logger)
+}
+
+// NewRestartedManager creates the manager replacing one whose Run was cancelled with ErrRestart. The first session
+// with each peer is flagged as a restart in the Graceful Restart capability, as the peers may retain its routes
+func NewRestartedManager(config cfg.Config, nodeName string, client kubernetes.Interface, logger logr.Logger) (Manager, error) {
+	return newManager(config, nodeName, true, client, logger)
+}
+
+func newManager(config cfg.Config, nodeName string, restarting bool, client kubernetes.Interface, logger logr.Logger) (*manager, error) {
+	if err := cfg.ValidateASN(config.LocalASN); err != nil {
+		return nil, fmt.Errorf("invalid local ASN: %w", err)
+	}
+
+	m := &manager{
+		localPort:     int(config.BGPLocalPort),
+		dynamicPeers:  make(map[*peer]*listenRange),
+		listenerKeysC: make(chan struct{}, 1),
+		stops:         make(map[*peer]func()),
+		routes:        make(map[netip.Prefix]RouteAttributes),
+		client:        client,
+		logger:        logger,
+	}
+	if m.localPort == 0 {
+		m.localPort = BGPPort
+	}
+
+	speaker := speakerConfig{
+		localASN:           config.LocalASN,
+		requireFourOctetAS: config.RequireFourOctetAS,
+		drainInterval:      time.Duration(config.DrainIntervalSeconds) * time.Second,
+		pathID:             nodePathID(nodeName),
+		restarting:         restarting,
+	}
+	if config.RouterID != "" {
+		addr, err := netip.ParseAddr(config.RouterID)
+		if err != nil || !addr.Is4() || addr.IsUnspecified() {
+			return nil, fmt.Errorf("invalid router ID %q: must be a non-zero IPv4 address", config.RouterID)
+		}
+		speaker.routerID = addr.As4()
+	}
+	if config.GracefulRestart != nil {
+		speaker.restartTime = time.Duration(config.GracefulRestart.RestartTimeSeconds) * time.Second
+	}
+	m.speaker = speaker
+
+	policies, err := newPolicies(config.PrefixLists, config.Policies)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, peerCfg := range config.Peers {
+		p, err := m.newConfiguredPeer(peerCfg, speaker, policies)
+		if err != nil {
+			return nil, err
+		}
+		m.peers = append(m.peers, p)
+	}
+
+	for _, rangeCfg := range config.ListenRanges {
+		r, err := m.newListenRange(rangeCfg, speaker, policies)
+		if err != nil {
+			return nil, err
+		}
+		m.listenRanges = append(m.listenRanges, r)
+	}
+
+	return m, nil
+}
+
+// newConfiguredPeer creates a configured peer with its policies, registering its BFD session and its interface when
+// enabled
+func (m *manager) newConfiguredPeer(peerCfg v1alphav1.BGPPeer, speaker speakerConfig, policies map[string]*policy) (*peer, error) {
+	name := cfg.PeerName(peerCfg)
+	if err := cfg.ValidateASN(peerCfg.ASN); err != nil {
+		return nil, fmt.Errorf("invalid BGP peer %s: invalid peer ASN: %w", name, err)
 	}
+	p, err := newPeer(peerCfg, speaker, m.snapshot, m.selectRoutes, m.logger.WithValues("peer", name))
+	if err != nil {
+		return nil, fmt.Errorf("invalid BGP peer %s: %w", name, err)
+	}
+	exportPolicy, importPolicy, err := peerPolicies(policies, peerCfg)
+	if err != nil {
+		return nil, err
+	}
+	p.config = peerCfg
+	p.exportPolicy.Store(exportPolicy)
+	p.importPolicy.Store(importPolicy)
+
+	if p.iface != "" {
+		if peerCfg.BFD != nil {
+			return nil, fmt.Errorf("invalid BGP peer %s: BFD is not supported with interface", name)
+		}
+		if m.discovery == nil {
+			m.discovery = ndp.NewDiscovery(m.logger.WithName("ndp"))
+		}
+		m.discovery.AddInterface(p.iface)
+		discovery := m.discovery
+		p.neighbor = func(ctx context.Context) (netip.Addr, error) { return discovery.Neighbor(ctx, p.iface) }
+	}
+
+	if peerCfg.BFD != nil {
+		if p.bfd, err = m.newBFDSession(p.remote.Addr(), peerCfg.BFD); err != nil {
+			return nil, fmt.Errorf("invalid BFD configuration for BGP peer %s: %w", name, err)
+		}
+	}
+
+	return p, nil
 }
 
-func (m *manager) AnnounceRoute(route string) {
-	m.logger.Info("Announcing route", "route", route)
+// newListenRange creates a listen range with the policies of its dynamic peers
+func (m *manager) newListenRange(rangeCfg v1alphav1.ListenRange, speaker speakerConfig, policies map[string]*policy) (*listenRange, error) {
+	r, err := newListenRange(rangeCfg, speaker, m.snapshot, m.selectRoutes)
+	if err != nil {
+		return nil, fmt.Errorf("invalid listen range %s: %w", rangeCfg.Prefix, err)
+	}
+	if r.exportPolicy, r.importPolicy, err = peerPolicies(policies, r.peerCfg); err != nil {
+		return nil, err
+	}
+
+	return r, nil
 }
 
-func (m *manager) WithdrawRoute(route string) {
-	m.logger.Info("Withdrawing route", "route", route)
+// peerPolicies returns the export and import policies of the peer, nil when the peer has none
+func peerPolicies(policies map[string]*policy, peerCfg v1alphav1.BGPPeer) (*policy, *policy, error) {
+	var exportPolicy, importPolicy *policy
+	if peerCfg.ExportPolicy != "" {
+		if exportPolicy = policies[peerCfg.ExportPolicy]; exportPolicy == nil {
+			return nil, nil, fmt.Errorf("unknown export policy %q for BGP peer %s", peerCfg.ExportPolicy, cfg.PeerName(peerCfg))
+		}
+	}
+	if peerCfg.ImportPolicy != "" {
+		if importPolicy = policies[peerCfg.ImportPolicy]; importPolicy == nil {
+			return nil, nil, fmt.Errorf("unknown import policy %q for BGP peer %s", peerCfg.ImportPolicy, cfg.PeerName(peerCfg))
+		}
+	}
+
+	return exportPolicy, importPolicy, nil
+}
+
+func (m *manager) Run(ctx context.Context) error {
+	var wg sync.WaitGroup
+
+	m.runLock.Lock()
+	m.runCtx, m.runWG = ctx, &wg
+	for _, p := range m.configuredPeers() {
+		m.startPeer(p)
+	}
+	m.startServices()
+	m.runLock.Unlock()
+
+	<-ctx.Done()
+
+	// Nothing is started once the context is cancelled, so that every goroutine is waited for
+	m.runLock.Lock()
+	m.runCtx, m.runWG = nil, nil
+	m.runLock.Unlock()
+
+	wg.Wait()
+	return nil
+}
+
+// startPeer runs the peer and its BFD session until the context of Run is cancelled or the peer is stopped through its
+// function in stops. It must be called with the runLock held while Run runs
+func (m *manager) startPeer(p *peer) {
+	ctx, cancel := context.WithCancel(m.runCtx)
+	runWG := m.runWG
+	var wg sync.WaitGroup
+
+	wg.Add(1)
+	runWG.Add(1)
+	go func() {
+		defer runWG.Done()
+		defer wg.Done()
+		p.run(ctx)
+	}()
+
+	if p.bfd != nil {
+		wg.Add(1)
+		runWG.Add(1)
+		go func() {
+			defer runWG.Done()
+			defer wg.Done()
+			if err := p.bfd.Run(ctx); err != nil {
+				p.logger.Error(err, "BFD session stopped with error")
+			}
+		}()
+	}
+
+	m.stops[p] = func() {
+		cancel()
+		wg.Wait()
+	}
+}
+
+// startServices starts the BFD listener, the neighbor discovery and the BGP listener once any peer or listen range
+// needs them, so that they are only run when needed. It must be called with the runLock held while Run runs
+func (m *manager) startServices() {
+	ctx, wg := m.runCtx, m.runWG
+
+	if m.bfdListener != nil && !m.bfdListenerStarted {
+		m.bfdListenerStarted = true
+		bfdListener := m.bfdListener
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			// BGP sessions keep working without BFD, as they are only torn down when BFD goes down after being up
+			if err := bfdListener.Run(ctx); err != nil {
+				m.logger.Error(err, "BFD listener stopped with error")
+			}
+		}()
+	}
+
+	if m.discovery != nil && !m.discoveryStarted {
+		m.discoveryStarted = true
+		discovery := m.discovery
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			// Unnumbered peers keep waiting for their neighbors, while the rest of the peers are not affected
+			if err := discovery.Run(ctx); err != nil {
+				m.logger.Error(err, "Neighbor discovery stopped with error")
+			}
+		}()
+	}
+
+	m.peersLock.RLock()
+	listening := len(m.listenRanges) > 0 || slices.ContainsFunc(m.peers, func(p *peer) bool { return p.passive })
+	m.peersLock.RUnlock()
+	if listening && !m.listenerStarted {
+		m.listenerStarted = true
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			// Sessions of the dynamic peers are added to the wait group, so that they are drained before returning
+			m.listen(ctx, wg)
+		}()
+	}
+}
+
+func (m *manager) AnnounceRoute(route string, attrs RouteAttributes) error {
+	prefix, err := parseRoute(route)
+	if err != nil {
+		return err
+	}
+
+	m.lock.Lock()
+	current, exists := m.routes[prefix]
+	m.routes[prefix] = attrs
+	m.lock.Unlock()
+
+	switch {
+	case !exists:
+		m.logger.Info("Announcing route", "route", prefix)
+	case !current.Equal(attrs):
+		m.logger.Info("Updating attributes of route", "route", prefix)
+	default:
+		return nil
+	}
+	m.selectRoutes([]netip.Prefix{prefix})
+	m.notifyPeers()
+
+	return nil
+}
+
+func (m *manager) WithdrawRoute(route string) error {
+	prefix, err := parseRoute(route)
+	if err != nil {
+		return err
+	}
+
+	m.lock.Lock()
+	_, exists := m.routes[prefix]
+	delete(m.routes, prefix)
+	m.lock.Unlock()
+
+	if exists {
+		m.logger.Info("Withdrawing route", "route", prefix)
+		m.selectRoutes([]netip.Prefix{prefix})
+		m.notifyPeers()
+	}
+
+	return nil
+}
+
+func (m *manager) Routes() map[string]RouteAttributes {
+	snapshot := m.snapshot()
+
+	routes := make(map[string]RouteAttributes, len(snapshot))
+	for prefix, attrs := range snapshot {
+		routes[prefix.String()] = attrs
+	}
+
+	return routes
+}
+
+func (m *manager) AdjRIBIn() map[string][]Route {
+	peers := m.allPeers()
+	ribs := make(map[string][]Route, len(peers))
+	for _, p := range peers {
+		ribs[p.name] = p.adjRIBIn.routes()
+	}
+
+	return ribs
+}
+
+func (m *manager) LocRIB() []Route {
+	return m.locRIB.routes()
+}
+
+func (m *manager) AdjRIBOut() map[string][]Route {
+	peers := m.allPeers()
+	ribs := make(map[string][]Route, len(peers))
+	for _, p := range peers {
+		ribs[p.name] = p.adjRIBOut.routes()
+	}
+
+	return ribs
+}
+
+func (m *manager) UpdatePeers(config cfg.Config) error {
+	m.updateLock.Lock()
+	defer m.updateLock.Unlock()
+
+	policies, err := newPolicies(config.PrefixLists, config.Policies)
+	if err != nil {
+		return err
+	}
+
+	// Every peer and listen range is validated before replacing any, so that an invalid configuration leaves them
+	// untouched. Interfaces and BFD sessions are only registered once the configuration is valid
+	validation := &manager{speaker: m.speaker, logger: logr.Discard()}
+	for _, peerCfg := range config.Peers {
+		if _, err = validation.newConfiguredPeer(peerCfg, validation.speaker, policies); err != nil {
+			return err
+		}
+	}
+
+	kept := make(map[*peer]struct{})
+	var added []v1alphav1.BGPPeer
+	for _, peerCfg := range config.Peers {
+		idx := slices.IndexFunc(m.peers, func(p *peer) bool { return peerEqual(p.config, peerCfg) })
+		if idx < 0 {
+			added = append(added, peerCfg)
+			continue
+		}
+		kept[m.peers[idx]] = struct{}{}
+	}
+	var removed []*peer
+	for _, p := range m.peers {
+		if _, ok := kept[p]; !ok {
+			removed = append(removed, p)
+		}
+	}
+
+	var ranges []*listenRange
+	for _, rangeCfg := range config.ListenRanges {
+		idx := slices.IndexFunc(m.listenRanges, func(r *listenRange) bool { return rangeEqual(r.config, rangeCfg) })
+		if idx >= 0 {
+			ranges = append(ranges, m.listenRanges[idx])
+			continue
+		}
+		r, err := m.newListenRange(rangeCfg, m.speaker, policies)
+		if err != nil {
+			return err
+		}
+		ranges = append(ranges, r)
+	}
+
+	// Removed peers stop accepting connections before their sessions are drained
+	m.peersLock.Lock()
+	m.peers = slices.DeleteFunc(slices.Clone(m.peers), func(p *peer) bool { _, ok := kept[p]; return !ok })
+	for _, r := range m.listenRanges {
+		if slices.Contains(ranges, r) {
+			continue
+		}
+		r.removed = true
+		for _, cancel := range r.sessions {
+			cancel()
+		}
+	}
+	m.listenRanges = ranges
+	m.peersLock.Unlock()
+
+	m.stopPeers(removed)
+
+	m.runLock.Lock()
+	defer m.runLock.Unlock()
+
+	var peers []*peer
+	for _, peerCfg := range config.Peers {
+		idx := slices.IndexFunc(m.peers, func(p *peer) bool { return peerEqual(p.config, peerCfg) })
+		if idx >= 0 {
+			peers = append(peers, m.peers[idx])
+			continue
+		}
+		// The configuration was validated, so that only the registration of the interfaces and BFD sessions remains
+		p, err := m.newConfiguredPeer(peerCfg, m.speaker, policies)
+		if err != nil {
+			return err
+		}
+		peers = append(peers, p)
+		if m.runCtx != nil {
+			m.startPeer(p)
+		}
+	}
+
+	m.peersLock.Lock()
+	m.peers = peers
+	m.peersLock.Unlock()
+
+	if m.runCtx != nil {
+		m.startServices()
+	}
+	select {
+	case m.listenerKeysC <- struct{}{}:
+	default:
+	}
+	m.logger.Info("Updated BGP peers", "peers", len(peers), "added", len(added), "removed", len(removed))
+
+	return nil
+}
+
+// stopPeers stops the sessions of the removed peers in parallel and waits for them to be drained, unregistering their
+// BFD sessions and the interfaces no longer used by any peer
+func (m *manager) stopPeers(removed []*peer) {
+	m.runLock.Lock()
+	var stops []func()
+	for _, p := range removed {
+		if stop, ok := m.stops[p]; ok {
+			stops = append(stops, stop)
+			delete(m.stops, p)
+		}
+	}
+	m.runLock.Unlock()
+
+	var wg sync.WaitGroup
+	for _, stop := range stops {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			stop()
+		}()
+	}
+	wg.Wait()
+
+	for _, p := range removed {
+		if p.bfd != nil {
+			m.bfdListener.RemoveSession(p.bfd)
+		}
+		if p.iface != "" && !slices.ContainsFunc(m.configuredPeers(), func(kept *peer) bool { return kept.iface == p.iface }) {
+			m.discovery.RemoveInterface(p.iface)
+		}
+	}
+}
+
+// peerEqual reports whether the settings of the peers are the same, ignoring their policies
+func peerEqual(a, b v1alphav1.BGPPeer) bool {
+	a.ExportPolicy, a.ImportPolicy = "", ""
+	b.ExportPolicy, b.ImportPolicy = "", ""
+	return reflect.DeepEqual(a, b)
+}
+
+// rangeEqual reports whether the settings of the listen ranges are the same, ignoring their policies
+func rangeEqual(a, b v1alphav1.ListenRange) bool {
+	a.ExportPolicy, a.ImportPolicy = "", ""
+	b.ExportPolicy, b.ImportPolicy = "", ""
+	return reflect.DeepEqual(a, b)
+}
+
+func (m *manager) UpdatePolicies(config cfg.Config) error {
+	m.updateLock.Lock()
+	defer m.updateLock.Unlock()
+
+	if len(config.Peers) != len(m.peers) {
+		return fmt.Errorf("configuration has %d BGP peers, expected %d", len(config.Peers), len(m.peers))
+	}
+	if len(config.ListenRanges) != len(m.listenRanges) {
+		return fmt.Errorf("configuration has %d listen ranges, expected %d", len(config.ListenRanges), len(m.listenRanges))
+	}
+
+	policies, err := newPolicies(config.PrefixLists, config.Policies)
+	if err != nil {
+		return err
+	}
+
+	// Every policy is resolved before replacing any, so that an invalid configuration leaves the policies untouched
+	exportPolicies := make([]*policy, len(m.peers))
+	importPolicies := make([]*policy, len(m.peers))
+	for i, peerCfg := range config.Peers {
+		if exportPolicies[i], importPolicies[i], err = peerPolicies(policies, peerCfg); err != nil {
+			return err
+		}
+	}
+	rangeExportPolicies := make([]*policy, len(m.listenRanges))
+	rangeImportPolicies := make([]*policy, len(m.listenRanges))
+	for i, rangeCfg := range config.ListenRanges {
+		if rangeExportPolicies[i], rangeImportPolicies[i], err = peerPolicies(policies, rangePeer(rangeCfg)); err != nil {
+			return err
+		}
+	}
+
+	for i, p := range m.peers {
+		p.exportPolicy.Store(exportPolicies[i])
+		p.importPolicy.Store(importPolicies[i])
+		p.refresh()
+	}
+
+	m.peersLock.Lock()
+	for i, r := range m.listenRanges {
+		r.exportPolicy, r.importPolicy = rangeExportPolicies[i], rangeImportPolicies[i]
+	}
+	for p, r := range m.dynamicPeers {
+		p.exportPolicy.Store(r.exportPolicy)
+		p.importPolicy.Store(r.importPolicy)
+		p.refresh()
+	}
+	dynamicPeers := len(m.dynamicPeers)
+	m.peersLock.Unlock()
+	m.logger.Info("Updated BGP policies", "peers", len(m.peers), "dynamicPeers", dynamicPeers)
+
+	return nil
+}
+
+func (m *manager) LookupRoute(addr string) (Route, bool, error) {
+	ip, err := netip.ParseAddr(addr)
+	if err != nil {
+		return Route{}, false, fmt.Errorf("failed to parse address %q: %w", addr, err)
+	}
+
+	route, ok := m.locRIB.lookup(ip.Unmap())
+	return route, ok, nil
+}
+
+// selectRoutes runs the decision process for the prefixes, storing the selected route of each one in the Loc-RIB
+func (m *manager) selectRoutes(prefixes []netip.Prefix) {
+	m.selectLock.Lock()
+	defer m.selectLock.Unlock()
+
+	for _, prefix := range prefixes {
+		if route, ok := m.bestRoute(prefix); ok {
+			m.locRIB.insert(route)
+		} else {
+			m.locRIB.delete(prefix)
+		}
+	}
+}
+
+// bestRoute returns the preferred route for the prefix. Routes received from the peers whose AS path contains the
+// local AS are not eligible, as they would create a loop (RFC 4271 section 9.1.2)
+func (m *manager) bestRoute(prefix netip.Prefix) (Route, bool) {
+	m.lock.RLock()
+	attrs, local := m.routes[prefix]
+	m.lock.RUnlock()
+
+	if local {
+		return Route{Prefix: prefix, Origin: packet.OriginIGP, Attributes: attrs}, true
+	}
+
+	var best Route
+	found := false
+	for _, p := range m.allPeers() {
+		route, ok := p.adjRIBIn.get(prefix)
+		if !ok || route.hasASN(p.localASN) {
+			continue
+		}
+		if !found || compareRoutes(route, best) < 0 {
+			best, found = route, true
+		}
+	}
+
+	return best, found
+}
+
+// newBFDSession creates the BFD session with the peer, together with the listener shared by every BFD session
+func (m *manager) newBFDSession(remote netip.Addr, config *v1alphav1.BFD) (*bfd.Session, error) {
+	if m.bfdListener == nil {
+		m.bfdListener = bfd.NewListener(m.logger.WithName("bfd"))
+	}
+
+	if config.DetectMultiplier < 1 || config.DetectMultiplier > 255 {
+		return nil, fmt.Errorf("detect multiplier %d out of range", config.DetectMultiplier)
+	}
+
+	return m.bfdListener.NewSession(bfd.SessionConfig{
+		Remote:                remote,
+		DesiredMinTxInterval:  time.Duration(config.TransmitIntervalMilliseconds) * time.Millisecond,
+		RequiredMinRxInterval: time.Duration(config.ReceiveIntervalMilliseconds) * time.Millisecond,
+		DetectMultiplier:      uint8(config.DetectMultiplier),
+	}, m.logger.WithName("bfd").WithValues("peer", remote))
+}
+
+// snapshot returns a copy of the routes that must be advertised to the peers
+func (m *manager) snapshot() map[netip.Prefix]RouteAttributes {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+
+	return maps.Clone(m.routes)
+}
+
+func (m *manager) notifyPeers() {
+	for _, p := range m.allPeers() {
+		p.notify()
+	}
+}
+
+// allPeers returns the configured peers together with the dynamic peers whose sessions are up
+func (m *manager) allPeers() []*peer {
+	m.peersLock.RLock()
+	defer m.peersLock.RUnlock()
+
+	if len(m.dynamicPeers) == 0 {
+		return m.peers
+	}
+	return slices.Concat(m.peers, slices.Collect(maps.Keys(m.dynamicPeers)))
+}
+
+// configuredPeers returns the configured peers, which are replaced as a whole when they change
+func (m *manager) configuredPeers() []*peer {
+	m.peersLock.RLock()
+	defer m.peersLock.RUnlock()
+
+	return m.peers
+}
+
+// parseRoute parses a route expressed either as a prefix or as a single IP address
+func parseRoute(route string) (netip.Prefix, error) {
+	if strings.Contains(route, "/") {
+		prefix, err := netip.ParsePrefix(route)
+		if err != nil {
+			return netip.Prefix{}, fmt.Errorf("failed to parse route %q: %w", route, err)
+		}
+		return netip.PrefixFrom(prefix.Addr().Unmap(), prefix.Bits()).Masked(), nil
+	}
+
+	addr, err := netip.ParseAddr(route)
+	if err != nil {
+		return netip.Prefix{}, fmt.Errorf("failed to parse route %q: %w", route, err)
+	}
+	addr = addr.Unmap()
+
+	return netip.PrefixFrom(addr, addr.BitLen()), nil
 }
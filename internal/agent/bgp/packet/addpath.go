@@ -0,0 +1,70 @@
+package packet
+
+import (
+	"encoding/binary"
+	"slices"
+)
+
+// PathIDLen is the length in bytes of the path identifier prepended to every prefix when ADD-PATH is negotiated
+const PathIDLen = 4
+
+// AddPathMode tells whether the speaker is able to send, receive or both send and receive multiple paths for the
+// address family
+type AddPathMode uint8
+
+const (
+	AddPathReceive     AddPathMode = 1
+	AddPathSend        AddPathMode = 2
+	AddPathSendReceive AddPathMode = AddPathReceive | AddPathSend
+)
+
+// CapAddPath advertises the ability of the speaker to send or receive multiple paths for the same prefix, each one
+// distinguished by a path identifier (RFC 7911)
+type CapAddPath struct {
+	Families []AddPathFamily
+}
+
+// AddPathFamily is an address family for which the speaker supports ADD-PATH in the given directions
+type AddPathFamily struct {
+	AFI  AFI
+	SAFI SAFI
+	Mode AddPathMode
+}
+
+func (*CapAddPath) Code() CapabilityCode {
+	return CapCodeAddPath
+}
+
+func (c *CapAddPath) marshalValue() []byte {
+	var value []byte
+	for _, fam := range c.Families {
+		value = binary.BigEndian.AppendUint16(value, uint16(fam.AFI))
+		value = append(value, uint8(fam.SAFI), uint8(fam.Mode))
+	}
+
+	return value
+}
+
+func unmarshalCapAddPath(value []byte) (*CapAddPath, error) {
+	if len(value) == 0 || len(value)%4 != 0 {
+		return nil, &NotificationError{Code: ErrCodeOpenMessage}
+	}
+
+	capability := &CapAddPath{}
+	for ; len(value) > 0; value = value[4:] {
+		capability.Families = append(capability.Families, AddPathFamily{
+			AFI:  AFI(binary.BigEndian.Uint16(value[0:2])),
+			SAFI: SAFI(value[2]),
+			Mode: AddPathMode(value[3]),
+		})
+	}
+
+	return capability, nil
+}
+
+// addPath reports whether the prefixes of the address family carry path identifiers in the given direction
+func (o Options) addPath(afi AFI, safi SAFI, mode AddPathMode) bool {
+	return slices.ContainsFunc(o.AddPath, func(fam AddPathFamily) bool {
+		return fam.AFI == afi && fam.SAFI == safi && fam.Mode&mode != 0
+	})
+}
@@ -0,0 +1,92 @@
+package packet
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net/netip"
+)
+
+const (
+	AttrCodeAS4Path       AttrCode = 17
+	AttrCodeAS4Aggregator AttrCode = 18
+
+	// ASTrans is the 2-octet AS number used in place of 4-octet AS numbers when talking to speakers that do not
+	// support them (RFC 6793)
+	ASTrans uint32 = 23456
+)
+
+// AS4Path is the optional transitive AS4_PATH attribute, carrying the 4-octet AS path towards speakers that only
+// understand 2-octet AS numbers (RFC 6793)
+type AS4Path struct {
+	Segments []ASPathSegment
+}
+
+func (*AS4Path) Code() AttrCode {
+	return AttrCodeAS4Path
+}
+
+func (*AS4Path) Flags() AttrFlags {
+	return AttrFlagOptional | AttrFlagTransitive
+}
+
+func (a *AS4Path) marshalValue(Options) ([]byte, error) {
+	return marshalASPathSegments(a.Segments, 4)
+}
+
+// unmarshalAS4Path decodes the AS4_PATH attribute. A malformed AS4_PATH must be discarded rather than resetting the
+// session (RFC 6793 section 6), so it returns nil in that case and the attribute is kept as an unknown one
+func unmarshalAS4Path(value []byte) *AS4Path {
+	segments, err := unmarshalASPathSegments(value, 4)
+	if err != nil {
+		return nil
+	}
+
+	return &AS4Path{Segments: segments}
+}
+
+// AS4Aggregator is the optional transitive AS4_AGGREGATOR attribute, carrying the 4-octet AS number of the
+// aggregator when the AGGREGATOR attribute contains AS_TRANS (RFC 6793)
+type AS4Aggregator struct {
+	ASN  uint32
+	Addr netip.Addr
+}
+
+func (*AS4Aggregator) Code() AttrCode {
+	return AttrCodeAS4Aggregator
+}
+
+func (*AS4Aggregator) Flags() AttrFlags {
+	return AttrFlagOptional | AttrFlagTransitive
+}
+
+func (a *AS4Aggregator) marshalValue(Options) ([]byte, error) {
+	return marshalAggregator(a.ASN, a.Addr, 4)
+}
+
+// asnLen returns the number of bytes used to encode AS numbers in the AS_PATH and AGGREGATOR attributes
+func (o Options) asnLen() int {
+	if o.FourOctetAS {
+		return 4
+	}
+	return 2
+}
+
+// appendASN appends the AS number encoded in asnLen bytes
+func appendASN(buf []byte, asn uint32, asnLen int) ([]byte, error) {
+	if asnLen == 4 {
+		return binary.BigEndian.AppendUint32(buf, asn), nil
+	}
+
+	if asn > 0xffff {
+		return nil, fmt.Errorf("AS %d does not fit in 2 octets", asn)
+	}
+	return binary.BigEndian.AppendUint16(buf, uint16(asn)), nil
+}
+
+// readASN decodes an AS number encoded in asnLen bytes
+func readASN(data []byte, asnLen int) uint32 {
+	if asnLen == 4 {
+		return binary.BigEndian.Uint32(data)
+	}
+	return uint32(binary.BigEndian.Uint16(data))
+}
@@ -0,0 +1,458 @@
+package packet
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net/netip"
+)
+
+// AttrCode is the type code of a path attribute
+type AttrCode uint8
+
+const (
+	AttrCodeOrigin          AttrCode = 1
+	AttrCodeASPath          AttrCode = 2
+	AttrCodeNextHop         AttrCode = 3
+	AttrCodeMultiExitDisc   AttrCode = 4
+	AttrCodeLocalPref       AttrCode = 5
+	AttrCodeAtomicAggregate AttrCode = 6
+	AttrCodeAggregator      AttrCode = 7
+)
+
+// AttrFlags are the flags of a path attribute
+type AttrFlags uint8
+
+const (
+	AttrFlagOptional       AttrFlags = 0x80
+	AttrFlagTransitive     AttrFlags = 0x40
+	AttrFlagPartial        AttrFlags = 0x20
+	AttrFlagExtendedLength AttrFlags = 0x10
+
+	// attrFlagsCategory are the flags that define the category of an attribute, the ones that must match the
+	// attribute type code
+	attrFlagsCategory = AttrFlagOptional | AttrFlagTransitive
+)
+
+// PathAttribute is implemented by every path attribute that can be carried in an UPDATE message
+type PathAttribute interface {
+	// Code returns the type code of the attribute
+	Code() AttrCode
+	// Flags returns the flags of the attribute. The extended length flag is computed when encoding
+	Flags() AttrFlags
+
+	marshalValue(Options) ([]byte, error)
+}
+
+// AttributesLen returns the number of bytes used to encode the path attributes with the default options
+func AttributesLen(attrs []PathAttribute) (int, error) {
+	return Options{}.AttributesLen(attrs)
+}
+
+// AttributesLen returns the number of bytes used to encode the path attributes
+func (o Options) AttributesLen(attrs []PathAttribute) (int, error) {
+	data, err := marshalPathAttributes(attrs, o)
+	return len(data), err
+}
+
+// ORIGIN values
+const (
+	OriginIGP        uint8 = 0
+	OriginEGP        uint8 = 1
+	OriginIncomplete uint8 = 2
+)
+
+// Origin is the well-known mandatory ORIGIN attribute
+type Origin struct {
+	Value uint8
+}
+
+func (*Origin) Code() AttrCode {
+	return AttrCodeOrigin
+}
+
+func (*Origin) Flags() AttrFlags {
+	return AttrFlagTransitive
+}
+
+func (o *Origin) marshalValue(Options) ([]byte, error) {
+	return []byte{o.Value}, nil
+}
+
+// AS_PATH segment types
+const (
+	ASSet            uint8 = 1
+	ASSequence       uint8 = 2
+	ASConfedSequence uint8 = 3
+	ASConfedSet      uint8 = 4
+)
+
+// ASPathSegment is a set or sequence of AS numbers
+type ASPathSegment struct {
+	Type uint8
+	ASNs []uint32
+}
+
+// ASPath is the well-known mandatory AS_PATH attribute
+type ASPath struct {
+	Segments []ASPathSegment
+}
+
+func (*ASPath) Code() AttrCode {
+	return AttrCodeASPath
+}
+
+func (*ASPath) Flags() AttrFlags {
+	return AttrFlagTransitive
+}
+
+func (a *ASPath) marshalValue(opts Options) ([]byte, error) {
+	return marshalASPathSegments(a.Segments, opts.asnLen())
+}
+
+func unmarshalASPath(value []byte, opts Options) (*ASPath, error) {
+	segments, err := unmarshalASPathSegments(value, opts.asnLen())
+	if err != nil {
+		return nil, &NotificationError{Code: ErrCodeUpdateMessage, Subcode: ErrSubcodeMalformedASPath}
+	}
+
+	return &ASPath{Segments: segments}, nil
+}
+
+// marshalASPathSegments encodes the segments of an AS_PATH or AS4_PATH attribute with asnLen bytes AS numbers
+func marshalASPathSegments(segments []ASPathSegment, asnLen int) ([]byte, error) {
+	var value []byte
+	for _, segment := range segments {
+		if len(segment.ASNs) == 0 || len(segment.ASNs) > 0xff {
+			return nil, fmt.Errorf("invalid AS path segment length %d", len(segment.ASNs))
+		}
+
+		value = append(value, segment.Type, uint8(len(segment.ASNs)))
+		for _, asn := range segment.ASNs {
+			var err error
+			if value, err = appendASN(value, asn, asnLen); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	return value, nil
+}
+
+// unmarshalASPathSegments decodes the segments of an AS_PATH or AS4_PATH attribute with asnLen bytes AS numbers
+func unmarshalASPathSegments(value []byte, asnLen int) ([]ASPathSegment, error) {
+	var segments []ASPathSegment
+	for len(value) > 0 {
+		if len(value) < 2 {
+			return nil, fmt.Errorf("truncated AS path segment")
+		}
+
+		segmentType, count := value[0], int(value[1])
+		if segmentType < ASSet || segmentType > ASConfedSet || count == 0 || len(value) < 2+asnLen*count {
+			return nil, fmt.Errorf("malformed AS path segment")
+		}
+
+		segment := ASPathSegment{Type: segmentType, ASNs: make([]uint32, count)}
+		for i := range segment.ASNs {
+			segment.ASNs[i] = readASN(value[2+asnLen*i:], asnLen)
+		}
+		segments = append(segments, segment)
+
+		value = value[2+asnLen*count:]
+	}
+
+	return segments, nil
+}
+
+// NextHop is the well-known mandatory NEXT_HOP attribute, only used for IPv4 NLRI
+type NextHop struct {
+	Addr netip.Addr
+}
+
+func (*NextHop) Code() AttrCode {
+	return AttrCodeNextHop
+}
+
+func (*NextHop) Flags() AttrFlags {
+	return AttrFlagTransitive
+}
+
+func (n *NextHop) marshalValue(Options) ([]byte, error) {
+	if !n.Addr.Is4() {
+		return nil, fmt.Errorf("NEXT_HOP %s is not an IPv4 address", n.Addr)
+	}
+
+	addr := n.Addr.As4()
+	return addr[:], nil
+}
+
+// MultiExitDisc is the optional non-transitive MULTI_EXIT_DISC attribute
+type MultiExitDisc struct {
+	Value uint32
+}
+
+func (*MultiExitDisc) Code() AttrCode {
+	return AttrCodeMultiExitDisc
+}
+
+func (*MultiExitDisc) Flags() AttrFlags {
+	return AttrFlagOptional
+}
+
+func (m *MultiExitDisc) marshalValue(Options) ([]byte, error) {
+	return binary.BigEndian.AppendUint32(nil, m.Value), nil
+}
+
+// LocalPref is the well-known LOCAL_PREF attribute, only exchanged between internal peers
+type LocalPref struct {
+	Value uint32
+}
+
+func (*LocalPref) Code() AttrCode {
+	return AttrCodeLocalPref
+}
+
+func (*LocalPref) Flags() AttrFlags {
+	return AttrFlagTransitive
+}
+
+func (l *LocalPref) marshalValue(Options) ([]byte, error) {
+	return binary.BigEndian.AppendUint32(nil, l.Value), nil
+}
+
+// AtomicAggregate is the well-known discretionary ATOMIC_AGGREGATE attribute
+type AtomicAggregate struct{}
+
+func (*AtomicAggregate) Code() AttrCode {
+	return AttrCodeAtomicAggregate
+}
+
+func (*AtomicAggregate) Flags() AttrFlags {
+	return AttrFlagTransitive
+}
+
+func (*AtomicAggregate) marshalValue(Options) ([]byte, error) {
+	return nil, nil
+}
+
+// Aggregator is the optional transitive AGGREGATOR attribute
+type Aggregator struct {
+	ASN  uint32
+	Addr netip.Addr
+}
+
+func (*Aggregator) Code() AttrCode {
+	return AttrCodeAggregator
+}
+
+func (*Aggregator) Flags() AttrFlags {
+	return AttrFlagOptional | AttrFlagTransitive
+}
+
+func (a *Aggregator) marshalValue(opts Options) ([]byte, error) {
+	return marshalAggregator(a.ASN, a.Addr, opts.asnLen())
+}
+
+// marshalAggregator encodes the value of an AGGREGATOR or AS4_AGGREGATOR attribute with an asnLen bytes AS number
+func marshalAggregator(asn uint32, addr netip.Addr, asnLen int) ([]byte, error) {
+	if !addr.Is4() {
+		return nil, fmt.Errorf("invalid aggregator address %s", addr)
+	}
+
+	value, err := appendASN(nil, asn, asnLen)
+	if err != nil {
+		return nil, err
+	}
+
+	addr4 := addr.As4()
+	return append(value, addr4[:]...), nil
+}
+
+// UnknownAttribute is a path attribute not understood by this package, its value is kept as is
+type UnknownAttribute struct {
+	AttrFlags AttrFlags
+	AttrCode  AttrCode
+	Value     []byte
+}
+
+func (u *UnknownAttribute) Code() AttrCode {
+	return u.AttrCode
+}
+
+func (u *UnknownAttribute) Flags() AttrFlags {
+	return u.AttrFlags &^ AttrFlagExtendedLength
+}
+
+func (u *UnknownAttribute) marshalValue(Options) ([]byte, error) {
+	return u.Value, nil
+}
+
+func marshalPathAttributes(attrs []PathAttribute, opts Options) ([]byte, error) {
+	var buf []byte
+	for _, attr := range attrs {
+		value, err := attr.marshalValue(opts)
+		if err != nil {
+			return nil, err
+		}
+
+		flags := attr.Flags()
+		switch {
+		case len(value) > 0xffff:
+			return nil, fmt.Errorf("path attribute %d too long", attr.Code())
+		case len(value) > 0xff:
+			buf = append(buf, uint8(flags|AttrFlagExtendedLength), uint8(attr.Code()))
+			buf = binary.BigEndian.AppendUint16(buf, uint16(len(value)))
+		default:
+			buf = append(buf, uint8(flags), uint8(attr.Code()), uint8(len(value)))
+		}
+		buf = append(buf, value...)
+	}
+
+	return buf, nil
+}
+
+func unmarshalPathAttributes(data []byte, opts Options) ([]PathAttribute, error) {
+	var attrs []PathAttribute
+	seen := make(map[AttrCode]bool)
+
+	for len(data) > 0 {
+		if len(data) < 3 {
+			return nil, &NotificationError{Code: ErrCodeUpdateMessage, Subcode: ErrSubcodeMalformedAttributeList}
+		}
+
+		flags, code := AttrFlags(data[0]), AttrCode(data[1])
+		headerLen, length := 3, int(data[2])
+		if flags&AttrFlagExtendedLength != 0 {
+			if len(data) < 4 {
+				return nil, &NotificationError{Code: ErrCodeUpdateMessage, Subcode: ErrSubcodeMalformedAttributeList}
+			}
+			headerLen, length = 4, int(binary.BigEndian.Uint16(data[2:4]))
+		}
+
+		if len(data) < headerLen+length {
+			return nil, &NotificationError{Code: ErrCodeUpdateMessage, Subcode: ErrSubcodeAttributeLengthError}
+		}
+		raw, value := data[:headerLen+length], data[headerLen:headerLen+length]
+		data = data[headerLen+length:]
+
+		if seen[code] {
+			return nil, &NotificationError{Code: ErrCodeUpdateMessage, Subcode: ErrSubcodeMalformedAttributeList}
+		}
+		seen[code] = true
+
+		attr, err := unmarshalPathAttribute(flags, code, value, opts)
+		if err != nil {
+			if notification, ok := err.(*NotificationError); ok && notification.Data == nil {
+				// Errors related to a specific attribute carry the erroneous attribute
+				notification.Data = append([]byte(nil), raw...)
+			}
+			return nil, err
+		}
+
+		attrs = append(attrs, attr)
+	}
+
+	return attrs, nil
+}
+
+func unmarshalPathAttribute(flags AttrFlags, code AttrCode, value []byte, opts Options) (PathAttribute, error) {
+	attr, err := newPathAttribute(code, value, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	if attr == nil {
+		// Unrecognized well-known attributes are an error, optional ones are kept as is
+		if flags&AttrFlagOptional == 0 {
+			return nil, &NotificationError{Code: ErrCodeUpdateMessage, Subcode: ErrSubcodeUnrecognizedWellKnownAttr}
+		}
+		return &UnknownAttribute{AttrFlags: flags &^ AttrFlagExtendedLength, AttrCode: code, Value: append([]byte(nil), value...)}, nil
+	}
+
+	if flags&attrFlagsCategory != attr.Flags()&attrFlagsCategory {
+		return nil, &NotificationError{Code: ErrCodeUpdateMessage, Subcode: ErrSubcodeAttributeFlagsError}
+	}
+
+	return attr, nil
+}
+
+// newPathAttribute decodes the value of a recognized path attribute. It returns nil if the attribute is unknown
+func newPathAttribute(code AttrCode, value []byte, opts Options) (PathAttribute, error) {
+	lengthError := &NotificationError{Code: ErrCodeUpdateMessage, Subcode: ErrSubcodeAttributeLengthError}
+
+	switch code {
+	case AttrCodeOrigin:
+		if len(value) != 1 {
+			return nil, lengthError
+		}
+		if value[0] > OriginIncomplete {
+			return nil, &NotificationError{Code: ErrCodeUpdateMessage, Subcode: ErrSubcodeInvalidOriginAttribute}
+		}
+		return &Origin{Value: value[0]}, nil
+	case AttrCodeASPath:
+		return unmarshalASPath(value, opts)
+	case AttrCodeNextHop:
+		if len(value) != 4 {
+			return nil, lengthError
+		}
+		addr := netip.AddrFrom4([4]byte(value))
+		if addr.IsUnspecified() || addr.IsMulticast() {
+			return nil, &NotificationError{Code: ErrCodeUpdateMessage, Subcode: ErrSubcodeInvalidNextHopAttribute}
+		}
+		return &NextHop{Addr: addr}, nil
+	case AttrCodeMultiExitDisc:
+		if len(value) != 4 {
+			return nil, lengthError
+		}
+		return &MultiExitDisc{Value: binary.BigEndian.Uint32(value)}, nil
+	case AttrCodeLocalPref:
+		if len(value) != 4 {
+			return nil, lengthError
+		}
+		return &LocalPref{Value: binary.BigEndian.Uint32(value)}, nil
+	case AttrCodeAtomicAggregate:
+		if len(value) != 0 {
+			return nil, lengthError
+		}
+		return &AtomicAggregate{}, nil
+	case AttrCodeAggregator:
+		asnLen := opts.asnLen()
+		if len(value) != asnLen+4 {
+			return nil, lengthError
+		}
+		return &Aggregator{
+			ASN:  readASN(value, asnLen),
+			Addr: netip.AddrFrom4([4]byte(value[asnLen:])),
+		}, nil
+	case AttrCodeCommunities:
+		return unmarshalCommunities(value)
+	case AttrCodeExtendedCommunities:
+		return unmarshalExtendedCommunities(value)
+	case AttrCodeLargeCommunities:
+		return unmarshalLargeCommunities(value)
+	case AttrCodeMPReachNLRI:
+		if mpReach, err := unmarshalMPReachNLRI(value, opts); mpReach != nil || err != nil {
+			return mpReach, err
+		}
+		return nil, nil
+	case AttrCodeMPUnreachNLRI:
+		if mpUnreach, err := unmarshalMPUnreachNLRI(value, opts); mpUnreach != nil || err != nil {
+			return mpUnreach, err
+		}
+		return nil, nil
+	case AttrCodeAS4Path:
+		if as4Path := unmarshalAS4Path(value); as4Path != nil {
+			return as4Path, nil
+		}
+		return nil, nil
+	case AttrCodeAS4Aggregator:
+		if len(value) != 8 {
+			return nil, nil
+		}
+		return &AS4Aggregator{
+			ASN:  binary.BigEndian.Uint32(value[0:4]),
+			Addr: netip.AddrFrom4([4]byte(value[4:8])),
+		}, nil
+	default:
+		return nil, nil
+	}
+}
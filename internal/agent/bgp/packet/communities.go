@@ -0,0 +1,161 @@
+package packet
+
+import (
+	"encoding/binary"
+	"fmt"
+)
+
+const (
+	AttrCodeCommunities         AttrCode = 8
+	AttrCodeExtendedCommunities AttrCode = 16
+	AttrCodeLargeCommunities    AttrCode = 32
+)
+
+// Well-known communities (RFC 1997, RFC 3765, RFC 7999 and RFC 8326)
+const (
+	CommunityGracefulShutdown  uint32 = 0xffff0000
+	CommunityBlackhole         uint32 = 0xffff029a
+	CommunityNoExport          uint32 = 0xffffff01
+	CommunityNoAdvertise       uint32 = 0xffffff02
+	CommunityNoExportSubconfed uint32 = 0xffffff03
+	CommunityNoPeer            uint32 = 0xffffff04
+)
+
+// Types and subtypes of the extended communities (RFC 4360 and RFC 5668)
+const (
+	ExtCommunityTypeTwoOctetAS  uint8 = 0x00
+	ExtCommunityTypeIPv4Address uint8 = 0x01
+	ExtCommunityTypeFourOctetAS uint8 = 0x02
+
+	ExtCommunitySubtypeRouteTarget uint8 = 0x02
+	ExtCommunitySubtypeRouteOrigin uint8 = 0x03
+)
+
+// Communities is the optional transitive COMMUNITIES attribute (RFC 1997)
+type Communities struct {
+	Values []uint32
+}
+
+func (*Communities) Code() AttrCode {
+	return AttrCodeCommunities
+}
+
+func (*Communities) Flags() AttrFlags {
+	return AttrFlagOptional | AttrFlagTransitive
+}
+
+func (c *Communities) marshalValue(Options) ([]byte, error) {
+	value := make([]byte, 0, 4*len(c.Values))
+	for _, community := range c.Values {
+		value = binary.BigEndian.AppendUint32(value, community)
+	}
+
+	return value, nil
+}
+
+func unmarshalCommunities(value []byte) (*Communities, error) {
+	if len(value) == 0 || len(value)%4 != 0 {
+		return nil, &NotificationError{Code: ErrCodeUpdateMessage, Subcode: ErrSubcodeAttributeLengthError}
+	}
+
+	communities := &Communities{Values: make([]uint32, len(value)/4)}
+	for i := range communities.Values {
+		communities.Values[i] = binary.BigEndian.Uint32(value[4*i:])
+	}
+
+	return communities, nil
+}
+
+// ExtendedCommunity is an 8-octet extended community, starting with its type and subtype (RFC 4360)
+type ExtendedCommunity [8]byte
+
+func (e ExtendedCommunity) String() string {
+	return fmt.Sprintf("0x%x", e[:])
+}
+
+// ExtendedCommunities is the optional transitive EXTENDED COMMUNITIES attribute (RFC 4360)
+type ExtendedCommunities struct {
+	Values []ExtendedCommunity
+}
+
+func (*ExtendedCommunities) Code() AttrCode {
+	return AttrCodeExtendedCommunities
+}
+
+func (*ExtendedCommunities) Flags() AttrFlags {
+	return AttrFlagOptional | AttrFlagTransitive
+}
+
+func (e *ExtendedCommunities) marshalValue(Options) ([]byte, error) {
+	value := make([]byte, 0, 8*len(e.Values))
+	for _, community := range e.Values {
+		value = append(value, community[:]...)
+	}
+
+	return value, nil
+}
+
+func unmarshalExtendedCommunities(value []byte) (*ExtendedCommunities, error) {
+	if len(value) == 0 || len(value)%8 != 0 {
+		return nil, &NotificationError{Code: ErrCodeUpdateMessage, Subcode: ErrSubcodeAttributeLengthError}
+	}
+
+	communities := &ExtendedCommunities{Values: make([]ExtendedCommunity, len(value)/8)}
+	for i := range communities.Values {
+		communities.Values[i] = ExtendedCommunity(value[8*i:])
+	}
+
+	return communities, nil
+}
+
+// LargeCommunity is a 12-octet large community (RFC 8092)
+type LargeCommunity struct {
+	GlobalAdministrator uint32
+	LocalData1          uint32
+	LocalData2          uint32
+}
+
+func (l LargeCommunity) String() string {
+	return fmt.Sprintf("%d:%d:%d", l.GlobalAdministrator, l.LocalData1, l.LocalData2)
+}
+
+// LargeCommunities is the optional transitive LARGE_COMMUNITY attribute (RFC 8092)
+type LargeCommunities struct {
+	Values []LargeCommunity
+}
+
+func (*LargeCommunities) Code() AttrCode {
+	return AttrCodeLargeCommunities
+}
+
+func (*LargeCommunities) Flags() AttrFlags {
+	return AttrFlagOptional | AttrFlagTransitive
+}
+
+func (l *LargeCommunities) marshalValue(Options) ([]byte, error) {
+	value := make([]byte, 0, 12*len(l.Values))
+	for _, community := range l.Values {
+		value = binary.BigEndian.AppendUint32(value, community.GlobalAdministrator)
+		value = binary.BigEndian.AppendUint32(value, community.LocalData1)
+		value = binary.BigEndian.AppendUint32(value, community.LocalData2)
+	}
+
+	return value, nil
+}
+
+func unmarshalLargeCommunities(value []byte) (*LargeCommunities, error) {
+	if len(value) == 0 || len(value)%12 != 0 {
+		return nil, &NotificationError{Code: ErrCodeUpdateMessage, Subcode: ErrSubcodeAttributeLengthError}
+	}
+
+	communities := &LargeCommunities{Values: make([]LargeCommunity, len(value)/12)}
+	for i := range communities.Values {
+		communities.Values[i] = LargeCommunity{
+			GlobalAdministrator: binary.BigEndian.Uint32(value[12*i:]),
+			LocalData1:          binary.BigEndian.Uint32(value[12*i+4:]),
+			LocalData2:          binary.BigEndian.Uint32(value[12*i+8:]),
+		}
+	}
+
+	return communities, nil
+}
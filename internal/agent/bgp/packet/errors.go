@@ -0,0 +1,73 @@
+package packet
+
+import "fmt"
+
+// NOTIFICATION error codes as defined in RFC 4271 section 4.5
+const (
+	ErrCodeMessageHeader   uint8 = 1
+	ErrCodeOpenMessage     uint8 = 2
+	ErrCodeUpdateMessage   uint8 = 3
+	ErrCodeHoldTimeExpired uint8 = 4
+	ErrCodeFSM             uint8 = 5
+	ErrCodeCease           uint8 = 6
+)
+
+// Message Header error subcodes
+const (
+	ErrSubcodeConnectionNotSynchronized uint8 = 1
+	ErrSubcodeBadMessageLength          uint8 = 2
+	ErrSubcodeBadMessageType            uint8 = 3
+)
+
+// OPEN Message error subcodes
+const (
+	ErrSubcodeUnsupportedVersionNumber uint8 = 1
+	ErrSubcodeBadPeerAS                uint8 = 2
+	ErrSubcodeBadBGPIdentifier         uint8 = 3
+	ErrSubcodeUnsupportedOptionalParam uint8 = 4
+	ErrSubcodeUnacceptableHoldTime     uint8 = 6
+	ErrSubcodeUnsupportedCapability    uint8 = 7
+)
+
+// UPDATE Message error subcodes
+const (
+	ErrSubcodeMalformedAttributeList    uint8 = 1
+	ErrSubcodeUnrecognizedWellKnownAttr uint8 = 2
+	ErrSubcodeMissingWellKnownAttr      uint8 = 3
+	ErrSubcodeAttributeFlagsError       uint8 = 4
+	ErrSubcodeAttributeLengthError      uint8 = 5
+	ErrSubcodeInvalidOriginAttribute    uint8 = 6
+	ErrSubcodeInvalidNextHopAttribute   uint8 = 8
+	ErrSubcodeOptionalAttributeError    uint8 = 9
+	ErrSubcodeInvalidNetworkField       uint8 = 10
+	ErrSubcodeMalformedASPath           uint8 = 11
+)
+
+// Cease subcodes as defined in RFC 4486
+const (
+	ErrSubcodeMaxPrefixesReached     uint8 = 1
+	ErrSubcodeAdministrativeShutdown uint8 = 2
+	ErrSubcodePeerDeconfigured       uint8 = 3
+	ErrSubcodeAdministrativeReset    uint8 = 4
+	ErrSubcodeConnectionRejected     uint8 = 5
+	ErrSubcodeOtherConfigChange      uint8 = 6
+	ErrSubcodeConnectionCollision    uint8 = 7
+	ErrSubcodeOutOfResources         uint8 = 8
+)
+
+// NotificationError is an error that must be reported to the peer with a NOTIFICATION message before closing the
+// session
+type NotificationError struct {
+	Code    uint8
+	Subcode uint8
+	Data    []byte
+}
+
+func (e *NotificationError) Error() string {
+	return fmt.Sprintf("bgp error (code %d, subcode %d)", e.Code, e.Subcode)
+}
+
+// Notification returns the NOTIFICATION message reporting the error
+func (e *NotificationError) Notification() *Notification {
+	return &Notification{Code: e.Code, Subcode: e.Subcode, Data: e.Data}
+}
@@ -0,0 +1,63 @@
+package packet
+
+import (
+	"encoding/binary"
+)
+
+// CapExtendedNextHop advertises the ability of the speaker to receive routes of an address family with next hops of
+// another address family, such as IPv4 routes with IPv6 next hops (RFC 8950). Those routes are carried in the
+// MP_REACH_NLRI attribute
+type CapExtendedNextHop struct {
+	Encodings []NextHopEncoding
+}
+
+// NextHopEncoding is an address family whose routes may carry next hops of NextHopAFI
+type NextHopEncoding struct {
+	AFI        AFI
+	SAFI       SAFI
+	NextHopAFI AFI
+}
+
+func (*CapExtendedNextHop) Code() CapabilityCode {
+	return CapCodeExtendedNextHop
+}
+
+func (c *CapExtendedNextHop) marshalValue() []byte {
+	var value []byte
+	for _, encoding := range c.Encodings {
+		// The SAFI takes two octets in this capability, unlike in the rest of the messages
+		value = binary.BigEndian.AppendUint16(value, uint16(encoding.AFI))
+		value = binary.BigEndian.AppendUint16(value, uint16(encoding.SAFI))
+		value = binary.BigEndian.AppendUint16(value, uint16(encoding.NextHopAFI))
+	}
+
+	return value
+}
+
+// unmarshalCapExtendedNextHop decodes the capability, skipping the encodings whose SAFI does not fit in one octet as
+// no such SAFI is supported. It returns nil when none of the encodings is left
+func unmarshalCapExtendedNextHop(value []byte) (*CapExtendedNextHop, error) {
+	if len(value) == 0 || len(value)%6 != 0 {
+		return nil, &NotificationError{Code: ErrCodeOpenMessage}
+	}
+
+	capability := &CapExtendedNextHop{}
+	for ; len(value) > 0; value = value[6:] {
+		safi := binary.BigEndian.Uint16(value[2:4])
+		if safi > 0xff {
+			continue
+		}
+		capability.Encodings = append(capability.Encodings, NextHopEncoding{
+			AFI:        AFI(binary.BigEndian.Uint16(value[0:2])),
+			SAFI:       SAFI(safi),
+			NextHopAFI: AFI(binary.BigEndian.Uint16(value[4:6])),
+		})
+	}
+
+	// Capabilities without any encoding of a supported SAFI are dropped, as an empty capability cannot be encoded
+	if len(capability.Encodings) == 0 {
+		return nil, nil
+	}
+
+	return capability, nil
+}
@@ -0,0 +1,55 @@
+package packet
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"reflect"
+	"testing"
+)
+
+// FuzzUnmarshal makes sure that malformed input never crashes the decoder and that every successfully decoded message
+// can be encoded back into an equivalent message, both with 2-octet and 4-octet AS numbers
+func FuzzUnmarshal(f *testing.F) {
+	entries, err := os.ReadDir("testdata")
+	if err != nil {
+		f.Fatalf("failed to read testdata: %v", err)
+	}
+	for _, entry := range entries {
+		if !entry.IsDir() {
+			f.Add(readFixture(f, entry.Name()), false)
+			f.Add(readFixture(f, entry.Name()), true)
+		}
+	}
+
+	f.Fuzz(func(t *testing.T, data []byte, fourOctetAS bool) {
+		opts := Options{FourOctetAS: fourOctetAS}
+
+		msg, err := opts.Unmarshal(data)
+		if err != nil {
+			var notification *NotificationError
+			if !errors.As(err, &notification) {
+				t.Fatalf("decoding error is not a NotificationError: %v", err)
+			}
+			return
+		}
+
+		encoded, err := opts.Marshal(msg)
+		if err != nil {
+			t.Fatalf("failed to marshal decoded message %#v: %v", msg, err)
+		}
+
+		decoded, err := opts.Unmarshal(encoded)
+		if err != nil {
+			t.Fatalf("failed to unmarshal encoded message %x: %v", encoded, err)
+		}
+		if !reflect.DeepEqual(msg, decoded) {
+			t.Fatalf("round trip mismatch:\n got: %#v\nwant: %#v", decoded, msg)
+		}
+
+		read, err := opts.ReadMessage(bytes.NewReader(data))
+		if err != nil || !reflect.DeepEqual(read, msg) {
+			t.Fatalf("ReadMessage() = %#v, %v; Unmarshal() = %#v", read, err, msg)
+		}
+	})
+}
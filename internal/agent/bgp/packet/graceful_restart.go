@@ -0,0 +1,88 @@
+package packet
+
+import (
+	"encoding/binary"
+)
+
+const (
+	// MaxRestartTime is the largest restart time in seconds that fits in the Graceful Restart capability
+	MaxRestartTime = 0x0fff
+
+	gracefulRestartFlagRestarting  = 0x8
+	gracefulRestartFlagForwarding  = 0x80
+	gracefulRestartRestartTimeMask = 0x0fff
+)
+
+// CapGracefulRestart advertises the ability of the speaker to preserve its forwarding state across a restart of its
+// BGP process, together with the address families for which the state is preserved (RFC 4724)
+type CapGracefulRestart struct {
+	// Restarting is set by a speaker that has just restarted, so that peers do not wait for its End-of-RIB markers
+	// before sending their own routes
+	Restarting bool
+	// RestartTime is the time in seconds the peer should retain the routes of the speaker after the session is lost
+	RestartTime uint16
+	Families    []GracefulRestartFamily
+}
+
+// GracefulRestartFamily is an address family for which the speaker supports graceful restart
+type GracefulRestartFamily struct {
+	AFI  AFI
+	SAFI SAFI
+	// ForwardingState is set when the forwarding state of the family has been preserved across the restart
+	ForwardingState bool
+}
+
+func (*CapGracefulRestart) Code() CapabilityCode {
+	return CapCodeGracefulRestart
+}
+
+func (c *CapGracefulRestart) marshalValue() []byte {
+	flagsAndTime := c.RestartTime & gracefulRestartRestartTimeMask
+	if c.Restarting {
+		flagsAndTime |= gracefulRestartFlagRestarting << 12
+	}
+
+	value := binary.BigEndian.AppendUint16(nil, flagsAndTime)
+	for _, fam := range c.Families {
+		var flags uint8
+		if fam.ForwardingState {
+			flags |= gracefulRestartFlagForwarding
+		}
+		value = binary.BigEndian.AppendUint16(value, uint16(fam.AFI))
+		value = append(value, uint8(fam.SAFI), flags)
+	}
+
+	return value
+}
+
+func unmarshalCapGracefulRestart(value []byte) (*CapGracefulRestart, error) {
+	if len(value) < 2 || (len(value)-2)%4 != 0 {
+		return nil, &NotificationError{Code: ErrCodeOpenMessage}
+	}
+
+	flagsAndTime := binary.BigEndian.Uint16(value[0:2])
+	capability := &CapGracefulRestart{
+		Restarting:  flagsAndTime>>12&gracefulRestartFlagRestarting != 0,
+		RestartTime: flagsAndTime & gracefulRestartRestartTimeMask,
+	}
+
+	for value = value[2:]; len(value) > 0; value = value[4:] {
+		capability.Families = append(capability.Families, GracefulRestartFamily{
+			AFI:             AFI(binary.BigEndian.Uint16(value[0:2])),
+			SAFI:            SAFI(value[2]),
+			ForwardingState: value[3]&gracefulRestartFlagForwarding != 0,
+		})
+	}
+
+	return capability, nil
+}
+
+// EndOfRIB returns the End-of-RIB marker of the address family, sent once the initial routes have been advertised.
+// IPv4 unicast uses an empty UPDATE, any other family an UPDATE with an empty MP_UNREACH_NLRI attribute
+func EndOfRIB(afi AFI, safi SAFI) *Update {
+	if afi == AFIIPv4 && safi == SAFIUnicast {
+		return &Update{}
+	}
+
+	return &Update{PathAttributes: []PathAttribute{&MPUnreachNLRI{AFI: afi, SAFI: safi}}}
+}
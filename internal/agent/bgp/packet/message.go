@@ -0,0 +1,301 @@
+// Package packet implements the wire format of BGP-4 messages as defined in RFC 4271 and its extensions. Every
+// message is represented by a typed struct that can be encoded with Marshal and decoded with Unmarshal or ReadMessage.
+// Messages whose encoding depends on the capabilities negotiated in the session are encoded and decoded with the
+// methods of Options.
+//
+// Decoding errors caused by malformed input are reported as *NotificationError, containing the error code and subcode
+// that must be sent back to the peer in a NOTIFICATION message before closing the session.
+package packet
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// Type is the type of a BGP message
+type Type uint8
+
+const (
+	TypeOpen         Type = 1
+	TypeUpdate       Type = 2
+	TypeNotification Type = 3
+	TypeKeepalive    Type = 4
+	TypeRouteRefresh Type = 5
+)
+
+func (t Type) String() string {
+	switch t {
+	case TypeOpen:
+		return "OPEN"
+	case TypeUpdate:
+		return "UPDATE"
+	case TypeNotification:
+		return "NOTIFICATION"
+	case TypeKeepalive:
+		return "KEEPALIVE"
+	case TypeRouteRefresh:
+		return "ROUTE-REFRESH"
+	default:
+		return fmt.Sprintf("Type(%d)", uint8(t))
+	}
+}
+
+const (
+	// HeaderLen is the length of the header preceding every BGP message
+	HeaderLen = 19
+	// MaxMessageLen is the maximum length of a BGP message, header included
+	MaxMessageLen = 4096
+
+	markerLen = 16
+)
+
+// ErrMessageTooLong is returned when a message does not fit in MaxMessageLen bytes
+var ErrMessageTooLong = errors.New("message exceeds the maximum BGP message length")
+
+// Message is implemented by every BGP message type
+type Message interface {
+	// Type returns the type of the message
+	Type() Type
+
+	marshalBody(Options) ([]byte, error)
+}
+
+// Options describes the capabilities negotiated in a session that change the encoding of the messages
+type Options struct {
+	// FourOctetAS is set when both speakers support 4-octet AS numbers (RFC 6793), in which case the AS_PATH and
+	// AGGREGATOR attributes carry 4-octet AS numbers
+	FourOctetAS bool
+	// AddPath contains the address families whose prefixes carry a path identifier (RFC 7911). The send direction
+	// applies to the encoded messages and the receive direction to the decoded ones, as each one is negotiated
+	// separately
+	AddPath []AddPathFamily
+}
+
+// Marshal encodes the message, header included, using the default options of a session without capabilities
+func Marshal(msg Message) ([]byte, error) {
+	return Options{}.Marshal(msg)
+}
+
+// Unmarshal decodes a single message using the default options of a session without capabilities
+func Unmarshal(data []byte) (Message, error) {
+	return Options{}.Unmarshal(data)
+}
+
+// ReadMessage reads a single message from r using the default options of a session without capabilities
+func ReadMessage(r io.Reader) (Message, error) {
+	return Options{}.ReadMessage(r)
+}
+
+// Marshal encodes the message, header included
+func (o Options) Marshal(msg Message) ([]byte, error) {
+	body, err := msg.marshalBody(o)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal %s message: %w", msg.Type(), err)
+	}
+
+	if HeaderLen+len(body) > MaxMessageLen {
+		return nil, ErrMessageTooLong
+	}
+
+	buf := make([]byte, HeaderLen, HeaderLen+len(body))
+	for i := 0; i < markerLen; i++ {
+		buf[i] = 0xff
+	}
+	binary.BigEndian.PutUint16(buf[16:18], uint16(HeaderLen+len(body)))
+	buf[18] = uint8(msg.Type())
+
+	return append(buf, body...), nil
+}
+
+// Unmarshal decodes a single message, header included. The data must contain exactly one message
+func (o Options) Unmarshal(data []byte) (Message, error) {
+	if len(data) < HeaderLen {
+		return nil, &NotificationError{Code: ErrCodeMessageHeader, Subcode: ErrSubcodeBadMessageLength}
+	}
+
+	msgType, length, err := parseHeader(data[:HeaderLen])
+	if err != nil {
+		return nil, err
+	}
+
+	if int(length) != len(data) {
+		return nil, &NotificationError{Code: ErrCodeMessageHeader, Subcode: ErrSubcodeBadMessageLength, Data: data[16:18]}
+	}
+
+	return o.unmarshalBody(msgType, data[HeaderLen:])
+}
+
+// ReadMessage reads and decodes a single message from r. Errors returned by r are returned as is, so that they can be
+// told apart from *NotificationError
+func (o Options) ReadMessage(r io.Reader) (Message, error) {
+	var header [HeaderLen]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		return nil, err
+	}
+
+	msgType, length, err := parseHeader(header[:])
+	if err != nil {
+		return nil, err
+	}
+
+	body := make([]byte, int(length)-HeaderLen)
+	if _, err = io.ReadFull(r, body); err != nil {
+		return nil, err
+	}
+
+	return o.unmarshalBody(msgType, body)
+}
+
+func parseHeader(header []byte) (Type, uint16, error) {
+	for _, b := range header[:markerLen] {
+		if b != 0xff {
+			return 0, 0, &NotificationError{Code: ErrCodeMessageHeader, Subcode: ErrSubcodeConnectionNotSynchronized}
+		}
+	}
+
+	length := binary.BigEndian.Uint16(header[16:18])
+	if length < HeaderLen || length > MaxMessageLen {
+		return 0, 0, &NotificationError{Code: ErrCodeMessageHeader, Subcode: ErrSubcodeBadMessageLength, Data: header[16:18]}
+	}
+
+	return Type(header[18]), length, nil
+}
+
+func (o Options) unmarshalBody(msgType Type, body []byte) (Message, error) {
+	var (
+		msg Message
+		err error
+	)
+
+	switch msgType {
+	case TypeOpen:
+		msg, err = unmarshalOpen(body)
+	case TypeUpdate:
+		msg, err = unmarshalUpdate(body, o)
+	case TypeNotification:
+		msg, err = unmarshalNotification(body)
+	case TypeKeepalive:
+		msg, err = unmarshalKeepalive(body)
+	case TypeRouteRefresh:
+		msg, err = unmarshalRouteRefresh(body)
+	default:
+		return nil, &NotificationError{Code: ErrCodeMessageHeader, Subcode: ErrSubcodeBadMessageType, Data: []byte{uint8(msgType)}}
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	return msg, nil
+}
+
+// badLength returns the error reported when the length of a message is not valid for its type
+func badLength(body []byte) *NotificationError {
+	data := make([]byte, 2)
+	binary.BigEndian.PutUint16(data, uint16(HeaderLen+len(body)))
+	return &NotificationError{Code: ErrCodeMessageHeader, Subcode: ErrSubcodeBadMessageLength, Data: data}
+}
+
+// Keepalive is sent periodically to keep the session alive, it has no body
+type Keepalive struct{}
+
+func (*Keepalive) Type() Type {
+	return TypeKeepalive
+}
+
+func (*Keepalive) marshalBody(Options) ([]byte, error) {
+	return nil, nil
+}
+
+func unmarshalKeepalive(body []byte) (*Keepalive, error) {
+	if len(body) != 0 {
+		return nil, badLength(body)
+	}
+	return &Keepalive{}, nil
+}
+
+// Notification is sent when an error is detected, the session is closed right after sending it
+type Notification struct {
+	Code    uint8
+	Subcode uint8
+	Data    []byte
+}
+
+func (*Notification) Type() Type {
+	return TypeNotification
+}
+
+// Err returns the notification as an error
+func (n *Notification) Err() *NotificationError {
+	return &NotificationError{Code: n.Code, Subcode: n.Subcode, Data: n.Data}
+}
+
+func (n *Notification) marshalBody(Options) ([]byte, error) {
+	return append([]byte{n.Code, n.Subcode}, n.Data...), nil
+}
+
+func unmarshalNotification(body []byte) (*Notification, error) {
+	if len(body) < 2 {
+		return nil, badLength(body)
+	}
+
+	notification := &Notification{Code: body[0], Subcode: body[1]}
+	if len(body) > 2 {
+		notification.Data = append([]byte(nil), body[2:]...)
+	}
+
+	return notification, nil
+}
+
+// ROUTE-REFRESH message subtypes (RFC 7313). Speakers without Enhanced Route Refresh support only send normal requests
+const (
+	RouteRefreshRequest uint8 = 0
+	// RouteRefreshBegin (BoRR) and RouteRefreshEnd (EoRR) demarcate the re-advertisement of the Adj-RIB-Out, so that
+	// the receiver can purge the routes that were not re-advertised
+	RouteRefreshBegin uint8 = 1
+	RouteRefreshEnd   uint8 = 2
+)
+
+// RouteRefresh requests the peer to re-advertise its Adj-RIB-Out for the given address family (RFC 2918), or
+// demarcates the re-advertisement when Enhanced Route Refresh is used
+type RouteRefresh struct {
+	AFI     AFI
+	Subtype uint8
+	SAFI    SAFI
+}
+
+func (*RouteRefresh) Type() Type {
+	return TypeRouteRefresh
+}
+
+func (r *RouteRefresh) marshalBody(Options) ([]byte, error) {
+	body := binary.BigEndian.AppendUint16(nil, uint16(r.AFI))
+	return append(body, r.Subtype, uint8(r.SAFI)), nil
+}
+
+func unmarshalRouteRefresh(body []byte) (*RouteRefresh, error) {
+	if len(body) != 4 {
+		return nil, badLength(body)
+	}
+
+	return &RouteRefresh{
+		AFI:     AFI(binary.BigEndian.Uint16(body[0:2])),
+		Subtype: body[2],
+		SAFI:    SAFI(body[3]),
+	}, nil
+}
+
+// AFI is an Address Family Identifier
+type AFI uint16
+
+// SAFI is a Subsequent Address Family Identifier
+type SAFI uint8
+
+const (
+	AFIIPv4 AFI = 1
+	AFIIPv6 AFI = 2
+
+	SAFIUnicast SAFI = 1
+)
@@ -0,0 +1,181 @@
+package packet
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net/netip"
+)
+
+const (
+	AttrCodeMPReachNLRI   AttrCode = 14
+	AttrCodeMPUnreachNLRI AttrCode = 15
+
+	SAFIMulticast SAFI = 2
+)
+
+// MPReachNLRI is the optional non-transitive MP_REACH_NLRI attribute, used to advertise feasible routes of any
+// address family together with their next hop (RFC 4760)
+type MPReachNLRI struct {
+	AFI  AFI
+	SAFI SAFI
+	// NextHops contains the network addresses of the next hop. IPv6 routes may carry both a global and a link-local
+	// address
+	NextHops []netip.Addr
+	NLRI     []netip.Prefix
+	// PathIDs contains the path identifier of each NLRI, only encoded when ADD-PATH is negotiated for the address
+	// family. Missing identifiers are encoded as zero
+	PathIDs []uint32
+}
+
+func (*MPReachNLRI) Code() AttrCode {
+	return AttrCodeMPReachNLRI
+}
+
+func (*MPReachNLRI) Flags() AttrFlags {
+	return AttrFlagOptional
+}
+
+func (m *MPReachNLRI) marshalValue(opts Options) ([]byte, error) {
+	addrLen, err := afiAddrLen(m.AFI)
+	if err != nil {
+		return nil, err
+	}
+
+	var nextHops []byte
+	for _, nextHop := range m.NextHops {
+		if !nextHop.IsValid() {
+			return nil, fmt.Errorf("invalid next hop")
+		}
+		nextHops = append(nextHops, nextHop.AsSlice()...)
+	}
+	if len(nextHops) > 0xff {
+		return nil, fmt.Errorf("next hop too long")
+	}
+
+	nlri, err := marshalPrefixes(m.NLRI, m.PathIDs, addrLen, opts.addPath(m.AFI, m.SAFI, AddPathSend))
+	if err != nil {
+		return nil, fmt.Errorf("invalid NLRI: %w", err)
+	}
+
+	value := binary.BigEndian.AppendUint16(nil, uint16(m.AFI))
+	value = append(value, uint8(m.SAFI), uint8(len(nextHops)))
+	value = append(value, nextHops...)
+	// Reserved, formerly the number of SNPAs
+	value = append(value, 0)
+
+	return append(value, nlri...), nil
+}
+
+// MPUnreachNLRI is the optional non-transitive MP_UNREACH_NLRI attribute, used to withdraw routes of any address
+// family (RFC 4760)
+type MPUnreachNLRI struct {
+	AFI             AFI
+	SAFI            SAFI
+	WithdrawnRoutes []netip.Prefix
+	// PathIDs contains the path identifier of each withdrawn route, only encoded when ADD-PATH is negotiated for the
+	// address family. Missing identifiers are encoded as zero
+	PathIDs []uint32
+}
+
+func (*MPUnreachNLRI) Code() AttrCode {
+	return AttrCodeMPUnreachNLRI
+}
+
+func (*MPUnreachNLRI) Flags() AttrFlags {
+	return AttrFlagOptional
+}
+
+func (m *MPUnreachNLRI) marshalValue(opts Options) ([]byte, error) {
+	addrLen, err := afiAddrLen(m.AFI)
+	if err != nil {
+		return nil, err
+	}
+
+	withdrawn, err := marshalPrefixes(m.WithdrawnRoutes, m.PathIDs, addrLen, opts.addPath(m.AFI, m.SAFI, AddPathSend))
+	if err != nil {
+		return nil, fmt.Errorf("invalid withdrawn routes: %w", err)
+	}
+
+	value := binary.BigEndian.AppendUint16(nil, uint16(m.AFI))
+	value = append(value, uint8(m.SAFI))
+
+	return append(value, withdrawn...), nil
+}
+
+// unmarshalMPReachNLRI decodes the MP_REACH_NLRI attribute. It returns nil if the address family is not supported by
+// this package, in which case the attribute is kept as an unknown one
+func unmarshalMPReachNLRI(value []byte, opts Options) (*MPReachNLRI, error) {
+	optionalError := &NotificationError{Code: ErrCodeUpdateMessage, Subcode: ErrSubcodeOptionalAttributeError}
+
+	if len(value) < 5 {
+		return nil, optionalError
+	}
+
+	mpReach := &MPReachNLRI{AFI: AFI(binary.BigEndian.Uint16(value[0:2])), SAFI: SAFI(value[2])}
+	addrLen, err := afiAddrLen(mpReach.AFI)
+	if err != nil || !prefixBasedSAFI(mpReach.SAFI) {
+		return nil, nil
+	}
+
+	nextHopLen := int(value[3])
+	if len(value) < 4+nextHopLen+1 {
+		return nil, optionalError
+	}
+	nextHops, nlri := value[4:4+nextHopLen], value[4+nextHopLen+1:]
+
+	switch nextHopLen {
+	case 4:
+		mpReach.NextHops = []netip.Addr{netip.AddrFrom4([4]byte(nextHops))}
+	case 16:
+		mpReach.NextHops = []netip.Addr{netip.AddrFrom16([16]byte(nextHops))}
+	case 32:
+		mpReach.NextHops = []netip.Addr{netip.AddrFrom16([16]byte(nextHops[:16])), netip.AddrFrom16([16]byte(nextHops[16:]))}
+	default:
+		return nil, optionalError
+	}
+
+	addPath := opts.addPath(mpReach.AFI, mpReach.SAFI, AddPathReceive)
+	if mpReach.NLRI, mpReach.PathIDs, err = unmarshalPrefixes(nlri, addrLen, addPath); err != nil {
+		return nil, err
+	}
+
+	return mpReach, nil
+}
+
+// unmarshalMPUnreachNLRI decodes the MP_UNREACH_NLRI attribute. It returns nil if the address family is not supported
+// by this package, in which case the attribute is kept as an unknown one
+func unmarshalMPUnreachNLRI(value []byte, opts Options) (*MPUnreachNLRI, error) {
+	if len(value) < 3 {
+		return nil, &NotificationError{Code: ErrCodeUpdateMessage, Subcode: ErrSubcodeOptionalAttributeError}
+	}
+
+	mpUnreach := &MPUnreachNLRI{AFI: AFI(binary.BigEndian.Uint16(value[0:2])), SAFI: SAFI(value[2])}
+	addrLen, err := afiAddrLen(mpUnreach.AFI)
+	if err != nil || !prefixBasedSAFI(mpUnreach.SAFI) {
+		return nil, nil
+	}
+
+	addPath := opts.addPath(mpUnreach.AFI, mpUnreach.SAFI, AddPathReceive)
+	if mpUnreach.WithdrawnRoutes, mpUnreach.PathIDs, err = unmarshalPrefixes(value[3:], addrLen, addPath); err != nil {
+		return nil, err
+	}
+
+	return mpUnreach, nil
+}
+
+// afiAddrLen returns the length in bytes of the addresses of the address family
+func afiAddrLen(afi AFI) (int, error) {
+	switch afi {
+	case AFIIPv4:
+		return 4, nil
+	case AFIIPv6:
+		return 16, nil
+	default:
+		return 0, fmt.Errorf("unsupported AFI %d", afi)
+	}
+}
+
+// prefixBasedSAFI reports whether the NLRI of the SAFI are encoded as plain prefixes
+func prefixBasedSAFI(safi SAFI) bool {
+	return safi == SAFIUnicast || safi == SAFIMulticast
+}
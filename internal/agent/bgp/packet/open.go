@@ -0,0 +1,241 @@
+package packet
+
+import (
+	"encoding/binary"
+	"fmt"
+)
+
+const (
+	minOpenLen = 10
+
+	optParamCapabilities uint8 = 2
+)
+
+// Open is the first message sent by each side after the TCP connection is established
+type Open struct {
+	Version       uint8
+	MyAS          uint16
+	HoldTime      uint16
+	BGPIdentifier [4]byte
+	Capabilities  []Capability
+}
+
+func (*Open) Type() Type {
+	return TypeOpen
+}
+
+func (o *Open) marshalBody(Options) ([]byte, error) {
+	body := make([]byte, minOpenLen)
+	body[0] = o.Version
+	binary.BigEndian.PutUint16(body[1:3], o.MyAS)
+	binary.BigEndian.PutUint16(body[3:5], o.HoldTime)
+	copy(body[5:9], o.BGPIdentifier[:])
+
+	if len(o.Capabilities) > 0 {
+		var caps []byte
+		for _, capability := range o.Capabilities {
+			value := capability.marshalValue()
+			if len(value) > 0xff {
+				return nil, fmt.Errorf("capability %d value too long", capability.Code())
+			}
+			caps = append(caps, uint8(capability.Code()), uint8(len(value)))
+			caps = append(caps, value...)
+		}
+
+		// All capabilities are carried in a single optional parameter
+		if len(caps) > 0xff-2 {
+			return nil, fmt.Errorf("capabilities too long")
+		}
+		body = append(body, optParamCapabilities, uint8(len(caps)))
+		body = append(body, caps...)
+	}
+
+	body[9] = uint8(len(body) - minOpenLen)
+
+	return body, nil
+}
+
+func unmarshalOpen(body []byte) (*Open, error) {
+	if len(body) < minOpenLen {
+		return nil, badLength(body)
+	}
+
+	open := &Open{
+		Version:  body[0],
+		MyAS:     binary.BigEndian.Uint16(body[1:3]),
+		HoldTime: binary.BigEndian.Uint16(body[3:5]),
+	}
+	copy(open.BGPIdentifier[:], body[5:9])
+
+	params := body[minOpenLen:]
+	if int(body[9]) != len(params) {
+		return nil, &NotificationError{Code: ErrCodeOpenMessage}
+	}
+
+	for len(params) > 0 {
+		if len(params) < 2 || len(params) < 2+int(params[1]) {
+			return nil, &NotificationError{Code: ErrCodeOpenMessage}
+		}
+		paramType, value := params[0], params[2:2+int(params[1])]
+		params = params[2+int(params[1]):]
+
+		if paramType != optParamCapabilities {
+			return nil, &NotificationError{Code: ErrCodeOpenMessage, Subcode: ErrSubcodeUnsupportedOptionalParam}
+		}
+
+		capabilities, err := unmarshalCapabilities(value)
+		if err != nil {
+			return nil, err
+		}
+		open.Capabilities = append(open.Capabilities, capabilities...)
+	}
+
+	return open, nil
+}
+
+// CapabilityCode identifies a capability advertised in the OPEN message (RFC 5492)
+type CapabilityCode uint8
+
+const (
+	CapCodeMultiprotocol        CapabilityCode = 1
+	CapCodeRouteRefresh         CapabilityCode = 2
+	CapCodeExtendedNextHop      CapabilityCode = 5
+	CapCodeGracefulRestart      CapabilityCode = 64
+	CapCodeFourOctetAS          CapabilityCode = 65
+	CapCodeAddPath              CapabilityCode = 69
+	CapCodeEnhancedRouteRefresh CapabilityCode = 70
+)
+
+// Capability is implemented by every capability that can be advertised in the OPEN message
+type Capability interface {
+	// Code returns the capability code
+	Code() CapabilityCode
+
+	marshalValue() []byte
+}
+
+// CapMultiprotocol advertises support for an address family (RFC 4760)
+type CapMultiprotocol struct {
+	AFI  AFI
+	SAFI SAFI
+}
+
+func (*CapMultiprotocol) Code() CapabilityCode {
+	return CapCodeMultiprotocol
+}
+
+func (c *CapMultiprotocol) marshalValue() []byte {
+	value := binary.BigEndian.AppendUint16(nil, uint16(c.AFI))
+	return append(value, 0, uint8(c.SAFI))
+}
+
+// CapRouteRefresh advertises support for the ROUTE-REFRESH message (RFC 2918)
+type CapRouteRefresh struct{}
+
+func (*CapRouteRefresh) Code() CapabilityCode {
+	return CapCodeRouteRefresh
+}
+
+func (*CapRouteRefresh) marshalValue() []byte {
+	return nil
+}
+
+// CapEnhancedRouteRefresh advertises support for the demarcation of route refreshes (RFC 7313)
+type CapEnhancedRouteRefresh struct{}
+
+func (*CapEnhancedRouteRefresh) Code() CapabilityCode {
+	return CapCodeEnhancedRouteRefresh
+}
+
+func (*CapEnhancedRouteRefresh) marshalValue() []byte {
+	return nil
+}
+
+// CapFourOctetAS advertises support for 4-octet AS numbers together with the actual AS of the speaker (RFC 6793)
+type CapFourOctetAS struct {
+	ASN uint32
+}
+
+func (*CapFourOctetAS) Code() CapabilityCode {
+	return CapCodeFourOctetAS
+}
+
+func (c *CapFourOctetAS) marshalValue() []byte {
+	return binary.BigEndian.AppendUint32(nil, c.ASN)
+}
+
+// CapUnknown is a capability not understood by this package, its value is kept as is
+type CapUnknown struct {
+	CapCode CapabilityCode
+	Value   []byte
+}
+
+func (c *CapUnknown) Code() CapabilityCode {
+	return c.CapCode
+}
+
+func (c *CapUnknown) marshalValue() []byte {
+	return c.Value
+}
+
+func unmarshalCapabilities(data []byte) ([]Capability, error) {
+	var capabilities []Capability
+
+	for len(data) > 0 {
+		if len(data) < 2 || len(data) < 2+int(data[1]) {
+			return nil, &NotificationError{Code: ErrCodeOpenMessage}
+		}
+		code, value := CapabilityCode(data[0]), data[2:2+int(data[1])]
+		data = data[2+int(data[1]):]
+
+		capability, err := unmarshalCapability(code, value)
+		if err != nil {
+			return nil, err
+		}
+		// Capabilities carrying nothing this package understands are dropped
+		if capability != nil {
+			capabilities = append(capabilities, capability)
+		}
+	}
+
+	return capabilities, nil
+}
+
+func unmarshalCapability(code CapabilityCode, value []byte) (Capability, error) {
+	malformed := &NotificationError{Code: ErrCodeOpenMessage}
+
+	switch code {
+	case CapCodeMultiprotocol:
+		if len(value) != 4 {
+			return nil, malformed
+		}
+		return &CapMultiprotocol{AFI: AFI(binary.BigEndian.Uint16(value[0:2])), SAFI: SAFI(value[3])}, nil
+	case CapCodeRouteRefresh:
+		if len(value) != 0 {
+			return nil, malformed
+		}
+		return &CapRouteRefresh{}, nil
+	case CapCodeEnhancedRouteRefresh:
+		if len(value) != 0 {
+			return nil, malformed
+		}
+		return &CapEnhancedRouteRefresh{}, nil
+	case CapCodeGracefulRestart:
+		return unmarshalCapGracefulRestart(value)
+	case CapCodeFourOctetAS:
+		if len(value) != 4 {
+			return nil, malformed
+		}
+		return &CapFourOctetAS{ASN: binary.BigEndian.Uint32(value)}, nil
+	case CapCodeAddPath:
+		return unmarshalCapAddPath(value)
+	case CapCodeExtendedNextHop:
+		capability, err := unmarshalCapExtendedNextHop(value)
+		if capability == nil {
+			return nil, err
+		}
+		return capability, nil
+	default:
+		return &CapUnknown{CapCode: code, Value: append([]byte(nil), value...)}, nil
+	}
+}
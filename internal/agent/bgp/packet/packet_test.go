@@ -0,0 +1,524 @@
+package packet
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/hex"
+	"errors"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// readFixture reads a hex encoded message from testdata. Whitespace is ignored and lines starting with # are comments
+func readFixture(t testing.TB, name string) []byte {
+	t.Helper()
+
+	file, err := os.Open(filepath.Join("testdata", name))
+	if err != nil {
+		t.Fatalf("failed to open fixture: %v", err)
+	}
+	defer file.Close()
+
+	var encoded strings.Builder
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if strings.HasPrefix(line, "#") {
+			continue
+		}
+		encoded.WriteString(strings.Join(strings.Fields(line), ""))
+	}
+
+	data, err := hex.DecodeString(encoded.String())
+	if err != nil {
+		t.Fatalf("failed to decode fixture %s: %v", name, err)
+	}
+
+	return data
+}
+
+func TestGoldenMessages(t *testing.T) {
+	tests := []struct {
+		fixture string
+		opts    Options
+		msg     Message
+	}{
+		{
+			fixture: "keepalive.hex",
+			msg:     &Keepalive{},
+		},
+		{
+			fixture: "open.hex",
+			msg: &Open{
+				Version:       4,
+				MyAS:          65000,
+				HoldTime:      90,
+				BGPIdentifier: [4]byte{192, 0, 2, 1},
+				Capabilities: []Capability{
+					&CapMultiprotocol{AFI: AFIIPv4, SAFI: SAFIUnicast},
+					&CapRouteRefresh{},
+					&CapFourOctetAS{ASN: 65000},
+				},
+			},
+		},
+		{
+			fixture: "open_minimal.hex",
+			msg: &Open{
+				Version:       4,
+				MyAS:          65001,
+				HoldTime:      180,
+				BGPIdentifier: [4]byte{10, 0, 0, 1},
+			},
+		},
+		{
+			fixture: "open_route_refresh.hex",
+			msg: &Open{
+				Version:       4,
+				MyAS:          65000,
+				HoldTime:      90,
+				BGPIdentifier: [4]byte{192, 0, 2, 1},
+				Capabilities:  []Capability{&CapRouteRefresh{}, &CapEnhancedRouteRefresh{}},
+			},
+		},
+		{
+			fixture: "open_add_path.hex",
+			msg: &Open{
+				Version:       4,
+				MyAS:          65000,
+				HoldTime:      90,
+				BGPIdentifier: [4]byte{192, 0, 2, 1},
+				Capabilities: []Capability{
+					&CapAddPath{Families: []AddPathFamily{
+						{AFI: AFIIPv4, SAFI: SAFIUnicast, Mode: AddPathSendReceive},
+						{AFI: AFIIPv6, SAFI: SAFIUnicast, Mode: AddPathSend},
+					}},
+				},
+			},
+		},
+		{
+			fixture: "open_extended_next_hop.hex",
+			msg: &Open{
+				Version:       4,
+				MyAS:          65000,
+				HoldTime:      90,
+				BGPIdentifier: [4]byte{192, 0, 2, 1},
+				Capabilities: []Capability{
+					&CapExtendedNextHop{Encodings: []NextHopEncoding{{AFI: AFIIPv4, SAFI: SAFIUnicast, NextHopAFI: AFIIPv6}}},
+				},
+			},
+		},
+		{
+			fixture: "open_graceful_restart.hex",
+			msg: &Open{
+				Version:       4,
+				MyAS:          65000,
+				HoldTime:      90,
+				BGPIdentifier: [4]byte{192, 0, 2, 1},
+				Capabilities: []Capability{
+					&CapGracefulRestart{
+						Restarting:  true,
+						RestartTime: 120,
+						Families: []GracefulRestartFamily{
+							{AFI: AFIIPv4, SAFI: SAFIUnicast, ForwardingState: true},
+							{AFI: AFIIPv6, SAFI: SAFIUnicast, ForwardingState: true},
+						},
+					},
+				},
+			},
+		},
+		{
+			fixture: "update_announce.hex",
+			msg: &Update{
+				PathAttributes: []PathAttribute{
+					&Origin{Value: OriginIGP},
+					&ASPath{Segments: []ASPathSegment{{Type: ASSequence, ASNs: []uint32{65000}}}},
+					&NextHop{Addr: netip.MustParseAddr("192.0.2.1")},
+					&MultiExitDisc{Value: 100},
+				},
+				NLRI: []netip.Prefix{
+					netip.MustParsePrefix("10.0.0.1/32"),
+					netip.MustParsePrefix("192.168.1.0/24"),
+				},
+			},
+		},
+		{
+			fixture: "update_communities.hex",
+			msg: &Update{
+				PathAttributes: []PathAttribute{
+					&Origin{Value: OriginIGP},
+					&ASPath{Segments: []ASPathSegment{{Type: ASSequence, ASNs: []uint32{65000}}}},
+					&NextHop{Addr: netip.MustParseAddr("192.0.2.1")},
+					&Communities{Values: []uint32{65000<<16 | 100, CommunityNoExport}},
+					&ExtendedCommunities{Values: []ExtendedCommunity{{ExtCommunityTypeTwoOctetAS, ExtCommunitySubtypeRouteTarget, 0xfd, 0xe8, 0, 0, 0, 100}}},
+					&LargeCommunities{Values: []LargeCommunity{{GlobalAdministrator: 4200000000, LocalData1: 1, LocalData2: 2}}},
+				},
+				NLRI: []netip.Prefix{netip.MustParsePrefix("10.0.0.1/32")},
+			},
+		},
+		{
+			fixture: "update_withdraw.hex",
+			msg: &Update{
+				WithdrawnRoutes: []netip.Prefix{netip.MustParsePrefix("10.0.0.1/32")},
+			},
+		},
+		{
+			fixture: "update_unknown_attribute.hex",
+			msg: &Update{
+				PathAttributes: []PathAttribute{
+					&Origin{Value: OriginIGP},
+					&ASPath{},
+					&NextHop{Addr: netip.MustParseAddr("192.0.2.1")},
+					&LocalPref{Value: 100},
+					&UnknownAttribute{
+						AttrFlags: AttrFlagOptional | AttrFlagTransitive,
+						AttrCode:  254,
+						Value:     []byte{0xde, 0xad, 0xbe, 0xef},
+					},
+				},
+				NLRI: []netip.Prefix{netip.MustParsePrefix("10.0.0.2/32")},
+			},
+		},
+		{
+			fixture: "update_mp_reach.hex",
+			msg: &Update{
+				PathAttributes: []PathAttribute{
+					&Origin{Value: OriginIGP},
+					&ASPath{Segments: []ASPathSegment{{Type: ASSequence, ASNs: []uint32{65000}}}},
+					&MPReachNLRI{
+						AFI:      AFIIPv6,
+						SAFI:     SAFIUnicast,
+						NextHops: []netip.Addr{netip.MustParseAddr("2001:db8::ffff")},
+						NLRI: []netip.Prefix{
+							netip.MustParsePrefix("2001:db8::1/128"),
+							netip.MustParsePrefix("2001:db8:1::/48"),
+						},
+					},
+				},
+			},
+		},
+		{
+			fixture: "update_mp_unreach.hex",
+			msg: &Update{
+				PathAttributes: []PathAttribute{
+					&MPUnreachNLRI{
+						AFI:             AFIIPv6,
+						SAFI:            SAFIUnicast,
+						WithdrawnRoutes: []netip.Prefix{netip.MustParsePrefix("2001:db8::1/128")},
+					},
+				},
+			},
+		},
+		{
+			fixture: "update_add_path.hex",
+			opts:    Options{AddPath: []AddPathFamily{{AFI: AFIIPv4, SAFI: SAFIUnicast, Mode: AddPathSendReceive}}},
+			msg: &Update{
+				WithdrawnRoutes: []netip.Prefix{netip.MustParsePrefix("10.0.0.2/32")},
+				PathAttributes: []PathAttribute{
+					&Origin{Value: OriginIGP},
+					&ASPath{Segments: []ASPathSegment{{Type: ASSequence, ASNs: []uint32{65000}}}},
+					&NextHop{Addr: netip.MustParseAddr("192.0.2.1")},
+				},
+				NLRI:             []netip.Prefix{netip.MustParsePrefix("10.0.0.1/32")},
+				WithdrawnPathIDs: []uint32{1},
+				NLRIPathIDs:      []uint32{7},
+			},
+		},
+		{
+			fixture: "update_mp_reach_add_path.hex",
+			opts:    Options{AddPath: []AddPathFamily{{AFI: AFIIPv6, SAFI: SAFIUnicast, Mode: AddPathSendReceive}}},
+			msg: &Update{
+				PathAttributes: []PathAttribute{
+					&Origin{Value: OriginIGP},
+					&ASPath{Segments: []ASPathSegment{{Type: ASSequence, ASNs: []uint32{65000}}}},
+					&MPReachNLRI{
+						AFI:      AFIIPv6,
+						SAFI:     SAFIUnicast,
+						NextHops: []netip.Addr{netip.MustParseAddr("2001:db8::ffff")},
+						NLRI:     []netip.Prefix{netip.MustParsePrefix("2001:db8::1/128")},
+						PathIDs:  []uint32{7},
+					},
+				},
+			},
+		},
+		{
+			fixture: "update_mp_reach_extended_next_hop.hex",
+			msg: &Update{
+				PathAttributes: []PathAttribute{
+					&Origin{Value: OriginIGP},
+					&ASPath{Segments: []ASPathSegment{{Type: ASSequence, ASNs: []uint32{65000}}}},
+					&MPReachNLRI{
+						AFI:      AFIIPv4,
+						SAFI:     SAFIUnicast,
+						NextHops: []netip.Addr{netip.MustParseAddr("fe80::1")},
+						NLRI:     []netip.Prefix{netip.MustParsePrefix("10.0.0.1/32")},
+					},
+				},
+			},
+		},
+		{
+			fixture: "update_end_of_rib_ipv6.hex",
+			msg:     EndOfRIB(AFIIPv6, SAFIUnicast),
+		},
+		{
+			fixture: "update_four_octet_as.hex",
+			opts:    Options{FourOctetAS: true},
+			msg: &Update{
+				PathAttributes: []PathAttribute{
+					&Origin{Value: OriginIGP},
+					&ASPath{Segments: []ASPathSegment{{Type: ASSequence, ASNs: []uint32{4200000000}}}},
+					&NextHop{Addr: netip.MustParseAddr("192.0.2.1")},
+					&Aggregator{ASN: 4200000000, Addr: netip.MustParseAddr("192.0.2.1")},
+				},
+				NLRI: []netip.Prefix{netip.MustParsePrefix("10.0.0.1/32")},
+			},
+		},
+		{
+			fixture: "update_as4_path.hex",
+			msg: &Update{
+				PathAttributes: []PathAttribute{
+					&Origin{Value: OriginIGP},
+					&ASPath{Segments: []ASPathSegment{{Type: ASSequence, ASNs: []uint32{ASTrans}}}},
+					&NextHop{Addr: netip.MustParseAddr("192.0.2.1")},
+					&AS4Path{Segments: []ASPathSegment{{Type: ASSequence, ASNs: []uint32{4200000000}}}},
+				},
+				NLRI: []netip.Prefix{netip.MustParsePrefix("10.0.0.1/32")},
+			},
+		},
+		{
+			fixture: "notification.hex",
+			msg: &Notification{
+				Code:    ErrCodeCease,
+				Subcode: ErrSubcodeAdministrativeShutdown,
+				Data:    append([]byte{11}, "maintenance"...),
+			},
+		},
+		{
+			fixture: "route_refresh.hex",
+			msg:     &RouteRefresh{AFI: AFIIPv4, SAFI: SAFIUnicast},
+		},
+		{
+			fixture: "route_refresh_borr.hex",
+			msg:     &RouteRefresh{AFI: AFIIPv6, Subtype: RouteRefreshBegin, SAFI: SAFIUnicast},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.fixture, func(t *testing.T) {
+			golden := readFixture(t, tt.fixture)
+
+			decoded, err := tt.opts.Unmarshal(golden)
+			if err != nil {
+				t.Fatalf("failed to unmarshal: %v", err)
+			}
+			if !reflect.DeepEqual(decoded, tt.msg) {
+				t.Fatalf("unexpected decoded message:\n got: %#v\nwant: %#v", decoded, tt.msg)
+			}
+
+			encoded, err := tt.opts.Marshal(tt.msg)
+			if err != nil {
+				t.Fatalf("failed to marshal: %v", err)
+			}
+			if !bytes.Equal(encoded, golden) {
+				t.Fatalf("unexpected encoding:\n got: %x\nwant: %x", encoded, golden)
+			}
+
+			read, err := tt.opts.ReadMessage(bytes.NewReader(golden))
+			if err != nil || !reflect.DeepEqual(read, tt.msg) {
+				t.Fatalf("ReadMessage() = %#v, %v", read, err)
+			}
+		})
+	}
+}
+
+func TestUnmarshalErrors(t *testing.T) {
+	marker := bytes.Repeat([]byte{0xff}, markerLen)
+	withHeader := func(msgType Type, body ...byte) []byte {
+		msg := append([]byte{}, marker...)
+		msg = append(msg, 0, uint8(HeaderLen+len(body)), uint8(msgType))
+		return append(msg, body...)
+	}
+	update := func(attrs []byte, nlri ...byte) []byte {
+		body := []byte{0, 0, 0, uint8(len(attrs))}
+		body = append(body, attrs...)
+		return withHeader(TypeUpdate, append(body, nlri...)...)
+	}
+	mandatory := []byte{0x40, 1, 1, 0, 0x40, 2, 0, 0x40, 3, 4, 192, 0, 2, 1}
+
+	tests := []struct {
+		name    string
+		data    []byte
+		code    uint8
+		subcode uint8
+	}{
+		{
+			name:    "bad marker",
+			data:    append(make([]byte, markerLen), 0, HeaderLen, uint8(TypeKeepalive)),
+			code:    ErrCodeMessageHeader,
+			subcode: ErrSubcodeConnectionNotSynchronized,
+		},
+		{
+			name:    "length shorter than header",
+			data:    append(append([]byte{}, marker...), 0, 18, uint8(TypeKeepalive)),
+			code:    ErrCodeMessageHeader,
+			subcode: ErrSubcodeBadMessageLength,
+		},
+		{
+			name:    "unknown message type",
+			data:    withHeader(42),
+			code:    ErrCodeMessageHeader,
+			subcode: ErrSubcodeBadMessageType,
+		},
+		{
+			name:    "keepalive with body",
+			data:    withHeader(TypeKeepalive, 0),
+			code:    ErrCodeMessageHeader,
+			subcode: ErrSubcodeBadMessageLength,
+		},
+		{
+			name:    "open with unsupported optional parameter",
+			data:    withHeader(TypeOpen, 4, 0xfd, 0xe8, 0, 90, 10, 0, 0, 1, 2, 1, 0),
+			code:    ErrCodeOpenMessage,
+			subcode: ErrSubcodeUnsupportedOptionalParam,
+		},
+		{
+			name:    "open with truncated capability",
+			data:    withHeader(TypeOpen, 4, 0xfd, 0xe8, 0, 90, 10, 0, 0, 1, 4, 2, 2, 1, 4),
+			code:    ErrCodeOpenMessage,
+			subcode: 0,
+		},
+		{
+			name:    "update with truncated withdrawn routes",
+			data:    withHeader(TypeUpdate, 0, 10, 0, 0),
+			code:    ErrCodeUpdateMessage,
+			subcode: ErrSubcodeMalformedAttributeList,
+		},
+		{
+			name:    "update with prefix longer than 32 bits",
+			data:    withHeader(TypeUpdate, 0, 2, 33, 10, 0, 0),
+			code:    ErrCodeUpdateMessage,
+			subcode: ErrSubcodeInvalidNetworkField,
+		},
+		{
+			name:    "update missing NEXT_HOP",
+			data:    update(mandatory[:7], 32, 10, 0, 0, 1),
+			code:    ErrCodeUpdateMessage,
+			subcode: ErrSubcodeMissingWellKnownAttr,
+		},
+		{
+			name:    "update with invalid ORIGIN",
+			data:    update([]byte{0x40, 1, 1, 3}),
+			code:    ErrCodeUpdateMessage,
+			subcode: ErrSubcodeInvalidOriginAttribute,
+		},
+		{
+			name:    "update with optional flag on ORIGIN",
+			data:    update([]byte{0xc0, 1, 1, 0}),
+			code:    ErrCodeUpdateMessage,
+			subcode: ErrSubcodeAttributeFlagsError,
+		},
+		{
+			name:    "update with duplicated attribute",
+			data:    update(append(append([]byte{}, mandatory...), 0x40, 1, 1, 0)),
+			code:    ErrCodeUpdateMessage,
+			subcode: ErrSubcodeMalformedAttributeList,
+		},
+		{
+			name:    "update with truncated attribute",
+			data:    update([]byte{0x40, 3, 4, 192, 0}),
+			code:    ErrCodeUpdateMessage,
+			subcode: ErrSubcodeAttributeLengthError,
+		},
+		{
+			name:    "update with malformed AS_PATH",
+			data:    update([]byte{0x40, 2, 4, 2, 2, 0xfd, 0xe8}),
+			code:    ErrCodeUpdateMessage,
+			subcode: ErrSubcodeMalformedASPath,
+		},
+		{
+			name:    "update with MP_REACH_NLRI missing AS_PATH",
+			data:    update([]byte{0x40, 1, 1, 0, 0x80, 14, 9, 0, 1, 1, 4, 192, 0, 2, 1, 0}),
+			code:    ErrCodeUpdateMessage,
+			subcode: ErrSubcodeMissingWellKnownAttr,
+		},
+		{
+			name:    "update with invalid MP_REACH_NLRI next hop length",
+			data:    update([]byte{0x80, 14, 7, 0, 2, 1, 2, 0, 0, 0}),
+			code:    ErrCodeUpdateMessage,
+			subcode: ErrSubcodeOptionalAttributeError,
+		},
+		{
+			name:    "update with 4-octet AS_PATH in a 2-octet session",
+			data:    update([]byte{0x40, 1, 1, 0, 0x40, 2, 6, 2, 1, 0xfa, 0x56, 0xea, 0x00}),
+			code:    ErrCodeUpdateMessage,
+			subcode: ErrSubcodeMalformedASPath,
+		},
+		{
+			name:    "update with unrecognized well-known attribute",
+			data:    update([]byte{0x40, 200, 0}),
+			code:    ErrCodeUpdateMessage,
+			subcode: ErrSubcodeUnrecognizedWellKnownAttr,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := Unmarshal(tt.data)
+
+			var notification *NotificationError
+			if !errors.As(err, &notification) {
+				t.Fatalf("expected NotificationError, got %v", err)
+			}
+			if notification.Code != tt.code || notification.Subcode != tt.subcode {
+				t.Fatalf("expected code %d subcode %d, got %d %d", tt.code, tt.subcode, notification.Code, notification.Subcode)
+			}
+		})
+	}
+}
+
+func TestMarshalFourOctetASInTwoOctetSession(t *testing.T) {
+	update := &Update{PathAttributes: []PathAttribute{&ASPath{Segments: []ASPathSegment{{Type: ASSequence, ASNs: []uint32{4200000000}}}}}}
+
+	if _, err := Marshal(update); err == nil {
+		t.Fatalf("expected error encoding a 4-octet AS number in a 2-octet AS_PATH")
+	}
+	if _, err := (Options{FourOctetAS: true}).Marshal(update); err != nil {
+		t.Fatalf("failed to marshal 4-octet AS_PATH: %v", err)
+	}
+}
+
+func TestMarshalTooLong(t *testing.T) {
+	var nlri []netip.Prefix
+	for i := 0; i < 1000; i++ {
+		nlri = append(nlri, netip.PrefixFrom(netip.AddrFrom4([4]byte{10, 0, byte(i >> 8), byte(i)}), 32))
+	}
+
+	if _, err := Marshal(&Update{NLRI: nlri}); !errors.Is(err, ErrMessageTooLong) {
+		t.Fatalf("expected ErrMessageTooLong, got %v", err)
+	}
+}
+
+func TestShutdownCommunication(t *testing.T) {
+	notification := &Notification{
+		Code:    ErrCodeCease,
+		Subcode: ErrSubcodeAdministrativeShutdown,
+		Data:    ShutdownCommunication("node drained"),
+	}
+	if reason, ok := notification.ShutdownCommunication(); !ok || reason != "node drained" {
+		t.Fatalf("unexpected shutdown communication %q", reason)
+	}
+
+	// Long reasons are truncated without splitting multi-byte characters
+	data := ShutdownCommunication(strings.Repeat("é", 200))
+	if len(data) != 1+254 || data[0] != 254 {
+		t.Fatalf("unexpected shutdown communication length %d", len(data))
+	}
+
+	notification.Data = []byte{10, 'a'}
+	if _, ok := notification.ShutdownCommunication(); ok {
+		t.Fatalf("expected truncated shutdown communication to be ignored")
+	}
+}
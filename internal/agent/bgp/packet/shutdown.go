@@ -0,0 +1,37 @@
+package packet
+
+import (
+	"unicode/utf8"
+)
+
+// MaxShutdownCommunicationLen is the maximum length in bytes of a shutdown communication, as extended by RFC 9003
+const MaxShutdownCommunicationLen = 255
+
+// ShutdownCommunication encodes the reason as the data of a Cease NOTIFICATION with the Administrative Shutdown or
+// Administrative Reset subcode (RFC 8203). Reasons too long to fit are truncated on a UTF-8 character boundary
+func ShutdownCommunication(reason string) []byte {
+	for len(reason) > MaxShutdownCommunicationLen {
+		_, size := utf8.DecodeLastRuneInString(reason)
+		reason = reason[:len(reason)-size]
+	}
+
+	return append([]byte{uint8(len(reason))}, reason...)
+}
+
+// ShutdownCommunication returns the reason carried by a Cease NOTIFICATION with the Administrative Shutdown or
+// Administrative Reset subcode, if any. Malformed communications are ignored, as required by RFC 8203
+func (n *Notification) ShutdownCommunication() (string, bool) {
+	if n.Code != ErrCodeCease || (n.Subcode != ErrSubcodeAdministrativeShutdown && n.Subcode != ErrSubcodeAdministrativeReset) {
+		return "", false
+	}
+	if len(n.Data) == 0 || n.Data[0] == 0 || int(n.Data[0]) > len(n.Data)-1 {
+		return "", false
+	}
+
+	reason := n.Data[1 : 1+int(n.Data[0])]
+	if !utf8.Valid(reason) {
+		return "", false
+	}
+
+	return string(reason), true
+}
@@ -0,0 +1,192 @@
+package packet
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net/netip"
+)
+
+const minUpdateLen = 4
+
+// Update advertises feasible routes sharing the same path attributes and withdraws unfeasible ones
+type Update struct {
+	WithdrawnRoutes []netip.Prefix
+	PathAttributes  []PathAttribute
+	NLRI            []netip.Prefix
+
+	// WithdrawnPathIDs and NLRIPathIDs contain the path identifier of each withdrawn route and NLRI, only encoded when
+	// ADD-PATH is negotiated for IPv4 unicast. Missing identifiers are encoded as zero
+	WithdrawnPathIDs []uint32
+	NLRIPathIDs      []uint32
+}
+
+func (*Update) Type() Type {
+	return TypeUpdate
+}
+
+// Attribute returns the path attribute with the given code, or nil if the update does not carry it
+func (u *Update) Attribute(code AttrCode) PathAttribute {
+	for _, attr := range u.PathAttributes {
+		if attr.Code() == code {
+			return attr
+		}
+	}
+	return nil
+}
+
+func (u *Update) marshalBody(opts Options) ([]byte, error) {
+	addPath := opts.addPath(AFIIPv4, SAFIUnicast, AddPathSend)
+
+	withdrawn, err := marshalPrefixes(u.WithdrawnRoutes, u.WithdrawnPathIDs, 4, addPath)
+	if err != nil {
+		return nil, fmt.Errorf("invalid withdrawn routes: %w", err)
+	}
+
+	attrs, err := marshalPathAttributes(u.PathAttributes, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	nlri, err := marshalPrefixes(u.NLRI, u.NLRIPathIDs, 4, addPath)
+	if err != nil {
+		return nil, fmt.Errorf("invalid NLRI: %w", err)
+	}
+
+	if len(withdrawn) > 0xffff || len(attrs) > 0xffff {
+		return nil, ErrMessageTooLong
+	}
+
+	body := make([]byte, 0, minUpdateLen+len(withdrawn)+len(attrs)+len(nlri))
+	body = binary.BigEndian.AppendUint16(body, uint16(len(withdrawn)))
+	body = append(body, withdrawn...)
+	body = binary.BigEndian.AppendUint16(body, uint16(len(attrs)))
+	body = append(body, attrs...)
+
+	return append(body, nlri...), nil
+}
+
+func unmarshalUpdate(body []byte, opts Options) (*Update, error) {
+	malformed := &NotificationError{Code: ErrCodeUpdateMessage, Subcode: ErrSubcodeMalformedAttributeList}
+
+	if len(body) < minUpdateLen {
+		return nil, badLength(body)
+	}
+
+	withdrawnLen := int(binary.BigEndian.Uint16(body[0:2]))
+	if len(body) < 2+withdrawnLen+2 {
+		return nil, malformed
+	}
+	withdrawnData := body[2 : 2+withdrawnLen]
+	body = body[2+withdrawnLen:]
+
+	attrsLen := int(binary.BigEndian.Uint16(body[0:2]))
+	if len(body) < 2+attrsLen {
+		return nil, malformed
+	}
+	attrsData, nlriData := body[2:2+attrsLen], body[2+attrsLen:]
+
+	update := &Update{}
+	addPath := opts.addPath(AFIIPv4, SAFIUnicast, AddPathReceive)
+
+	var err error
+	if update.WithdrawnRoutes, update.WithdrawnPathIDs, err = unmarshalPrefixes(withdrawnData, 4, addPath); err != nil {
+		return nil, err
+	}
+	if update.PathAttributes, err = unmarshalPathAttributes(attrsData, opts); err != nil {
+		return nil, err
+	}
+	if update.NLRI, update.NLRIPathIDs, err = unmarshalPrefixes(nlriData, 4, addPath); err != nil {
+		return nil, err
+	}
+
+	// Well-known mandatory attributes are only required when the update carries NLRI, either in the NLRI field or in
+	// the MP_REACH_NLRI attribute. The NEXT_HOP attribute is only meaningful for the former
+	var mandatory []AttrCode
+	if update.Attribute(AttrCodeMPReachNLRI) != nil {
+		mandatory = []AttrCode{AttrCodeOrigin, AttrCodeASPath}
+	}
+	if len(update.NLRI) > 0 {
+		mandatory = []AttrCode{AttrCodeOrigin, AttrCodeASPath, AttrCodeNextHop}
+	}
+	for _, code := range mandatory {
+		if update.Attribute(code) == nil {
+			return nil, &NotificationError{
+				Code:    ErrCodeUpdateMessage,
+				Subcode: ErrSubcodeMissingWellKnownAttr,
+				Data:    []byte{uint8(code)},
+			}
+		}
+	}
+
+	return update, nil
+}
+
+// PrefixLen returns the number of bytes used to encode the prefix in the NLRI or withdrawn routes fields
+func PrefixLen(prefix netip.Prefix) int {
+	return 1 + (prefix.Bits()+7)/8
+}
+
+// marshalPrefixes encodes the prefixes in the <length, prefix> form, all of them must have addrLen bytes addresses.
+// With ADD-PATH every prefix is preceded by its path identifier
+func marshalPrefixes(prefixes []netip.Prefix, pathIDs []uint32, addrLen int, addPath bool) ([]byte, error) {
+	var buf []byte
+	for i, prefix := range prefixes {
+		if !prefix.IsValid() || prefix.Addr().BitLen() != addrLen*8 {
+			return nil, fmt.Errorf("invalid prefix %s for %d bytes addresses", prefix, addrLen)
+		}
+
+		if addPath {
+			var pathID uint32
+			if i < len(pathIDs) {
+				pathID = pathIDs[i]
+			}
+			buf = binary.BigEndian.AppendUint32(buf, pathID)
+		}
+
+		addr := prefix.Addr().AsSlice()
+		buf = append(buf, uint8(prefix.Bits()))
+		buf = append(buf, addr[:(prefix.Bits()+7)/8]...)
+	}
+
+	return buf, nil
+}
+
+// unmarshalPrefixes decodes a list of prefixes in the <length, prefix> form with addrLen bytes addresses, together with
+// their path identifiers when ADD-PATH is negotiated
+func unmarshalPrefixes(data []byte, addrLen int, addPath bool) ([]netip.Prefix, []uint32, error) {
+	invalid := &NotificationError{Code: ErrCodeUpdateMessage, Subcode: ErrSubcodeInvalidNetworkField}
+
+	var prefixes []netip.Prefix
+	var pathIDs []uint32
+	for len(data) > 0 {
+		if addPath {
+			if len(data) < PathIDLen+1 {
+				return nil, nil, invalid
+			}
+			pathIDs = append(pathIDs, binary.BigEndian.Uint32(data[:PathIDLen]))
+			data = data[PathIDLen:]
+		}
+
+		bits := int(data[0])
+		size := (bits + 7) / 8
+		if bits > addrLen*8 || len(data) < 1+size {
+			return nil, nil, invalid
+		}
+
+		var raw [16]byte
+		copy(raw[:], data[1:1+size])
+		data = data[1+size:]
+
+		var addr netip.Addr
+		if addrLen == 4 {
+			addr = netip.AddrFrom4([4]byte(raw[:4]))
+		} else {
+			addr = netip.AddrFrom16(raw)
+		}
+
+		// Trailing bits are irrelevant and therefore masked
+		prefixes = append(prefixes, netip.PrefixFrom(addr, bits).Masked())
+	}
+
+	return prefixes, pathIDs, nil
+}
@@ -1,3 +1,1491 @@
 package bgp
 
-// todo: encapsulates a BGP peer session
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"net"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"slices"
+	"sync/atomic"
+	"time"
+
+	"github.com/go-logr/logr"
+	"github.com/yago-123/routebird/api/v1alphav1"
+	"github.com/yago-123/routebird/internal/agent/bfd"
+	"github.com/yago-123/routebird/internal/agent/bgp/packet"
+	cfg "github.com/yago-123/routebird/internal/common"
+)
+
+const (
+	// BGPPort is the well-known TCP port in which BGP speakers listen for connections
+	BGPPort = 179
+
+	// DefaultHoldTime is the hold time proposed to peers in the OPEN message
+	DefaultHoldTime = 90 * time.Second
+	// DefaultConnectRetryTime is the time waited between connection attempts to a peer
+	DefaultConnectRetryTime = 30 * time.Second
+
+	// openHoldTime is the hold time used while waiting for the OPEN message of the peer, as suggested by RFC 4271
+	openHoldTime = 4 * time.Minute
+
+	dialTimeout  = 10 * time.Second
+	writeTimeout = 10 * time.Second
+
+	bgpVersion = 4
+
+	defaultLocalPref uint32 = 100
+
+	defaultWarningThresholdPercent    = 75
+	defaultMaxPrefixesRestartInterval = 60 * time.Second
+
+	// shutdownReason is sent to the peers in the Cease NOTIFICATION closing the sessions when the agent stops
+	shutdownReason = "routebird agent shutting down"
+)
+
+// peer encapsulates the BGP session with a single remote peer. It keeps dialing the peer until the context is
+// cancelled and, once the session is established, keeps the routes advertised to the peer in sync with the routes
+// provided by the manager
+type peer struct {
+	speakerConfig
+
+	// config contains the settings of the configured peers, zero for the dynamic ones
+	config v1alphav1.BGPPeer
+
+	// name identifies the peer, which is its address or the interface of unnumbered peers
+	name   string
+	remote netip.AddrPort
+	asn    uint32
+	// peerASNs are the ASNs accepted from dynamic peers, whose asn is learned from their OPEN message. Nil for the
+	// configured peers
+	peerASNs []v1alphav1.ASNRange
+	// iface is the interface of unnumbered peers, whose address is discovered by neighbor and whose remote only holds
+	// the port. Empty for the peers with a configured address
+	iface    string
+	neighbor func(ctx context.Context) (netip.Addr, error)
+
+	holdTime         time.Duration
+	connectRetryTime time.Duration
+	// keepaliveTime is the interval between KEEPALIVE messages, zero uses a third of the negotiated hold time
+	keepaliveTime time.Duration
+
+	// passive peers are not dialed, their connections are accepted on the local BGP port and received on acceptCh
+	passive  bool
+	acceptCh chan net.Conn
+
+	// sourceAddr is the local address of the connections dialed to the peer, the system picks one when invalid
+	sourceAddr netip.Addr
+	// ttl and minTTL are the TTL of the packets sent to the peer and the minimum TTL of the packets accepted from it,
+	// zero keeps the system defaults
+	ttl    int
+	minTTL int
+	// passwordFile contains the TCP MD5 signature key of the peer, empty when the sessions are not signed
+	passwordFile string
+	// bfd detects failures of the forwarding path to the peer, nil when BFD is not enabled for the peer
+	bfd *bfd.Session
+	// hasEstablished is set once a session with the peer has been established by the manager, so that the following
+	// sessions are not flagged as restarts in the Graceful Restart capability
+	hasEstablished bool
+
+	// routes returns the routes that must be advertised to the peer, together with their path attributes
+	routes func() map[netip.Prefix]RouteAttributes
+	// selectRoutes runs the decision process for the prefixes whose routes received from the peer changed
+	selectRoutes func(prefixes []netip.Prefix)
+	// adjRIBIn contains the routes received from the peer and adjRIBOut the routes advertised to it, both are only
+	// written by the goroutine running the session and emptied once it is closed
+	adjRIBIn  table
+	adjRIBOut table
+	// exportPolicy filters and modifies the routes advertised to the peer, nil advertises every route unmodified
+	exportPolicy atomic.Pointer[policy]
+	// importPolicy filters and modifies the routes received from the peer, nil rejects every route
+	importPolicy atomic.Pointer[policy]
+	// refreshCh is signaled when the policies of the peer are replaced, so that the established session applies them
+	refreshCh chan struct{}
+	// maxPrefixes limits the number of routes received from the peer, nil when unlimited
+	maxPrefixes *maxPrefixes
+	// notifyCh wakes up the established session whenever the routes to be advertised change
+	notifyCh chan struct{}
+
+	state  atomic.Int32
+	logger logr.Logger
+}
+
+var (
+	// errBFDDown is returned when the session is torn down because the BFD session with the peer went down
+	errBFDDown = errors.New("BFD session with peer went down")
+	// errMaxPrefixesReached is returned when the session is torn down because the peer exceeded its maximum number of
+	// prefixes
+	errMaxPrefixesReached = errors.New("maximum number of prefixes reached")
+)
+
+// maxPrefixes limits the number of routes received from a peer
+type maxPrefixes struct {
+	limit int
+	// warning is the number of routes from which a warning is logged
+	warning         int
+	action          v1alphav1.MaxPrefixesAction
+	restartInterval time.Duration
+}
+
+// speakerConfig contains the settings of the local BGP speaker, shared by the sessions with every peer
+type speakerConfig struct {
+	localASN uint32
+	// routerID is the BGP identifier of the speaker, derived from the local address of each session when zero
+	routerID [4]byte
+	// requireFourOctetAS rejects the peers without 4-octet AS support when localASN does not fit in 2 octets, instead
+	// of advertising AS_TRANS to them
+	requireFourOctetAS bool
+	// drainInterval is the time an established session is kept up after withdrawing its routes on shutdown, so
+	// that the peer can move traffic away before the session is closed
+	drainInterval time.Duration
+	// restartTime is advertised in the Graceful Restart capability, zero disables the capability
+	restartTime time.Duration
+	// pathID identifies the routes of the speaker among the ones advertised by other nodes for the same prefixes, sent
+	// to the peers that negotiated ADD-PATH
+	pathID uint32
+	// restarting is set when the speaker replaces one that closed its sessions for graceful restart, so that the
+	// first session with each peer is flagged as a restart
+	restarting bool
+}
+
+func newPeer(
+	peerCfg v1alphav1.BGPPeer,
+	speaker speakerConfig,
+	routes func() map[netip.Prefix]RouteAttributes,
+	selectRoutes func(prefixes []netip.Prefix),
+	logger logr.Logger,
+) (*peer, error) {
+	var addr netip.Addr
+	var err error
+	if peerCfg.Interface == "" {
+		if addr, err = netip.ParseAddr(peerCfg.Address); err != nil {
+			return nil, fmt.Errorf("failed to parse peer address %q: %w", peerCfg.Address, err)
+		}
+	} else if peerCfg.SourceAddress != "" || (peerCfg.Passive && peerCfg.PasswordSecretRef != nil) {
+		return nil, fmt.Errorf("source address and passwords of passive peers are not supported with interface %s", peerCfg.Interface)
+	}
+
+	p := &peer{
+		speakerConfig:    speaker,
+		name:             peerCfg.Interface,
+		remote:           netip.AddrPortFrom(addr.Unmap(), BGPPort),
+		asn:              peerCfg.ASN,
+		iface:            peerCfg.Interface,
+		holdTime:         DefaultHoldTime,
+		connectRetryTime: DefaultConnectRetryTime,
+		passive:          peerCfg.Passive,
+		acceptCh:         make(chan net.Conn),
+		routes:           routes,
+		selectRoutes:     selectRoutes,
+		notifyCh:         make(chan struct{}, 1),
+		refreshCh:        make(chan struct{}, 1),
+		logger:           logger,
+	}
+	if p.iface == "" {
+		p.name = p.remote.Addr().String()
+	}
+
+	if peerCfg.HoldTimeSeconds != nil {
+		// A hold time of zero disables the hold timer, otherwise it must be at least three seconds
+		if holdTime := *peerCfg.HoldTimeSeconds; holdTime < 0 || holdTime == 1 || holdTime == 2 || holdTime > 65535 {
+			return nil, fmt.Errorf("invalid hold time %d", holdTime)
+		}
+		p.holdTime = time.Duration(*peerCfg.HoldTimeSeconds) * time.Second
+	}
+	if peerCfg.KeepaliveTimeSeconds != nil {
+		if *peerCfg.KeepaliveTimeSeconds < 1 {
+			return nil, fmt.Errorf("invalid keepalive time %d", *peerCfg.KeepaliveTimeSeconds)
+		}
+		p.keepaliveTime = time.Duration(*peerCfg.KeepaliveTimeSeconds) * time.Second
+	}
+	if peerCfg.ConnectRetryTimeSeconds > 0 {
+		p.connectRetryTime = time.Duration(peerCfg.ConnectRetryTimeSeconds) * time.Second
+	}
+
+	if peerCfg.SourceAddress != "" {
+		if p.sourceAddr, err = netip.ParseAddr(peerCfg.SourceAddress); err != nil {
+			return nil, fmt.Errorf("failed to parse source address %q: %w", peerCfg.SourceAddress, err)
+		}
+		p.sourceAddr = p.sourceAddr.Unmap()
+		if p.sourceAddr.Is4() != p.remote.Addr().Is4() {
+			return nil, fmt.Errorf("source address %s does not match the address family of the peer", p.sourceAddr)
+		}
+	}
+
+	if p.ttl, p.minTTL, err = ttlSettings(peerCfg, speaker.localASN); err != nil {
+		return nil, err
+	}
+
+	if peerCfg.PasswordSecretRef != nil {
+		p.passwordFile = filepath.Join(cfg.PeerPasswordsPath, cfg.PeerPasswordFilename(*peerCfg.PasswordSecretRef))
+	}
+
+	if peerCfg.MaxPrefixes != nil {
+		if p.maxPrefixes, err = newMaxPrefixes(*peerCfg.MaxPrefixes); err != nil {
+			return nil, fmt.Errorf("invalid maximum number of prefixes: %w", err)
+		}
+	}
+
+	return p, nil
+}
+
+// newMaxPrefixes validates the maximum number of prefixes of a peer, applying the defaults of the unset settings
+func newMaxPrefixes(config v1alphav1.MaxPrefixes) (*maxPrefixes, error) {
+	if config.Limit < 1 {
+		return nil, fmt.Errorf("invalid limit %d", config.Limit)
+	}
+
+	threshold := config.WarningThresholdPercent
+	if threshold == 0 {
+		threshold = defaultWarningThresholdPercent
+	}
+	if threshold < 1 || threshold > 100 {
+		return nil, fmt.Errorf("invalid warning threshold %d%%", threshold)
+	}
+
+	limits := &maxPrefixes{
+		limit:           int(config.Limit),
+		warning:         max(1, int(config.Limit)*int(threshold)/100),
+		action:          config.Action,
+		restartInterval: time.Duration(config.RestartIntervalSeconds) * time.Second,
+	}
+	switch limits.action {
+	case "":
+		limits.action = v1alphav1.MaxPrefixesActionTeardown
+	case v1alphav1.MaxPrefixesActionLog, v1alphav1.MaxPrefixesActionTeardown, v1alphav1.MaxPrefixesActionRestart:
+	default:
+		return nil, fmt.Errorf("unknown action %q", limits.action)
+	}
+	if limits.restartInterval <= 0 {
+		limits.restartInterval = defaultMaxPrefixesRestartInterval
+	}
+
+	return limits, nil
+}
+
+// ttlSettings returns the TTL of the packets sent to the peer and the minimum TTL of the packets accepted from it.
+// External peers are expected to be directly connected unless multihop is enabled, while GTSM sends packets with the
+// maximum TTL and only accepts the ones that crossed at most the allowed number of hops (RFC 5082)
+func ttlSettings(peerCfg v1alphav1.BGPPeer, localASN uint32) (int, int, error) {
+	if peerCfg.EBGPMultihopTTL < 0 || peerCfg.EBGPMultihopTTL > maxTTL {
+		return 0, 0, fmt.Errorf("invalid eBGP multihop TTL %d", peerCfg.EBGPMultihopTTL)
+	}
+
+	hops := 1
+	if peerCfg.EBGPMultihopTTL > 0 {
+		hops = int(peerCfg.EBGPMultihopTTL)
+	}
+
+	switch {
+	case peerCfg.GTSM:
+		return maxTTL, maxTTL + 1 - hops, nil
+	case peerCfg.ASN != localASN:
+		return hops, 0, nil
+	default:
+		return 0, 0, nil
+	}
+}
+
+// State returns the current state of the session with the peer
+func (p *peer) State() State {
+	return State(p.state.Load())
+}
+
+func (p *peer) setState(state State) {
+	if old := State(p.state.Swap(int32(state))); old != state {
+		p.logger.Info("BGP session state changed", "from", old, "to", state)
+	}
+}
+
+// notify signals the session that the routes to be advertised have changed. It never blocks, multiple notifications
+// are collapsed into a single one
+func (p *peer) notify() {
+	select {
+	case p.notifyCh <- struct{}{}:
+	default:
+	}
+}
+
+// refresh signals the session that the policies of the peer have been replaced. It never blocks
+func (p *peer) refresh() {
+	select {
+	case p.refreshCh <- struct{}{}:
+	default:
+	}
+}
+
+// bfdDown returns the channel signaled when the BFD session with the peer goes down, nil when BFD is not enabled
+func (p *peer) bfdDown() <-chan struct{} {
+	if p.bfd == nil {
+		return nil
+	}
+	return p.bfd.Down()
+}
+
+// run drives the session with the peer until the context is cancelled
+func (p *peer) run(ctx context.Context) {
+	defer p.setState(StateIdle)
+
+	for {
+		// Passive peers are free to connect again right away
+		retryIn := p.connectRetryTime
+		if p.passive {
+			retryIn = 0
+		}
+
+		conn, err := p.connect(ctx)
+		switch {
+		case ctx.Err() != nil:
+			return
+		case err != nil:
+			p.setState(StateActive)
+			p.logger.Error(err, "Failed to connect to BGP peer", "retryIn", retryIn)
+		default:
+			err = p.runSession(ctx, conn)
+			if ctx.Err() != nil {
+				return
+			}
+
+			if errors.Is(err, errMaxPrefixesReached) {
+				if p.maxPrefixes.action == v1alphav1.MaxPrefixesActionTeardown {
+					p.logger.Error(err, "BGP session torn down, not connecting again until the agent restarts")
+					<-ctx.Done()
+					return
+				}
+				retryIn = p.maxPrefixes.restartInterval
+			}
+			p.logger.Error(err, "BGP session closed", "retryIn", retryIn)
+		}
+
+		if retryIn == 0 {
+			continue
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(retryIn):
+		}
+	}
+}
+
+// runSession runs a session with the peer over the connection until it is closed, removing the routes of the peer
+// afterwards
+func (p *peer) runSession(ctx context.Context, conn net.Conn) error {
+	err := newSession(p, conn).run(ctx)
+	_ = conn.Close()
+	p.clearRIBs()
+
+	p.setState(StateIdle)
+	return err
+}
+
+// clearRIBs removes the routes received from and advertised to the peer once the session is closed
+func (p *peer) clearRIBs() {
+	p.adjRIBOut.clear()
+
+	removed := p.adjRIBIn.clear()
+	if len(removed) == 0 {
+		return
+	}
+
+	prefixes := make([]netip.Prefix, 0, len(removed))
+	for _, route := range removed {
+		prefixes = append(prefixes, route.Prefix)
+	}
+	p.selectRoutes(prefixes)
+}
+
+// connect dials the peer or, for passive peers, waits for the peer to connect
+func (p *peer) connect(ctx context.Context) (net.Conn, error) {
+	if p.passive {
+		p.setState(StateActive)
+
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case conn := <-p.acceptCh:
+			return conn, nil
+		}
+	}
+
+	remote := p.remote
+	if p.iface != "" {
+		p.setState(StateActive)
+		addr, err := p.neighbor(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("failed to discover neighbor on interface %s: %w", p.iface, err)
+		}
+		remote = netip.AddrPortFrom(addr, p.remote.Port())
+	}
+
+	p.setState(StateConnect)
+	return p.dial(ctx, remote)
+}
+
+// acceptsASN reports whether the ASN of the OPEN message of the peer is the expected one, or any of the ASNs of the
+// listen range for dynamic peers
+func (p *peer) acceptsASN(asn uint32) bool {
+	if p.peerASNs == nil {
+		return asn == p.asn
+	}
+	return slices.ContainsFunc(p.peerASNs, func(r v1alphav1.ASNRange) bool { return asn >= r.First && asn <= r.Last })
+}
+
+// accepts reports whether the incoming connection from the address belongs to the peer. Connections of unnumbered
+// peers come from any link-local address of their interface
+func (p *peer) accepts(remote netip.Addr) bool {
+	if p.iface != "" {
+		return remote.Is6() && remote.IsLinkLocalUnicast() && remote.Zone() == p.iface
+	}
+	return remote == p.remote.Addr()
+}
+
+func (p *peer) dial(ctx context.Context, remote netip.AddrPort) (net.Conn, error) {
+	dialer := net.Dialer{Timeout: dialTimeout}
+	if p.sourceAddr.IsValid() {
+		dialer.LocalAddr = net.TCPAddrFromAddrPort(netip.AddrPortFrom(p.sourceAddr, 0))
+	}
+
+	opts := socketOptions{ttl: p.ttl, minTTL: p.minTTL}
+	if p.passwordFile != "" {
+		// The password is read on every attempt so that rotations of the secret apply to the next session
+		password, err := p.password()
+		if err != nil {
+			return nil, err
+		}
+		opts.md5Keys = map[netip.Addr]string{remote.Addr(): password}
+	}
+	if !opts.isZero() {
+		dialer.Control = opts.control
+	}
+
+	return dialer.DialContext(ctx, "tcp", remote.String())
+}
+
+// password returns the TCP MD5 signature key of the peer
+func (p *peer) password() (string, error) {
+	password, err := os.ReadFile(p.passwordFile)
+	if err != nil {
+		return "", fmt.Errorf("failed to read TCP MD5 password: %w", err)
+	}
+
+	return string(password), nil
+}
+
+// session holds the state of a single TCP connection with the peer, from the OPEN exchange until it is closed
+type session struct {
+	peer *peer
+	conn net.Conn
+
+	localAddr netip.Addr
+	// remoteAddr is the address of the peer in the connection, which is discovered for unnumbered peers
+	remoteAddr netip.Addr
+	routerID   [4]byte
+
+	holdTime   time.Duration
+	holdTimer  *time.Timer
+	keepalive  *time.Ticker
+	keepaliveC <-chan time.Time
+	notifyC    <-chan struct{}
+	refreshC   <-chan struct{}
+
+	// families contains the address families negotiated with the peer
+	families map[family]struct{}
+	// fourOctetAS is set once both speakers announced support for 4-octet AS numbers. It is read by the goroutine
+	// decoding the messages received from the peer
+	fourOctetAS atomic.Bool
+	// addPath contains the address families for which the path identifier is sent to the peer, negotiated through the
+	// ADD-PATH capability. It is read by the goroutine reading messages as well
+	addPath atomic.Pointer[[]packet.AddPathFamily]
+	// gracefulRestart is set when both speakers advertised the Graceful Restart capability, in which case the peer
+	// retains the routes of the session for the restart time once it is lost
+	gracefulRestart bool
+	// routeRefresh is set when the peer supports the ROUTE-REFRESH message, and enhancedRouteRefresh when it also
+	// supports the demarcation of route refreshes (RFC 7313)
+	routeRefresh         bool
+	enhancedRouteRefresh bool
+	// extendedNextHop is set when both speakers support advertising IPv4 routes with IPv6 next hops (RFC 8950)
+	extendedNextHop bool
+	// received contains the prefixes announced by the peer in the session whether its import policy accepted them or
+	// not, which are the ones counted against its maximum number of prefixes
+	received map[netip.Prefix]struct{}
+	// stale contains the routes received from the peer that were not re-advertised yet since the peer started a route
+	// refresh of their address family. The ones left when the refresh ends are removed
+	stale map[family]map[netip.Prefix]struct{}
+	// maxPrefixesWarned and maxPrefixesExceeded are set while the number of routes received from the peer is above the
+	// warning threshold and the limit, so that they are only logged once every time they are crossed
+	maxPrefixesWarned   bool
+	maxPrefixesExceeded bool
+
+	// draining is set once every route has been withdrawn on shutdown, while waiting for the session to be closed
+	draining bool
+}
+
+func newSession(p *peer, conn net.Conn) *session {
+	var localAddr, remoteAddr netip.Addr
+	if tcpAddr, ok := conn.LocalAddr().(*net.TCPAddr); ok {
+		localAddr = tcpAddr.AddrPort().Addr().Unmap()
+	}
+	if tcpAddr, ok := conn.RemoteAddr().(*net.TCPAddr); ok {
+		remoteAddr = tcpAddr.AddrPort().Addr().Unmap()
+	}
+
+	s := &session{
+		peer:       p,
+		conn:       conn,
+		localAddr:  localAddr,
+		remoteAddr: remoteAddr,
+		routerID:   p.routerID,
+	}
+	if s.routerID == ([4]byte{}) {
+		s.routerID = routerID(localAddr)
+	}
+	return s
+}
+
+func (s *session) run(ctx context.Context) error {
+	done := make(chan struct{})
+	defer close(done)
+
+	var capabilities []packet.Capability
+	for _, fam := range supportedFamilies {
+		capabilities = append(capabilities, &packet.CapMultiprotocol{AFI: fam.afi, SAFI: fam.safi})
+	}
+	if s.localAddr.Is6() {
+		capabilities = append(capabilities, &packet.CapExtendedNextHop{Encodings: []packet.NextHopEncoding{extendedNextHop}})
+	}
+	capabilities = append(capabilities, &packet.CapRouteRefresh{}, &packet.CapEnhancedRouteRefresh{})
+	if s.peer.restartTime > 0 {
+		capabilities = append(capabilities, s.gracefulRestartCapability())
+	}
+	capabilities = append(capabilities, &packet.CapFourOctetAS{ASN: s.peer.localASN}, addPathCapability())
+
+	if err := s.send(&packet.Open{
+		Version:       bgpVersion,
+		MyAS:          twoOctetASN(s.peer.localASN),
+		HoldTime:      uint16(s.peer.holdTime / time.Second),
+		BGPIdentifier: s.routerID,
+		Capabilities:  capabilities,
+	}); err != nil {
+		return err
+	}
+	s.peer.setState(StateOpenSent)
+
+	s.holdTimer = time.NewTimer(openHoldTime)
+	defer s.stopTimers()
+
+	msgCh := make(chan packet.Message)
+	errCh := make(chan error, 1)
+	go s.readLoop(done, msgCh, errCh)
+
+	// Only the BFD failures happening during this session must tear it down
+	bfdDownC := s.peer.bfdDown()
+	select {
+	case <-bfdDownC:
+	default:
+	}
+
+	doneC := ctx.Done()
+	var drainC <-chan time.Time
+
+	for {
+		select {
+		case <-doneC:
+			if s.peer.State() == StateEstablished && s.gracefulRestart && errors.Is(context.Cause(ctx), ErrRestart) {
+				// Closing the connection without NOTIFICATION makes the peer retain the routes while the agent
+				// restarts, as the forwarding state of the node is preserved meanwhile. When the agent stops instead,
+				// the session is drained as any other
+				s.peer.logger.Info("Closing BGP session for graceful restart, peer retains the routes", "restartTime", s.peer.restartTime)
+				return ctx.Err()
+			}
+			if s.peer.State() != StateEstablished || s.peer.drainInterval <= 0 {
+				s.shutdown()
+				return ctx.Err()
+			}
+
+			// Withdraw every route and keep the session up for the drain interval, so that the peer moves traffic
+			// away before the session is closed instead of blackholing it until the hold timer expires
+			drainTimer := time.NewTimer(s.peer.drainInterval)
+			defer drainTimer.Stop()
+			doneC, drainC = nil, drainTimer.C
+
+			s.draining = true
+			s.notifyC, s.refreshC = nil, nil
+			if err := s.syncRoutes(); err != nil {
+				return s.fail(err)
+			}
+			s.peer.logger.Info("Withdrew routes from BGP peer, draining session", "drainInterval", s.peer.drainInterval)
+		case <-drainC:
+			s.shutdown()
+			return ctx.Err()
+		case <-bfdDownC:
+			// The signal may be stale if the BFD session recovered meanwhile
+			if s.peer.bfd.State() == bfd.StateUp {
+				continue
+			}
+			// The forwarding path to the peer is down, so the session is closed without sending a NOTIFICATION
+			return errBFDDown
+		case err := <-errCh:
+			return s.fail(fmt.Errorf("failed to read message: %w", err))
+		case msg := <-msgCh:
+			if err := s.handleMessage(msg); err != nil {
+				return s.fail(err)
+			}
+		case <-s.holdTimer.C:
+			return s.fail(&packet.NotificationError{Code: packet.ErrCodeHoldTimeExpired})
+		case <-s.keepaliveC:
+			if err := s.send(&packet.Keepalive{}); err != nil {
+				return err
+			}
+		case <-s.notifyC:
+			if err := s.syncRoutes(); err != nil {
+				return s.fail(err)
+			}
+		case <-s.refreshC:
+			if err := s.applyPolicies(); err != nil {
+				return s.fail(err)
+			}
+		}
+	}
+}
+
+// handleMessage processes a message received from the peer according to the current state of the session
+func (s *session) handleMessage(msg packet.Message) error {
+	if notification, ok := msg.(*packet.Notification); ok {
+		if reason, hasReason := notification.ShutdownCommunication(); hasReason {
+			return fmt.Errorf("received NOTIFICATION from peer (code %d, subcode %d): %q", notification.Code, notification.Subcode, reason)
+		}
+		return fmt.Errorf("received NOTIFICATION from peer (code %d, subcode %d)", notification.Code, notification.Subcode)
+	}
+
+	switch state := s.peer.State(); {
+	case state == StateOpenSent && msg.Type() == packet.TypeOpen:
+		open := msg.(*packet.Open)
+		if err := s.validateOpen(open); err != nil {
+			return err
+		}
+
+		s.holdTime = min(s.peer.holdTime, time.Duration(open.HoldTime)*time.Second)
+		s.negotiateFamilies(open)
+		if _, fourOctetAS := peerASN(open); fourOctetAS {
+			s.fourOctetAS.Store(true)
+		} else if s.peer.localASN > maxTwoOctetASN {
+			// Unless required by requireFourOctetAS, RFC 6793 keeps such peers working by sending AS_TRANS in place of
+			// the local ASN, with the actual AS path in AS4_PATH
+			s.peer.logger.Info("BGP peer does not support 4-octet AS numbers, advertising AS_TRANS", "localASN", s.peer.localASN)
+		}
+		s.negotiateAddPath(open)
+		s.routeRefresh = hasCapability(open, packet.CapCodeRouteRefresh)
+		s.enhancedRouteRefresh = s.routeRefresh && hasCapability(open, packet.CapCodeEnhancedRouteRefresh)
+		s.negotiateExtendedNextHop(open)
+		if s.peer.restartTime > 0 && hasCapability(open, packet.CapCodeGracefulRestart) {
+			s.gracefulRestart = true
+			s.peer.logger.Info("Negotiated graceful restart with BGP peer")
+		}
+		if err := s.send(&packet.Keepalive{}); err != nil {
+			return err
+		}
+		s.resetHoldTimer()
+		s.peer.setState(StateOpenConfirm)
+
+	case state == StateOpenConfirm && msg.Type() == packet.TypeKeepalive:
+		s.resetHoldTimer()
+		if s.holdTime > 0 {
+			s.keepalive = time.NewTicker(s.keepaliveInterval())
+			s.keepaliveC = s.keepalive.C
+		}
+		s.notifyC = s.peer.notifyCh
+		s.refreshC = s.peer.refreshCh
+		s.peer.setState(StateEstablished)
+		s.peer.hasEstablished = true
+
+		if err := s.syncRoutes(); err != nil {
+			return err
+		}
+		return s.sendEndOfRIB()
+
+	case state == StateEstablished && msg.Type() == packet.TypeKeepalive:
+		s.resetHoldTimer()
+
+	case state == StateEstablished && msg.Type() == packet.TypeUpdate:
+		s.resetHoldTimer()
+		return s.receiveUpdate(msg.(*packet.Update))
+
+	case state == StateEstablished && msg.Type() == packet.TypeRouteRefresh:
+		return s.receiveRouteRefresh(msg.(*packet.RouteRefresh))
+
+	default:
+		return &packet.NotificationError{Code: packet.ErrCodeFSM}
+	}
+
+	return nil
+}
+
+func (s *session) validateOpen(open *packet.Open) error {
+	if open.Version != bgpVersion {
+		return &packet.NotificationError{
+			Code:    packet.ErrCodeOpenMessage,
+			Subcode: packet.ErrSubcodeUnsupportedVersionNumber,
+			Data:    []byte{0, bgpVersion},
+		}
+	}
+
+	// Peers without 4-octet AS support can only use 2-octet AS numbers, so a 4-octet peer ASN is always rejected
+	asn, _ := peerASN(open)
+	if !s.peer.acceptsASN(asn) {
+		return &packet.NotificationError{Code: packet.ErrCodeOpenMessage, Subcode: packet.ErrSubcodeBadPeerAS}
+	}
+	if s.peer.peerASNs != nil {
+		s.peer.asn = asn
+	}
+
+	// The capability the peer lacks is listed in the NOTIFICATION (RFC 5492)
+	if _, fourOctetAS := peerASN(open); !fourOctetAS && s.peer.requireFourOctetAS && s.peer.localASN > maxTwoOctetASN {
+		return &packet.NotificationError{
+			Code:    packet.ErrCodeOpenMessage,
+			Subcode: packet.ErrSubcodeUnsupportedCapability,
+			Data:    binary.BigEndian.AppendUint32([]byte{byte(packet.CapCodeFourOctetAS), 4}, s.peer.localASN),
+		}
+	}
+
+	if open.HoldTime == 1 || open.HoldTime == 2 {
+		return &packet.NotificationError{Code: packet.ErrCodeOpenMessage, Subcode: packet.ErrSubcodeUnacceptableHoldTime}
+	}
+
+	// The identifier must be valid and, for internal peers, different from ours
+	if open.BGPIdentifier == [4]byte{} || (s.isInternal() && open.BGPIdentifier == s.routerID) {
+		return &packet.NotificationError{Code: packet.ErrCodeOpenMessage, Subcode: packet.ErrSubcodeBadBGPIdentifier}
+	}
+
+	return nil
+}
+
+// negotiateFamilies computes the address families that can be exchanged with the peer. A peer that does not
+// advertise any multiprotocol capability only supports IPv4 unicast (RFC 4760)
+func (s *session) negotiateFamilies(open *packet.Open) {
+	s.families = make(map[family]struct{})
+
+	advertised := false
+	for _, capability := range open.Capabilities {
+		mp, ok := capability.(*packet.CapMultiprotocol)
+		if !ok {
+			continue
+		}
+
+		advertised = true
+		fam := family{afi: mp.AFI, safi: mp.SAFI}
+		if slices.Contains(supportedFamilies, fam) {
+			s.families[fam] = struct{}{}
+		}
+	}
+
+	if !advertised {
+		s.families[familyIPv4Unicast] = struct{}{}
+	}
+
+	var negotiated []string
+	for _, fam := range supportedFamilies {
+		if _, ok := s.families[fam]; ok {
+			negotiated = append(negotiated, fam.String())
+		}
+	}
+	s.peer.logger.Info("Negotiated address families with BGP peer", "families", negotiated)
+}
+
+// negotiateExtendedNextHop enables advertising IPv4 routes with IPv6 next hops when the peer is able to receive them,
+// which is only offered over IPv6 sessions (RFC 8950)
+func (s *session) negotiateExtendedNextHop(open *packet.Open) {
+	if !s.localAddr.Is6() {
+		return
+	}
+
+	for _, capability := range open.Capabilities {
+		if capExtendedNextHop, ok := capability.(*packet.CapExtendedNextHop); ok &&
+			slices.Contains(capExtendedNextHop.Encodings, extendedNextHop) {
+			s.extendedNextHop = true
+			s.peer.logger.Info("Negotiated extended next hop with BGP peer")
+			return
+		}
+	}
+}
+
+// negotiateAddPath computes the address families for which the path identifier is sent to the peer, which are the
+// negotiated ones the peer is able to receive multiple paths for (RFC 7911)
+func (s *session) negotiateAddPath(open *packet.Open) {
+	var addPath []packet.AddPathFamily
+	var negotiated []string
+	for _, capability := range open.Capabilities {
+		capAddPath, ok := capability.(*packet.CapAddPath)
+		if !ok {
+			continue
+		}
+
+		for _, peerFam := range capAddPath.Families {
+			fam := family{afi: peerFam.AFI, safi: peerFam.SAFI}
+			if _, ok = s.families[fam]; !ok || peerFam.Mode&packet.AddPathReceive == 0 {
+				continue
+			}
+			addPath = append(addPath, packet.AddPathFamily{AFI: fam.afi, SAFI: fam.safi, Mode: packet.AddPathSend})
+			negotiated = append(negotiated, fam.String())
+		}
+	}
+
+	s.addPath.Store(&addPath)
+	if len(negotiated) > 0 {
+		s.peer.logger.Info("Negotiated ADD-PATH with BGP peer", "families", negotiated, "pathID", s.peer.pathID)
+	}
+}
+
+// pathID returns the path identifier of the routes of the address family, nil when ADD-PATH was not negotiated for it
+func (s *session) pathID(fam family) *uint32 {
+	addPath := s.addPath.Load()
+	if addPath == nil || !slices.ContainsFunc(*addPath, func(addPathFam packet.AddPathFamily) bool {
+		return addPathFam.AFI == fam.afi && addPathFam.SAFI == fam.safi
+	}) {
+		return nil
+	}
+
+	return &s.peer.pathID
+}
+
+// syncRoutes sends the UPDATE messages required for the routes advertised to the peer to match the routes provided
+// by the manager, or to withdraw every route once the session is draining. The routes of the resent address families
+// are announced again even if they did not change
+func (s *session) syncRoutes(resent ...family) error {
+	var routes map[netip.Prefix]RouteAttributes
+	if !s.draining {
+		routes = s.peer.routes()
+	}
+
+	desired := make(map[netip.Prefix]RouteAttributes)
+	for prefix, attrs := range routes {
+		// Routes of address families that were not negotiated cannot be advertised to the peer
+		if _, ok := s.families[prefixFamily(prefix)]; !ok {
+			continue
+		}
+
+		if exportPolicy := s.peer.exportPolicy.Load(); exportPolicy != nil {
+			var accepted bool
+			if attrs, accepted = exportPolicy.apply(prefix, attrs); !accepted {
+				continue
+			}
+		}
+		desired[prefix] = attrs
+	}
+
+	withdrawn := make(map[family][]netip.Prefix)
+	announced := make(map[family][]routeGroup)
+	for _, route := range s.peer.adjRIBOut.routes() {
+		if _, ok := desired[route.Prefix]; !ok {
+			fam := prefixFamily(route.Prefix)
+			withdrawn[fam] = append(withdrawn[fam], route.Prefix)
+		}
+	}
+	for prefix, attrs := range desired {
+		// Routes whose attributes changed are announced again, which implicitly replaces the previous announcement.
+		// Changes of the service advertised by the routes are never sent to the peers, so they are not announced again
+		fam := prefixFamily(prefix)
+		if current, ok := s.peer.adjRIBOut.get(prefix); !ok || !current.Attributes.wireEqual(attrs) || slices.Contains(resent, fam) {
+			announced[fam] = addToGroup(announced[fam], prefix, attrs)
+		}
+	}
+
+	totalWithdrawn, totalAnnounced := 0, 0
+	for _, fam := range supportedFamilies {
+		slices.SortFunc(withdrawn[fam], comparePrefixes)
+		pathID := s.pathID(fam)
+		updates, err := buildUpdates(fam, withdrawn[fam], nil, nil, netip.Addr{}, pathID)
+		if err != nil {
+			return fmt.Errorf("failed to build UPDATE messages for %s: %w", fam, err)
+		}
+
+		// Routes sharing the same attributes are packed together, as an UPDATE message carries a single set of them
+		for _, group := range announced[fam] {
+			slices.SortFunc(group.prefixes, comparePrefixes)
+		}
+		slices.SortFunc(announced[fam], func(a, b routeGroup) int {
+			return comparePrefixes(a.prefixes[0], b.prefixes[0])
+		})
+
+		var sent []Route
+		for _, group := range announced[fam] {
+			nextHop, ok := s.nextHop(fam, group.attrs)
+			if !ok {
+				s.peer.logger.Info("Skipping routes, session has no next hop for the address family", "family", fam, "localAddress", s.localAddr)
+				continue
+			}
+
+			groupUpdates, errBuild := buildUpdates(fam, nil, group.prefixes, s.attributes(group.attrs), nextHop, pathID)
+			if errBuild != nil {
+				return fmt.Errorf("failed to build UPDATE messages for %s: %w", fam, errBuild)
+			}
+			updates = append(updates, groupUpdates...)
+			for _, prefix := range group.prefixes {
+				sent = append(sent, Route{
+					Prefix:     prefix,
+					Peer:       s.remoteAddr,
+					Internal:   s.isInternal(),
+					NextHop:    nextHop,
+					Origin:     packet.OriginIGP,
+					ASPath:     s.asPath(group.attrs),
+					Attributes: group.attrs,
+				})
+			}
+		}
+
+		for _, update := range updates {
+			if err = s.send(update); err != nil {
+				return err
+			}
+		}
+
+		for _, prefix := range withdrawn[fam] {
+			s.peer.adjRIBOut.delete(prefix)
+		}
+		for _, route := range sent {
+			s.peer.adjRIBOut.insert(route)
+		}
+
+		totalWithdrawn += len(withdrawn[fam])
+		totalAnnounced += len(sent)
+	}
+
+	if totalWithdrawn > 0 || totalAnnounced > 0 {
+		s.peer.logger.Info("Synced routes with BGP peer", "announced", totalAnnounced, "withdrawn", totalWithdrawn)
+	}
+
+	return nil
+}
+
+// sendEndOfRIB sends the End-of-RIB marker of every negotiated address family once the initial routes have been
+// advertised, so that a peer retaining stale routes from a previous session can flush the ones no longer advertised
+func (s *session) sendEndOfRIB() error {
+	if !s.gracefulRestart {
+		return nil
+	}
+
+	for _, fam := range supportedFamilies {
+		if _, ok := s.families[fam]; !ok {
+			continue
+		}
+		if err := s.send(packet.EndOfRIB(fam.afi, fam.safi)); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// receiveRouteRefresh handles a ROUTE-REFRESH message of the peer. Requests are answered by advertising again every
+// route of the address family, while the markers of an enhanced route refresh flag the routes received from the peer
+// as stale and remove the ones that were not advertised again before the refresh ended (RFC 7313). Messages for address
+// families that were not negotiated and unknown subtypes are ignored
+func (s *session) receiveRouteRefresh(refresh *packet.RouteRefresh) error {
+	fam := family{afi: refresh.AFI, safi: refresh.SAFI}
+	if _, ok := s.families[fam]; !ok {
+		s.peer.logger.V(1).Info("Ignoring ROUTE-REFRESH for an address family that was not negotiated", "afi", refresh.AFI, "safi", refresh.SAFI)
+		return nil
+	}
+
+	switch refresh.Subtype {
+	case packet.RouteRefreshRequest:
+		s.peer.logger.Info("BGP peer requested a route refresh", "afi", refresh.AFI, "safi", refresh.SAFI)
+		return s.refreshRoutes([]family{fam})
+
+	case packet.RouteRefreshBegin:
+		if !s.enhancedRouteRefresh {
+			return nil
+		}
+		// Routes rejected by the import policy are tracked as well, so that they stop counting against the maximum
+		// number of prefixes once the peer no longer advertises them
+		stale := make(map[netip.Prefix]struct{})
+		for prefix := range s.received {
+			if prefixFamily(prefix) == fam {
+				stale[prefix] = struct{}{}
+			}
+		}
+		if s.stale == nil {
+			s.stale = make(map[family]map[netip.Prefix]struct{})
+		}
+		s.stale[fam] = stale
+
+	case packet.RouteRefreshEnd:
+		if !s.enhancedRouteRefresh {
+			return nil
+		}
+		var removed []netip.Prefix
+		for prefix := range s.stale[fam] {
+			delete(s.received, prefix)
+			if s.peer.adjRIBIn.delete(prefix) {
+				removed = append(removed, prefix)
+			}
+		}
+		delete(s.stale, fam)
+		if len(removed) > 0 {
+			s.peer.logger.Info("Removed stale routes after route refresh of BGP peer", "routes", len(removed))
+			s.peer.selectRoutes(removed)
+		}
+	}
+
+	return nil
+}
+
+// refreshRoutes advertises again every route of the address families to the peer, within the markers of an enhanced
+// route refresh when the peer supports them so that it can remove the routes that are no longer advertised
+func (s *session) refreshRoutes(families []family) error {
+	if s.enhancedRouteRefresh {
+		for _, fam := range families {
+			if err := s.send(&packet.RouteRefresh{AFI: fam.afi, Subtype: packet.RouteRefreshBegin, SAFI: fam.safi}); err != nil {
+				return err
+			}
+		}
+	}
+
+	if err := s.syncRoutes(families...); err != nil {
+		return err
+	}
+
+	if s.enhancedRouteRefresh {
+		for _, fam := range families {
+			if err := s.send(&packet.RouteRefresh{AFI: fam.afi, Subtype: packet.RouteRefreshEnd, SAFI: fam.safi}); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// applyPolicies applies the policies that replaced the ones of the peer without resetting the session, advertising
+// again every route through the new export policy and requesting the peer to advertise again its routes so that they
+// go through the new import policy. Peers without route refresh support only have the new import policy applied to
+// the routes they advertise from now on
+func (s *session) applyPolicies() error {
+	var families []family
+	for _, fam := range supportedFamilies {
+		if _, ok := s.families[fam]; ok {
+			families = append(families, fam)
+		}
+	}
+
+	s.peer.logger.Info("Applying updated policies to BGP peer")
+	if err := s.refreshRoutes(families); err != nil {
+		return err
+	}
+
+	if !s.routeRefresh {
+		s.peer.logger.Info("BGP peer does not support route refresh, the import policy only applies to the routes it advertises from now on")
+		return nil
+	}
+	for _, fam := range families {
+		if err := s.send(&packet.RouteRefresh{AFI: fam.afi, Subtype: packet.RouteRefreshRequest, SAFI: fam.safi}); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// gracefulRestartCapability returns the Graceful Restart capability advertised to the peer. The forwarding state is
+// always preserved, as the agent does not program the data plane of the node. Only the first session after a graceful
+// restart of the agent is flagged as a restart, as the peer retained the routes of the speaker only then (RFC 4724)
+func (s *session) gracefulRestartCapability() *packet.CapGracefulRestart {
+	capability := &packet.CapGracefulRestart{
+		Restarting:  s.peer.restarting && !s.peer.hasEstablished,
+		RestartTime: uint16(min(s.peer.restartTime/time.Second, packet.MaxRestartTime)),
+	}
+	for _, fam := range supportedFamilies {
+		capability.Families = append(capability.Families, packet.GracefulRestartFamily{
+			AFI:             fam.afi,
+			SAFI:            fam.safi,
+			ForwardingState: true,
+		})
+	}
+
+	return capability
+}
+
+// nextHop returns the next hop advertised for routes of the address family, which is the next hop configured in the
+// attributes of the routes or else the local address of the session. IPv6 routes advertised over IPv4 sessions use the
+// IPv4-mapped IPv6 local address, while IPv4 routes require an IPv4 session or the extended next hop encoding
+func (s *session) nextHop(fam family, attrs RouteAttributes) (netip.Addr, bool) {
+	switch {
+	case fam == familyIPv4Unicast && attrs.NextHopIPv4.IsValid():
+		return attrs.NextHopIPv4, true
+	case fam == familyIPv6Unicast && attrs.NextHopIPv6.IsValid():
+		return attrs.NextHopIPv6, true
+	case fam == familyIPv4Unicast && s.localAddr.Is4():
+		return s.localAddr, true
+	case fam == familyIPv4Unicast && s.localAddr.Is6() && s.extendedNextHop:
+		return s.localAddr.WithZone(""), true
+	case fam == familyIPv6Unicast && s.localAddr.Is6():
+		return s.localAddr.WithZone(""), true
+	case fam == familyIPv6Unicast && s.localAddr.Is4():
+		return netip.AddrFrom16(s.localAddr.As16()), true
+	default:
+		return netip.Addr{}, false
+	}
+}
+
+// attributes returns the path attributes of routes advertised to the peer with the provided attributes, except for
+// the next hop which depends on the address family of the routes. The local AS is only prepended for external peers,
+// as internal peers would discard routes whose AS_PATH contains their own AS
+func (s *session) attributes(attrs RouteAttributes) []packet.PathAttribute {
+	pathAttrs := []packet.PathAttribute{&packet.Origin{Value: packet.OriginIGP}}
+
+	if s.isInternal() {
+		localPref := defaultLocalPref
+		if attrs.LocalPref != nil {
+			localPref = *attrs.LocalPref
+		}
+		pathAttrs = append(pathAttrs,
+			&packet.ASPath{},
+			&packet.LocalPref{Value: localPref},
+		)
+	} else if s.fourOctetAS.Load() || s.peer.localASN <= maxTwoOctetASN {
+		pathAttrs = append(pathAttrs, &packet.ASPath{Segments: s.asPath(attrs)})
+	} else {
+		// Peers without 4-octet AS support see AS_TRANS, the actual path is carried in AS4_PATH (RFC 6793)
+		pathAttrs = append(pathAttrs,
+			&packet.ASPath{Segments: prependedASPath(packet.ASTrans, attrs.ASPathPrepend)},
+			&packet.AS4Path{Segments: s.asPath(attrs)},
+		)
+	}
+
+	return append(pathAttrs, attrs.pathAttributes()...)
+}
+
+// asPath returns the AS path of routes advertised to the peer with the provided attributes, which is empty for
+// internal peers
+func (s *session) asPath(attrs RouteAttributes) []packet.ASPathSegment {
+	if s.isInternal() {
+		return nil
+	}
+	return prependedASPath(s.peer.localASN, attrs.ASPathPrepend)
+}
+
+// receiveUpdate stores the routes announced by the peer and accepted by its import policy in its Adj-RIB-In, removes
+// the withdrawn ones and runs the decision process for the affected prefixes. Routes of address families that were not
+// negotiated are ignored
+func (s *session) receiveUpdate(update *packet.Update) error {
+	if s.received == nil {
+		s.received = make(map[netip.Prefix]struct{})
+	}
+	received := s.receivedRoute(update)
+	importPolicy := s.peer.importPolicy.Load()
+
+	var changed []netip.Prefix
+	withdraw := func(fam family, prefixes []netip.Prefix) {
+		if _, ok := s.families[fam]; !ok {
+			return
+		}
+		for _, prefix := range prefixes {
+			delete(s.stale[fam], prefix)
+			delete(s.received, prefix)
+			if s.peer.adjRIBIn.delete(prefix) {
+				changed = append(changed, prefix)
+			}
+		}
+	}
+	announce := func(fam family, prefixes []netip.Prefix, nextHop netip.Addr) {
+		if _, ok := s.families[fam]; !ok {
+			return
+		}
+		for _, prefix := range prefixes {
+			delete(s.stale[fam], prefix)
+			s.received[prefix] = struct{}{}
+
+			var attrs RouteAttributes
+			accepted := false
+			if importPolicy != nil {
+				attrs, accepted = importPolicy.apply(prefix, received.Attributes)
+			}
+
+			if !accepted {
+				// The rejected route replaces the route previously accepted for the prefix
+				if s.peer.adjRIBIn.delete(prefix) {
+					changed = append(changed, prefix)
+				}
+				continue
+			}
+
+			route := received
+			route.Prefix, route.NextHop, route.Attributes = prefix, nextHop, attrs
+			s.peer.adjRIBIn.insert(route)
+			changed = append(changed, prefix)
+		}
+	}
+
+	withdraw(familyIPv4Unicast, update.WithdrawnRoutes)
+	for _, attr := range update.PathAttributes {
+		switch attr := attr.(type) {
+		case *packet.MPUnreachNLRI:
+			withdraw(family{afi: attr.AFI, safi: attr.SAFI}, attr.WithdrawnRoutes)
+		case *packet.MPReachNLRI:
+			var nextHop netip.Addr
+			if len(attr.NextHops) > 0 {
+				nextHop = attr.NextHops[0]
+			}
+			announce(family{afi: attr.AFI, safi: attr.SAFI}, attr.NLRI, nextHop)
+		}
+	}
+	if len(update.NLRI) > 0 {
+		var nextHop netip.Addr
+		if attr, ok := update.Attribute(packet.AttrCodeNextHop).(*packet.NextHop); ok {
+			nextHop = attr.Addr
+		}
+		announce(familyIPv4Unicast, update.NLRI, nextHop)
+	}
+
+	if len(changed) > 0 {
+		s.peer.selectRoutes(changed)
+	}
+
+	return s.checkMaxPrefixes()
+}
+
+// checkMaxPrefixes logs a warning once the number of routes received from the peer crosses the warning threshold, and
+// takes the configured action once it exceeds the limit. Routes rejected by the import policy are counted as well, so
+// that a peer flooding routes is limited even when the policy rejects them. Closing the session is reported with a Cease NOTIFICATION
+// (RFC 4486)
+func (s *session) checkMaxPrefixes() error {
+	limits := s.peer.maxPrefixes
+	if limits == nil {
+		return nil
+	}
+
+	count := len(s.received)
+	if count < limits.warning {
+		s.maxPrefixesWarned, s.maxPrefixesExceeded = false, false
+		return nil
+	}
+	if !s.maxPrefixesWarned {
+		s.maxPrefixesWarned = true
+		s.peer.logger.Info("BGP peer is approaching its maximum number of prefixes", "prefixes", count, "limit", limits.limit)
+	}
+
+	if count <= limits.limit {
+		s.maxPrefixesExceeded = false
+		return nil
+	}
+
+	err := fmt.Errorf("%w: %d prefixes received, limit is %d", errMaxPrefixesReached, count, limits.limit)
+	if limits.action != v1alphav1.MaxPrefixesActionLog {
+		return errors.Join(err, &packet.NotificationError{Code: packet.ErrCodeCease, Subcode: packet.ErrSubcodeMaxPrefixesReached})
+	}
+
+	if !s.maxPrefixesExceeded {
+		s.maxPrefixesExceeded = true
+		s.peer.logger.Error(err, "BGP peer exceeded its maximum number of prefixes")
+	}
+	return nil
+}
+
+// receivedRoute returns the route described by the path attributes of the UPDATE message, without prefix nor next
+// hop. LOCAL_PREF is only meaningful between internal peers, so it is ignored for external ones
+func (s *session) receivedRoute(update *packet.Update) Route {
+	route := Route{Peer: s.remoteAddr, Internal: s.isInternal()}
+
+	var as4Path []packet.ASPathSegment
+	for _, attr := range update.PathAttributes {
+		switch attr := attr.(type) {
+		case *packet.Origin:
+			route.Origin = attr.Value
+		case *packet.ASPath:
+			route.ASPath = attr.Segments
+		case *packet.AS4Path:
+			as4Path = attr.Segments
+		case *packet.LocalPref:
+			if route.Internal {
+				route.Attributes.LocalPref = &attr.Value
+			}
+		case *packet.MultiExitDisc:
+			route.Attributes.MED = &attr.Value
+		case *packet.Communities:
+			route.Attributes.Communities = attr.Values
+		case *packet.LargeCommunities:
+			route.Attributes.LargeCommunities = attr.Values
+		case *packet.ExtendedCommunities:
+			route.Attributes.ExtendedCommunities = attr.Values
+		}
+	}
+
+	// AS4_PATH is only sent by peers without 4-octet AS support, it must be ignored otherwise (RFC 6793)
+	if as4Path != nil && !s.fourOctetAS.Load() {
+		route.ASPath = mergeAS4Path(route.ASPath, as4Path)
+	}
+
+	return route
+}
+
+// keepaliveInterval returns the interval between KEEPALIVE messages, which must not exceed a third of the negotiated
+// hold time
+func (s *session) keepaliveInterval() time.Duration {
+	if s.peer.keepaliveTime > 0 {
+		return min(s.peer.keepaliveTime, s.holdTime/3)
+	}
+	return s.holdTime / 3
+}
+
+func (s *session) isInternal() bool {
+	return s.peer.asn == s.peer.localASN
+}
+
+func (s *session) resetHoldTimer() {
+	s.holdTimer.Stop()
+	if s.holdTime > 0 {
+		s.holdTimer.Reset(s.holdTime)
+	}
+}
+
+func (s *session) stopTimers() {
+	s.holdTimer.Stop()
+	if s.keepalive != nil {
+		s.keepalive.Stop()
+	}
+}
+
+func (s *session) readLoop(done <-chan struct{}, msgCh chan<- packet.Message, errCh chan<- error) {
+	for {
+		msg, err := s.options().ReadMessage(s.conn)
+		if err != nil {
+			errCh <- err
+			return
+		}
+
+		select {
+		case msgCh <- msg:
+		case <-done:
+			return
+		}
+	}
+}
+
+// options returns the encoding options negotiated with the peer
+func (s *session) options() packet.Options {
+	opts := packet.Options{FourOctetAS: s.fourOctetAS.Load()}
+	if addPath := s.addPath.Load(); addPath != nil {
+		opts.AddPath = *addPath
+	}
+	return opts
+}
+
+// send encodes and writes the message to the peer
+func (s *session) send(msg packet.Message) error {
+	data, err := s.options().Marshal(msg)
+	if err != nil {
+		return err
+	}
+
+	if err = s.conn.SetWriteDeadline(time.Now().Add(writeTimeout)); err != nil {
+		return err
+	}
+
+	if _, err = s.conn.Write(data); err != nil {
+		return fmt.Errorf("failed to send %s message: %w", msg.Type(), err)
+	}
+
+	return nil
+}
+
+// fail notifies the peer about the error when required by the protocol and returns it
+func (s *session) fail(err error) error {
+	var notification *packet.NotificationError
+	if errors.As(err, &notification) {
+		s.sendNotification(notification)
+	}
+
+	return err
+}
+
+// shutdown closes the session with a Cease NOTIFICATION carrying the reason of the shutdown (RFC 8203)
+func (s *session) shutdown() {
+	s.sendNotification(&packet.NotificationError{
+		Code:    packet.ErrCodeCease,
+		Subcode: packet.ErrSubcodeAdministrativeShutdown,
+		Data:    packet.ShutdownCommunication(shutdownReason),
+	})
+}
+
+func (s *session) sendNotification(notification *packet.NotificationError) {
+	if err := s.send(notification.Notification()); err != nil {
+		s.peer.logger.Error(err, "Failed to send NOTIFICATION message")
+	}
+}
+
+// peerASN returns the AS number of the peer, taken from the 4-octet AS capability when present, and whether the
+// peer supports 4-octet AS numbers
+func peerASN(open *packet.Open) (uint32, bool) {
+	for _, capability := range open.Capabilities {
+		if fourOctetAS, ok := capability.(*packet.CapFourOctetAS); ok {
+			return fourOctetAS.ASN, true
+		}
+	}
+
+	return uint32(open.MyAS), false
+}
+
+// hasCapability reports whether the peer advertised the capability in its OPEN message
+func hasCapability(open *packet.Open, code packet.CapabilityCode) bool {
+	return slices.ContainsFunc(open.Capabilities, func(capability packet.Capability) bool {
+		return capability.Code() == code
+	})
+}
+
+// twoOctetASN returns the AS number to be used where only 2-octet AS numbers fit, AS_TRANS for 4-octet ones
+func twoOctetASN(asn uint32) uint16 {
+	if asn > maxTwoOctetASN {
+		return uint16(packet.ASTrans)
+	}
+	return uint16(asn)
+}
+
+// routerID derives the BGP identifier from the local address of the session. RFC 6286 only requires the identifier
+// to be a non-zero 4-octet value, so IPv6 addresses are hashed
+func routerID(addr netip.Addr) [4]byte {
+	if addr.Is4() {
+		return addr.As4()
+	}
+
+	hasher := fnv.New32a()
+	_, _ = hasher.Write(addr.AsSlice())
+
+	var id [4]byte
+	binary.BigEndian.PutUint32(id[:], max(hasher.Sum32(), 1))
+	return id
+}
+
+// addPathCapability returns the ADD-PATH capability advertised to the peers. The speaker only sends multiple paths, as
+// it keeps a single route per prefix received from each peer
+func addPathCapability() *packet.CapAddPath {
+	capability := &packet.CapAddPath{}
+	for _, fam := range supportedFamilies {
+		capability.Families = append(capability.Families, packet.AddPathFamily{AFI: fam.afi, SAFI: fam.safi, Mode: packet.AddPathSend})
+	}
+	return capability
+}
+
+// nodePathID derives the path identifier of the routes of the node from its name, so that the routes advertised by
+// different nodes for the same prefixes are told apart by the peers that receive all of them
+func nodePathID(nodeName string) uint32 {
+	hasher := fnv.New32a()
+	_, _ = hasher.Write([]byte(nodeName))
+	return hasher.Sum32()
+}
+
+// prependedASPath returns an AS path containing the AS number, prepended the given number of times
+func prependedASPath(asn uint32, prepend int) []packet.ASPathSegment {
+	return []packet.ASPathSegment{{Type: packet.ASSequence, ASNs: slices.Repeat([]uint32{asn}, 1+prepend)}}
+}
+
+func comparePrefixes(a, b netip.Prefix) int {
+	if c := a.Addr().Compare(b.Addr()); c != 0 {
+		return c
+	}
+	return a.Bits() - b.Bits()
+}
@@ -0,0 +1,1275 @@
+package bgp
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"maps"
+	"net"
+	"net/netip"
+	"path/filepath"
+	"reflect"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/go-logr/logr"
+	"github.com/yago-123/routebird/api/v1alphav1"
+	"github.com/yago-123/routebird/internal/agent/bgp/packet"
+	corev1 "k8s.io/api/core/v1"
+
+	cfg "github.com/yago-123/routebird/internal/common"
+)
+
+// fakePeer accepts a single BGP session and exposes helpers to drive it from the remote side
+type fakePeer struct {
+	t    *testing.T
+	conn net.Conn
+	opts packet.Options
+}
+
+func (f *fakePeer) expect(msgType packet.Type) packet.Message {
+	f.t.Helper()
+
+	if err := f.conn.SetReadDeadline(time.Now().Add(5 * time.Second)); err != nil {
+		f.t.Fatalf("failed to set read deadline: %v", err)
+	}
+
+	msg, err := f.opts.ReadMessage(f.conn)
+	if err != nil {
+		f.t.Fatalf("failed to read message: %v", err)
+	}
+	if msg.Type() != msgType {
+		f.t.Fatalf("expected %s message, got %s", msgType, msg.Type())
+	}
+
+	return msg
+}
+
+func (f *fakePeer) send(msg packet.Message) {
+	f.t.Helper()
+
+	data, err := f.opts.Marshal(msg)
+	if err != nil {
+		f.t.Fatalf("failed to marshal message: %v", err)
+	}
+	if _, err = f.conn.Write(data); err != nil {
+		f.t.Fatalf("failed to write message: %v", err)
+	}
+}
+
+func newTestManager(t *testing.T, localASN, peerASN uint32) (*manager, *fakePeer, context.CancelFunc) {
+	t.Helper()
+
+	return newTestManagerWithConfig(t, cfg.Config{
+		LocalASN: localASN,
+		Peers:    []v1alphav1.BGPPeer{{Address: "127.0.0.1", ASN: peerASN}},
+	})
+}
+
+// newTestManagerWithConfig runs a manager with a single peer, redirected to a fake peer listening on localhost
+func newTestManagerWithConfig(t *testing.T, config cfg.Config) (*manager, *fakePeer, context.CancelFunc) {
+	t.Helper()
+
+	mgr, remote, cancel := runTestManager(t, config, false)
+	return mgr, remote, func() { cancel(nil) }
+}
+
+// runTestManager runs a manager with a single peer as newTestManagerWithConfig, optionally replacing a manager stopped
+// for graceful restart
+func runTestManager(t *testing.T, config cfg.Config, restarting bool) (*manager, *fakePeer, context.CancelCauseFunc) {
+	t.Helper()
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	t.Cleanup(func() { _ = listener.Close() })
+
+	mgr, err := newManager(config, "node", restarting, nil, logr.Discard())
+	if err != nil {
+		t.Fatalf("failed to create manager: %v", err)
+	}
+	mgr.peers[0].remote = netip.MustParseAddrPort(listener.Addr().String())
+
+	ctx, cancel := context.WithCancelCause(context.Background())
+	go func() { _ = mgr.Run(ctx) }()
+
+	conn, err := listener.Accept()
+	if err != nil {
+		t.Fatalf("failed to accept connection: %v", err)
+	}
+	t.Cleanup(func() { _ = conn.Close() })
+
+	return mgr, &fakePeer{t: t, conn: conn}, cancel
+}
+
+func TestSessionEstablishAndAnnounce(t *testing.T) {
+	mgr, remote, cancel := newTestManager(t, 65000, 65001)
+	defer cancel()
+
+	for _, route := range []string{"10.0.0.1", "2001:db8::1"} {
+		if err := mgr.AnnounceRoute(route, RouteAttributes{}); err != nil {
+			t.Fatalf("failed to announce route: %v", err)
+		}
+	}
+
+	capabilities := []packet.Capability{
+		&packet.CapMultiprotocol{AFI: packet.AFIIPv4, SAFI: packet.SAFIUnicast},
+		&packet.CapMultiprotocol{AFI: packet.AFIIPv6, SAFI: packet.SAFIUnicast},
+	}
+
+	open := remote.expect(packet.TypeOpen).(*packet.Open)
+	if open.MyAS != 65000 || open.HoldTime != 90 || open.BGPIdentifier != [4]byte{127, 0, 0, 1} {
+		t.Fatalf("unexpected OPEN message: %+v", open)
+	}
+	expectedCapabilities := slices.Concat(capabilities, []packet.Capability{
+		&packet.CapRouteRefresh{},
+		&packet.CapEnhancedRouteRefresh{},
+		&packet.CapFourOctetAS{ASN: 65000},
+		&packet.CapAddPath{Families: []packet.AddPathFamily{
+			{AFI: packet.AFIIPv4, SAFI: packet.SAFIUnicast, Mode: packet.AddPathSend},
+			{AFI: packet.AFIIPv6, SAFI: packet.SAFIUnicast, Mode: packet.AddPathSend},
+		}},
+	})
+	if !reflect.DeepEqual(open.Capabilities, expectedCapabilities) {
+		t.Fatalf("unexpected OPEN capabilities: %#v", open.Capabilities)
+	}
+
+	remote.send(&packet.Open{
+		Version:       bgpVersion,
+		MyAS:          65001,
+		HoldTime:      30,
+		BGPIdentifier: [4]byte{192, 0, 2, 1},
+		Capabilities:  append(capabilities, &packet.CapFourOctetAS{ASN: 65001}),
+	})
+	remote.opts = packet.Options{FourOctetAS: true}
+	remote.expect(packet.TypeKeepalive)
+	remote.send(&packet.Keepalive{})
+
+	asPath := &packet.ASPath{Segments: []packet.ASPathSegment{{Type: packet.ASSequence, ASNs: []uint32{65000}}}}
+	update := remote.expect(packet.TypeUpdate).(*packet.Update)
+	expected := &packet.Update{
+		PathAttributes: []packet.PathAttribute{
+			&packet.Origin{Value: packet.OriginIGP},
+			asPath,
+			&packet.NextHop{Addr: netip.MustParseAddr("127.0.0.1")},
+		},
+		NLRI: []netip.Prefix{netip.MustParsePrefix("10.0.0.1/32")},
+	}
+	if !reflect.DeepEqual(update, expected) {
+		t.Fatalf("unexpected UPDATE message: %#v", update)
+	}
+
+	// IPv6 routes are advertised over the IPv4 session with the IPv4-mapped local address as next hop
+	update = remote.expect(packet.TypeUpdate).(*packet.Update)
+	expectedIPv6 := &packet.Update{
+		PathAttributes: []packet.PathAttribute{
+			&packet.Origin{Value: packet.OriginIGP},
+			asPath,
+			&packet.MPReachNLRI{
+				AFI:      packet.AFIIPv6,
+				SAFI:     packet.SAFIUnicast,
+				NextHops: []netip.Addr{netip.MustParseAddr("::ffff:127.0.0.1")},
+				NLRI:     []netip.Prefix{netip.MustParsePrefix("2001:db8::1/128")},
+			},
+		},
+	}
+	if !reflect.DeepEqual(update, expectedIPv6) {
+		t.Fatalf("unexpected IPv6 UPDATE message: %#v", update)
+	}
+	if mgr.peers[0].State() != StateEstablished {
+		t.Fatalf("expected session to be established, got %s", mgr.peers[0].State())
+	}
+
+	if err := mgr.WithdrawRoute("10.0.0.1/32"); err != nil {
+		t.Fatalf("failed to withdraw route: %v", err)
+	}
+	withdraw := remote.expect(packet.TypeUpdate).(*packet.Update)
+	if !reflect.DeepEqual(withdraw, &packet.Update{WithdrawnRoutes: expected.NLRI}) {
+		t.Fatalf("unexpected withdraw UPDATE: %#v", withdraw)
+	}
+
+	if err := mgr.WithdrawRoute("2001:db8::1"); err != nil {
+		t.Fatalf("failed to withdraw route: %v", err)
+	}
+	withdraw = remote.expect(packet.TypeUpdate).(*packet.Update)
+	expectedWithdraw := &packet.Update{PathAttributes: []packet.PathAttribute{&packet.MPUnreachNLRI{
+		AFI:             packet.AFIIPv6,
+		SAFI:            packet.SAFIUnicast,
+		WithdrawnRoutes: []netip.Prefix{netip.MustParsePrefix("2001:db8::1/128")},
+	}}}
+	if !reflect.DeepEqual(withdraw, expectedWithdraw) {
+		t.Fatalf("unexpected IPv6 withdraw UPDATE: %#v", withdraw)
+	}
+
+	cancel()
+	notification := remote.expect(packet.TypeNotification).(*packet.Notification)
+	if notification.Code != packet.ErrCodeCease || notification.Subcode != packet.ErrSubcodeAdministrativeShutdown {
+		t.Fatalf("expected administrative shutdown, got %+v", notification)
+	}
+}
+
+func TestSessionDrainsOnShutdown(t *testing.T) {
+	mgr, remote, cancel := newTestManagerWithConfig(t, cfg.Config{
+		LocalASN:             65000,
+		Peers:                []v1alphav1.BGPPeer{{Address: "127.0.0.1", ASN: 65001}},
+		DrainIntervalSeconds: 1,
+	})
+	defer cancel()
+
+	if err := mgr.AnnounceRoute("10.0.0.1", RouteAttributes{}); err != nil {
+		t.Fatalf("failed to announce route: %v", err)
+	}
+
+	remote.expect(packet.TypeOpen)
+	remote.send(&packet.Open{Version: bgpVersion, MyAS: 65001, HoldTime: 30, BGPIdentifier: [4]byte{192, 0, 2, 1}})
+	remote.expect(packet.TypeKeepalive)
+	remote.send(&packet.Keepalive{})
+	remote.expect(packet.TypeUpdate)
+
+	cancel()
+	stopped := time.Now()
+
+	// Routes are withdrawn right away, while the session is kept up until the drain interval elapses
+	withdraw := remote.expect(packet.TypeUpdate).(*packet.Update)
+	if !reflect.DeepEqual(withdraw, &packet.Update{WithdrawnRoutes: []netip.Prefix{netip.MustParsePrefix("10.0.0.1/32")}}) {
+		t.Fatalf("unexpected withdraw UPDATE: %#v", withdraw)
+	}
+
+	notification := remote.expect(packet.TypeNotification).(*packet.Notification)
+	if elapsed := time.Since(stopped); elapsed < time.Second {
+		t.Fatalf("session closed after %s, before the drain interval", elapsed)
+	}
+	if reason, ok := notification.ShutdownCommunication(); !ok || reason != shutdownReason {
+		t.Fatalf("expected administrative shutdown with reason, got %+v", notification)
+	}
+}
+
+func TestSessionGracefulRestart(t *testing.T) {
+	mgr, remote, cancel := runTestManager(t, cfg.Config{
+		LocalASN:             65000,
+		Peers:                []v1alphav1.BGPPeer{{Address: "127.0.0.1", ASN: 65001}},
+		GracefulRestart:      &v1alphav1.GracefulRestart{RestartTimeSeconds: 120},
+		DrainIntervalSeconds: 10,
+	}, true)
+	defer cancel(nil)
+
+	if err := mgr.AnnounceRoute("10.0.0.1", RouteAttributes{}); err != nil {
+		t.Fatalf("failed to announce route: %v", err)
+	}
+
+	open := remote.expect(packet.TypeOpen).(*packet.Open)
+	expectedCapability := &packet.CapGracefulRestart{
+		Restarting:  true,
+		RestartTime: 120,
+		Families: []packet.GracefulRestartFamily{
+			{AFI: packet.AFIIPv4, SAFI: packet.SAFIUnicast, ForwardingState: true},
+			{AFI: packet.AFIIPv6, SAFI: packet.SAFIUnicast, ForwardingState: true},
+		},
+	}
+	if !slices.ContainsFunc(open.Capabilities, func(capability packet.Capability) bool {
+		return reflect.DeepEqual(capability, expectedCapability)
+	}) {
+		t.Fatalf("expected graceful restart capability, got %#v", open.Capabilities)
+	}
+
+	// The peer only supports the receiving side of graceful restart, which is enough for it to retain our routes
+	remote.send(&packet.Open{
+		Version:       bgpVersion,
+		MyAS:          65001,
+		HoldTime:      30,
+		BGPIdentifier: [4]byte{192, 0, 2, 1},
+		Capabilities:  []packet.Capability{&packet.CapGracefulRestart{RestartTime: 120}},
+	})
+	remote.expect(packet.TypeKeepalive)
+	remote.send(&packet.Keepalive{})
+
+	if update := remote.expect(packet.TypeUpdate).(*packet.Update); len(update.NLRI) != 1 {
+		t.Fatalf("unexpected UPDATE message: %#v", update)
+	}
+	if endOfRIB := remote.expect(packet.TypeUpdate).(*packet.Update); !reflect.DeepEqual(endOfRIB, packet.EndOfRIB(packet.AFIIPv4, packet.SAFIUnicast)) {
+		t.Fatalf("expected End-of-RIB marker, got %#v", endOfRIB)
+	}
+
+	// On restart the connection is closed right away, without withdrawing the routes nor sending a NOTIFICATION
+	cancel(ErrRestart)
+	if err := remote.conn.SetReadDeadline(time.Now().Add(5 * time.Second)); err != nil {
+		t.Fatalf("failed to set read deadline: %v", err)
+	}
+	if msg, err := remote.opts.ReadMessage(remote.conn); !errors.Is(err, io.EOF) {
+		t.Fatalf("expected connection to be closed, got %#v, %v", msg, err)
+	}
+}
+
+func TestSessionGracefulRestartDrainsOnShutdown(t *testing.T) {
+	mgr, remote, cancel := newTestManagerWithConfig(t, cfg.Config{
+		LocalASN:             65000,
+		Peers:                []v1alphav1.BGPPeer{{Address: "127.0.0.1", ASN: 65001}},
+		GracefulRestart:      &v1alphav1.GracefulRestart{RestartTimeSeconds: 120},
+		DrainIntervalSeconds: 1,
+	})
+	defer cancel()
+
+	if err := mgr.AnnounceRoute("10.0.0.1", RouteAttributes{}); err != nil {
+		t.Fatalf("failed to announce route: %v", err)
+	}
+
+	// The first session of a manager that did not replace another one is not flagged as a restart, as the peer does
+	// not retain any route of the speaker
+	open := remote.expect(packet.TypeOpen).(*packet.Open)
+	if !slices.ContainsFunc(open.Capabilities, func(capability packet.Capability) bool {
+		gr, ok := capability.(*packet.CapGracefulRestart)
+		return ok && !gr.Restarting
+	}) {
+		t.Fatalf("expected graceful restart capability without restart flag, got %#v", open.Capabilities)
+	}
+
+	remote.send(&packet.Open{
+		Version:       bgpVersion,
+		MyAS:          65001,
+		HoldTime:      30,
+		BGPIdentifier: [4]byte{192, 0, 2, 1},
+		Capabilities:  []packet.Capability{&packet.CapGracefulRestart{RestartTime: 120}},
+	})
+	remote.expect(packet.TypeKeepalive)
+	remote.send(&packet.Keepalive{})
+	remote.expect(packet.TypeUpdate)
+	remote.expect(packet.TypeUpdate)
+
+	// Stopping the agent drains the session even though graceful restart was negotiated
+	cancel()
+	withdraw := remote.expect(packet.TypeUpdate).(*packet.Update)
+	if !reflect.DeepEqual(withdraw, &packet.Update{WithdrawnRoutes: []netip.Prefix{netip.MustParsePrefix("10.0.0.1/32")}}) {
+		t.Fatalf("unexpected withdraw UPDATE: %#v", withdraw)
+	}
+	remote.expect(packet.TypeNotification)
+}
+
+func TestSessionRouteAttributes(t *testing.T) {
+	mgr, remote, cancel := newTestManager(t, 65000, 65001)
+	defer cancel()
+
+	med := uint32(50)
+	attrs := RouteAttributes{
+		Communities:   []uint32{packet.CommunityNoExport},
+		MED:           &med,
+		ASPathPrepend: 2,
+		NextHopIPv4:   netip.MustParseAddr("192.0.2.10"),
+	}
+	if err := mgr.AnnounceRoute("10.0.0.1", attrs); err != nil {
+		t.Fatalf("failed to announce route: %v", err)
+	}
+
+	remote.expect(packet.TypeOpen)
+	remote.send(&packet.Open{Version: bgpVersion, MyAS: 65001, HoldTime: 30, BGPIdentifier: [4]byte{192, 0, 2, 1}})
+	remote.expect(packet.TypeKeepalive)
+	remote.send(&packet.Keepalive{})
+
+	update := remote.expect(packet.TypeUpdate).(*packet.Update)
+	expected := &packet.Update{
+		PathAttributes: []packet.PathAttribute{
+			&packet.Origin{Value: packet.OriginIGP},
+			&packet.ASPath{Segments: []packet.ASPathSegment{{Type: packet.ASSequence, ASNs: []uint32{65000, 65000, 65000}}}},
+			&packet.NextHop{Addr: netip.MustParseAddr("192.0.2.10")},
+			&packet.MultiExitDisc{Value: 50},
+			&packet.Communities{Values: []uint32{packet.CommunityNoExport}},
+		},
+		NLRI: []netip.Prefix{netip.MustParsePrefix("10.0.0.1/32")},
+	}
+	if !reflect.DeepEqual(update, expected) {
+		t.Fatalf("unexpected UPDATE message: %#v", update)
+	}
+
+	// Changing the attributes of the route announces it again, replacing the previous announcement
+	attrs.MED = nil
+	if err := mgr.AnnounceRoute("10.0.0.1", attrs); err != nil {
+		t.Fatalf("failed to announce route: %v", err)
+	}
+	update = remote.expect(packet.TypeUpdate).(*packet.Update)
+	if update.Attribute(packet.AttrCodeMultiExitDisc) != nil || !reflect.DeepEqual(update.NLRI, expected.NLRI) {
+		t.Fatalf("expected route to be announced again without MED, got %#v", update)
+	}
+}
+
+func TestSessionRIBs(t *testing.T) {
+	mgr, remote, cancel := newTestManagerWithConfig(t, cfg.Config{
+		LocalASN: 65000,
+		Peers:    []v1alphav1.BGPPeer{{Address: "127.0.0.1", ASN: 65001, ImportPolicy: "accept"}},
+		Policies: []v1alphav1.Policy{{Name: "accept", DefaultAction: v1alphav1.PolicyActionAccept}},
+	})
+	defer cancel()
+
+	if err := mgr.AnnounceRoute("10.0.0.1", RouteAttributes{}); err != nil {
+		t.Fatalf("failed to announce route: %v", err)
+	}
+
+	remote.expect(packet.TypeOpen)
+	remote.send(&packet.Open{Version: bgpVersion, MyAS: 65001, HoldTime: 30, BGPIdentifier: [4]byte{192, 0, 2, 1}})
+	remote.expect(packet.TypeKeepalive)
+	remote.send(&packet.Keepalive{})
+	remote.expect(packet.TypeUpdate)
+
+	received := func(asns ...uint32) []packet.PathAttribute {
+		return []packet.PathAttribute{
+			&packet.Origin{Value: packet.OriginIGP},
+			&packet.ASPath{Segments: []packet.ASPathSegment{{Type: packet.ASSequence, ASNs: asns}}},
+			&packet.NextHop{Addr: netip.MustParseAddr("192.0.2.1")},
+		}
+	}
+	remote.send(&packet.Update{PathAttributes: received(65001), NLRI: []netip.Prefix{
+		netip.MustParsePrefix("0.0.0.0/0"),
+		netip.MustParsePrefix("10.0.0.1/32"),
+	}})
+	// Routes looping through the local AS are stored but never selected
+	remote.send(&packet.Update{PathAttributes: received(65001, 65000), NLRI: []netip.Prefix{netip.MustParsePrefix("198.51.100.0/24")}})
+
+	peer := mgr.peers[0].remote.Addr()
+	waitForRIB := func(description string, ready func() bool) {
+		t.Helper()
+		for range 50 {
+			if ready() {
+				return
+			}
+			time.Sleep(100 * time.Millisecond)
+		}
+		t.Fatalf("timed out waiting for %s", description)
+	}
+	waitForRIB("received routes", func() bool { return len(mgr.AdjRIBIn()[peer.String()]) == 3 })
+
+	locRIB := mgr.LocRIB()
+	if len(locRIB) != 2 || locRIB[0].Prefix.String() != "0.0.0.0/0" || locRIB[0].Peer != peer || locRIB[1].Peer.IsValid() {
+		t.Fatalf("expected the received default route and the local route to be selected, got %+v", locRIB)
+	}
+	route, ok, err := mgr.LookupRoute("203.0.113.1")
+	if err != nil || !ok || route.NextHop != netip.MustParseAddr("192.0.2.1") {
+		t.Fatalf("expected lookup to return the default route, got %+v, %t, %v", route, ok, err)
+	}
+
+	adjRIBOut := mgr.AdjRIBOut()[peer.String()]
+	if len(adjRIBOut) != 1 || adjRIBOut[0].Prefix.String() != "10.0.0.1/32" || adjRIBOut[0].NextHop != netip.MustParseAddr("127.0.0.1") {
+		t.Fatalf("unexpected Adj-RIB-Out: %+v", adjRIBOut)
+	}
+
+	// Withdrawing the local route selects the one received from the peer
+	if err = mgr.WithdrawRoute("10.0.0.1"); err != nil {
+		t.Fatalf("failed to withdraw route: %v", err)
+	}
+	remote.expect(packet.TypeUpdate)
+	if route, _, _ = mgr.LookupRoute("10.0.0.1"); route.Prefix.String() != "10.0.0.1/32" || route.Peer != peer {
+		t.Fatalf("expected the received route to be selected, got %+v", route)
+	}
+
+	remote.send(&packet.Update{WithdrawnRoutes: []netip.Prefix{netip.MustParsePrefix("0.0.0.0/0")}})
+	waitForRIB("withdrawn routes", func() bool {
+		_, ok, _ = mgr.LookupRoute("203.0.113.1")
+		return !ok
+	})
+	if adjRIBIn := mgr.AdjRIBIn()[peer.String()]; len(adjRIBIn) != 2 {
+		t.Fatalf("expected the withdrawn route to be removed from the Adj-RIB-In, got %+v", adjRIBIn)
+	}
+}
+
+func TestSessionRouteRefresh(t *testing.T) {
+	config := cfg.Config{
+		LocalASN: 65000,
+		Peers:    []v1alphav1.BGPPeer{{Address: "127.0.0.1", ASN: 65001, ExportPolicy: "export", ImportPolicy: "import"}},
+		Policies: []v1alphav1.Policy{
+			{Name: "export", DefaultAction: v1alphav1.PolicyActionAccept},
+			{Name: "import", DefaultAction: v1alphav1.PolicyActionAccept},
+		},
+	}
+	mgr, remote, cancel := newTestManagerWithConfig(t, config)
+	defer cancel()
+
+	if err := mgr.AnnounceRoute("10.0.0.1", RouteAttributes{}); err != nil {
+		t.Fatalf("failed to announce route: %v", err)
+	}
+
+	remote.expect(packet.TypeOpen)
+	remote.send(&packet.Open{
+		Version:       bgpVersion,
+		MyAS:          65001,
+		HoldTime:      30,
+		BGPIdentifier: [4]byte{192, 0, 2, 1},
+		Capabilities:  []packet.Capability{&packet.CapRouteRefresh{}, &packet.CapEnhancedRouteRefresh{}},
+	})
+	remote.expect(packet.TypeKeepalive)
+	remote.send(&packet.Keepalive{})
+	remote.expect(packet.TypeUpdate)
+
+	refresh := func(subtype uint8) *packet.RouteRefresh {
+		return &packet.RouteRefresh{AFI: packet.AFIIPv4, Subtype: subtype, SAFI: packet.SAFIUnicast}
+	}
+	expectRefresh := func(subtype uint8) {
+		t.Helper()
+		if msg := remote.expect(packet.TypeRouteRefresh); !reflect.DeepEqual(msg, refresh(subtype)) {
+			t.Fatalf("expected ROUTE-REFRESH with subtype %d, got %#v", subtype, msg)
+		}
+	}
+
+	// A refresh request is answered with every route, within the markers of an enhanced route refresh
+	remote.send(refresh(packet.RouteRefreshRequest))
+	expectRefresh(packet.RouteRefreshBegin)
+	if update := remote.expect(packet.TypeUpdate).(*packet.Update); len(update.NLRI) != 1 {
+		t.Fatalf("expected the route to be advertised again, got %#v", update)
+	}
+	expectRefresh(packet.RouteRefreshEnd)
+
+	// Routes that are not advertised again during an enhanced route refresh of the peer are removed
+	attrs := []packet.PathAttribute{
+		&packet.Origin{Value: packet.OriginIGP},
+		&packet.ASPath{Segments: []packet.ASPathSegment{{Type: packet.ASSequence, ASNs: []uint32{65001}}}},
+		&packet.NextHop{Addr: netip.MustParseAddr("192.0.2.1")},
+	}
+	remote.send(&packet.Update{PathAttributes: attrs, NLRI: []netip.Prefix{
+		netip.MustParsePrefix("198.51.100.0/24"),
+		netip.MustParsePrefix("203.0.113.0/24"),
+	}})
+	remote.send(refresh(packet.RouteRefreshBegin))
+	remote.send(&packet.Update{PathAttributes: attrs, NLRI: []netip.Prefix{netip.MustParsePrefix("203.0.113.0/24")}})
+	remote.send(refresh(packet.RouteRefreshEnd))
+
+	// Both routes are received before the refresh begins, so the stale one is only missing once the refresh ended
+	peer := mgr.peers[0].remote.Addr().String()
+	for range 50 {
+		if _, ok, _ := mgr.LookupRoute("203.0.113.1"); ok {
+			if _, ok, _ = mgr.LookupRoute("198.51.100.1"); !ok {
+				break
+			}
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	if adjRIBIn := mgr.AdjRIBIn()[peer]; len(adjRIBIn) != 1 || adjRIBIn[0].Prefix.String() != "203.0.113.0/24" {
+		t.Fatalf("expected the stale route to be removed, got %+v", adjRIBIn)
+	}
+
+	// Updated policies withdraw the rejected routes and request the routes of the peer again, keeping the session
+	config.Policies[0].DefaultAction = v1alphav1.PolicyActionReject
+	if err := mgr.UpdatePolicies(config); err != nil {
+		t.Fatalf("failed to update policies: %v", err)
+	}
+	expectRefresh(packet.RouteRefreshBegin)
+	if update := remote.expect(packet.TypeUpdate).(*packet.Update); len(update.WithdrawnRoutes) != 1 {
+		t.Fatalf("expected the route to be withdrawn, got %#v", update)
+	}
+	expectRefresh(packet.RouteRefreshEnd)
+	expectRefresh(packet.RouteRefreshRequest)
+
+	config.Peers[0].ImportPolicy = "missing"
+	if err := mgr.UpdatePolicies(config); err == nil {
+		t.Fatalf("expected policies referencing an unknown policy to be rejected")
+	}
+}
+
+func TestReceiveUpdate(t *testing.T) {
+	p, err := newPeer(v1alphav1.BGPPeer{
+		Address:     "192.0.2.1",
+		ASN:         65001,
+		MaxPrefixes: &v1alphav1.MaxPrefixes{Limit: 2, Action: v1alphav1.MaxPrefixesActionRestart},
+	}, speakerConfig{localASN: 65000}, nil, func([]netip.Prefix) {}, logr.Discard())
+	if err != nil {
+		t.Fatalf("failed to create peer: %v", err)
+	}
+	s := &session{peer: p, families: map[family]struct{}{familyIPv4Unicast: {}}}
+
+	update := func(prefixes ...string) *packet.Update {
+		u := &packet.Update{PathAttributes: []packet.PathAttribute{
+			&packet.Origin{Value: packet.OriginIGP},
+			&packet.ASPath{Segments: []packet.ASPathSegment{{Type: packet.ASSequence, ASNs: []uint32{65001}}}},
+			&packet.NextHop{Addr: netip.MustParseAddr("192.0.2.1")},
+			&packet.LocalPref{Value: 300},
+		}}
+		for _, prefix := range prefixes {
+			u.NLRI = append(u.NLRI, netip.MustParsePrefix(prefix))
+		}
+		return u
+	}
+
+	// Every route is rejected without import policy
+	if err = s.receiveUpdate(update("10.0.0.0/24", "10.1.0.0/24")); err != nil || p.adjRIBIn.len() != 0 {
+		t.Fatalf("expected routes to be rejected without error, got %d routes, %v", p.adjRIBIn.len(), err)
+	}
+	if err = s.receiveUpdate(&packet.Update{WithdrawnRoutes: []netip.Prefix{netip.MustParsePrefix("10.1.0.0/24")}}); err != nil {
+		t.Fatalf("failed to receive withdraw: %v", err)
+	}
+
+	localPref := uint32(200)
+	policies, err := newPolicies(nil, []v1alphav1.Policy{{
+		Name: "import",
+		Statements: []v1alphav1.PolicyStatement{{
+			Match: v1alphav1.PolicyMatch{PrefixLength: &v1alphav1.PrefixLengthRange{Min: 24, Max: 24}},
+			Set:   &v1alphav1.PolicySet{LocalPreference: &localPref},
+		}},
+	}})
+	if err != nil {
+		t.Fatalf("failed to compile policies: %v", err)
+	}
+	p.importPolicy.Store(policies["import"])
+
+	// LOCAL_PREF received from external peers is ignored, the one set by the import policy is kept
+	if err = s.receiveUpdate(update("10.0.0.0/24", "10.1.0.0/16")); err != nil {
+		t.Fatalf("failed to receive update: %v", err)
+	}
+	routes := p.adjRIBIn.routes()
+	if len(routes) != 1 || routes[0].Prefix.String() != "10.0.0.0/24" || routes[0].localPref() != 200 {
+		t.Fatalf("expected the routes accepted by the import policy, got %+v", routes)
+	}
+
+	// Routes rejected by the import policy count against the limit as well
+	err = s.receiveUpdate(update("10.3.0.0/16"))
+	var notification *packet.NotificationError
+	if !errors.Is(err, errMaxPrefixesReached) || !errors.As(err, &notification) || notification.Subcode != packet.ErrSubcodeMaxPrefixesReached {
+		t.Fatalf("expected the session to be closed once the limit is exceeded, got %v", err)
+	}
+}
+
+func TestSessionWithoutMultiprotocolCapability(t *testing.T) {
+	mgr, remote, cancel := newTestManager(t, 65000, 65001)
+	defer cancel()
+
+	for _, route := range []string{"2001:db8::1", "10.0.0.1"} {
+		if err := mgr.AnnounceRoute(route, RouteAttributes{}); err != nil {
+			t.Fatalf("failed to announce route: %v", err)
+		}
+	}
+
+	remote.expect(packet.TypeOpen)
+	remote.send(&packet.Open{Version: bgpVersion, MyAS: 65001, HoldTime: 30, BGPIdentifier: [4]byte{192, 0, 2, 1}})
+	remote.expect(packet.TypeKeepalive)
+	remote.send(&packet.Keepalive{})
+
+	// Peers without multiprotocol capabilities only support IPv4 unicast, so the IPv6 route is never advertised
+	update := remote.expect(packet.TypeUpdate).(*packet.Update)
+	if update.Attribute(packet.AttrCodeMPReachNLRI) != nil || !reflect.DeepEqual(update.NLRI, []netip.Prefix{netip.MustParsePrefix("10.0.0.1/32")}) {
+		t.Fatalf("unexpected UPDATE message: %#v", update)
+	}
+
+	if err := mgr.WithdrawRoute("10.0.0.1"); err != nil {
+		t.Fatalf("failed to withdraw route: %v", err)
+	}
+	withdraw := remote.expect(packet.TypeUpdate).(*packet.Update)
+	if !reflect.DeepEqual(withdraw, &packet.Update{WithdrawnRoutes: update.NLRI}) {
+		t.Fatalf("unexpected withdraw UPDATE: %#v", withdraw)
+	}
+}
+
+func TestSessionAddPath(t *testing.T) {
+	mgr, remote, cancel := newTestManager(t, 65000, 65001)
+	defer cancel()
+
+	if err := mgr.AnnounceRoute("10.0.0.1", RouteAttributes{}); err != nil {
+		t.Fatalf("failed to announce route: %v", err)
+	}
+
+	// The peer only receives multiple paths for IPv4 unicast
+	addPath := []packet.AddPathFamily{{AFI: packet.AFIIPv4, SAFI: packet.SAFIUnicast, Mode: packet.AddPathReceive}}
+	remote.expect(packet.TypeOpen)
+	remote.send(&packet.Open{
+		Version:       bgpVersion,
+		MyAS:          65001,
+		HoldTime:      30,
+		BGPIdentifier: [4]byte{192, 0, 2, 1},
+		Capabilities:  []packet.Capability{&packet.CapAddPath{Families: addPath}},
+	})
+	remote.opts = packet.Options{AddPath: addPath}
+	remote.expect(packet.TypeKeepalive)
+	remote.send(&packet.Keepalive{})
+
+	pathID := nodePathID("node")
+	if update := remote.expect(packet.TypeUpdate).(*packet.Update); !reflect.DeepEqual(update.NLRIPathIDs, []uint32{pathID}) {
+		t.Fatalf("expected route to be announced with path identifier %d, got %#v", pathID, update)
+	}
+
+	if err := mgr.WithdrawRoute("10.0.0.1"); err != nil {
+		t.Fatalf("failed to withdraw route: %v", err)
+	}
+	if update := remote.expect(packet.TypeUpdate).(*packet.Update); !reflect.DeepEqual(update.WithdrawnPathIDs, []uint32{pathID}) {
+		t.Fatalf("expected route to be withdrawn with path identifier %d, got %#v", pathID, update)
+	}
+}
+
+func TestSessionUnnumbered(t *testing.T) {
+	listener, err := net.Listen("tcp", "[::1]:0")
+	if err != nil {
+		t.Skipf("IPv6 loopback not available: %v", err)
+	}
+	defer func() { _ = listener.Close() }()
+
+	m, err := NewManager(cfg.Config{LocalASN: 65000, Peers: []v1alphav1.BGPPeer{{Interface: "swp1", ASN: 65001}}}, "node", nil, logr.Discard())
+	if err != nil {
+		t.Fatalf("failed to create manager: %v", err)
+	}
+
+	// The neighbor of the interface is discovered at the other end of the loopback instead
+	mgr := m.(*manager)
+	mgr.discovery = nil
+	p := mgr.peers[0]
+	p.remote = netip.AddrPortFrom(netip.Addr{}, uint16(listener.Addr().(*net.TCPAddr).Port))
+	p.neighbor = func(context.Context) (netip.Addr, error) { return netip.IPv6Loopback(), nil }
+
+	if err = mgr.AnnounceRoute("10.0.0.1", RouteAttributes{}); err != nil {
+		t.Fatalf("failed to announce route: %v", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() { _ = mgr.Run(ctx) }()
+
+	conn, err := listener.Accept()
+	if err != nil {
+		t.Fatalf("failed to accept connection: %v", err)
+	}
+	defer func() { _ = conn.Close() }()
+	remote := &fakePeer{t: t, conn: conn}
+
+	extendedNextHop := &packet.CapExtendedNextHop{Encodings: []packet.NextHopEncoding{
+		{AFI: packet.AFIIPv4, SAFI: packet.SAFIUnicast, NextHopAFI: packet.AFIIPv6},
+	}}
+	if open := remote.expect(packet.TypeOpen).(*packet.Open); !slices.ContainsFunc(open.Capabilities, func(c packet.Capability) bool {
+		return reflect.DeepEqual(c, extendedNextHop)
+	}) {
+		t.Fatalf("expected extended next hop capability, got %#v", open.Capabilities)
+	}
+	remote.send(&packet.Open{
+		Version:       bgpVersion,
+		MyAS:          65001,
+		HoldTime:      30,
+		BGPIdentifier: [4]byte{192, 0, 2, 1},
+		Capabilities:  []packet.Capability{&packet.CapMultiprotocol{AFI: packet.AFIIPv4, SAFI: packet.SAFIUnicast}, extendedNextHop},
+	})
+	remote.expect(packet.TypeKeepalive)
+	remote.send(&packet.Keepalive{})
+
+	// IPv4 routes are advertised with the IPv6 address of the session as next hop
+	update := remote.expect(packet.TypeUpdate).(*packet.Update)
+	mpReach, ok := update.Attribute(packet.AttrCodeMPReachNLRI).(*packet.MPReachNLRI)
+	if !ok || mpReach.AFI != packet.AFIIPv4 || !reflect.DeepEqual(mpReach.NextHops, []netip.Addr{netip.IPv6Loopback()}) ||
+		!reflect.DeepEqual(mpReach.NLRI, []netip.Prefix{netip.MustParsePrefix("10.0.0.1/32")}) {
+		t.Fatalf("expected IPv4 route with IPv6 next hop, got %#v", update)
+	}
+}
+
+func TestSessionRouterID(t *testing.T) {
+	_, remote, cancel := newTestManagerWithConfig(t, cfg.Config{
+		LocalASN: 65000,
+		RouterID: "10.1.2.3",
+		Peers:    []v1alphav1.BGPPeer{{Address: "127.0.0.1", ASN: 65001}},
+	})
+	defer cancel()
+
+	if open := remote.expect(packet.TypeOpen).(*packet.Open); open.BGPIdentifier != [4]byte{10, 1, 2, 3} {
+		t.Fatalf("expected router ID to override the local address, got %v", open.BGPIdentifier)
+	}
+
+	for _, routerID := range []string{"0.0.0.0", "2001:db8::1", "invalid"} {
+		if _, err := NewManager(cfg.Config{LocalASN: 65000, RouterID: routerID}, "node", nil, logr.Discard()); err == nil {
+			t.Errorf("expected router ID %s to be rejected", routerID)
+		}
+	}
+}
+
+func TestSessionFourOctetASWithTwoOctetPeer(t *testing.T) {
+	mgr, remote, cancel := newTestManager(t, 4200000000, 65001)
+	defer cancel()
+
+	if err := mgr.AnnounceRoute("10.0.0.1", RouteAttributes{}); err != nil {
+		t.Fatalf("failed to announce route: %v", err)
+	}
+
+	open := remote.expect(packet.TypeOpen).(*packet.Open)
+	if open.MyAS != uint16(packet.ASTrans) {
+		t.Fatalf("expected AS_TRANS in OPEN message, got %d", open.MyAS)
+	}
+	if asn, ok := peerASN(open); !ok || asn != 4200000000 {
+		t.Fatalf("expected 4-octet AS capability with ASN 4200000000, got %d", asn)
+	}
+
+	// The remote peer does not support 4-octet AS numbers
+	remote.send(&packet.Open{Version: bgpVersion, MyAS: 65001, HoldTime: 30, BGPIdentifier: [4]byte{192, 0, 2, 1}})
+	remote.expect(packet.TypeKeepalive)
+	remote.send(&packet.Keepalive{})
+
+	update := remote.expect(packet.TypeUpdate).(*packet.Update)
+	expected := []packet.PathAttribute{
+		&packet.Origin{Value: packet.OriginIGP},
+		&packet.ASPath{Segments: []packet.ASPathSegment{{Type: packet.ASSequence, ASNs: []uint32{packet.ASTrans}}}},
+		&packet.NextHop{Addr: netip.MustParseAddr("127.0.0.1")},
+		&packet.AS4Path{Segments: []packet.ASPathSegment{{Type: packet.ASSequence, ASNs: []uint32{4200000000}}}},
+	}
+	if !reflect.DeepEqual(update.PathAttributes, expected) {
+		t.Fatalf("unexpected path attributes: %#v", update.PathAttributes)
+	}
+}
+
+func TestSessionRequiresFourOctetAS(t *testing.T) {
+	_, remote, cancel := newTestManagerWithConfig(t, cfg.Config{
+		LocalASN:           4200000000,
+		RequireFourOctetAS: true,
+		Peers:              []v1alphav1.BGPPeer{{Address: "127.0.0.1", ASN: 65001}},
+	})
+	defer cancel()
+
+	remote.expect(packet.TypeOpen)
+	remote.send(&packet.Open{Version: bgpVersion, MyAS: 65001, HoldTime: 30, BGPIdentifier: [4]byte{192, 0, 2, 1}})
+
+	notification := remote.expect(packet.TypeNotification).(*packet.Notification)
+	if notification.Code != packet.ErrCodeOpenMessage || notification.Subcode != packet.ErrSubcodeUnsupportedCapability ||
+		!bytes.Equal(notification.Data, []byte{byte(packet.CapCodeFourOctetAS), 4, 0xfa, 0x56, 0xea, 0x00}) {
+		t.Fatalf("expected unsupported 4-octet AS capability notification, got %+v", notification)
+	}
+}
+
+func TestReceiveUpdateFromTwoOctetPeer(t *testing.T) {
+	p, err := newPeer(v1alphav1.BGPPeer{Address: "192.0.2.1", ASN: 65001}, speakerConfig{localASN: 4200000000}, nil,
+		func([]netip.Prefix) {}, logr.Discard())
+	if err != nil {
+		t.Fatalf("failed to create peer: %v", err)
+	}
+	policies, err := newPolicies(nil, []v1alphav1.Policy{{Name: "import", DefaultAction: v1alphav1.PolicyActionAccept}})
+	if err != nil {
+		t.Fatalf("failed to compile policies: %v", err)
+	}
+	p.importPolicy.Store(policies["import"])
+	s := &session{peer: p, families: map[family]struct{}{familyIPv4Unicast: {}}}
+
+	// The peer does not support 4-octet AS numbers, so the ones it cannot represent are carried in AS4_PATH
+	err = s.receiveUpdate(&packet.Update{
+		PathAttributes: []packet.PathAttribute{
+			&packet.Origin{Value: packet.OriginIGP},
+			&packet.ASPath{Segments: []packet.ASPathSegment{{Type: packet.ASSequence, ASNs: []uint32{65001, packet.ASTrans}}}},
+			&packet.NextHop{Addr: netip.MustParseAddr("192.0.2.1")},
+			&packet.AS4Path{Segments: []packet.ASPathSegment{{Type: packet.ASSequence, ASNs: []uint32{4200000001}}}},
+		},
+		NLRI: []netip.Prefix{netip.MustParsePrefix("10.0.0.0/24")},
+	})
+	if err != nil {
+		t.Fatalf("failed to receive update: %v", err)
+	}
+
+	expected := []packet.ASPathSegment{
+		{Type: packet.ASSequence, ASNs: []uint32{65001}},
+		{Type: packet.ASSequence, ASNs: []uint32{4200000001}},
+	}
+	if routes := p.adjRIBIn.routes(); len(routes) != 1 || !reflect.DeepEqual(routes[0].ASPath, expected) {
+		t.Fatalf("expected AS_TRANS to be replaced with the ASN of AS4_PATH, got %+v", routes)
+	}
+}
+
+func TestSessionRejectsFourOctetPeerASWithoutCapability(t *testing.T) {
+	_, remote, cancel := newTestManager(t, 65000, 4200000001)
+	defer cancel()
+
+	remote.expect(packet.TypeOpen)
+	remote.send(&packet.Open{Version: bgpVersion, MyAS: uint16(packet.ASTrans), HoldTime: 90, BGPIdentifier: [4]byte{192, 0, 2, 1}})
+
+	notification := remote.expect(packet.TypeNotification).(*packet.Notification)
+	if notification.Code != packet.ErrCodeOpenMessage || notification.Subcode != packet.ErrSubcodeBadPeerAS {
+		t.Fatalf("expected bad peer AS notification, got %+v", notification)
+	}
+}
+
+func TestSessionRejectsBadPeerAS(t *testing.T) {
+	_, remote, cancel := newTestManager(t, 65000, 65001)
+	defer cancel()
+
+	remote.expect(packet.TypeOpen)
+	remote.send(&packet.Open{Version: bgpVersion, MyAS: 65002, HoldTime: 90, BGPIdentifier: [4]byte{192, 0, 2, 1}})
+
+	notification := remote.expect(packet.TypeNotification).(*packet.Notification)
+	if notification.Code != packet.ErrCodeOpenMessage || notification.Subcode != packet.ErrSubcodeBadPeerAS {
+		t.Fatalf("expected bad peer AS notification, got %+v", notification)
+	}
+}
+
+func TestPassivePeer(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	port := listener.Addr().(*net.TCPAddr).Port
+	_ = listener.Close()
+
+	holdTime := int32(30)
+	m, err := NewManager(cfg.Config{
+		LocalASN:     65000,
+		BGPLocalPort: int32(port),
+		Peers:        []v1alphav1.BGPPeer{{Address: "127.0.0.1", ASN: 65001, Passive: true, HoldTimeSeconds: &holdTime}},
+	}, "node", nil, logr.Discard())
+	if err != nil {
+		t.Fatalf("failed to create manager: %v", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() { _ = m.Run(ctx) }()
+
+	// The listener is started asynchronously, so the first attempts may be refused
+	var conn net.Conn
+	for range 50 {
+		if conn, err = net.Dial("tcp", fmt.Sprintf("127.0.0.1:%d", port)); err == nil {
+			break
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	if err != nil {
+		t.Fatalf("failed to connect to passive peer: %v", err)
+	}
+	defer func() { _ = conn.Close() }()
+	remote := &fakePeer{t: t, conn: conn}
+
+	if open := remote.expect(packet.TypeOpen).(*packet.Open); open.HoldTime != 30 {
+		t.Fatalf("expected configured hold time in OPEN message, got %d", open.HoldTime)
+	}
+	remote.send(&packet.Open{Version: bgpVersion, MyAS: 65001, HoldTime: 90, BGPIdentifier: [4]byte{192, 0, 2, 1}})
+	remote.expect(packet.TypeKeepalive)
+	remote.send(&packet.Keepalive{})
+
+	if err = m.AnnounceRoute("10.0.0.1", RouteAttributes{}); err != nil {
+		t.Fatalf("failed to announce route: %v", err)
+	}
+	remote.expect(packet.TypeUpdate)
+
+	// Further connections of the peer are rejected while its session is in progress
+	second, err := net.Dial("tcp", fmt.Sprintf("127.0.0.1:%d", port))
+	if err != nil {
+		t.Fatalf("failed to connect to passive peer: %v", err)
+	}
+	defer func() { _ = second.Close() }()
+	if err = second.SetReadDeadline(time.Now().Add(5 * time.Second)); err != nil {
+		t.Fatalf("failed to set read deadline: %v", err)
+	}
+	if _, err = second.Read(make([]byte, 1)); !errors.Is(err, io.EOF) {
+		t.Fatalf("expected second connection to be closed, got %v", err)
+	}
+}
+
+func TestListenerRecovers(t *testing.T) {
+	// The port is busy when the manager starts, so that the listener must retry
+	busy, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	port := busy.Addr().(*net.TCPAddr).Port
+
+	mgr, err := newManager(cfg.Config{
+		LocalASN:     65000,
+		BGPLocalPort: int32(port),
+		Peers: []v1alphav1.BGPPeer{
+			{Address: "127.0.0.1", ASN: 65001, Passive: true},
+			{Address: "127.0.0.2", ASN: 65002, Passive: true, PasswordSecretRef: &corev1.SecretKeySelector{Key: "password"}},
+		},
+	}, "node", false, nil, logr.Discard())
+	if err != nil {
+		t.Fatalf("failed to create manager: %v", err)
+	}
+	// The password of the second peer cannot be read, which must not affect the first one
+	mgr.peers[1].passwordFile = filepath.Join(t.TempDir(), "missing")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() { _ = mgr.Run(ctx) }()
+
+	time.Sleep(500 * time.Millisecond)
+	_ = busy.Close()
+
+	var conn net.Conn
+	for range 50 {
+		if conn, err = net.Dial("tcp", fmt.Sprintf("127.0.0.1:%d", port)); err == nil {
+			break
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	if err != nil {
+		t.Fatalf("failed to connect to passive peer: %v", err)
+	}
+	defer func() { _ = conn.Close() }()
+
+	remote := &fakePeer{t: t, conn: conn}
+	remote.expect(packet.TypeOpen)
+}
+
+func TestListenRange(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	port := listener.Addr().(*net.TCPAddr).Port
+	_ = listener.Close()
+
+	m, err := NewManager(cfg.Config{
+		LocalASN:     65000,
+		BGPLocalPort: int32(port),
+		ListenRanges: []v1alphav1.ListenRange{{
+			Prefix:   "127.0.0.0/8",
+			PeerASNs: []v1alphav1.ASNRange{{First: 65100, Last: 65199}},
+			MaxPeers: 1,
+		}},
+	}, "node", nil, logr.Discard())
+	if err != nil {
+		t.Fatalf("failed to create manager: %v", err)
+	}
+	mgr := m.(*manager)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() { _ = m.Run(ctx) }()
+
+	// The listener is started asynchronously, so the first attempts may be refused
+	dialFrom := func(local string) *fakePeer {
+		t.Helper()
+
+		dialer := net.Dialer{LocalAddr: &net.TCPAddr{IP: net.ParseIP(local)}}
+		var conn net.Conn
+		for range 50 {
+			if conn, err = dialer.Dial("tcp", fmt.Sprintf("127.0.0.1:%d", port)); err == nil {
+				break
+			}
+			time.Sleep(100 * time.Millisecond)
+		}
+		if err != nil {
+			t.Fatalf("failed to connect from %s: %v", local, err)
+		}
+		t.Cleanup(func() { _ = conn.Close() })
+		return &fakePeer{t: t, conn: conn}
+	}
+	waitForPeers := func(expected ...string) {
+		t.Helper()
+
+		for range 50 {
+			if peers := slices.Sorted(maps.Keys(mgr.AdjRIBIn())); slices.Equal(peers, expected) {
+				return
+			}
+			time.Sleep(100 * time.Millisecond)
+		}
+		t.Fatalf("expected dynamic peers %v, got %v", expected, slices.Sorted(maps.Keys(mgr.AdjRIBIn())))
+	}
+
+	// Peers with an ASN outside of the range are rejected
+	rejected := dialFrom("127.0.0.2")
+	rejected.expect(packet.TypeOpen)
+	rejected.send(&packet.Open{Version: bgpVersion, MyAS: 65001, HoldTime: 90, BGPIdentifier: [4]byte{192, 0, 2, 2}})
+	notification := rejected.expect(packet.TypeNotification).(*packet.Notification)
+	if notification.Code != packet.ErrCodeOpenMessage || notification.Subcode != packet.ErrSubcodeBadPeerAS {
+		t.Fatalf("expected bad peer AS notification, got %+v", notification)
+	}
+	waitForPeers()
+
+	remote := dialFrom("127.0.0.3")
+	remote.expect(packet.TypeOpen)
+	remote.send(&packet.Open{Version: bgpVersion, MyAS: 65150, HoldTime: 90, BGPIdentifier: [4]byte{192, 0, 2, 3}})
+	remote.expect(packet.TypeKeepalive)
+	remote.send(&packet.Keepalive{})
+	waitForPeers("127.0.0.3")
+
+	if err = m.AnnounceRoute("10.0.0.1", RouteAttributes{}); err != nil {
+		t.Fatalf("failed to announce route: %v", err)
+	}
+	update := remote.expect(packet.TypeUpdate).(*packet.Update)
+	if asPath, ok := update.Attribute(packet.AttrCodeASPath).(*packet.ASPath); !ok ||
+		!reflect.DeepEqual(asPath.Segments, prependedASPath(65000, 0)) {
+		t.Fatalf("expected route advertised to external dynamic peer, got %#v", update)
+	}
+
+	// Further peers are rejected once the range reached its maximum number of peers
+	second := dialFrom("127.0.0.4")
+	if err = second.conn.SetReadDeadline(time.Now().Add(5 * time.Second)); err != nil {
+		t.Fatalf("failed to set read deadline: %v", err)
+	}
+	if _, err = second.conn.Read(make([]byte, 1)); !errors.Is(err, io.EOF) {
+		t.Fatalf("expected connection beyond the maximum number of peers to be closed, got %v", err)
+	}
+
+	// Dynamic peers are removed once their sessions are closed
+	_ = remote.conn.Close()
+	waitForPeers()
+}
+
+func TestUpdatePeers(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	port := listener.Addr().(*net.TCPAddr).Port
+	_ = listener.Close()
+
+	config := cfg.Config{
+		LocalASN:     65000,
+		BGPLocalPort: int32(port),
+		Peers:        []v1alphav1.BGPPeer{{Address: "127.0.0.2", ASN: 65002, Passive: true}},
+	}
+	mgr, err := newManager(config, "node", false, nil, logr.Discard())
+	if err != nil {
+		t.Fatalf("failed to create manager: %v", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() { _ = mgr.Run(ctx) }()
+
+	// The listener is started asynchronously, so the first attempts may be refused
+	establish := func(local string, asn uint16) *fakePeer {
+		t.Helper()
+
+		dialer := net.Dialer{LocalAddr: &net.TCPAddr{IP: net.ParseIP(local)}}
+		var conn net.Conn
+		for range 50 {
+			if conn, err = dialer.Dial("tcp", fmt.Sprintf("127.0.0.1:%d", port)); err == nil {
+				break
+			}
+			time.Sleep(100 * time.Millisecond)
+		}
+		if err != nil {
+			t.Fatalf("failed to connect from %s: %v", local, err)
+		}
+		t.Cleanup(func() { _ = conn.Close() })
+
+		remote := &fakePeer{t: t, conn: conn}
+		remote.expect(packet.TypeOpen)
+		remote.send(&packet.Open{Version: bgpVersion, MyAS: asn, HoldTime: 90, BGPIdentifier: [4]byte{192, 0, 2, 1}})
+		remote.expect(packet.TypeKeepalive)
+		remote.send(&packet.Keepalive{})
+		return remote
+	}
+	first := establish("127.0.0.2", 65002)
+
+	// Invalid peers leave the current ones untouched
+	invalid := config
+	invalid.Peers = []v1alphav1.BGPPeer{{Address: "127.0.0.3", ASN: 0, Passive: true}}
+	if err = mgr.UpdatePeers(invalid); err == nil {
+		t.Fatal("expected invalid peer to be rejected")
+	}
+
+	// Added peers are started while the session with the rest of them is kept
+	config.Peers = append(config.Peers, v1alphav1.BGPPeer{Address: "127.0.0.3", ASN: 65003, Passive: true})
+	if err = mgr.UpdatePeers(config); err != nil {
+		t.Fatalf("failed to update peers: %v", err)
+	}
+	second := establish("127.0.0.3", 65003)
+
+	if err = mgr.AnnounceRoute("10.0.0.1", RouteAttributes{}); err != nil {
+		t.Fatalf("failed to announce route: %v", err)
+	}
+	first.expect(packet.TypeUpdate)
+	second.expect(packet.TypeUpdate)
+
+	// Removed peers are shut down before returning
+	config.Peers = config.Peers[1:]
+	if err = mgr.UpdatePeers(config); err != nil {
+		t.Fatalf("failed to update peers: %v", err)
+	}
+	for {
+		if err = first.conn.SetReadDeadline(time.Now().Add(5 * time.Second)); err != nil {
+			t.Fatalf("failed to set read deadline: %v", err)
+		}
+		msg, errRead := first.opts.ReadMessage(first.conn)
+		if errRead != nil {
+			t.Fatalf("expected NOTIFICATION message, got %v", errRead)
+		}
+		if msg.Type() == packet.TypeNotification {
+			break
+		}
+	}
+
+	if err = mgr.AnnounceRoute("10.0.0.2", RouteAttributes{}); err != nil {
+		t.Fatalf("failed to announce route: %v", err)
+	}
+	second.expect(packet.TypeUpdate)
+	if peers := slices.Sorted(maps.Keys(mgr.AdjRIBOut())); !slices.Equal(peers, []string{"127.0.0.3"}) {
+		t.Fatalf("expected only the added peer, got %v", peers)
+	}
+}
+
+func TestTTLSettings(t *testing.T) {
+	tests := []struct {
+		name           string
+		peer           v1alphav1.BGPPeer
+		expectedTTL    int
+		expectedMinTTL int
+	}{
+		{name: "internal", peer: v1alphav1.BGPPeer{ASN: 65000}},
+		{name: "external", peer: v1alphav1.BGPPeer{ASN: 65001}, expectedTTL: 1},
+		{name: "multihop", peer: v1alphav1.BGPPeer{ASN: 65001, EBGPMultihopTTL: 3}, expectedTTL: 3},
+		{name: "gtsm", peer: v1alphav1.BGPPeer{ASN: 65001, GTSM: true}, expectedTTL: 255, expectedMinTTL: 255},
+		{name: "gtsm multihop", peer: v1alphav1.BGPPeer{ASN: 65001, GTSM: true, EBGPMultihopTTL: 3}, expectedTTL: 255, expectedMinTTL: 253},
+	}
+
+	for _, tt := range tests {
+		ttl, minTTL, err := ttlSettings(tt.peer, 65000)
+		if err != nil {
+			t.Errorf("%s: unexpected error: %v", tt.name, err)
+			continue
+		}
+		if ttl != tt.expectedTTL || minTTL != tt.expectedMinTTL {
+			t.Errorf("%s: expected TTL %d and minimum TTL %d, got %d and %d", tt.name, tt.expectedTTL, tt.expectedMinTTL, ttl, minTTL)
+		}
+	}
+}
+
+func TestListenRangePeerTTL(t *testing.T) {
+	tests := []struct {
+		name        string
+		peerASNs    []v1alphav1.ASNRange
+		expectedTTL int
+	}{
+		{name: "internal", peerASNs: []v1alphav1.ASNRange{{First: 65000, Last: 65000}}},
+		{name: "external", peerASNs: []v1alphav1.ASNRange{{First: 65100, Last: 65199}}, expectedTTL: 1},
+		{name: "mixed", peerASNs: []v1alphav1.ASNRange{{First: 65000, Last: 65000}, {First: 65100, Last: 65100}}, expectedTTL: 1},
+	}
+
+	for _, tt := range tests {
+		r, err := newListenRange(v1alphav1.ListenRange{Prefix: "192.0.2.0/24", PeerASNs: tt.peerASNs},
+			speakerConfig{localASN: 65000}, nil, func([]netip.Prefix) {})
+		if err != nil {
+			t.Fatalf("%s: failed to create listen range: %v", tt.name, err)
+		}
+		p, err := r.newPeer(netip.MustParseAddr("192.0.2.1"), logr.Discard())
+		if err != nil {
+			t.Fatalf("%s: failed to create dynamic peer: %v", tt.name, err)
+		}
+		if p.ttl != tt.expectedTTL {
+			t.Errorf("%s: expected TTL %d, got %d", tt.name, tt.expectedTTL, p.ttl)
+		}
+	}
+}
+
+func TestNewManagerRejectsReservedASN(t *testing.T) {
+	for _, asn := range []uint32{0, packet.ASTrans, 65535, 4294967295} {
+		if _, err := NewManager(cfg.Config{LocalASN: asn}, "node", nil, logr.Discard()); err == nil {
+			t.Errorf("expected local ASN %d to be rejected", asn)
+		}
+	}
+
+	if _, err := NewManager(cfg.Config{LocalASN: 4200000000}, "node", nil, logr.Discard()); err != nil {
+		t.Errorf("failed to create manager with 4-octet local ASN: %v", err)
+	}
+}
+
+func TestParseRoute(t *testing.T) {
+	tests := []struct {
+		route    string
+		expected string
+		wantErr  bool
+	}{
+		{route: "10.0.0.1", expected: "10.0.0.1/32"},
+		{route: "10.0.0.1/24", expected: "10.0.0.0/24"},
+		{route: "2001:db8::1", expected: "2001:db8::1/128"},
+		{route: "::ffff:10.0.0.1", expected: "10.0.0.1/32"},
+		{route: "not-an-ip", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		prefix, err := parseRoute(tt.route)
+		if tt.wantErr {
+			if err == nil {
+				t.Errorf("parseRoute(%q): expected error", tt.route)
+			}
+			continue
+		}
+		if err != nil || prefix.String() != tt.expected {
+			t.Errorf("parseRoute(%q) = %s, %v; expected %s", tt.route, prefix, err, tt.expected)
+		}
+	}
+}
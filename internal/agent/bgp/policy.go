@@ -0,0 +1,278 @@
+package bgp
+
+import (
+	"fmt"
+	"net/netip"
+	"slices"
+
+	"github.com/yago-123/routebird/api/v1alphav1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+)
+
+// policy is an export or import policy, deciding which routes are advertised to a peer or accepted from it, and with
+// which attributes
+type policy struct {
+	name          string
+	statements    []policyStatement
+	defaultAccept bool
+}
+
+type policyStatement struct {
+	match  policyMatch
+	accept bool
+	// set modifies the attributes of the accepted routes, nil when the statement does not modify them
+	set *policySet
+}
+
+// policyMatch contains the conditions of a statement, unset conditions match every route
+type policyMatch struct {
+	prefixLists []prefixList
+	lengths     *lengthRange
+	namespaces  []string
+	selector    labels.Selector
+}
+
+// prefixList matches a route when any of its entries matches it
+type prefixList []prefixListEntry
+
+// prefixListEntry matches the routes contained in prefix whose length is within lengths
+type prefixListEntry struct {
+	prefix  netip.Prefix
+	lengths lengthRange
+}
+
+// lengthRange is an inclusive range of prefix lengths
+type lengthRange struct {
+	min, max int
+}
+
+// policySet adds the communities of attrs to the ones of the routes, and replaces the rest of the attributes of the
+// routes with the ones set in attrs
+type policySet struct {
+	attrs RouteAttributes
+	// asPathPrepend replaces the prepend count of the routes when set, as zero is a meaningful value
+	asPathPrepend *int
+}
+
+// newPolicies compiles the policies, indexed by name, resolving the prefix lists they reference
+func newPolicies(prefixListsCfg []v1alphav1.PrefixList, policiesCfg []v1alphav1.Policy) (map[string]*policy, error) {
+	prefixLists := make(map[string]prefixList, len(prefixListsCfg))
+	for _, prefixListCfg := range prefixListsCfg {
+		if _, exists := prefixLists[prefixListCfg.Name]; exists {
+			return nil, fmt.Errorf("duplicated prefix list %q", prefixListCfg.Name)
+		}
+
+		list, err := newPrefixList(prefixListCfg)
+		if err != nil {
+			return nil, fmt.Errorf("invalid prefix list %q: %w", prefixListCfg.Name, err)
+		}
+		prefixLists[prefixListCfg.Name] = list
+	}
+
+	policies := make(map[string]*policy, len(policiesCfg))
+	for _, policyCfg := range policiesCfg {
+		if _, exists := policies[policyCfg.Name]; exists {
+			return nil, fmt.Errorf("duplicated policy %q", policyCfg.Name)
+		}
+
+		p, err := newPolicy(policyCfg, prefixLists)
+		if err != nil {
+			return nil, fmt.Errorf("invalid policy %q: %w", policyCfg.Name, err)
+		}
+		policies[policyCfg.Name] = p
+	}
+
+	return policies, nil
+}
+
+func newPrefixList(config v1alphav1.PrefixList) (prefixList, error) {
+	list := make(prefixList, 0, len(config.Entries))
+	for _, entryCfg := range config.Entries {
+		prefix, err := netip.ParsePrefix(entryCfg.Prefix)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse prefix %q: %w", entryCfg.Prefix, err)
+		}
+		prefix = netip.PrefixFrom(prefix.Addr().Unmap(), prefix.Bits()).Masked()
+
+		lengths := lengthRange{min: prefix.Bits(), max: prefix.Bits()}
+		if entryCfg.GE > 0 {
+			lengths = lengthRange{min: int(entryCfg.GE), max: prefix.Addr().BitLen()}
+		}
+		if entryCfg.LE > 0 {
+			lengths.max = int(entryCfg.LE)
+		}
+		if lengths.min < prefix.Bits() || lengths.max < lengths.min || lengths.max > prefix.Addr().BitLen() {
+			return nil, fmt.Errorf("invalid length range [%d, %d] for prefix %s", lengths.min, lengths.max, prefix)
+		}
+
+		list = append(list, prefixListEntry{prefix: prefix, lengths: lengths})
+	}
+
+	return list, nil
+}
+
+func newPolicy(config v1alphav1.Policy, prefixLists map[string]prefixList) (*policy, error) {
+	p := &policy{name: config.Name, defaultAccept: config.DefaultAction == v1alphav1.PolicyActionAccept}
+
+	for i, statementCfg := range config.Statements {
+		statement := policyStatement{accept: statementCfg.Action != v1alphav1.PolicyActionReject}
+
+		var err error
+		if statement.match, err = newPolicyMatch(statementCfg.Match, prefixLists); err != nil {
+			return nil, fmt.Errorf("invalid match of statement %d: %w", i, err)
+		}
+		if statementCfg.Set != nil {
+			if statement.set, err = newPolicySet(*statementCfg.Set); err != nil {
+				return nil, fmt.Errorf("invalid set of statement %d: %w", i, err)
+			}
+		}
+
+		p.statements = append(p.statements, statement)
+	}
+
+	return p, nil
+}
+
+func newPolicyMatch(config v1alphav1.PolicyMatch, prefixLists map[string]prefixList) (policyMatch, error) {
+	match := policyMatch{namespaces: config.ServiceNamespaces}
+
+	for _, name := range config.PrefixLists {
+		list, ok := prefixLists[name]
+		if !ok {
+			return policyMatch{}, fmt.Errorf("unknown prefix list %q", name)
+		}
+		match.prefixLists = append(match.prefixLists, list)
+	}
+
+	if config.PrefixLength != nil {
+		match.lengths = &lengthRange{min: int(config.PrefixLength.Min), max: int(config.PrefixLength.Max)}
+		if match.lengths.min < 0 || match.lengths.max < match.lengths.min {
+			return policyMatch{}, fmt.Errorf("invalid prefix length range [%d, %d]", match.lengths.min, match.lengths.max)
+		}
+	}
+
+	if config.ServiceSelector != nil {
+		selector, err := metav1.LabelSelectorAsSelector(config.ServiceSelector)
+		if err != nil {
+			return policyMatch{}, fmt.Errorf("invalid service selector: %w", err)
+		}
+		match.selector = selector
+	}
+
+	return match, nil
+}
+
+func newPolicySet(config v1alphav1.PolicySet) (*policySet, error) {
+	// The values of the set are parsed as route attributes, communities are then added to the ones of the routes
+	// while the rest replace them when set
+	attrs, err := ParseRouteAttributes(v1alphav1.RouteAttributes{
+		Communities:         config.AddCommunities,
+		LargeCommunities:    config.AddLargeCommunities,
+		ExtendedCommunities: config.AddExtendedCommunities,
+		LocalPreference:     config.LocalPreference,
+		MED:                 config.MED,
+		NextHops:            config.NextHops,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	set := &policySet{attrs: attrs}
+	if config.ASPathPrepend != nil {
+		prepend := int(*config.ASPathPrepend)
+		if err = validateASPathPrepend(prepend); err != nil {
+			return nil, err
+		}
+		set.asPathPrepend = &prepend
+	}
+
+	return set, nil
+}
+
+// apply evaluates the policy for the route, returning whether the route is advertised and its resulting attributes
+func (p *policy) apply(prefix netip.Prefix, attrs RouteAttributes) (RouteAttributes, bool) {
+	for _, statement := range p.statements {
+		if !statement.match.matches(prefix, attrs) {
+			continue
+		}
+
+		if !statement.accept {
+			return RouteAttributes{}, false
+		}
+		if statement.set != nil {
+			attrs = statement.set.apply(attrs)
+		}
+		return attrs, true
+	}
+
+	return attrs, p.defaultAccept
+}
+
+func (m policyMatch) matches(prefix netip.Prefix, attrs RouteAttributes) bool {
+	if len(m.prefixLists) > 0 && !slices.ContainsFunc(m.prefixLists, func(list prefixList) bool {
+		return list.matches(prefix)
+	}) {
+		return false
+	}
+
+	if m.lengths != nil && !m.lengths.contains(prefix.Bits()) {
+		return false
+	}
+
+	if len(m.namespaces) > 0 && !slices.Contains(m.namespaces, attrs.ServiceNamespace) {
+		return false
+	}
+
+	return m.selector == nil || m.selector.Matches(labels.Set(attrs.ServiceLabels))
+}
+
+func (l prefixList) matches(prefix netip.Prefix) bool {
+	return slices.ContainsFunc(l, func(entry prefixListEntry) bool {
+		return entry.prefix.Addr().Is4() == prefix.Addr().Is4() &&
+			entry.prefix.Bits() <= prefix.Bits() &&
+			entry.prefix.Contains(prefix.Addr()) &&
+			entry.lengths.contains(prefix.Bits())
+	})
+}
+
+func (r lengthRange) contains(length int) bool {
+	return length >= r.min && length <= r.max
+}
+
+// apply returns the attributes modified by the set, without modifying the provided ones
+func (s *policySet) apply(attrs RouteAttributes) RouteAttributes {
+	attrs.Communities = mergeSorted(attrs.Communities, s.attrs.Communities, compareCommunities)
+	attrs.LargeCommunities = mergeSorted(attrs.LargeCommunities, s.attrs.LargeCommunities, compareLargeCommunities)
+	attrs.ExtendedCommunities = mergeSorted(attrs.ExtendedCommunities, s.attrs.ExtendedCommunities, compareExtendedCommunities)
+
+	if s.attrs.LocalPref != nil {
+		attrs.LocalPref = s.attrs.LocalPref
+	}
+	if s.attrs.MED != nil {
+		attrs.MED = s.attrs.MED
+	}
+	if s.asPathPrepend != nil {
+		attrs.ASPathPrepend = *s.asPathPrepend
+	}
+	if s.attrs.NextHopIPv4.IsValid() {
+		attrs.NextHopIPv4 = s.attrs.NextHopIPv4
+	}
+	if s.attrs.NextHopIPv6.IsValid() {
+		attrs.NextHopIPv6 = s.attrs.NextHopIPv6
+	}
+
+	return attrs
+}
+
+// mergeSorted returns the sorted union of two sorted lists without duplicates, reusing the first one when the second
+// is empty
+func mergeSorted[T any](a, b []T, compare func(T, T) int) []T {
+	if len(b) == 0 {
+		return a
+	}
+
+	merged := slices.Concat(a, b)
+	slices.SortFunc(merged, compare)
+	return slices.CompactFunc(merged, func(x, y T) bool { return compare(x, y) == 0 })
+}
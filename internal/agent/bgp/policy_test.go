@@ -0,0 +1,92 @@
+package bgp
+
+import (
+	"net/netip"
+	"testing"
+
+	"github.com/yago-123/routebird/api/v1alphav1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestPolicy(t *testing.T) {
+	prepend := int32(2)
+	policies, err := newPolicies(
+		[]v1alphav1.PrefixList{
+			{Name: "blocked", Entries: []v1alphav1.PrefixListEntry{{Prefix: "198.51.100.0/24", GE: 24}}},
+			{Name: "aggregates", Entries: []v1alphav1.PrefixListEntry{{Prefix: "192.0.2.0/24", LE: 28}}},
+		},
+		[]v1alphav1.Policy{{
+			Name: "export",
+			Statements: []v1alphav1.PolicyStatement{
+				{
+					Match:  v1alphav1.PolicyMatch{PrefixLists: []string{"blocked"}},
+					Action: v1alphav1.PolicyActionReject,
+				},
+				{
+					Match: v1alphav1.PolicyMatch{
+						PrefixLists:     []string{"aggregates"},
+						ServiceSelector: &metav1.LabelSelector{MatchLabels: map[string]string{"tier": "public"}},
+					},
+					Set: &v1alphav1.PolicySet{AddCommunities: []string{"65000:1"}, ASPathPrepend: &prepend},
+				},
+				{
+					Match: v1alphav1.PolicyMatch{
+						PrefixLength:      &v1alphav1.PrefixLengthRange{Min: 32, Max: 32},
+						ServiceNamespaces: []string{"edge"},
+					},
+				},
+			},
+		}},
+	)
+	if err != nil {
+		t.Fatalf("failed to compile policies: %v", err)
+	}
+	export := policies["export"]
+
+	public := RouteAttributes{Communities: []uint32{65000<<16 | 2}, ServiceLabels: map[string]string{"tier": "public"}}
+	tests := []struct {
+		prefix   string
+		attrs    RouteAttributes
+		accepted bool
+	}{
+		// Prefix lists match routes within their length range only
+		{prefix: "198.51.100.10/32", attrs: public, accepted: false},
+		{prefix: "192.0.2.0/28", attrs: public, accepted: true},
+		{prefix: "192.0.2.0/32", attrs: public, accepted: false},
+		// Every condition of a statement must match
+		{prefix: "192.0.2.0/28", attrs: RouteAttributes{}, accepted: false},
+		{prefix: "203.0.113.1/32", attrs: RouteAttributes{ServiceNamespace: "edge"}, accepted: true},
+		{prefix: "203.0.113.0/24", attrs: RouteAttributes{ServiceNamespace: "edge"}, accepted: false},
+		{prefix: "2001:db8::1/128", attrs: RouteAttributes{ServiceNamespace: "edge"}, accepted: false},
+	}
+	for _, tt := range tests {
+		if _, accepted := export.apply(netip.MustParsePrefix(tt.prefix), tt.attrs); accepted != tt.accepted {
+			t.Errorf("expected %s with %+v to be accepted %t, got %t", tt.prefix, tt.attrs, tt.accepted, accepted)
+		}
+	}
+
+	attrs, _ := export.apply(netip.MustParsePrefix("192.0.2.0/28"), public)
+	expected := RouteAttributes{
+		Communities:   []uint32{65000<<16 | 1, 65000<<16 | 2},
+		ASPathPrepend: 2,
+		ServiceLabels: public.ServiceLabels,
+	}
+	if !attrs.Equal(expected) {
+		t.Fatalf("unexpected attributes:\n got: %+v\nwant: %+v", attrs, expected)
+	}
+	if len(public.Communities) != 1 {
+		t.Fatalf("expected the attributes of the route to be left unmodified, got %+v", public)
+	}
+
+	for _, invalid := range []v1alphav1.Policy{
+		{Name: "unknown", Statements: []v1alphav1.PolicyStatement{{Match: v1alphav1.PolicyMatch{PrefixLists: []string{"missing"}}}}},
+		{Name: "range", Statements: []v1alphav1.PolicyStatement{{Match: v1alphav1.PolicyMatch{PrefixLength: &v1alphav1.PrefixLengthRange{Min: 24, Max: 16}}}}},
+	} {
+		if _, err = newPolicies(nil, []v1alphav1.Policy{invalid}); err == nil {
+			t.Errorf("expected policy %q to be rejected", invalid.Name)
+		}
+	}
+	if _, err = newPolicies([]v1alphav1.PrefixList{{Name: "le", Entries: []v1alphav1.PrefixListEntry{{Prefix: "192.0.2.0/24", LE: 16}}}}, nil); err == nil {
+		t.Errorf("expected prefix list with a maximum length shorter than its prefix to be rejected")
+	}
+}
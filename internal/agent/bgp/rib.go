@@ -0,0 +1,324 @@
+package bgp
+
+import (
+	"cmp"
+	"net/netip"
+	"slices"
+	"sync"
+
+	"github.com/yago-123/routebird/internal/agent/bgp/packet"
+)
+
+// Route is a route stored in the RIBs of the speaker. Routes are shared by the RIBs and the callers reading them, so
+// they must not be modified once stored
+type Route struct {
+	Prefix netip.Prefix
+	// Peer is the address of the peer the route was received from or advertised to, invalid for the routes announced
+	// through the manager
+	Peer netip.Addr
+	// Internal is set for the routes received from or advertised to internal peers
+	Internal bool
+	// NextHop is the next hop of the route, invalid for the routes announced through the manager
+	NextHop netip.Addr
+	Origin  uint8
+	// ASPath is the AS path of the route, merged with the AS4_PATH for peers without 4-octet AS support
+	ASPath     []packet.ASPathSegment
+	Attributes RouteAttributes
+}
+
+// localPref returns the LOCAL_PREF of the route, routes without it are assumed to have the default one
+func (r Route) localPref() uint32 {
+	if r.Attributes.LocalPref != nil {
+		return *r.Attributes.LocalPref
+	}
+	return defaultLocalPref
+}
+
+// med returns the MULTI_EXIT_DISC of the route, routes without it are assumed to have the lowest one
+func (r Route) med() uint32 {
+	if r.Attributes.MED != nil {
+		return *r.Attributes.MED
+	}
+	return 0
+}
+
+// pathLength returns the length of the AS path, in which every AS_SET counts as a single AS (RFC 4271 section 9.1.2.2)
+func (r Route) pathLength() int {
+	return asPathLength(r.ASPath)
+}
+
+// neighborAS returns the AS the route was received from, which is the first AS of the path or zero for routes
+// originated in the local AS
+func (r Route) neighborAS() uint32 {
+	if len(r.ASPath) == 0 || r.ASPath[0].Type != packet.ASSequence || len(r.ASPath[0].ASNs) == 0 {
+		return 0
+	}
+	return r.ASPath[0].ASNs[0]
+}
+
+// hasASN reports whether the AS path of the route contains the AS number
+func (r Route) hasASN(asn uint32) bool {
+	return slices.ContainsFunc(r.ASPath, func(segment packet.ASPathSegment) bool {
+		return slices.Contains(segment.ASNs, asn)
+	})
+}
+
+// compareRoutes orders two routes for the same prefix by preference, negative when a is preferred over b. The steps of
+// the decision process that depend on the data plane are skipped, as the agent does not install routes (RFC 4271
+// section 9.1.2.2): routes announced through the manager are preferred, then the higher LOCAL_PREF, the shorter AS
+// path, the lower ORIGIN, the lower MED among routes from the same neighbor AS, external routes over internal ones and
+// finally the lower peer address
+func compareRoutes(a, b Route) int {
+	if local := cmp.Compare(boolRank(!a.Peer.IsValid()), boolRank(!b.Peer.IsValid())); local != 0 {
+		return local
+	}
+
+	c := cmp.Or(
+		cmp.Compare(b.localPref(), a.localPref()),
+		cmp.Compare(a.pathLength(), b.pathLength()),
+		cmp.Compare(a.Origin, b.Origin),
+	)
+	if c != 0 {
+		return c
+	}
+
+	if a.neighborAS() == b.neighborAS() {
+		if c = cmp.Compare(a.med(), b.med()); c != 0 {
+			return c
+		}
+	}
+
+	return cmp.Or(
+		cmp.Compare(boolRank(!a.Internal), boolRank(!b.Internal)),
+		a.Peer.Compare(b.Peer),
+	)
+}
+
+// boolRank ranks true before false when used as a sort key
+func boolRank(b bool) int {
+	if b {
+		return 0
+	}
+	return 1
+}
+
+// asPathLength returns the length of the AS path, in which every AS_SET counts as a single AS
+func asPathLength(segments []packet.ASPathSegment) int {
+	length := 0
+	for _, segment := range segments {
+		switch segment.Type {
+		case packet.ASSequence:
+			length += len(segment.ASNs)
+		case packet.ASSet:
+			length++
+		}
+	}
+	return length
+}
+
+// mergeAS4Path reconstructs the AS path of a route received from a peer without 4-octet AS support, replacing the
+// trailing AS numbers of the AS_PATH with the AS4_PATH. The AS4_PATH is ignored when it is longer than the AS_PATH
+// (RFC 6793 section 4.2.3)
+func mergeAS4Path(asPath, as4Path []packet.ASPathSegment) []packet.ASPathSegment {
+	keep := asPathLength(asPath) - asPathLength(as4Path)
+	if keep < 0 {
+		return asPath
+	}
+
+	var merged []packet.ASPathSegment
+	for _, segment := range asPath {
+		if keep <= 0 {
+			break
+		}
+
+		switch segment.Type {
+		case packet.ASSequence:
+			asns := segment.ASNs[:min(keep, len(segment.ASNs))]
+			merged = append(merged, packet.ASPathSegment{Type: segment.Type, ASNs: asns})
+			keep -= len(asns)
+		case packet.ASSet:
+			merged = append(merged, segment)
+			keep--
+		}
+	}
+
+	return append(merged, as4Path...)
+}
+
+// table contains routes indexed by prefix in a binary trie, at most one per prefix. It is safe for concurrent use and
+// its zero value is an empty table
+type table struct {
+	lock sync.RWMutex
+	ipv4 *trieNode
+	ipv6 *trieNode
+	size int
+}
+
+// trieNode is a node of the trie, at the depth given by the length of its prefix. Each child extends the prefix of
+// the node with one more bit, 0 for the first child and 1 for the second
+type trieNode struct {
+	route    *Route
+	children [2]*trieNode
+}
+
+// len returns the number of routes in the table
+func (t *table) len() int {
+	t.lock.RLock()
+	defer t.lock.RUnlock()
+
+	return t.size
+}
+
+// get returns the route for the prefix
+func (t *table) get(prefix netip.Prefix) (Route, bool) {
+	t.lock.RLock()
+	defer t.lock.RUnlock()
+
+	node := t.root(prefix.Addr())
+	for bit := 0; node != nil && bit < prefix.Bits(); bit++ {
+		node = node.children[addrBit(prefix.Addr(), bit)]
+	}
+
+	if node == nil || node.route == nil {
+		return Route{}, false
+	}
+	return *node.route, true
+}
+
+// lookup returns the route with the longest prefix containing the address
+func (t *table) lookup(addr netip.Addr) (Route, bool) {
+	t.lock.RLock()
+	defer t.lock.RUnlock()
+
+	var match *Route
+	node := t.root(addr)
+	for bit := 0; node != nil; bit++ {
+		if node.route != nil {
+			match = node.route
+		}
+		if bit == addr.BitLen() {
+			break
+		}
+		node = node.children[addrBit(addr, bit)]
+	}
+
+	if match == nil {
+		return Route{}, false
+	}
+	return *match, true
+}
+
+// insert stores the route, replacing the route for the same prefix if any
+func (t *table) insert(route Route) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	root := &t.ipv4
+	if route.Prefix.Addr().Is6() {
+		root = &t.ipv6
+	}
+	if *root == nil {
+		*root = &trieNode{}
+	}
+
+	node := *root
+	for bit := 0; bit < route.Prefix.Bits(); bit++ {
+		child := &node.children[addrBit(route.Prefix.Addr(), bit)]
+		if *child == nil {
+			*child = &trieNode{}
+		}
+		node = *child
+	}
+
+	if node.route == nil {
+		t.size++
+	}
+	node.route = &route
+}
+
+// delete removes the route for the prefix, returning whether there was one
+func (t *table) delete(prefix netip.Prefix) bool {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	root := &t.ipv4
+	if prefix.Addr().Is6() {
+		root = &t.ipv6
+	}
+
+	// The path from the root is kept to prune the nodes left without routes nor children
+	path := []**trieNode{root}
+	node := *root
+	for bit := 0; node != nil && bit < prefix.Bits(); bit++ {
+		path = append(path, &node.children[addrBit(prefix.Addr(), bit)])
+		node = node.children[addrBit(prefix.Addr(), bit)]
+	}
+	if node == nil || node.route == nil {
+		return false
+	}
+
+	node.route = nil
+	t.size--
+	for i := len(path) - 1; i >= 0; i-- {
+		if n := *path[i]; n.route != nil || n.children[0] != nil || n.children[1] != nil {
+			break
+		}
+		*path[i] = nil
+	}
+
+	return true
+}
+
+// routes returns every route of the table sorted by prefix, IPv4 ones first
+func (t *table) routes() []Route {
+	t.lock.RLock()
+	defer t.lock.RUnlock()
+
+	routes := make([]Route, 0, t.size)
+	routes = t.ipv4.appendRoutes(routes)
+	return t.ipv6.appendRoutes(routes)
+}
+
+// clear removes every route of the table, returning the removed routes
+func (t *table) clear() []Route {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	routes := make([]Route, 0, t.size)
+	routes = t.ipv4.appendRoutes(routes)
+	routes = t.ipv6.appendRoutes(routes)
+	t.ipv4, t.ipv6, t.size = nil, nil, 0
+
+	return routes
+}
+
+func (t *table) root(addr netip.Addr) *trieNode {
+	if addr.Is6() {
+		return t.ipv6
+	}
+	return t.ipv4
+}
+
+// appendRoutes appends the routes of the subtree in pre-order, which sorts them by address and then by prefix length
+func (n *trieNode) appendRoutes(routes []Route) []Route {
+	if n == nil {
+		return routes
+	}
+
+	if n.route != nil {
+		routes = append(routes, *n.route)
+	}
+	routes = n.children[0].appendRoutes(routes)
+	return n.children[1].appendRoutes(routes)
+}
+
+// addrBit returns the bit of the address at the given position, starting from the most significant one
+func addrBit(addr netip.Addr, bit int) int {
+	var b byte
+	if addr.Is4() {
+		b = addr.As4()[bit/8]
+	} else {
+		b = addr.As16()[bit/8]
+	}
+	return int(b>>(7-bit%8)) & 1
+}
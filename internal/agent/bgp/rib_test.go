@@ -0,0 +1,105 @@
+package bgp
+
+import (
+	"net/netip"
+	"reflect"
+	"testing"
+
+	"github.com/yago-123/routebird/internal/agent/bgp/packet"
+)
+
+func TestTable(t *testing.T) {
+	var rib table
+	for _, prefix := range []string{"2001:db8::/32", "10.0.0.0/24", "0.0.0.0/0", "10.0.0.128/25", "10.0.0.0/8"} {
+		rib.insert(Route{Prefix: netip.MustParsePrefix(prefix)})
+	}
+
+	var prefixes []string
+	for _, route := range rib.routes() {
+		prefixes = append(prefixes, route.Prefix.String())
+	}
+	expected := []string{"0.0.0.0/0", "10.0.0.0/8", "10.0.0.0/24", "10.0.0.128/25", "2001:db8::/32"}
+	if !reflect.DeepEqual(prefixes, expected) {
+		t.Fatalf("unexpected routes order: %v", prefixes)
+	}
+
+	for addr, expected := range map[string]string{
+		"10.0.0.200":     "10.0.0.128/25",
+		"10.0.0.1":       "10.0.0.0/24",
+		"10.1.0.1":       "10.0.0.0/8",
+		"192.0.2.1":      "0.0.0.0/0",
+		"2001:db8::1":    "2001:db8::/32",
+		"2001:db9::1":    "",
+		"::ffff:1.2.3.4": "",
+	} {
+		route, ok := rib.lookup(netip.MustParseAddr(addr))
+		if (expected == "" && ok) || (expected != "" && route.Prefix.String() != expected) {
+			t.Errorf("expected lookup of %s to return %q, got %v", addr, expected, route.Prefix)
+		}
+	}
+
+	if rib.delete(netip.MustParsePrefix("10.0.0.0/16")) {
+		t.Fatalf("expected deletion of a missing prefix to fail")
+	}
+	if !rib.delete(netip.MustParsePrefix("10.0.0.128/25")) || rib.len() != 4 {
+		t.Fatalf("expected the route to be deleted, got %d routes", rib.len())
+	}
+	if route, _ := rib.lookup(netip.MustParseAddr("10.0.0.200")); route.Prefix.String() != "10.0.0.0/24" {
+		t.Fatalf("expected lookup to fall back to the covering route, got %v", route.Prefix)
+	}
+
+	if removed := rib.clear(); len(removed) != 4 || rib.len() != 0 || rib.ipv4 != nil || rib.ipv6 != nil {
+		t.Fatalf("expected table to be emptied, removed %d routes", len(removed))
+	}
+}
+
+func TestCompareRoutes(t *testing.T) {
+	localPref := uint32(200)
+	med := uint32(10)
+	path := func(asns ...uint32) []packet.ASPathSegment {
+		return []packet.ASPathSegment{{Type: packet.ASSequence, ASNs: asns}}
+	}
+	peerA, peerB := netip.MustParseAddr("192.0.2.1"), netip.MustParseAddr("192.0.2.2")
+
+	tests := []struct {
+		name             string
+		preferred, other Route
+	}{
+		{"local", Route{}, Route{Peer: peerA, Attributes: RouteAttributes{LocalPref: &localPref}}},
+		{"local preference", Route{Peer: peerB, ASPath: path(1, 2), Attributes: RouteAttributes{LocalPref: &localPref}}, Route{Peer: peerA, ASPath: path(1)}},
+		{"AS path length", Route{Peer: peerB, ASPath: path(1)}, Route{Peer: peerA, ASPath: path(1, 2)}},
+		{"origin", Route{Peer: peerB, Origin: packet.OriginIGP}, Route{Peer: peerA, Origin: packet.OriginIncomplete}},
+		{"MED", Route{Peer: peerB, ASPath: path(1)}, Route{Peer: peerA, ASPath: path(1), Attributes: RouteAttributes{MED: &med}}},
+		{"MED of different AS", Route{Peer: peerA, ASPath: path(2), Attributes: RouteAttributes{MED: &med}}, Route{Peer: peerB, ASPath: path(1)}},
+		{"external", Route{Peer: peerB}, Route{Peer: peerA, Internal: true}},
+		{"peer address", Route{Peer: peerA}, Route{Peer: peerB}},
+	}
+	for _, tt := range tests {
+		if compareRoutes(tt.preferred, tt.other) >= 0 || compareRoutes(tt.other, tt.preferred) <= 0 {
+			t.Errorf("%s: expected %+v to be preferred over %+v", tt.name, tt.preferred, tt.other)
+		}
+	}
+}
+
+func TestMergeAS4Path(t *testing.T) {
+	asPath := []packet.ASPathSegment{
+		{Type: packet.ASSequence, ASNs: []uint32{65001, packet.ASTrans}},
+		{Type: packet.ASSet, ASNs: []uint32{packet.ASTrans, 65002}},
+	}
+	as4Path := []packet.ASPathSegment{
+		{Type: packet.ASSequence, ASNs: []uint32{4200000000}},
+		{Type: packet.ASSet, ASNs: []uint32{4200000001, 65002}},
+	}
+
+	expected := []packet.ASPathSegment{{Type: packet.ASSequence, ASNs: []uint32{65001}}}
+	expected = append(expected, as4Path...)
+	if merged := mergeAS4Path(asPath, as4Path); !reflect.DeepEqual(merged, expected) {
+		t.Fatalf("unexpected merged AS path: %+v", merged)
+	}
+
+	// A longer AS4_PATH is ignored
+	short := []packet.ASPathSegment{{Type: packet.ASSequence, ASNs: []uint32{packet.ASTrans}}}
+	if merged := mergeAS4Path(short, as4Path); !reflect.DeepEqual(merged, short) {
+		t.Fatalf("expected AS4_PATH to be ignored, got %+v", merged)
+	}
+}
@@ -0,0 +1,22 @@
+package bgp
+
+import (
+	"net/netip"
+)
+
+// maxTTL is the TTL of the packets sent by GTSM protected sessions (RFC 5082)
+const maxTTL = 255
+
+// socketOptions contains the options set on the sockets of the BGP sessions
+type socketOptions struct {
+	// md5Keys contains the TCP MD5 signature key of each peer
+	md5Keys map[netip.Addr]string
+	// ttl is the TTL of the packets sent, zero keeps the system default
+	ttl int
+	// minTTL is the minimum TTL of the packets received, zero disables the check
+	minTTL int
+}
+
+func (o socketOptions) isZero() bool {
+	return len(o.md5Keys) == 0 && o.ttl == 0 && o.minTTL == 0
+}
@@ -0,0 +1,91 @@
+//go:build linux
+
+package bgp
+
+import (
+	"fmt"
+	"net/netip"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+// control sets the socket options on a socket, either before it is connected or bound, as a net.Dialer or
+// net.ListenConfig control function, or on an accepted connection
+func (o socketOptions) control(network, _ string, c syscall.RawConn) error {
+	var errSet error
+	err := c.Control(func(fd uintptr) {
+		errSet = o.set(int(fd), network)
+	})
+	if err != nil {
+		return err
+	}
+
+	return errSet
+}
+
+func (o socketOptions) set(fd int, network string) error {
+	for addr, key := range o.md5Keys {
+		if err := setTCPMD5Sig(fd, network, addr, key); err != nil {
+			return err
+		}
+	}
+
+	// IPv4 traffic of IPv6 sockets is governed by the IPv4 options, so both are set on them
+	if o.ttl > 0 {
+		if err := unix.SetsockoptInt(fd, unix.IPPROTO_IP, unix.IP_TTL, o.ttl); err != nil && network == "tcp4" {
+			return fmt.Errorf("failed to set TTL: %w", err)
+		}
+		if network != "tcp4" {
+			if err := unix.SetsockoptInt(fd, unix.IPPROTO_IPV6, unix.IPV6_UNICAST_HOPS, o.ttl); err != nil {
+				return fmt.Errorf("failed to set hop limit: %w", err)
+			}
+		}
+	}
+
+	if o.minTTL > 0 {
+		if err := unix.SetsockoptInt(fd, unix.IPPROTO_IP, unix.IP_MINTTL, o.minTTL); err != nil && network == "tcp4" {
+			return fmt.Errorf("failed to set minimum TTL: %w", err)
+		}
+		if network != "tcp4" {
+			if err := unix.SetsockoptInt(fd, unix.IPPROTO_IPV6, unix.IPV6_MINHOPCOUNT, o.minTTL); err != nil {
+				return fmt.Errorf("failed to set minimum hop count: %w", err)
+			}
+		}
+	}
+
+	return nil
+}
+
+// setTCPMD5Sig sets the TCP_MD5SIG socket option for the peer (RFC 2385), deleting the key of the peer when empty.
+// IPv4 peers are given as IPv4-mapped addresses to IPv6 sockets, which also accept IPv4 connections
+func setTCPMD5Sig(fd int, network string, addr netip.Addr, key string) error {
+	if len(key) > unix.TCP_MD5SIG_MAXKEYLEN {
+		return fmt.Errorf("TCP MD5 key of peer %s exceeds %d bytes", addr, unix.TCP_MD5SIG_MAXKEYLEN)
+	}
+
+	sig := unix.TCPMD5Sig{Keylen: uint16(len(key))}
+	copy(sig.Key[:], key)
+
+	if network == "tcp4" {
+		if !addr.Is4() {
+			return fmt.Errorf("cannot set TCP MD5 key of IPv6 peer %s on an IPv4 socket", addr)
+		}
+		// The address of sockaddr_in follows the family and the port, which is left unset as it is not used to match
+		// the peer
+		sig.Addr.Family = unix.AF_INET
+		ip := addr.As4()
+		copy(sig.Addr.Data[2:], ip[:])
+	} else {
+		// The address of sockaddr_in6 follows the family, the port and the flow information
+		sig.Addr.Family = unix.AF_INET6
+		ip := netip.AddrFrom16(addr.As16()).As16()
+		copy(sig.Addr.Data[6:], ip[:])
+	}
+
+	if err := unix.SetsockoptTCPMD5Sig(fd, unix.IPPROTO_TCP, unix.TCP_MD5SIG, &sig); err != nil {
+		return fmt.Errorf("failed to set TCP MD5 key of peer %s: %w", addr, err)
+	}
+
+	return nil
+}
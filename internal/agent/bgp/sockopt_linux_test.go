@@ -0,0 +1,130 @@
+//go:build linux
+
+package bgp
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/go-logr/logr"
+	"github.com/yago-123/routebird/api/v1alphav1"
+	corev1 "k8s.io/api/core/v1"
+
+	cfg "github.com/yago-123/routebird/internal/common"
+)
+
+func TestTCPMD5Signature(t *testing.T) {
+	loopback := netip.MustParseAddr("127.0.0.1")
+
+	listenConfig := net.ListenConfig{Control: socketOptions{md5Keys: map[netip.Addr]string{loopback: "secret"}}.control}
+	listener, err := listenConfig.Listen(context.Background(), "tcp4", "127.0.0.1:0")
+	if errors.Is(err, syscall.ENOPROTOOPT) || errors.Is(err, syscall.ENOENT) {
+		t.Skipf("TCP MD5 signatures not supported by the kernel: %v", err)
+	}
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	defer func() { _ = listener.Close() }()
+
+	go func() {
+		for {
+			conn, errAccept := listener.Accept()
+			if errAccept != nil {
+				return
+			}
+			_ = conn.Close()
+		}
+	}()
+
+	// Segments signed with the right key are accepted, while unsigned ones are silently dropped by the kernel
+	signed := net.Dialer{Timeout: time.Second, Control: socketOptions{md5Keys: map[netip.Addr]string{loopback: "secret"}}.control}
+	conn, err := signed.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatalf("failed to connect with TCP MD5 signature: %v", err)
+	}
+	_ = conn.Close()
+
+	unsigned := net.Dialer{Timeout: 500 * time.Millisecond}
+	if conn, err = unsigned.Dial("tcp", listener.Addr().String()); err == nil {
+		_ = conn.Close()
+		t.Fatalf("expected connection without TCP MD5 signature to fail")
+	}
+}
+
+func TestUpdateListenerKeys(t *testing.T) {
+	loopback := netip.MustParseAddr("127.0.0.1")
+
+	mgr, err := newManager(cfg.Config{
+		LocalASN: 65000,
+		Peers: []v1alphav1.BGPPeer{{
+			Address:           loopback.String(),
+			ASN:               65001,
+			Passive:           true,
+			PasswordSecretRef: &corev1.SecretKeySelector{Key: "password"},
+		}},
+	}, "node", false, nil, logr.Discard())
+	if err != nil {
+		t.Fatalf("failed to create manager: %v", err)
+	}
+	mgr.peers[0].passwordFile = filepath.Join(t.TempDir(), "password")
+
+	keys := map[netip.Addr]string{loopback: "old"}
+	listenConfig := net.ListenConfig{Control: socketOptions{md5Keys: keys}.control}
+	listener, err := listenConfig.Listen(context.Background(), "tcp4", "127.0.0.1:0")
+	if errors.Is(err, syscall.ENOPROTOOPT) || errors.Is(err, syscall.ENOENT) {
+		t.Skipf("TCP MD5 signatures not supported by the kernel: %v", err)
+	}
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	defer func() { _ = listener.Close() }()
+
+	go func() {
+		for {
+			conn, errAccept := listener.Accept()
+			if errAccept != nil {
+				return
+			}
+			_ = conn.Close()
+		}
+	}()
+
+	rawConn, err := listener.(*net.TCPListener).SyscallConn()
+	if err != nil {
+		t.Fatalf("failed to access listener socket: %v", err)
+	}
+
+	// Keys whose password file cannot be read are kept
+	mgr.updateListenerKeys(rawConn, "tcp4", keys)
+	if keys[loopback] != "old" {
+		t.Fatalf("expected key to be kept, got %q", keys[loopback])
+	}
+
+	if err = os.WriteFile(mgr.peers[0].passwordFile, []byte("new"), 0o600); err != nil {
+		t.Fatalf("failed to write password file: %v", err)
+	}
+	mgr.updateListenerKeys(rawConn, "tcp4", keys)
+	if keys[loopback] != "new" {
+		t.Fatalf("expected key to be updated, got %q", keys[loopback])
+	}
+
+	signed := net.Dialer{Timeout: time.Second, Control: socketOptions{md5Keys: map[netip.Addr]string{loopback: "new"}}.control}
+	conn, err := signed.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatalf("failed to connect with updated TCP MD5 key: %v", err)
+	}
+	_ = conn.Close()
+
+	stale := net.Dialer{Timeout: 500 * time.Millisecond, Control: socketOptions{md5Keys: map[netip.Addr]string{loopback: "old"}}.control}
+	if conn, err = stale.Dial("tcp", listener.Addr().String()); err == nil {
+		_ = conn.Close()
+		t.Fatalf("expected connection with the previous TCP MD5 key to fail")
+	}
+}
@@ -0,0 +1,16 @@
+//go:build !linux
+
+package bgp
+
+import (
+	"errors"
+	"syscall"
+)
+
+// control fails unless no option is set, as TCP MD5 signatures and TTL security are only supported on Linux
+func (o socketOptions) control(string, string, syscall.RawConn) error {
+	if o.isZero() {
+		return nil
+	}
+	return errors.New("TCP MD5 signatures and TTL settings are only supported on Linux")
+}
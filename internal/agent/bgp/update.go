@@ -0,0 +1,178 @@
+package bgp
+
+import (
+	"cmp"
+	"fmt"
+	"net/netip"
+	"slices"
+
+	"github.com/yago-123/routebird/internal/agent/bgp/packet"
+)
+
+const (
+	// emptyUpdateLen is the length of an UPDATE message without any withdrawn route, path attribute or NLRI
+	emptyUpdateLen = packet.HeaderLen + 4
+
+	// Worst case lengths of the MP_REACH_NLRI and MP_UNREACH_NLRI attributes without next hop nor prefixes, assuming
+	// that the extended length flag is used
+	mpReachOverhead   = 4 + 5
+	mpUnreachOverhead = 4 + 3
+)
+
+// family identifies an address family by its AFI and SAFI
+type family struct {
+	afi  packet.AFI
+	safi packet.SAFI
+}
+
+var (
+	familyIPv4Unicast = family{afi: packet.AFIIPv4, safi: packet.SAFIUnicast}
+	familyIPv6Unicast = family{afi: packet.AFIIPv6, safi: packet.SAFIUnicast}
+
+	// supportedFamilies contains the address families announced in the multiprotocol capabilities of the OPEN message
+	supportedFamilies = []family{familyIPv4Unicast, familyIPv6Unicast}
+
+	// extendedNextHop is the encoding of IPv4 unicast routes with IPv6 next hops offered to the peers over IPv6
+	// sessions (RFC 8950)
+	extendedNextHop = packet.NextHopEncoding{AFI: packet.AFIIPv4, SAFI: packet.SAFIUnicast, NextHopAFI: packet.AFIIPv6}
+)
+
+func (f family) String() string {
+	switch f {
+	case familyIPv4Unicast:
+		return "ipv4-unicast"
+	case familyIPv6Unicast:
+		return "ipv6-unicast"
+	default:
+		return fmt.Sprintf("afi-%d-safi-%d", f.afi, f.safi)
+	}
+}
+
+// prefixFamily returns the unicast address family of the prefix
+func prefixFamily(prefix netip.Prefix) family {
+	if prefix.Addr().Is4() {
+		return familyIPv4Unicast
+	}
+	return familyIPv6Unicast
+}
+
+// buildUpdates packs the withdrawn and announced prefixes of the address family into as many UPDATE messages as
+// required so that none of them exceeds the maximum BGP message length. IPv4 unicast prefixes are carried in the
+// withdrawn routes and NLRI fields unless announced with an IPv6 next hop, any other family is carried in the
+// MP_UNREACH_NLRI and MP_REACH_NLRI attributes. Every prefix carries the path identifier when it is set, which requires
+// ADD-PATH to be negotiated for the family
+func buildUpdates(fam family, withdrawn, announced []netip.Prefix, attrs []packet.PathAttribute, nextHop netip.Addr, pathID *uint32) ([]*packet.Update, error) {
+	var updates []*packet.Update
+
+	pathIDLen := 0
+	pathIDs := func(int) []uint32 { return nil }
+	if pathID != nil {
+		pathIDLen = packet.PathIDLen
+		pathIDs = func(n int) []uint32 { return slices.Repeat([]uint32{*pathID}, n) }
+	}
+
+	limit := packet.MaxMessageLen - emptyUpdateLen
+	if fam != familyIPv4Unicast {
+		limit -= mpUnreachOverhead
+	}
+
+	for len(withdrawn) > 0 {
+		var chunk []netip.Prefix
+		chunk, withdrawn = splitPrefixes(withdrawn, limit, pathIDLen)
+		if len(chunk) == 0 {
+			return nil, packet.ErrMessageTooLong
+		}
+
+		if fam == familyIPv4Unicast {
+			updates = append(updates, &packet.Update{WithdrawnRoutes: chunk, WithdrawnPathIDs: pathIDs(len(chunk))})
+		} else {
+			updates = append(updates, &packet.Update{PathAttributes: []packet.PathAttribute{
+				&packet.MPUnreachNLRI{AFI: fam.afi, SAFI: fam.safi, WithdrawnRoutes: chunk, PathIDs: pathIDs(len(chunk))},
+			}})
+		}
+	}
+
+	if len(announced) == 0 {
+		return updates, nil
+	}
+
+	// AS numbers are assumed to take 4 octets, which is the worst case regardless of the negotiated capabilities
+	attrsLen, err := packet.Options{FourOctetAS: true}.AttributesLen(attrs)
+	if err != nil {
+		return nil, fmt.Errorf("invalid path attributes: %w", err)
+	}
+
+	// IPv4 routes with IPv6 next hops are carried in MP_REACH_NLRI as well (RFC 8950)
+	nlriField := fam == familyIPv4Unicast && nextHop.Is4()
+	limit = packet.MaxMessageLen - emptyUpdateLen - attrsLen
+	if nlriField {
+		attrs = append(slices.Clip(attrs), &packet.NextHop{Addr: nextHop})
+		limit -= 3 + 4
+	} else {
+		limit -= mpReachOverhead + nextHop.BitLen()/8
+	}
+
+	for len(announced) > 0 {
+		var chunk []netip.Prefix
+		chunk, announced = splitPrefixes(announced, limit, pathIDLen)
+		if len(chunk) == 0 {
+			return nil, packet.ErrMessageTooLong
+		}
+
+		if nlriField {
+			updates = append(updates, &packet.Update{PathAttributes: sortAttributes(attrs), NLRI: chunk, NLRIPathIDs: pathIDs(len(chunk))})
+		} else {
+			updates = append(updates, &packet.Update{PathAttributes: sortAttributes(append(slices.Clip(attrs), &packet.MPReachNLRI{
+				AFI:      fam.afi,
+				SAFI:     fam.safi,
+				NextHops: []netip.Addr{nextHop},
+				NLRI:     chunk,
+				PathIDs:  pathIDs(len(chunk)),
+			}))})
+		}
+	}
+
+	return updates, nil
+}
+
+// sortAttributes sorts the path attributes in ascending order of type code, as recommended by RFC 4271
+func sortAttributes(attrs []packet.PathAttribute) []packet.PathAttribute {
+	sorted := slices.Clone(attrs)
+	slices.SortStableFunc(sorted, func(a, b packet.PathAttribute) int {
+		return cmp.Compare(a.Code(), b.Code())
+	})
+
+	return sorted
+}
+
+// splitPrefixes returns the longest head of prefixes whose encoding fits in limit bytes, together with the remaining
+// prefixes. Each prefix takes pathIDLen more bytes for its path identifier
+func splitPrefixes(prefixes []netip.Prefix, limit, pathIDLen int) ([]netip.Prefix, []netip.Prefix) {
+	size := 0
+	for i, prefix := range prefixes {
+		size += pathIDLen + packet.PrefixLen(prefix)
+		if size > limit {
+			return prefixes[:i], prefixes[i:]
+		}
+	}
+
+	return prefixes, nil
+}
+
+// routeGroup contains prefixes advertised with the same path attributes
+type routeGroup struct {
+	attrs    RouteAttributes
+	prefixes []netip.Prefix
+}
+
+// addToGroup adds the prefix to the group with the same attributes sent to the peers, creating it if none exists yet
+func addToGroup(groups []routeGroup, prefix netip.Prefix, attrs RouteAttributes) []routeGroup {
+	for i := range groups {
+		if groups[i].attrs.wireEqual(attrs) {
+			groups[i].prefixes = append(groups[i].prefixes, prefix)
+			return groups
+		}
+	}
+
+	return append(groups, routeGroup{attrs: attrs, prefixes: []netip.Prefix{prefix}})
+}
@@ -1,3 +1,26 @@
 package config
 
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+
+	cfg "github.com/yago-123/routebird/internal/common"
+)
+
 // todo: loads config from env/configmap/flags/CRD
+
+// Load reads the agent configuration rendered by the controller into the agent ConfigMap
+func Load(path string) (cfg.Config, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return cfg.Config{}, fmt.Errorf("failed to read config file %s: %w", path, err)
+	}
+
+	var config cfg.Config
+	if err = json.Unmarshal(data, &config); err != nil {
+		return cfg.Config{}, fmt.Errorf("failed to parse config file %s: %w", path, err)
+	}
+
+	return config, nil
+}
@@ -0,0 +1,123 @@
+package k8s
+
+import (
+	"fmt"
+	"maps"
+	"strings"
+
+	"github.com/yago-123/routebird/api/v1alphav1"
+	"github.com/yago-123/routebird/internal/agent/bgp"
+	corev1 "k8s.io/api/core/v1"
+)
+
+// attributeAnnotations maps the service annotations overriding the path attributes of the BGPRoute to the function
+// applying their comma separated values. Empty annotations unset the attribute
+var attributeAnnotations = []struct {
+	key   string
+	apply func(attrs *bgp.RouteAttributes, values []string) error
+}{
+	{
+		key: v1alphav1.CommunitiesAnnotation,
+		apply: func(attrs *bgp.RouteAttributes, values []string) (err error) {
+			attrs.Communities, err = bgp.ParseCommunities(values)
+			return err
+		},
+	},
+	{
+		key: v1alphav1.LargeCommunitiesAnnotation,
+		apply: func(attrs *bgp.RouteAttributes, values []string) (err error) {
+			attrs.LargeCommunities, err = bgp.ParseLargeCommunities(values)
+			return err
+		},
+	},
+	{
+		key: v1alphav1.ExtendedCommunitiesAnnotation,
+		apply: func(attrs *bgp.RouteAttributes, values []string) (err error) {
+			attrs.ExtendedCommunities, err = bgp.ParseExtendedCommunities(values)
+			return err
+		},
+	},
+	{
+		key: v1alphav1.LocalPreferenceAnnotation,
+		apply: func(attrs *bgp.RouteAttributes, values []string) (err error) {
+			attrs.LocalPref, err = parseSingle(values, bgp.ParseUint32)
+			return err
+		},
+	},
+	{
+		key: v1alphav1.MEDAnnotation,
+		apply: func(attrs *bgp.RouteAttributes, values []string) (err error) {
+			attrs.MED, err = parseSingle(values, bgp.ParseUint32)
+			return err
+		},
+	},
+	{
+		key: v1alphav1.ASPathPrependAnnotation,
+		apply: func(attrs *bgp.RouteAttributes, values []string) (err error) {
+			attrs.ASPathPrepend, err = parseSingle(values, bgp.ParseASPathPrepend)
+			return err
+		},
+	},
+	{
+		key: v1alphav1.NextHopsAnnotation,
+		apply: func(attrs *bgp.RouteAttributes, values []string) (err error) {
+			attrs.NextHopIPv4, attrs.NextHopIPv6, err = bgp.ParseNextHops(values)
+			return err
+		},
+	},
+}
+
+// serviceAttributes returns the path attributes of the routes of the service, which are the default attributes of the
+// BGPRoute overridden by the annotations of the service. Invalid annotations are ignored, so that a typo does not stop
+// the advertisement of the service
+func (r *controlLoop) serviceAttributes(svc *corev1.Service) bgp.RouteAttributes {
+	attrs := r.defaultAttributes
+	attrs.ServiceNamespace = svc.Namespace
+	attrs.ServiceLabels = maps.Clone(svc.Labels)
+
+	for _, annotation := range attributeAnnotations {
+		values, ok := annotationList(svc, annotation.key)
+		if !ok {
+			continue
+		}
+
+		overridden := attrs
+		if err := annotation.apply(&overridden, values); err != nil {
+			r.logger.Error(err, "Ignoring invalid annotation", "service", svc.Name, "annotation", annotation.key)
+			continue
+		}
+		attrs = overridden
+	}
+
+	return attrs
+}
+
+// annotationList returns the comma separated values of the annotation of the service, and whether it is present
+func annotationList(svc *corev1.Service, key string) ([]string, bool) {
+	annotation, ok := svc.Annotations[key]
+	if !ok {
+		return nil, false
+	}
+
+	var values []string
+	for _, value := range strings.Split(annotation, ",") {
+		if value = strings.TrimSpace(value); value != "" {
+			values = append(values, value)
+		}
+	}
+
+	return values, true
+}
+
+// parseSingle parses the value of an annotation holding a single value, returning the zero value for empty ones
+func parseSingle[T any](values []string, parse func(string) (T, error)) (T, error) {
+	var zero T
+	switch len(values) {
+	case 0:
+		return zero, nil
+	case 1:
+		return parse(values[0])
+	default:
+		return zero, fmt.Errorf("expected a single value, got %d", len(values))
+	}
+}
@@ -2,15 +2,23 @@ package k8s
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"maps"
+	"net/netip"
+	"slices"
+	"sync"
 
 	"github.com/go-logr/logr"
+	"github.com/yago-123/routebird/internal/agent/bgp"
 	corev1 "k8s.io/api/core/v1"
 	discoveryv1 "k8s.io/api/discovery/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
 	"k8s.io/apimachinery/pkg/labels"
 	"k8s.io/client-go/informers"
 	v1 "k8s.io/client-go/listers/core/v1"
 	discoveryv1Lister "k8s.io/client-go/listers/discovery/v1"
+	"k8s.io/client-go/tools/cache"
 )
 
 type ControlLoop interface {
@@ -22,20 +30,53 @@ type ControlLoop interface {
 	//
 	// It returns an error if the resynchronization fails and should be retried.
 	Resync(ctx context.Context) error
+
+	// Reconcile recomputes the routes of a single service, identified by its namespace/name key, and aligns the BGP
+	// route advertisements with them. Keys of deleted services withdraw the routes of the service.
+	//
+	// It returns an error if the reconciliation fails and should be retried.
+	Reconcile(ctx context.Context, key string) error
+
+	// UpdateSelection replaces the selector of the advertised services and the default path attributes of their
+	// routes, announcing and withdrawing the routes of the services accordingly.
+	//
+	// It returns an error if the resulting reconciliation fails and should be retried.
+	UpdateSelection(ctx context.Context, selector labels.Selector, defaultAttributes bgp.RouteAttributes) error
 }
 
-// TODO(): this implementation is flawed, the current impl. is just to mock a control loop
+// serviceRoutes are the routes advertised for a service, all of them with the same path attributes
+type serviceRoutes struct {
+	prefixes   []string
+	attributes bgp.RouteAttributes
+}
 
 type controlLoop struct {
 	svcLister v1.ServiceLister
 	epsLister discoveryv1Lister.EndpointSliceLister
 
+	bgpManager bgp.Manager
+
+	// serviceSelector selects the services handled by the agent
+	serviceSelector labels.Selector
+
+	// defaultAttributes are the path attributes of the routes of services that do not override them
+	defaultAttributes bgp.RouteAttributes
+
+	// routes contains the routes of every advertised service, indexed by service key. The lock is held while the
+	// routes are computed from the listers and applied, so that a resync never reverts a concurrent reconciliation
+	// with routes computed before it. It guards the selector and the default attributes as well
+	routes map[string]serviceRoutes
+	lock   sync.Mutex
+
 	nodeName string
 	logger   logr.Logger
 }
 
 func NewControlLoop(
 	informerFactory informers.SharedInformerFactory,
+	bgpManager bgp.Manager,
+	serviceSelector labels.Selector,
+	defaultAttributes bgp.RouteAttributes,
 	nodeName string,
 	logger logr.Logger,
 ) ControlLoop {
@@ -44,71 +85,220 @@ func NewControlLoop(
 	epsLister := informerFactory.Discovery().V1().EndpointSlices().Lister()
 
 	return &controlLoop{
-		svcLister: svcLister,
-		epsLister: epsLister,
-		nodeName:  nodeName,
-		logger:    logger,
+		svcLister:         svcLister,
+		epsLister:         epsLister,
+		bgpManager:        bgpManager,
+		serviceSelector:   serviceSelector,
+		defaultAttributes: defaultAttributes,
+		routes:            make(map[string]serviceRoutes),
+		nodeName:          nodeName,
+		logger:            logger,
 	}
 }
 
-func (r *controlLoop) Resync(ctx context.Context) error {
-	// TODO(): the cache should sync before running to simulate a real control loop, but given that this is a mock of
-	// TODO(): a real control loop, right now it's OK
+// Resync recomputes the routes of every service and announces or withdraws only the difference with the routes
+// currently advertised by the BGP manager, so that repeated calls without cluster changes are no-ops
+func (r *controlLoop) Resync(_ context.Context) error {
+	r.lock.Lock()
+	defer r.lock.Unlock()
 
-	services, err := r.svcLister.List(labels.Everything())
+	return r.resync()
+}
+
+func (r *controlLoop) UpdateSelection(_ context.Context, selector labels.Selector, defaultAttributes bgp.RouteAttributes) error {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	r.serviceSelector = selector
+	r.defaultAttributes = defaultAttributes
+	return r.resync()
+}
+
+// resync recomputes the routes of every service and applies them as Resync does. It must be called with the lock held
+func (r *controlLoop) resync() error {
+	services, err := r.svcLister.List(r.serviceSelector)
 	if err != nil {
-		return fmt.Errorf("failed to list services: %v", err)
+		return fmt.Errorf("failed to list services: %w", err)
 	}
+
+	routes := make(map[string]serviceRoutes)
 	for _, svc := range services {
-		if svc.Spec.Type != corev1.ServiceTypeLoadBalancer {
-			r.logger.Info("Skipping non LoadBalancer service", "service", svc.Name)
-			continue
+		svcRoutes, errRoutes := r.serviceRoutes(svc)
+		if errRoutes != nil {
+			return errRoutes
 		}
-
-		if svc.Spec.ExternalTrafficPolicy != corev1.ServiceExternalTrafficPolicyTypeCluster {
-			r.logger.Info("Skipping service with externalTrafficPolicy different from Cluster", "service", svc.Name)
-			continue
+		if len(svcRoutes.prefixes) > 0 {
+			routes[svc.Namespace+"/"+svc.Name] = svcRoutes
 		}
+	}
 
-		if len(svc.Spec.Selector) == 0 {
-			r.logger.Info("Skipping service without selector", "service", svc.Name)
-			continue
+	r.routes = routes
+	return r.syncRoutes()
+}
+
+func (r *controlLoop) Reconcile(_ context.Context, key string) error {
+	namespace, name, err := cache.SplitMetaNamespaceKey(key)
+	if err != nil {
+		return fmt.Errorf("invalid service key %q: %w", key, err)
+	}
+
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	var svcRoutes serviceRoutes
+	svc, err := r.svcLister.Services(namespace).Get(name)
+	switch {
+	case apierrors.IsNotFound(err):
+		// The service is gone, its routes must be withdrawn
+	case err != nil:
+		return fmt.Errorf("failed to get service %s: %w", key, err)
+	default:
+		if svcRoutes, err = r.serviceRoutes(svc); err != nil {
+			return err
 		}
+	}
 
-		svcIPs := make([]string, 0)
-		for _, ingress := range svc.Status.LoadBalancer.Ingress {
-			if ingress.IP != "" {
-				svcIPs = append(svcIPs, ingress.IP)
+	if len(svcRoutes.prefixes) > 0 {
+		r.routes[key] = svcRoutes
+	} else {
+		delete(r.routes, key)
+	}
+
+	return r.syncRoutes()
+}
+
+// syncRoutes announces or withdraws the difference between the routes of every service and the routes currently
+// advertised by the BGP manager, including changes of their path attributes. Routes shared by several services are
+// advertised while any of them requires it, with the attributes of the first service in key order. It must be called
+// with the lock held
+func (r *controlLoop) syncRoutes() error {
+	desired := make(map[string]bgp.RouteAttributes)
+	for _, key := range slices.Sorted(maps.Keys(r.routes)) {
+		for _, route := range r.routes[key].prefixes {
+			if _, ok := desired[route]; !ok {
+				desired[route] = r.routes[key].attributes
 			}
 		}
+	}
 
-		if len(svcIPs) == 0 {
-			r.logger.Info("Skipping service without LoadBalancer IP", "service", svc.Name)
+	advertised := r.bgpManager.Routes()
+
+	// Keep going on failures so that a single invalid route does not block the rest of the advertisements
+	var errs []error
+	announced, withdrawn := 0, 0
+	for route, attrs := range desired {
+		if current, ok := advertised[route]; ok && current.Equal(attrs) {
+			continue
+		}
+		if errAnnounce := r.bgpManager.AnnounceRoute(route, attrs); errAnnounce != nil {
+			errs = append(errs, fmt.Errorf("failed to announce route %s: %w", route, errAnnounce))
 			continue
 		}
+		announced++
+	}
+	for route := range advertised {
+		if _, ok := desired[route]; ok {
+			continue
+		}
+		if errWithdraw := r.bgpManager.WithdrawRoute(route); errWithdraw != nil {
+			errs = append(errs, fmt.Errorf("failed to withdraw route %s: %w", route, errWithdraw))
+			continue
+		}
+		withdrawn++
+	}
 
-		selector := labels.Set(map[string]string{
-			discoveryv1.LabelServiceName: svc.Name,
-		}).AsSelector()
+	if announced > 0 || withdrawn > 0 {
+		r.logger.Info("Reconciled advertised routes", "announced", announced, "withdrawn", withdrawn, "total", len(desired))
+	}
 
-		epsForService, errEPSLister := r.epsLister.EndpointSlices(svc.Namespace).List(selector)
-		if errEPSLister != nil {
-			return fmt.Errorf("failed to list endpoint slices for service %s: %v", svc.Name, errEPSLister)
-		}
+	return errors.Join(errs...)
+}
+
+// serviceRoutes returns the host routes of the LoadBalancer IPs of the service if it must be advertised by this node,
+// in the canonical prefix form used by the BGP manager, together with their path attributes
+func (r *controlLoop) serviceRoutes(svc *corev1.Service) (serviceRoutes, error) {
+	advertise, err := r.shouldAdvertise(svc)
+	if err != nil || !advertise {
+		return serviceRoutes{}, err
+	}
+
+	routes := serviceRoutes{attributes: r.serviceAttributes(svc)}
+	for _, ip := range r.serviceIPs(svc) {
+		routes.prefixes = append(routes.prefixes, netip.PrefixFrom(ip, ip.BitLen()).String())
+	}
+
+	return routes, nil
+}
+
+// shouldAdvertise reports whether the LoadBalancer IPs of the service must be advertised by this node. Services with
+// the Cluster externalTrafficPolicy are advertised by every node as long as they have a ready endpoint, as traffic is
+// forwarded to any node. Services with the Local policy are only advertised by the nodes hosting a ready endpoint, so
+// that client source IPs are preserved
+func (r *controlLoop) shouldAdvertise(svc *corev1.Service) (bool, error) {
+	if !isSelectedService(svc, r.serviceSelector) {
+		return false, nil
+	}
+
+	if len(svc.Spec.Selector) == 0 {
+		r.logger.V(1).Info("Skipping service without selector", "service", svc.Name)
+		return false, nil
+	}
 
-		for _, eps := range epsForService {
-			// Iterate over the endpoints within each EndpointSlice
-			for _, endpoint := range eps.Endpoints {
-				if endpoint.NodeName != nil && *endpoint.NodeName == r.nodeName {
-					r.logger.Info("Resync", "endpointSlice", eps.Name, "node", r.nodeName)
-					// No need to check further endpoints in this EndpointSlice
-					break
-				}
+	switch svc.Spec.ExternalTrafficPolicy {
+	case corev1.ServiceExternalTrafficPolicyCluster, "":
+		return r.hasReadyEndpoint(svc, false)
+	case corev1.ServiceExternalTrafficPolicyLocal:
+		return r.hasReadyEndpoint(svc, true)
+	default:
+		r.logger.V(1).Info("Skipping service with unknown externalTrafficPolicy", "service", svc.Name, "policy", svc.Spec.ExternalTrafficPolicy)
+		return false, nil
+	}
+}
+
+// hasReadyEndpoint reports whether the service has at least one ready endpoint. When local is set only the endpoints
+// hosted by this node are considered
+func (r *controlLoop) hasReadyEndpoint(svc *corev1.Service, local bool) (bool, error) {
+	selector := labels.Set(map[string]string{
+		discoveryv1.LabelServiceName: svc.Name,
+	}).AsSelector()
+
+	epsForService, err := r.epsLister.EndpointSlices(svc.Namespace).List(selector)
+	if err != nil {
+		return false, fmt.Errorf("failed to list endpoint slices for service %s: %w", svc.Name, err)
+	}
+
+	for _, eps := range epsForService {
+		for _, endpoint := range eps.Endpoints {
+			if local && (endpoint.NodeName == nil || *endpoint.NodeName != r.nodeName) {
+				continue
+			}
+
+			// A nil ready condition must be interpreted as ready
+			if endpoint.Conditions.Ready == nil || *endpoint.Conditions.Ready {
+				return true, nil
 			}
 		}
+	}
+
+	return false, nil
+}
+
+// serviceIPs returns the LoadBalancer ingress IPs of the service. Both IPv4 and IPv6 IPs are returned, dual-stack
+// services carry one of each
+func (r *controlLoop) serviceIPs(svc *corev1.Service) []netip.Addr {
+	ips := make([]netip.Addr, 0, len(svc.Status.LoadBalancer.Ingress))
+	for _, ingress := range svc.Status.LoadBalancer.Ingress {
+		if ingress.IP == "" {
+			continue
+		}
 
-		r.logger.Info("Resyncing", "service", svc.Name)
+		ip, err := netip.ParseAddr(ingress.IP)
+		if err != nil {
+			r.logger.Error(err, "Skipping invalid LoadBalancer IP", "service", svc.Name, "ip", ingress.IP)
+			continue
+		}
+		ips = append(ips, ip.Unmap())
 	}
 
-	return nil
+	return ips
 }
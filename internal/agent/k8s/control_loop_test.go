@@ -0,0 +1,361 @@
+package k8s
+
+import (
+	"context"
+	"maps"
+	"slices"
+	"testing"
+
+	"github.com/go-logr/logr"
+	"github.com/yago-123/routebird/api/v1alphav1"
+	"github.com/yago-123/routebird/internal/agent/bgp"
+	"github.com/yago-123/routebird/internal/agent/bgp/packet"
+	cfg "github.com/yago-123/routebird/internal/common"
+	corev1 "k8s.io/api/core/v1"
+	discoveryv1 "k8s.io/api/discovery/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/informers"
+	"k8s.io/client-go/kubernetes/fake"
+	"k8s.io/client-go/tools/cache"
+)
+
+// fakeManager records the routes announced and withdrawn through it
+type fakeManager struct {
+	routes    map[string]bgp.RouteAttributes
+	announced []string
+	withdrawn []string
+}
+
+func (f *fakeManager) Run(context.Context) error {
+	return nil
+}
+
+func (f *fakeManager) AnnounceRoute(route string, attrs bgp.RouteAttributes) error {
+	f.routes[route] = attrs
+	f.announced = append(f.announced, route)
+	return nil
+}
+
+func (f *fakeManager) WithdrawRoute(route string) error {
+	delete(f.routes, route)
+	f.withdrawn = append(f.withdrawn, route)
+	return nil
+}
+
+func (f *fakeManager) Routes() map[string]bgp.RouteAttributes {
+	return maps.Clone(f.routes)
+}
+
+func (f *fakeManager) AdjRIBIn() map[string][]bgp.Route {
+	return nil
+}
+
+func (f *fakeManager) LocRIB() []bgp.Route {
+	return nil
+}
+
+func (f *fakeManager) AdjRIBOut() map[string][]bgp.Route {
+	return nil
+}
+
+func (f *fakeManager) LookupRoute(string) (bgp.Route, bool, error) {
+	return bgp.Route{}, false, nil
+}
+
+func (f *fakeManager) UpdatePeers(cfg.Config) error {
+	return nil
+}
+
+func (f *fakeManager) UpdatePolicies(cfg.Config) error {
+	return nil
+}
+
+// prefixes returns the advertised routes in order
+func (f *fakeManager) prefixes() []string {
+	return slices.Sorted(maps.Keys(f.routes))
+}
+
+func (f *fakeManager) reset() {
+	f.announced, f.withdrawn = nil, nil
+}
+
+// testCluster gives direct access to the informer caches read by the control loop
+type testCluster struct {
+	services       cache.Indexer
+	endpointSlices cache.Indexer
+}
+
+func newTestControlLoop(t *testing.T, nodeName string, selector metav1.LabelSelector) (ControlLoop, *testCluster, *fakeManager) {
+	t.Helper()
+
+	serviceSelector, err := NewServiceSelector(selector)
+	if err != nil {
+		t.Fatalf("failed to create service selector: %v", err)
+	}
+
+	informerFactory := informers.NewSharedInformerFactory(fake.NewClientset(), 0)
+	manager := &fakeManager{routes: make(map[string]bgp.RouteAttributes)}
+	controlLoop := NewControlLoop(informerFactory, manager, serviceSelector, bgp.RouteAttributes{}, nodeName, logr.Discard())
+
+	return controlLoop, &testCluster{
+		services:       informerFactory.Core().V1().Services().Informer().GetIndexer(),
+		endpointSlices: informerFactory.Discovery().V1().EndpointSlices().Informer().GetIndexer(),
+	}, manager
+}
+
+func newLoadBalancerService(name string, policy corev1.ServiceExternalTrafficPolicy, ips ...string) *corev1.Service {
+	svc := &corev1.Service{
+		ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: "default", Labels: map[string]string{"app": name}},
+		Spec: corev1.ServiceSpec{
+			Type:                  corev1.ServiceTypeLoadBalancer,
+			ExternalTrafficPolicy: policy,
+			Selector:              map[string]string{"app": name},
+		},
+	}
+	for _, ip := range ips {
+		svc.Status.LoadBalancer.Ingress = append(svc.Status.LoadBalancer.Ingress, corev1.LoadBalancerIngress{IP: ip})
+	}
+
+	return svc
+}
+
+// newEndpointSlice returns an endpoint slice of the service with a ready endpoint on each of the nodes
+func newEndpointSlice(service string, nodeNames ...string) *discoveryv1.EndpointSlice {
+	eps := &discoveryv1.EndpointSlice{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      service + "-abcde",
+			Namespace: "default",
+			Labels:    map[string]string{discoveryv1.LabelServiceName: service},
+		},
+	}
+	for _, nodeName := range nodeNames {
+		eps.Endpoints = append(eps.Endpoints, discoveryv1.Endpoint{Addresses: []string{"10.244.0.10"}, NodeName: &nodeName})
+	}
+
+	return eps
+}
+
+func TestResyncAnnouncesOnlyDelta(t *testing.T) {
+	controlLoop, cluster, manager := newTestControlLoop(t, "node-a", metav1.LabelSelector{})
+
+	policy := corev1.ServiceExternalTrafficPolicyCluster
+	_ = cluster.services.Add(newLoadBalancerService("web", policy, "192.0.2.10", "2001:db8::10"))
+	_ = cluster.services.Add(newLoadBalancerService("idle", policy, "192.0.2.20"))
+	_ = cluster.endpointSlices.Add(newEndpointSlice("web", "node-b"))
+
+	// A route left over from a previous state of the cluster
+	manager.routes["192.0.2.99/32"] = bgp.RouteAttributes{}
+
+	if err := controlLoop.Resync(context.Background()); err != nil {
+		t.Fatalf("failed to resync: %v", err)
+	}
+	slices.Sort(manager.announced)
+	if !slices.Equal(manager.announced, []string{"192.0.2.10/32", "2001:db8::10/128"}) {
+		t.Fatalf("unexpected announced routes: %v", manager.announced)
+	}
+	if !slices.Equal(manager.withdrawn, []string{"192.0.2.99/32"}) {
+		t.Fatalf("unexpected withdrawn routes: %v", manager.withdrawn)
+	}
+
+	// Resyncing without changes in the cluster must not touch the advertised routes
+	manager.reset()
+	if err := controlLoop.Resync(context.Background()); err != nil {
+		t.Fatalf("failed to resync: %v", err)
+	}
+	if len(manager.announced) != 0 || len(manager.withdrawn) != 0 {
+		t.Fatalf("expected no changes, announced %v and withdrew %v", manager.announced, manager.withdrawn)
+	}
+
+	// Once the endpoints are gone, the service is no longer advertised
+	manager.reset()
+	_ = cluster.endpointSlices.Update(newEndpointSlice("web"))
+	if err := controlLoop.Resync(context.Background()); err != nil {
+		t.Fatalf("failed to resync: %v", err)
+	}
+	if len(manager.announced) != 0 || len(manager.prefixes()) != 0 {
+		t.Fatalf("expected every route to be withdrawn, advertising %v", manager.prefixes())
+	}
+}
+
+func TestResyncHonoursServiceSelector(t *testing.T) {
+	tests := []struct {
+		name     string
+		selector metav1.LabelSelector
+		expected []string
+	}{
+		{
+			name:     "default selector",
+			selector: metav1.LabelSelector{MatchLabels: map[string]string{v1alphav1.NeverMatchLabelKey: "true"}},
+		},
+		{
+			name:     "match labels",
+			selector: metav1.LabelSelector{MatchLabels: map[string]string{"app": "web"}},
+			expected: []string{"192.0.2.10/32"},
+		},
+		{
+			name: "match expressions",
+			selector: metav1.LabelSelector{MatchExpressions: []metav1.LabelSelectorRequirement{
+				{Key: "app", Operator: metav1.LabelSelectorOpNotIn, Values: []string{"web"}},
+			}},
+			expected: []string{"192.0.2.20/32"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			controlLoop, cluster, manager := newTestControlLoop(t, "node-a", tt.selector)
+
+			for name, ip := range map[string]string{"web": "192.0.2.10", "api": "192.0.2.20"} {
+				_ = cluster.services.Add(newLoadBalancerService(name, corev1.ServiceExternalTrafficPolicyCluster, ip))
+				_ = cluster.endpointSlices.Add(newEndpointSlice(name, "node-a"))
+			}
+
+			if err := controlLoop.Resync(context.Background()); err != nil {
+				t.Fatalf("failed to resync: %v", err)
+			}
+			if routes := manager.prefixes(); !slices.Equal(routes, tt.expected) {
+				t.Fatalf("expected routes %v, got %v", tt.expected, routes)
+			}
+		})
+	}
+}
+
+func TestUpdateSelection(t *testing.T) {
+	controlLoop, cluster, manager := newTestControlLoop(t, "node-a", metav1.LabelSelector{MatchLabels: map[string]string{"app": "web"}})
+
+	for name, ip := range map[string]string{"web": "192.0.2.10", "api": "192.0.2.20"} {
+		_ = cluster.services.Add(newLoadBalancerService(name, corev1.ServiceExternalTrafficPolicyCluster, ip))
+		_ = cluster.endpointSlices.Add(newEndpointSlice(name, "node-a"))
+	}
+	if err := controlLoop.Resync(context.Background()); err != nil {
+		t.Fatalf("failed to resync: %v", err)
+	}
+
+	selector, err := NewServiceSelector(metav1.LabelSelector{MatchLabels: map[string]string{"app": "api"}})
+	if err != nil {
+		t.Fatalf("failed to create service selector: %v", err)
+	}
+	localPref := uint32(200)
+	if err = controlLoop.UpdateSelection(context.Background(), selector, bgp.RouteAttributes{LocalPref: &localPref}); err != nil {
+		t.Fatalf("failed to update selection: %v", err)
+	}
+
+	// Routes of the services no longer selected are withdrawn, while the newly selected ones get the new attributes
+	if routes := manager.prefixes(); !slices.Equal(routes, []string{"192.0.2.20/32"}) {
+		t.Fatalf("expected routes of the newly selected service, got %v", routes)
+	}
+	if route := manager.routes["192.0.2.20/32"]; route.LocalPref == nil || *route.LocalPref != localPref {
+		t.Fatalf("expected route with the new default attributes, got %+v", manager.routes["192.0.2.20/32"])
+	}
+}
+
+func TestResyncExternalTrafficPolicyLocal(t *testing.T) {
+	controlLoop, cluster, manager := newTestControlLoop(t, "node-a", metav1.LabelSelector{})
+
+	_ = cluster.services.Add(newLoadBalancerService("web", corev1.ServiceExternalTrafficPolicyLocal, "192.0.2.10"))
+	eps := newEndpointSlice("web", "node-a", "node-b")
+	_ = cluster.endpointSlices.Add(eps)
+
+	if err := controlLoop.Resync(context.Background()); err != nil {
+		t.Fatalf("failed to resync: %v", err)
+	}
+	if routes := manager.prefixes(); !slices.Equal(routes, []string{"192.0.2.10/32"}) {
+		t.Fatalf("expected service to be advertised, got %v", routes)
+	}
+
+	// The endpoint of another node being ready is not enough, the route is withdrawn when the local one is not ready
+	notReady := false
+	eps = eps.DeepCopy()
+	eps.Endpoints[0].Conditions.Ready = &notReady
+	_ = cluster.endpointSlices.Update(eps)
+
+	if err := controlLoop.Resync(context.Background()); err != nil {
+		t.Fatalf("failed to resync: %v", err)
+	}
+	if routes := manager.prefixes(); len(routes) != 0 {
+		t.Fatalf("expected service to be withdrawn, got %v", routes)
+	}
+}
+
+func TestReconcileSharedRoutes(t *testing.T) {
+	controlLoop, cluster, manager := newTestControlLoop(t, "node-a", metav1.LabelSelector{})
+
+	// Both services share the same LoadBalancer IP on different ports. The route takes the attributes of the first
+	// service in key order, so it is reconciled first to avoid announcing the route again with its attributes
+	for _, name := range []string{"api", "web"} {
+		_ = cluster.services.Add(newLoadBalancerService(name, corev1.ServiceExternalTrafficPolicyCluster, "192.0.2.10"))
+		_ = cluster.endpointSlices.Add(newEndpointSlice(name, "node-a"))
+
+		if err := controlLoop.Reconcile(context.Background(), "default/"+name); err != nil {
+			t.Fatalf("failed to reconcile %s: %v", name, err)
+		}
+	}
+	if !slices.Equal(manager.announced, []string{"192.0.2.10/32"}) {
+		t.Fatalf("expected the shared route to be announced once, got %v", manager.announced)
+	}
+
+	// The route is kept while any of the services requires it
+	_ = cluster.services.Delete(newLoadBalancerService("web", corev1.ServiceExternalTrafficPolicyCluster))
+	if err := controlLoop.Reconcile(context.Background(), "default/web"); err != nil {
+		t.Fatalf("failed to reconcile deleted service: %v", err)
+	}
+	if len(manager.withdrawn) != 0 {
+		t.Fatalf("expected shared route to be kept, withdrew %v", manager.withdrawn)
+	}
+
+	_ = cluster.services.Delete(newLoadBalancerService("api", corev1.ServiceExternalTrafficPolicyCluster))
+	if err := controlLoop.Reconcile(context.Background(), "default/api"); err != nil {
+		t.Fatalf("failed to reconcile deleted service: %v", err)
+	}
+	if !slices.Equal(manager.withdrawn, []string{"192.0.2.10/32"}) {
+		t.Fatalf("expected shared route to be withdrawn, got %v", manager.withdrawn)
+	}
+}
+
+func TestServiceAttributeAnnotations(t *testing.T) {
+	loop, cluster, manager := newTestControlLoop(t, "node-a", metav1.LabelSelector{})
+	loop.(*controlLoop).defaultAttributes = bgp.RouteAttributes{
+		Communities:      []uint32{65000<<16 | 100},
+		LargeCommunities: []packet.LargeCommunity{{GlobalAdministrator: 65000, LocalData1: 1, LocalData2: 1}},
+	}
+
+	svc := newLoadBalancerService("web", corev1.ServiceExternalTrafficPolicyCluster, "192.0.2.10")
+	_ = cluster.services.Add(svc)
+	_ = cluster.endpointSlices.Add(newEndpointSlice("web", "node-a"))
+
+	if err := loop.Reconcile(context.Background(), "default/web"); err != nil {
+		t.Fatalf("failed to reconcile: %v", err)
+	}
+	if attrs := manager.routes["192.0.2.10/32"]; !slices.Equal(attrs.Communities, []uint32{65000<<16 | 100}) {
+		t.Fatalf("expected default communities, got %v", attrs.Communities)
+	}
+
+	// Annotations override the defaults, an empty annotation removes them and invalid ones are ignored
+	svc = svc.DeepCopy()
+	svc.Annotations = map[string]string{
+		v1alphav1.CommunitiesAnnotation:         "no-export, 65000:200",
+		v1alphav1.LargeCommunitiesAnnotation:    "",
+		v1alphav1.ExtendedCommunitiesAnnotation: "rt:invalid",
+		v1alphav1.MEDAnnotation:                 "50",
+		v1alphav1.ASPathPrependAnnotation:       "1,2",
+	}
+	_ = cluster.services.Update(svc)
+
+	manager.reset()
+	if err := loop.Reconcile(context.Background(), "default/web"); err != nil {
+		t.Fatalf("failed to reconcile: %v", err)
+	}
+	med := uint32(50)
+	expected := bgp.RouteAttributes{
+		Communities:      []uint32{65000<<16 | 200, packet.CommunityNoExport},
+		MED:              &med,
+		ServiceNamespace: "default",
+		ServiceLabels:    map[string]string{"app": "web"},
+	}
+	if attrs := manager.routes["192.0.2.10/32"]; !attrs.Equal(expected) {
+		t.Fatalf("expected overridden attributes %+v, got %+v", expected, attrs)
+	}
+	if !slices.Equal(manager.announced, []string{"192.0.2.10/32"}) {
+		t.Fatalf("expected the route to be announced again with the new attributes, got %v", manager.announced)
+	}
+}
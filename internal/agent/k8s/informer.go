@@ -3,12 +3,17 @@ package k8s
 import (
 	"context"
 	"fmt"
+	"sync"
 
 	corev1 "k8s.io/api/core/v1"
+	discoveryv1 "k8s.io/api/discovery/v1"
+	"k8s.io/apimachinery/pkg/labels"
 
 	"github.com/go-logr/logr"
 	"k8s.io/client-go/informers"
+	v1 "k8s.io/client-go/listers/core/v1"
 	"k8s.io/client-go/tools/cache"
+	"k8s.io/client-go/util/workqueue"
 )
 
 // todo: watches for Node, Pod, Service, or CR changes
@@ -20,6 +25,10 @@ type Watcher interface {
 	// This method should run continuously until the provided context is canceled. Upon detecting changes, it should
 	// notify the reconciliation process to promptly align BGP route advertisements with the updated state.
 	Watch(ctx context.Context) error
+
+	// UpdateServiceSelector replaces the selector of the services whose events are notified, so that the services it
+	// selects are watched without registering the event handlers again.
+	UpdateServiceSelector(selector labels.Selector)
 }
 
 // Service watcher must watch for
@@ -37,9 +46,14 @@ type watcher struct {
 
 	svcInformer cache.SharedIndexInformer
 	epsInformer cache.SharedIndexInformer
+	svcLister   v1.ServiceLister
+
+	// serviceSelector selects the services handled by the agent
+	serviceSelector labels.Selector
+	selectorLock    sync.RWMutex
 
-	// todo: really needed to be stored?
-	eventCh chan<- Event
+	// queue receives the key of every service whose advertisement may have changed
+	queue workqueue.TypedRateLimitingInterface[string]
 
 	nodeName string
 	logger   logr.Logger
@@ -47,7 +61,8 @@ type watcher struct {
 
 func NewWatcher(
 	informerFactory informers.SharedInformerFactory,
-	eventCh chan<- Event,
+	queue workqueue.TypedRateLimitingInterface[string],
+	serviceSelector labels.Selector,
 	nodeName string,
 	logger logr.Logger,
 ) Watcher {
@@ -62,19 +77,21 @@ func NewWatcher(
 		informerFactory: informerFactory,
 		svcInformer:     svcInformer,
 		epsInformer:     epsInformer,
-		eventCh:         eventCh,
+		svcLister:       informerFactory.Core().V1().Services().Lister(),
+		serviceSelector: serviceSelector,
+		queue:           queue,
 		nodeName:        nodeName,
 		logger:          logger,
 	}
 }
 
 func (w *watcher) Watch(ctx context.Context) error {
-	svcEventRegistration, err := w.svcInformer.AddEventHandler(newHandler(w.eventCh))
+	svcEventRegistration, err := w.svcInformer.AddEventHandler(newHandlerSvc(w.queue, w.selector))
 	if err != nil {
 		return fmt.Errorf("failed to add service event handler: %w", err)
 	}
 
-	epsEventRegistration, err := w.epsInformer.AddEventHandler(newHandler(w.eventCh))
+	epsEventRegistration, err := w.epsInformer.AddEventHandler(newHandlerEps(w.queue, w.svcLister, w.selector, w.logger))
 	if err != nil {
 		return fmt.Errorf("failed to add endpoint slices event handler: %w", err)
 	}
@@ -94,66 +111,81 @@ func (w *watcher) Watch(ctx context.Context) error {
 	return nil
 }
 
-func newHandlerSvc(eventCh chan<- Event, logger logr.Logger) cache.ResourceEventHandlerFuncs {
-	return cache.ResourceEventHandlerFuncs{
-		AddFunc: func(obj any) {
-			if svc, ok := obj.(*corev1.Service); ok {
-				// Only support LoadBalancer type services
-				if svc.Spec.Type != corev1.ServiceTypeLoadBalancer {
-					logger.Info("Service different from LoadBalancer", "service", svc.Name)
-					return
-				}
-
-				if svc.Spec.ExternalTrafficPolicy == corev1.ServiceExternalTrafficPolicyTypeLocal {
+func (w *watcher) UpdateServiceSelector(selector labels.Selector) {
+	w.selectorLock.Lock()
+	defer w.selectorLock.Unlock()
 
-				}
+	w.serviceSelector = selector
+}
 
-				if svc.Spec.ExternalTrafficPolicy == corev1.ServiceExternalTrafficPolicyCluster {
+// selector returns the current selector of the services handled by the agent
+func (w *watcher) selector() labels.Selector {
+	w.selectorLock.RLock()
+	defer w.selectorLock.RUnlock()
 
-				}
+	return w.serviceSelector
+}
 
-				// Only support services with selectors
-				if len(svc.Spec.Selector) == 0 {
-					logger.Info("Service has no selector", "service", svc.Name)
-					return
-				}
+// newHandlerSvc enqueues the key of LoadBalancer services selected by the current selector. Services that stop being
+// selected are enqueued as well, so that their routes are withdrawn
+func newHandlerSvc(queue workqueue.TypedInterface[string], selector func() labels.Selector) cache.ResourceEventHandler {
+	enqueue := func(obj any) {
+		// Keys can only fail to be computed for objects without metadata, which informers never deliver
+		if key, err := cache.DeletionHandlingMetaNamespaceKeyFunc(obj); err == nil {
+			queue.Add(key)
+		}
+	}
 
-				sendEvent(EventAdd, obj, eventCh)
-			}
-		},
-		UpdateFunc: func(_, newObj any) {
-			sendEvent(EventUpdate, newObj, eventCh)
+	return cache.FilteringResourceEventHandler{
+		FilterFunc: func(obj any) bool {
+			svc, ok := unwrapTombstone(obj).(*corev1.Service)
+			return ok && isSelectedService(svc, selector())
 		},
-		DeleteFunc: func(obj any) {
-			sendEvent(EventDelete, obj, eventCh)
+		Handler: cache.ResourceEventHandlerFuncs{
+			AddFunc:    enqueue,
+			UpdateFunc: func(_, newObj any) { enqueue(newObj) },
+			DeleteFunc: enqueue,
 		},
 	}
 }
 
-func newHandler(eventCh chan<- Event) cache.ResourceEventHandlerFuncs {
-	return cache.ResourceEventHandlerFuncs{
-		AddFunc: func(obj any) {
-			sendEvent(EventAdd, obj, eventCh)
-		},
-		UpdateFunc: func(_, newObj any) {
-			sendEvent(EventUpdate, newObj, eventCh)
-		},
-		DeleteFunc: func(obj any) {
-			sendEvent(EventDelete, obj, eventCh)
-		},
+// newHandlerEps enqueues the key of the service owning the endpoint slice, as long as the service is selected by the
+// current selector. Bursts of changes in the endpoint slices of a service collapse into a single reconciliation
+func newHandlerEps(queue workqueue.TypedInterface[string], svcLister v1.ServiceLister, selector func() labels.Selector, logger logr.Logger) cache.ResourceEventHandler {
+	enqueue := func(obj any) {
+		eps, ok := unwrapTombstone(obj).(*discoveryv1.EndpointSlice)
+		if !ok {
+			return
+		}
+
+		svcName, ok := eps.Labels[discoveryv1.LabelServiceName]
+		if !ok {
+			return
+		}
+
+		svc, err := svcLister.Services(eps.Namespace).Get(svcName)
+		if err != nil {
+			logger.V(1).Info("Ignoring endpoint slice of unknown service", "endpointSlice", eps.Name, "service", svcName)
+			return
+		}
+		if !isSelectedService(svc, selector()) {
+			return
+		}
+
+		queue.Add(eps.Namespace + "/" + svcName)
 	}
-}
 
-func sendEvent(eventType EventType, obj any, eventCh chan<- Event) {
-	key, err := cache.MetaNamespaceKeyFunc(obj)
-	if err != nil {
-		fmt.Printf("Failed to get key for object: %v\n", err)
-		return
+	return cache.ResourceEventHandlerFuncs{
+		AddFunc:    enqueue,
+		UpdateFunc: func(_, newObj any) { enqueue(newObj) },
+		DeleteFunc: enqueue,
 	}
+}
 
-	eventCh <- Event{
-		Type: eventType,
-		Obj:  obj,
-		Key:  key,
+// unwrapTombstone returns the last known state of objects whose deletion was missed by the informer
+func unwrapTombstone(obj any) any {
+	if tombstone, ok := obj.(cache.DeletedFinalStateUnknown); ok {
+		return tombstone.Obj
 	}
+	return obj
 }
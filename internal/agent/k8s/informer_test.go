@@ -0,0 +1,39 @@
+package k8s
+
+import (
+	"testing"
+
+	"github.com/go-logr/logr"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/client-go/informers"
+	"k8s.io/client-go/kubernetes/fake"
+	"k8s.io/client-go/util/workqueue"
+)
+
+func TestEndpointSliceEventsCollapseIntoServiceKey(t *testing.T) {
+	informerFactory := informers.NewSharedInformerFactory(fake.NewClientset(), 0)
+	svcIndexer := informerFactory.Core().V1().Services().Informer().GetIndexer()
+	_ = svcIndexer.Add(newLoadBalancerService("web", corev1.ServiceExternalTrafficPolicyCluster, "192.0.2.10"))
+	_ = svcIndexer.Add(newLoadBalancerService("other", corev1.ServiceExternalTrafficPolicyCluster, "192.0.2.20"))
+
+	queue := workqueue.NewTypedRateLimitingQueue(workqueue.DefaultTypedControllerRateLimiter[string]())
+	defer queue.ShutDown()
+
+	selector := labels.SelectorFromSet(labels.Set{"app": "web"})
+	handler := newHandlerEps(queue, informerFactory.Core().V1().Services().Lister(), func() labels.Selector { return selector }, logr.Discard())
+
+	eps := newEndpointSlice("web", "node-a")
+	handler.OnAdd(eps, false)
+	handler.OnUpdate(eps, newEndpointSlice("web", "node-a", "node-b"))
+	handler.OnDelete(eps)
+	// Endpoint slices of services not selected by the BGPRoute are ignored
+	handler.OnAdd(newEndpointSlice("other", "node-a"), false)
+
+	if queue.Len() != 1 {
+		t.Fatalf("expected a single queued key, got %d", queue.Len())
+	}
+	if key, _ := queue.Get(); key != "default/web" {
+		t.Fatalf("expected default/web to be queued, got %s", key)
+	}
+}
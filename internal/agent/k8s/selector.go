@@ -0,0 +1,30 @@
+package k8s
+
+import (
+	"fmt"
+
+	"github.com/yago-123/routebird/api/v1alphav1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+)
+
+// NewServiceSelector converts the ServiceSelector of the BGPRoute into a selector, including its matchExpressions.
+// The default selector of the BGPRoute selects no service at all
+func NewServiceSelector(selector metav1.LabelSelector) (labels.Selector, error) {
+	if _, ok := selector.MatchLabels[v1alphav1.NeverMatchLabelKey]; ok {
+		return labels.Nothing(), nil
+	}
+
+	svcSelector, err := metav1.LabelSelectorAsSelector(&selector)
+	if err != nil {
+		return nil, fmt.Errorf("invalid service selector: %w", err)
+	}
+
+	return svcSelector, nil
+}
+
+// isSelectedService reports whether the service is a LoadBalancer service selected by the selector
+func isSelectedService(svc *corev1.Service, selector labels.Selector) bool {
+	return svc.Spec.Type == corev1.ServiceTypeLoadBalancer && selector.Matches(labels.Set(svc.Labels))
+}
@@ -0,0 +1,259 @@
+// Package ndp discovers the IPv6 link-local address of the neighbor connected to each interface of the node from the
+// router advertisements it sends (RFC 4861), so that BGP sessions can be established over unnumbered interfaces
+package ndp
+
+import (
+	"context"
+	"fmt"
+	"maps"
+	"net"
+	"net/netip"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/go-logr/logr"
+	"golang.org/x/net/ipv6"
+)
+
+const (
+	// AdvertisementInterval is the interval between the router advertisements sent over every interface, so that the
+	// neighbors discover the link-local address of the node as well
+	AdvertisementInterval = 10 * time.Second
+
+	// hopLimit is the hop limit of the messages sent and the only one accepted in received ones, so that messages
+	// forged from outside the link are discarded (RFC 4861 section 6.1.2)
+	hopLimit = 255
+)
+
+// Discovery learns the neighbor of each registered interface from the router advertisements received over it. It
+// solicits the advertisements of the neighbors and advertises the node over the interfaces as well, with a zero router
+// lifetime so that the neighbors never use the node as a default router
+type Discovery struct {
+	// neighbors contains the neighbor of every registered interface, indexed by interface name
+	neighbors map[string]*neighbor
+	lock      sync.Mutex
+
+	logger logr.Logger
+}
+
+// neighbor is the neighbor connected to an interface
+type neighbor struct {
+	// addr is the link-local address of the neighbor, invalid until it is discovered
+	addr netip.Addr
+	// changed is closed and replaced whenever the address of the neighbor changes
+	changed chan struct{}
+}
+
+func NewDiscovery(logger logr.Logger) *Discovery {
+	return &Discovery{
+		neighbors: make(map[string]*neighbor),
+		logger:    logger,
+	}
+}
+
+// AddInterface registers an interface whose neighbor must be discovered, either before or while the discovery runs
+func (d *Discovery) AddInterface(name string) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	if _, exists := d.neighbors[name]; !exists {
+		d.neighbors[name] = &neighbor{changed: make(chan struct{})}
+	}
+}
+
+// RemoveInterface unregisters an interface, which is no longer advertised over. Calls to Neighbor waiting for its
+// neighbor return an error
+func (d *Discovery) RemoveInterface(name string) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	if n, exists := d.neighbors[name]; exists {
+		delete(d.neighbors, name)
+		close(n.changed)
+	}
+}
+
+// Neighbor returns the link-local address of the neighbor connected to the interface, zoned with the name of the
+// interface. It waits until the neighbor is discovered or the context is cancelled
+func (d *Discovery) Neighbor(ctx context.Context, name string) (netip.Addr, error) {
+	for {
+		d.lock.Lock()
+		n, exists := d.neighbors[name]
+		var addr netip.Addr
+		var changed chan struct{}
+		if exists {
+			addr, changed = n.addr, n.changed
+		}
+		d.lock.Unlock()
+
+		switch {
+		case !exists:
+			return netip.Addr{}, fmt.Errorf("interface %s is not registered", name)
+		case addr.IsValid():
+			return addr, nil
+		}
+
+		select {
+		case <-ctx.Done():
+			return netip.Addr{}, ctx.Err()
+		case <-changed:
+		}
+	}
+}
+
+// Run discovers the neighbors of the registered interfaces until the context is cancelled
+func (d *Discovery) Run(ctx context.Context) error {
+	conn, err := net.ListenPacket("ip6:ipv6-icmp", "::")
+	if err != nil {
+		return fmt.Errorf("failed to listen for ICMPv6 messages: %w", err)
+	}
+
+	packetConn := ipv6.NewPacketConn(conn)
+	if err = configure(packetConn); err != nil {
+		_ = conn.Close()
+		return err
+	}
+
+	go func() {
+		<-ctx.Done()
+		_ = conn.Close()
+	}()
+	go d.advertise(ctx, packetConn)
+
+	buf := make([]byte, 1500)
+	for {
+		n, cm, src, errRead := packetConn.ReadFrom(buf)
+		if errRead != nil {
+			if ctx.Err() != nil {
+				return nil
+			}
+			return fmt.Errorf("failed to read ICMPv6 message: %w", errRead)
+		}
+
+		ipAddr, ok := src.(*net.IPAddr)
+		if !ok || cm == nil {
+			continue
+		}
+		ifi, errIfi := net.InterfaceByIndex(cm.IfIndex)
+		if errIfi != nil {
+			continue
+		}
+		srcAddr, ok := netip.AddrFromSlice(ipAddr.IP)
+		if !ok {
+			continue
+		}
+
+		if d.handle(ifi.Name, srcAddr, cm.HopLimit, buf[:n]) {
+			// Solicitations are answered right away instead of waiting for the next advertisement
+			d.send(packetConn, ifi.Name, &Message{Type: TypeRouterAdvertisement}, net.IPv6linklocalallnodes)
+		}
+	}
+}
+
+// configure sets up the socket to send and receive neighbor discovery messages, only receiving router solicitations
+// and advertisements together with their hop limit and interface
+func configure(packetConn *ipv6.PacketConn) error {
+	var filter ipv6.ICMPFilter
+	filter.SetAll(true)
+	filter.Accept(ipv6.ICMPTypeRouterSolicitation)
+	filter.Accept(ipv6.ICMPTypeRouterAdvertisement)
+
+	for _, step := range []struct {
+		name string
+		set  func() error
+	}{
+		{"ICMPv6 filter", func() error { return packetConn.SetICMPFilter(&filter) }},
+		{"hop limit", func() error { return packetConn.SetHopLimit(hopLimit) }},
+		{"multicast hop limit", func() error { return packetConn.SetMulticastHopLimit(hopLimit) }},
+		{"multicast loopback", func() error { return packetConn.SetMulticastLoopback(false) }},
+		{"control messages", func() error {
+			return packetConn.SetControlMessage(ipv6.FlagHopLimit|ipv6.FlagInterface, true)
+		}},
+	} {
+		if err := step.set(); err != nil {
+			return fmt.Errorf("failed to set %s: %w", step.name, err)
+		}
+	}
+
+	return nil
+}
+
+// handle processes a message received over the interface, learning the neighbor from router advertisements. It
+// returns whether the message is a router solicitation that must be answered
+func (d *Discovery) handle(name string, src netip.Addr, msgHopLimit int, data []byte) bool {
+	d.lock.Lock()
+	n, exists := d.neighbors[name]
+	d.lock.Unlock()
+	if !exists {
+		return false
+	}
+
+	if msgHopLimit != hopLimit || !src.IsLinkLocalUnicast() {
+		d.logger.V(1).Info("Discarding neighbor discovery message", "interface", name, "source", src, "hopLimit", msgHopLimit)
+		return false
+	}
+
+	msg, err := Unmarshal(data)
+	if err != nil {
+		d.logger.V(1).Info("Discarding neighbor discovery message", "interface", name, "source", src, "error", err.Error())
+		return false
+	}
+	if msg.Type == TypeRouterSolicitation {
+		return true
+	}
+
+	addr := src.WithZone(name)
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	if n.addr != addr {
+		d.logger.Info("Discovered neighbor", "interface", name, "address", addr, "previous", n.addr)
+		n.addr = addr
+		close(n.changed)
+		n.changed = make(chan struct{})
+	}
+
+	return false
+}
+
+// advertise solicits the advertisements of the neighbors and periodically advertises the node over every registered
+// interface until the context is cancelled. Interfaces registered while running are solicited on the next advertisement
+func (d *Discovery) advertise(ctx context.Context, packetConn *ipv6.PacketConn) {
+	ticker := time.NewTicker(AdvertisementInterval)
+	defer ticker.Stop()
+
+	solicited := make(map[string]bool)
+	for {
+		d.lock.Lock()
+		names := slices.Sorted(maps.Keys(d.neighbors))
+		d.lock.Unlock()
+
+		for _, name := range names {
+			if !solicited[name] {
+				d.send(packetConn, name, &Message{Type: TypeRouterSolicitation}, net.IPv6linklocalallrouters)
+				solicited[name] = true
+			}
+			d.send(packetConn, name, &Message{Type: TypeRouterAdvertisement}, net.IPv6linklocalallnodes)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// send sends the message over the interface, failures are only logged as interfaces may be down or not exist yet
+func (d *Discovery) send(packetConn *ipv6.PacketConn, name string, msg *Message, dst net.IP) {
+	ifi, err := net.InterfaceByName(name)
+	if err == nil {
+		msg.SourceLinkLayerAddress = ifi.HardwareAddr
+		cm := &ipv6.ControlMessage{HopLimit: hopLimit, IfIndex: ifi.Index}
+		_, err = packetConn.WriteTo(msg.Marshal(), cm, &net.IPAddr{IP: dst, Zone: name})
+	}
+	if err != nil {
+		d.logger.V(1).Info("Failed to send neighbor discovery message", "interface", name, "error", err.Error())
+	}
+}
@@ -0,0 +1,81 @@
+package ndp
+
+import (
+	"context"
+	"net/netip"
+	"testing"
+	"time"
+
+	"github.com/go-logr/logr"
+)
+
+func TestDiscoveryHandle(t *testing.T) {
+	d := NewDiscovery(logr.Discard())
+	d.AddInterface("swp1")
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	found := make(chan netip.Addr, 1)
+	go func() {
+		addr, err := d.Neighbor(ctx, "swp1")
+		if err != nil {
+			t.Errorf("failed to discover neighbor: %v", err)
+		}
+		found <- addr
+	}()
+
+	advertisement := (&Message{Type: TypeRouterAdvertisement}).Marshal()
+	neighbor := netip.MustParseAddr("fe80::1")
+
+	// Messages forged from outside the link, from global addresses or from unknown interfaces are ignored
+	d.handle("swp1", neighbor, 64, advertisement)
+	d.handle("swp1", netip.MustParseAddr("2001:db8::1"), hopLimit, advertisement)
+	d.handle("swp2", neighbor, hopLimit, advertisement)
+	if addr, _ := d.Neighbor(context.Background(), "swp2"); addr.IsValid() {
+		t.Fatalf("expected neighbor of unknown interface to be ignored, got %s", addr)
+	}
+
+	if respond := d.handle("swp1", neighbor, hopLimit, (&Message{Type: TypeRouterSolicitation}).Marshal()); !respond {
+		t.Fatalf("expected router solicitation to be answered")
+	}
+	select {
+	case addr := <-found:
+		t.Fatalf("expected neighbor to be discovered from router advertisements only, got %s", addr)
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	if respond := d.handle("swp1", neighbor, hopLimit, advertisement); respond {
+		t.Fatalf("expected router advertisement not to be answered")
+	}
+	if addr := <-found; addr != neighbor.WithZone("swp1") {
+		t.Fatalf("expected neighbor fe80::1%%swp1, got %s", addr)
+	}
+}
+
+func TestDiscoveryRemoveInterface(t *testing.T) {
+	d := NewDiscovery(logr.Discard())
+	d.AddInterface("swp1")
+
+	errCh := make(chan error, 1)
+	go func() {
+		_, err := d.Neighbor(context.Background(), "swp1")
+		errCh <- err
+	}()
+
+	// Waiting for the neighbor of a removed interface fails instead of blocking forever
+	time.Sleep(100 * time.Millisecond)
+	d.RemoveInterface("swp1")
+	select {
+	case err := <-errCh:
+		if err == nil {
+			t.Fatalf("expected neighbor of removed interface to fail")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("expected neighbor of removed interface to return")
+	}
+
+	if d.handle("swp1", netip.MustParseAddr("fe80::1"), hopLimit, (&Message{Type: TypeRouterAdvertisement}).Marshal()) {
+		t.Fatalf("expected messages of removed interface to be ignored")
+	}
+}
@@ -0,0 +1,95 @@
+package ndp
+
+import (
+	"encoding/binary"
+	"errors"
+	"net"
+)
+
+// Types of the ICMPv6 messages of the neighbor discovery used to find the neighbors (RFC 4861)
+const (
+	TypeRouterSolicitation  uint8 = 133
+	TypeRouterAdvertisement uint8 = 134
+)
+
+const (
+	// optionSourceLinkLayerAddress carries the link-layer address of the sender of a message
+	optionSourceLinkLayerAddress = 1
+
+	routerSolicitationLen  = 8
+	routerAdvertisementLen = 16
+)
+
+var errMalformedMessage = errors.New("malformed neighbor discovery message")
+
+// Message is a router solicitation or a router advertisement. Only the fields required to discover the neighbors are
+// kept, the checksum is computed by the kernel when the message is sent
+type Message struct {
+	Type uint8
+	// RouterLifetime is the lifetime of the sender as a default router in seconds, only sent in router advertisements.
+	// Advertisements with a zero lifetime announce the address of the sender without offering a default route
+	RouterLifetime uint16
+	// SourceLinkLayerAddress is the link-layer address of the sender, omitted when empty
+	SourceLinkLayerAddress net.HardwareAddr
+}
+
+// Marshal encodes the message as an ICMPv6 message
+func (m *Message) Marshal() []byte {
+	length := routerSolicitationLen
+	if m.Type == TypeRouterAdvertisement {
+		length = routerAdvertisementLen
+	}
+
+	data := make([]byte, length)
+	data[0] = m.Type
+	if m.Type == TypeRouterAdvertisement {
+		binary.BigEndian.PutUint16(data[6:8], m.RouterLifetime)
+	}
+
+	if len(m.SourceLinkLayerAddress) > 0 {
+		// Options are padded to a multiple of 8 octets, in which their length is expressed
+		units := (2 + len(m.SourceLinkLayerAddress) + 7) / 8
+		option := make([]byte, units*8)
+		option[0], option[1] = optionSourceLinkLayerAddress, uint8(units)
+		copy(option[2:], m.SourceLinkLayerAddress)
+		data = append(data, option...)
+	}
+
+	return data
+}
+
+// Unmarshal decodes a router solicitation or a router advertisement
+func Unmarshal(data []byte) (*Message, error) {
+	if len(data) < routerSolicitationLen || data[1] != 0 {
+		return nil, errMalformedMessage
+	}
+
+	m := &Message{Type: data[0]}
+	var options []byte
+	switch m.Type {
+	case TypeRouterSolicitation:
+		options = data[routerSolicitationLen:]
+	case TypeRouterAdvertisement:
+		if len(data) < routerAdvertisementLen {
+			return nil, errMalformedMessage
+		}
+		m.RouterLifetime = binary.BigEndian.Uint16(data[6:8])
+		options = data[routerAdvertisementLen:]
+	default:
+		return nil, errMalformedMessage
+	}
+
+	for len(options) > 0 {
+		if len(options) < 2 || options[1] == 0 || len(options) < int(options[1])*8 {
+			return nil, errMalformedMessage
+		}
+		option := options[:int(options[1])*8]
+		options = options[len(option):]
+
+		if option[0] == optionSourceLinkLayerAddress {
+			m.SourceLinkLayerAddress = net.HardwareAddr(append([]byte(nil), option[2:]...))
+		}
+	}
+
+	return m, nil
+}
@@ -0,0 +1,44 @@
+package ndp
+
+import (
+	"bytes"
+	"encoding/hex"
+	"net"
+	"reflect"
+	"testing"
+)
+
+func TestMessage(t *testing.T) {
+	mac := net.HardwareAddr{0x02, 0x00, 0x5e, 0x00, 0x53, 0x01}
+	advertisement := &Message{Type: TypeRouterAdvertisement, SourceLinkLayerAddress: mac}
+
+	expected, _ := hex.DecodeString("86000000" + "00000000" + "00000000" + "00000000" + "0101" + "02005e005301")
+	data := advertisement.Marshal()
+	if !bytes.Equal(data, expected) {
+		t.Fatalf("unexpected router advertisement: %x", data)
+	}
+
+	decoded, err := Unmarshal(data)
+	if err != nil {
+		t.Fatalf("failed to decode router advertisement: %v", err)
+	}
+	if !reflect.DeepEqual(decoded, advertisement) {
+		t.Fatalf("unexpected decoded router advertisement: %+v", decoded)
+	}
+
+	solicitation := &Message{Type: TypeRouterSolicitation}
+	if decoded, err = Unmarshal(solicitation.Marshal()); err != nil || !reflect.DeepEqual(decoded, solicitation) {
+		t.Fatalf("unexpected decoded router solicitation: %+v, %v", decoded, err)
+	}
+
+	for _, data := range [][]byte{
+		{134, 0, 0, 0, 0, 0, 0, 0},
+		{135, 0, 0, 0, 0, 0, 0, 0},
+		append(solicitation.Marshal(), 1, 0),
+		append(solicitation.Marshal(), 1, 2, 0, 0),
+	} {
+		if _, err = Unmarshal(data); err == nil {
+			t.Errorf("expected %x to be rejected", data)
+		}
+	}
+}
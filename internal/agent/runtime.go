@@ -2,37 +2,370 @@ package agent
 
 import (
 	"context"
+	"errors"
+	"fmt"
+	"reflect"
+	"slices"
+	"sync"
+	"time"
 
 	"github.com/go-logr/logr"
+	"github.com/yago-123/routebird/api/v1alphav1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/informers"
+	"k8s.io/client-go/util/workqueue"
 
 	"github.com/yago-123/routebird/internal/agent/bgp"
+	"github.com/yago-123/routebird/internal/agent/config"
 	"github.com/yago-123/routebird/internal/agent/k8s"
 	cfg "github.com/yago-123/routebird/internal/common"
 	"k8s.io/client-go/kubernetes"
 )
 
-// todo: start watchers, BGP manager, handles event loop
+const (
+	// todo(): set from config or env
+	InformerResyncInterval = 1 * time.Minute
+	// ControlLoopResyncInterval is the interval between full reconciliations, independently of the received events
+	ControlLoopResyncInterval = 30 * time.Second
+	// ConfigReloadInterval is the interval between reloads of the configuration file, which kubelet updates in place
+	// when the agent ConfigMap changes
+	ConfigReloadInterval = 30 * time.Second
+)
+
+// errSpeakerChanged is returned by a run of the runtime when the BGP speaker settings of the node change, such as its
+// local ASN, so that the runtime is started again to establish the sessions with the new settings
+var errSpeakerChanged = errors.New("BGP speaker settings of the node changed")
 
+// Runtime wires together the Kubernetes watchers, the control loop and the BGP manager of the agent
 type Runtime struct {
-	bgpManager bgp.Manager
-	watchers   []k8s.Watcher
-}
+	bgpManager      bgp.Manager
+	informerFactory informers.SharedInformerFactory
+	watcher         k8s.Watcher
+	controlLoop     k8s.ControlLoop
+	// queue contains the keys of the services pending reconciliation, duplicated keys are collapsed and failed
+	// reconciliations are retried with exponential backoff
+	queue workqueue.TypedRateLimitingInterface[string]
 
-func NewRuntime(cfg cfg.Config, client kubernetes.Interface, logger logr.Logger) *Runtime {
-	bgpManager := bgp.NewManager(cfg.Peers, client, logger)
+	// config is the configuration of the node the agent is running with, loaded from configPath
+	config     cfg.Config
+	configPath string
+	nodeName   string
+
+	client kubernetes.Interface
+	logger logr.Logger
+}
 
-	watchers := []k8s.Watcher{
-		// k8s.NewNodeWatcher(client, bgpManager),
-		// k8s.NewCRDWatcher(client, bgpManager),
+func NewRuntime(cfg cfg.Config, configPath string, client kubernetes.Interface, nodeName string, logger logr.Logger) (*Runtime, error) {
+	r := &Runtime{
+		configPath: configPath,
+		nodeName:   nodeName,
+		client:     client,
+		logger:     logger,
+	}
+	if err := r.setup(cfg.ForNode(nodeName), false); err != nil {
+		return nil, err
 	}
 
-	return &Runtime{bgpManager, watchers}
+	return r, nil
 }
 
-func (r *Runtime) Watch(ctx context.Context) error {
-	// for _, w := range r.watchers {
-	// 		go w.Watch(ctx)
-	// }
-	<-ctx.Done()
+// setup creates the BGP manager, the watcher and the control loop of the runtime for the configuration of the node.
+// They are created again each time the runtime is started again, as none of them can be started twice, in which case
+// the BGP manager replaces the one stopped for graceful restart
+func (r *Runtime) setup(config cfg.Config, restarting bool) error {
+	newManager := bgp.NewManager
+	if restarting {
+		newManager = bgp.NewRestartedManager
+	}
+	bgpManager, err := newManager(config, r.nodeName, r.client, r.logger.WithName("bgp"))
+	if err != nil {
+		return fmt.Errorf("failed to create BGP manager: %w", err)
+	}
+
+	informerFactory := informers.NewSharedInformerFactoryWithOptions(
+		r.client,
+		InformerResyncInterval,
+		informers.WithNamespace(metav1.NamespaceAll),
+	)
+
+	serviceSelector, err := k8s.NewServiceSelector(config.ServiceSelector)
+	if err != nil {
+		return err
+	}
+
+	defaultAttributes, err := bgp.ParseRouteAttributes(config.Attributes)
+	if err != nil {
+		return fmt.Errorf("invalid route attributes: %w", err)
+	}
+
+	queue := workqueue.NewTypedRateLimitingQueueWithConfig(
+		workqueue.DefaultTypedControllerRateLimiter[string](),
+		workqueue.TypedRateLimitingQueueConfig[string]{Name: "routebird-agent"},
+	)
+
+	r.bgpManager = bgpManager
+	r.informerFactory = informerFactory
+	r.watcher = k8s.NewWatcher(informerFactory, queue, serviceSelector, r.nodeName, r.logger.WithName("watcher"))
+	r.controlLoop = k8s.NewControlLoop(informerFactory, bgpManager, serviceSelector, defaultAttributes, r.nodeName, r.logger.WithName("control-loop"))
+	r.queue = queue
+	r.config = config
+
 	return nil
 }
+
+// Run starts the watcher, the control loop and the BGP manager, and blocks until the context is cancelled and all of
+// them have stopped. When the BGP speaker settings of the node change, all of them are stopped and started again with
+// the new configuration within the same process, so that configuration changes never count as container restarts
+func (r *Runtime) Run(ctx context.Context) error {
+	for {
+		err := r.run(ctx)
+		if !errors.Is(err, errSpeakerChanged) {
+			return err
+		}
+		if ctx.Err() != nil {
+			return nil
+		}
+
+		if err = r.setup(r.config, true); err != nil {
+			return fmt.Errorf("failed to restart agent runtime: %w", err)
+		}
+		r.logger.Info("Agent runtime restarted with new BGP speaker settings")
+	}
+}
+
+// run starts the watcher, the control loop and the BGP manager once, until the context is cancelled, any of them fails
+// or the BGP speaker settings of the node change
+func (r *Runtime) run(ctx context.Context) error {
+	ctx, cancelCause := context.WithCancelCause(ctx)
+	cancel := func() { cancelCause(nil) }
+	defer cancel()
+
+	var wg sync.WaitGroup
+
+	// The watcher registers the event handlers, so it must be running before the informers start
+	watchErrCh := make(chan error, 1)
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		watchErrCh <- r.watcher.Watch(ctx)
+	}()
+
+	r.informerFactory.Start(ctx.Done())
+
+	for informerType, synced := range r.informerFactory.WaitForCacheSync(ctx.Done()) {
+		if !synced {
+			cancel()
+			wg.Wait()
+			return fmt.Errorf("failed to sync informer cache for %v", informerType)
+		}
+	}
+
+	// The routes are computed before the BGP sessions are started, so that peers retaining the routes of the previous
+	// run of the agent through graceful restart receive the complete set of routes before the End-of-RIB marker
+	if err := r.controlLoop.Resync(ctx); err != nil {
+		r.logger.Error(err, "Failed to resync control loop")
+	}
+
+	reloadErrCh := make(chan error, 1)
+	wg.Add(4)
+	go func() {
+		defer wg.Done()
+		if err := r.bgpManager.Run(ctx); err != nil {
+			r.logger.Error(err, "BGP manager stopped with error")
+		}
+	}()
+	go func() {
+		defer wg.Done()
+		for r.processNextItem(ctx) {
+		}
+	}()
+	go func() {
+		defer wg.Done()
+		r.resyncPeriodically(ctx)
+	}()
+	go func() {
+		defer wg.Done()
+		reloadErrCh <- r.reloadConfigPeriodically(ctx)
+	}()
+
+	r.logger.Info("Agent runtime started")
+
+	var err error
+	select {
+	case <-ctx.Done():
+	case err = <-watchErrCh:
+		// The watcher only returns before the context is cancelled when it fails
+		if err != nil {
+			err = fmt.Errorf("failed to watch resources: %w", err)
+		}
+		cancel()
+	case err = <-reloadErrCh:
+		// Peers retain the routes of the sessions closed for graceful restart until the runtime is started again
+		if errors.Is(err, errSpeakerChanged) {
+			cancelCause(bgp.ErrRestart)
+		}
+		cancel()
+	}
+
+	r.queue.ShutDown()
+	wg.Wait()
+	r.logger.Info("Agent runtime stopped")
+
+	return err
+}
+
+// processNextItem reconciles the next service of the queue, retrying it with backoff on failure. It returns false
+// once the queue is shut down
+func (r *Runtime) processNextItem(ctx context.Context) bool {
+	key, shutdown := r.queue.Get()
+	if shutdown {
+		return false
+	}
+	defer r.queue.Done(key)
+
+	if err := r.controlLoop.Reconcile(ctx, key); err != nil {
+		r.logger.Error(err, "Failed to reconcile service, retrying", "service", key, "retries", r.queue.NumRequeues(key))
+		r.queue.AddRateLimited(key)
+		return true
+	}
+
+	r.queue.Forget(key)
+	return true
+}
+
+// resyncPeriodically performs a full reconciliation periodically, as a safety net for missed events
+func (r *Runtime) resyncPeriodically(ctx context.Context) {
+	ticker := time.NewTicker(ControlLoopResyncInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		if err := r.controlLoop.Resync(ctx); err != nil {
+			r.logger.Error(err, "Failed to resync control loop")
+		}
+	}
+}
+
+// reloadConfigPeriodically reloads the configuration file periodically, applying the changes of the service selector,
+// the route attributes, the BGP peers and the BGP policies without resetting the sessions with the peers that did not
+// change. Once the BGP speaker settings
+// of the node change, it stores the new configuration and returns errSpeakerChanged, so that the runtime is started
+// again with it
+func (r *Runtime) reloadConfigPeriodically(ctx context.Context) error {
+	ticker := time.NewTicker(ConfigReloadInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+		}
+
+		updated, err := config.Load(r.configPath)
+		if err != nil {
+			r.logger.Error(err, "Failed to reload configuration")
+			continue
+		}
+		updated = updated.ForNode(r.nodeName)
+		if reflect.DeepEqual(updated, r.config) {
+			continue
+		}
+
+		if speakerChanged(updated, r.config) {
+			r.logger.Info("BGP speaker settings of the node changed, restarting agent runtime", "localASN", updated.LocalASN,
+				"routerID", updated.RouterID, "peers", len(updated.Peers), "listenRanges", len(updated.ListenRanges))
+			r.config = updated
+			return errSpeakerChanged
+		}
+
+		if !reflect.DeepEqual(updated.ServiceSelector, r.config.ServiceSelector) ||
+			!reflect.DeepEqual(updated.Attributes, r.config.Attributes) {
+			if err = r.updateSelection(ctx, updated); err != nil {
+				r.logger.Error(err, "Failed to update advertised services")
+			}
+		}
+		if !reflect.DeepEqual(withoutPolicies(updated).Peers, withoutPolicies(r.config).Peers) ||
+			!reflect.DeepEqual(withoutPolicies(updated).ListenRanges, withoutPolicies(r.config).ListenRanges) {
+			if err = r.bgpManager.UpdatePeers(updated); err != nil {
+				// Policies of the previous peers cannot be matched with the new ones
+				r.logger.Error(err, "Failed to update BGP peers")
+				r.config = updated
+				continue
+			}
+		}
+		if !policiesEqual(updated, r.config) {
+			if err = r.bgpManager.UpdatePolicies(updated); err != nil {
+				r.logger.Error(err, "Failed to update BGP policies")
+			}
+		}
+		r.config = updated
+	}
+}
+
+// updateSelection applies the service selector and the route attributes of the configuration to the watcher and the
+// control loop, announcing and withdrawing the routes of the services accordingly
+func (r *Runtime) updateSelection(ctx context.Context, config cfg.Config) error {
+	serviceSelector, err := k8s.NewServiceSelector(config.ServiceSelector)
+	if err != nil {
+		return err
+	}
+	defaultAttributes, err := bgp.ParseRouteAttributes(config.Attributes)
+	if err != nil {
+		return fmt.Errorf("invalid route attributes: %w", err)
+	}
+
+	r.watcher.UpdateServiceSelector(serviceSelector)
+	r.logger.Info("Updated advertised services", "serviceSelector", serviceSelector.String())
+	return r.controlLoop.UpdateSelection(ctx, serviceSelector, defaultAttributes)
+}
+
+// speakerChanged reports whether the settings shared by every BGP session of the node differ between both
+// configurations, which only apply to the sessions established once the runtime is started again
+func speakerChanged(a, b cfg.Config) bool {
+	return a.LocalASN != b.LocalASN || a.RouterID != b.RouterID || a.RequireFourOctetAS != b.RequireFourOctetAS ||
+		a.BGPLocalPort != b.BGPLocalPort || a.DrainIntervalSeconds != b.DrainIntervalSeconds ||
+		!reflect.DeepEqual(a.GracefulRestart, b.GracefulRestart)
+}
+
+// policiesEqual reports whether both configurations have the same prefix lists and policies, and the peers and listen
+// ranges present in both reference the same policies. Peers and listen ranges added by UpdatePeers are already created
+// with the policies of their configuration
+func policiesEqual(a, b cfg.Config) bool {
+	if !reflect.DeepEqual(a.PrefixLists, b.PrefixLists) || !reflect.DeepEqual(a.Policies, b.Policies) {
+		return false
+	}
+	for _, x := range a.Peers {
+		idx := slices.IndexFunc(b.Peers, func(y v1alphav1.BGPPeer) bool { return cfg.PeerName(x) == cfg.PeerName(y) })
+		if idx >= 0 && (x.ExportPolicy != b.Peers[idx].ExportPolicy || x.ImportPolicy != b.Peers[idx].ImportPolicy) {
+			return false
+		}
+	}
+	for _, x := range a.ListenRanges {
+		idx := slices.IndexFunc(b.ListenRanges, func(y v1alphav1.ListenRange) bool { return x.Prefix == y.Prefix })
+		if idx >= 0 && (x.ExportPolicy != b.ListenRanges[idx].ExportPolicy || x.ImportPolicy != b.ListenRanges[idx].ImportPolicy) {
+			return false
+		}
+	}
+	return true
+}
+
+// withoutPolicies returns a copy of the configuration without the prefix lists, the policies and the references of the
+// peers and the listen ranges to them
+func withoutPolicies(config cfg.Config) cfg.Config {
+	config.PrefixLists, config.Policies = nil, nil
+	config.Peers = slices.Clone(config.Peers)
+	for i := range config.Peers {
+		config.Peers[i].ExportPolicy, config.Peers[i].ImportPolicy = "", ""
+	}
+	config.ListenRanges = slices.Clone(config.ListenRanges)
+	for i := range config.ListenRanges {
+		config.ListenRanges[i].ExportPolicy, config.ListenRanges[i].ImportPolicy = "", ""
+	}
+	return config
+}
@@ -0,0 +1,23 @@
+package common
+
+import "fmt"
+
+const (
+	// asTrans stands for 4-octet AS numbers towards speakers without 4-octet AS support (RFC 6793), so it is never
+	// assigned to a speaker
+	asTrans = 23456
+	// lastTwoOctetASN and lastASN are reserved by RFC 7300
+	lastTwoOctetASN = 65535
+	lastASN         = 4294967295
+)
+
+// ValidateASN checks that the AS number can be used by a BGP speaker, either 2-octet or 4-octet (RFC 6793). It is
+// shared by the controller and the agent, so that the controller never renders an ASN the agent rejects
+func ValidateASN(asn uint32) error {
+	switch asn {
+	case 0, asTrans, lastTwoOctetASN, lastASN:
+		return fmt.Errorf("AS number %d is reserved", asn)
+	default:
+		return nil
+	}
+}
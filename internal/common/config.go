@@ -1,13 +1,23 @@
 package common
 
 import (
+	"slices"
+
 	"github.com/yago-123/routebird/api/v1alphav1"
+	corev1 "k8s.io/api/core/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 )
 
 const (
 	ConfigMapPath     = "/routebird/config"
 	ConfigMapFilename = "config.json"
+
+	// PeerPasswordsPath is the directory in which the TCP MD5 passwords of the peers are projected from their secrets,
+	// so that they are never stored in the ConfigMap
+	PeerPasswordsPath = "/routebird/passwords"
+
+	// NodeNameEnvVar is the environment variable in which the name of the node running the agent is exposed
+	NodeNameEnvVar = "NODE_NAME"
 )
 
 // todo(): decide how to add versioning to this config struct
@@ -16,4 +26,69 @@ type Config struct {
 	LocalASN        uint32
 	BGPLocalPort    int32
 	Peers           []v1alphav1.BGPPeer
+
+	// RouterID is the BGP identifier of the agent, derived from the local address of each session when empty
+	RouterID string
+
+	// RequireFourOctetAS rejects the peers without 4-octet AS support when LocalASN does not fit in 2 octets
+	RequireFourOctetAS bool
+
+	// ListenRanges accept the sessions of the peers connecting from their prefixes
+	ListenRanges []v1alphav1.ListenRange
+
+	// Nodes contains the configuration specific to the agent of each node, indexed by node name
+	Nodes map[string]NodeConfig
+
+	// GracefulRestart enables the BGP Graceful Restart capability when set
+	GracefulRestart *v1alphav1.GracefulRestart
+
+	// Attributes are the default path attributes of the advertised routes
+	Attributes v1alphav1.RouteAttributes
+
+	// PrefixLists and Policies define the import and export policies referenced by the peers
+	PrefixLists []v1alphav1.PrefixList
+	Policies    []v1alphav1.Policy
+
+	// DrainIntervalSeconds is the time waited between withdrawing the routes and closing the BGP sessions on shutdown
+	DrainIntervalSeconds int32
+}
+
+// NodeConfig contains the configuration specific to the agent of a node
+type NodeConfig struct {
+	// LocalASN replaces the LocalASN of the configuration when set
+	LocalASN uint32 `json:",omitempty"`
+	// RouterID replaces the RouterID of the configuration when set
+	RouterID string `json:",omitempty"`
+	// Peers are established in addition to the peers of the configuration
+	Peers []v1alphav1.BGPPeer `json:",omitempty"`
+}
+
+// ForNode returns the configuration of the agent running on the node, with the settings specific to the node applied
+func (c Config) ForNode(nodeName string) Config {
+	node := c.Nodes[nodeName]
+	c.Peers = slices.Concat(c.Peers, node.Peers)
+	if node.LocalASN != 0 {
+		c.LocalASN = node.LocalASN
+	}
+	if node.RouterID != "" {
+		c.RouterID = node.RouterID
+	}
+	c.Nodes = nil
+	return c
+}
+
+// PeerName returns the name identifying the peer, which is its address or the interface of unnumbered peers
+func PeerName(peer v1alphav1.BGPPeer) string {
+	if peer.Interface != "" {
+		return peer.Interface
+	}
+	return peer.Address
+}
+
+// PeerPasswordFilename returns the name of the file containing the TCP MD5 password within PeerPasswordsPath, given the
+// secret key it is projected from. Files are named after the secret key rather than the peer, as peers of different
+// nodes may share their names while referencing different secrets. Secret names never contain underscores, which keeps
+// the file names unique
+func PeerPasswordFilename(ref corev1.SecretKeySelector) string {
+	return ref.Name + "_" + ref.Key
 }
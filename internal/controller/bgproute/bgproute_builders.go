@@ -3,12 +3,19 @@ package controller
 import (
 	"encoding/json"
 	"fmt"
+	"maps"
+	"net/netip"
+	"slices"
+	"strconv"
+	"strings"
 
+	"github.com/go-logr/logr"
 	rbacv1 "k8s.io/api/rbac/v1"
 
 	appsv1 "k8s.io/api/apps/v1"
 	corev1 "k8s.io/api/core/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
 
 	bgpv1alphav1 "github.com/yago-123/routebird/api/v1alphav1"
 	"github.com/yago-123/routebird/internal/common"
@@ -19,21 +26,237 @@ const (
 	DiscoveryAPIGroup = "discovery.k8s.io"
 
 	DaemonSetVolumeMountName = "config"
+	// DaemonSetPasswordsVolumeName is the name of the volume projecting the TCP MD5 passwords of the peers
+	DaemonSetPasswordsVolumeName = "peer-passwords"
 
 	ConfigMapHashAnnotationKey = "configMapHash"
 
+	// TerminationGracePeriodBufferSeconds is added to the drain interval of the agent to compute the termination grace
+	// period of its pods, leaving time to withdraw the routes and close the BGP sessions
+	TerminationGracePeriodBufferSeconds = 15
+
 	ClusterRoleKind    = "ClusterRole"
 	ServiceAccountKind = "ServiceAccount"
 )
 
-func buildAgentConfigMap(routeCR bgpv1alphav1.BGPRoute, commonLabels map[string]string) (*corev1.ConfigMap, error) {
-	cfg := common.Config{
+// buildAgentConfig renders the configuration of the agents. Peers reading their address from the nodes, the peers of
+// the node peer groups, the local ASN and the router ID are rendered for each node running an agent
+func buildAgentConfig(routeCR bgpv1alphav1.BGPRoute, nodes []corev1.Node, logger logr.Logger) (common.Config, error) {
+	var peers, nodePeers []bgpv1alphav1.BGPPeer
+	for _, peer := range routeCR.Spec.Peers {
+		if peer.AddressFrom != nil {
+			nodePeers = append(nodePeers, peer)
+		} else {
+			peers = append(peers, peer)
+		}
+	}
+
+	nodeConfigs, err := buildNodeConfigs(routeCR, nodePeers, nodes, logger)
+	if err != nil {
+		return common.Config{}, err
+	}
+
+	return common.Config{
 		ServiceSelector: routeCR.Spec.ServiceSelector,
 		LocalASN:        routeCR.Spec.LocalASN,
 		BGPLocalPort:    routeCR.Spec.BGPLocalPort,
-		Peers:           routeCR.Spec.Peers,
+		Peers:           peers,
+		ListenRanges:    routeCR.Spec.ListenRanges,
+		Nodes:           nodeConfigs,
+		GracefulRestart: routeCR.Spec.GracefulRestart,
+		Attributes:      routeCR.Spec.Attributes,
+		PrefixLists:     routeCR.Spec.PrefixLists,
+		Policies:        routeCR.Spec.Policies,
+
+		RequireFourOctetAS:   routeCR.Spec.RequireFourOctetAS,
+		DrainIntervalSeconds: routeCR.Spec.Agent.DrainIntervalSeconds,
+	}, nil
+}
+
+// buildNodeConfigs renders the configuration of every node matching the node selector of the agents. The peers of a
+// node are the ones of the node peer groups selecting it together with the provided peers, and its local ASN is read
+// from the node or allocated from the range of the BGPRoute. Nodes without any specific setting are left out
+func buildNodeConfigs(routeCR bgpv1alphav1.BGPRoute, peers []bgpv1alphav1.BGPPeer, nodes []corev1.Node, logger logr.Logger) (map[string]common.NodeConfig, error) {
+	selectors := make([]labels.Selector, len(routeCR.Spec.NodePeers))
+	for i, group := range routeCR.Spec.NodePeers {
+		selector, err := metav1.LabelSelectorAsSelector(&group.NodeSelector)
+		if err != nil {
+			return nil, fmt.Errorf("invalid node selector of node peers %d: %w", i, err)
+		}
+		selectors[i] = selector
+	}
+
+	agentSelector := labels.SelectorFromSet(routeCR.Spec.NodeSelector)
+	nodeConfigs := make(map[string]common.NodeConfig)
+	for _, node := range nodes {
+		if !agentSelector.Matches(labels.Set(node.Labels)) {
+			continue
+		}
+
+		candidates := slices.Clone(peers)
+		for i, group := range routeCR.Spec.NodePeers {
+			if selectors[i].Matches(labels.Set(node.Labels)) {
+				candidates = append(candidates, group.Peers...)
+			}
+		}
+
+		var nodeConfig common.NodeConfig
+		for _, peer := range candidates {
+			nodeConfig.Peers = append(nodeConfig.Peers, resolvePeerAddresses(peer, node, logger)...)
+		}
+
+		if asn, ok := nodeLocalASN(routeCR, node, logger); ok {
+			nodeConfig.LocalASN = asn
+		} else {
+			nodeConfig.LocalASN = routeCR.Status.NodeASNs[node.Name]
+		}
+		nodeConfig.RouterID = nodeRouterID(routeCR, node, logger)
+
+		if nodeConfig.LocalASN != 0 || nodeConfig.RouterID != "" || len(nodeConfig.Peers) > 0 {
+			nodeConfigs[node.Name] = nodeConfig
+		}
+	}
+
+	if len(nodeConfigs) == 0 {
+		return nil, nil
+	}
+	return nodeConfigs, nil
+}
+
+// allocateNodeASNs allocates a local ASN from the range of the BGPRoute to every node running an agent without its own
+// ASN. Nodes keep the ASN allocated in the status while it stays within the range, and new nodes get the lowest free
+// ASNs in the order of their names. Nodes left without ASN once the range is exhausted fall back to the LocalASN
+func allocateNodeASNs(routeCR bgpv1alphav1.BGPRoute, nodes []corev1.Node, logger logr.Logger) map[string]uint32 {
+	asnRange := routeCR.Spec.LocalASNRange
+	if asnRange == nil {
+		return nil
+	}
+
+	agentSelector := labels.SelectorFromSet(routeCR.Spec.NodeSelector)
+	allocated := make(map[string]uint32)
+	used := make(map[uint32]bool)
+	var pending []string
+	for _, node := range nodes {
+		if !agentSelector.Matches(labels.Set(node.Labels)) {
+			continue
+		}
+		if _, ok := nodeLocalASN(routeCR, node, logger); ok {
+			continue
+		}
+
+		asn, ok := routeCR.Status.NodeASNs[node.Name]
+		if ok && asn >= asnRange.First && asn <= asnRange.Last && !used[asn] && common.ValidateASN(asn) == nil {
+			allocated[node.Name] = asn
+			used[asn] = true
+			continue
+		}
+		pending = append(pending, node.Name)
+	}
+
+	// Reserved ASNs within the range are never allocated, as the agents would reject them
+	slices.Sort(pending)
+	next := asnRange.First
+	for _, nodeName := range pending {
+		for next <= asnRange.Last && (used[next] || common.ValidateASN(next) != nil) {
+			next++
+		}
+		if next > asnRange.Last {
+			logger.Error(nil, "No ASN left in the local ASN range for node", "Node.Name", nodeName)
+			continue
+		}
+
+		allocated[nodeName] = next
+		used[next] = true
+	}
+
+	if len(allocated) == 0 {
+		return nil
+	}
+	return allocated
+}
+
+// nodeLocalASN reads the local ASN of the node from the label or annotation referenced by the BGPRoute, if any. Invalid
+// ASNs are skipped so that the node falls back to the other sources of its ASN
+func nodeLocalASN(routeCR bgpv1alphav1.BGPRoute, node corev1.Node, logger logr.Logger) (uint32, bool) {
+	value := nodeMetadata(routeCR.Spec.LocalASNFrom, node)
+	if value == "" {
+		return 0, false
+	}
+
+	asn, err := strconv.ParseUint(value, 10, 32)
+	if err == nil {
+		err = common.ValidateASN(uint32(asn))
+	}
+	if err != nil {
+		logger.Error(err, "Skipping invalid local ASN of node", "Node.Name", node.Name, "asn", value)
+		return 0, false
+	}
+	return uint32(asn), true
+}
+
+// nodeRouterID returns the router ID of the node, read from the label or annotation referenced by the BGPRoute or
+// otherwise taken from the first IPv4 InternalIP of the node. Nodes without any IPv4 address get an empty router ID,
+// so that the agent derives it from the local address of each session
+func nodeRouterID(routeCR bgpv1alphav1.BGPRoute, node corev1.Node, logger logr.Logger) string {
+	if value := nodeMetadata(routeCR.Spec.RouterIDFrom, node); value != "" {
+		if addr, err := netip.ParseAddr(value); err == nil && addr.Is4() && !addr.IsUnspecified() {
+			return addr.String()
+		}
+		logger.Error(nil, "Skipping invalid router ID of node", "Node.Name", node.Name, "routerID", value)
+	}
+
+	for _, address := range node.Status.Addresses {
+		if address.Type != corev1.NodeInternalIP {
+			continue
+		}
+		if addr, err := netip.ParseAddr(address.Address); err == nil && addr.Is4() {
+			return addr.String()
+		}
+	}
+	return ""
+}
+
+// nodeMetadata returns the value of the label or annotation of the node referenced by the source, empty when the
+// source is not set
+func nodeMetadata(source *bgpv1alphav1.NodeMetadataSource, node corev1.Node) string {
+	if source == nil {
+		return ""
+	}
+	if source.Label != "" {
+		return strings.TrimSpace(node.Labels[source.Label])
+	}
+	return strings.TrimSpace(node.Annotations[source.Annotation])
+}
+
+// resolvePeerAddresses returns a peer for every address read from the node when the address of the peer comes from
+// it, or the peer itself otherwise. Invalid addresses are skipped so that they do not prevent the agent from starting
+func resolvePeerAddresses(peer bgpv1alphav1.BGPPeer, node corev1.Node, logger logr.Logger) []bgpv1alphav1.BGPPeer {
+	if peer.AddressFrom == nil {
+		return []bgpv1alphav1.BGPPeer{peer}
 	}
 
+	value := nodeMetadata(peer.AddressFrom, node)
+
+	var peers []bgpv1alphav1.BGPPeer
+	for _, address := range strings.Split(value, ",") {
+		address = strings.TrimSpace(address)
+		if address == "" {
+			continue
+		}
+		if _, err := netip.ParseAddr(address); err != nil {
+			logger.Error(err, "Skipping invalid peer address of node", "Node.Name", node.Name, "address", address)
+			continue
+		}
+
+		resolved := *peer.DeepCopy()
+		resolved.Address, resolved.AddressFrom = address, nil
+		peers = append(peers, resolved)
+	}
+
+	return peers
+}
+
+func buildAgentConfigMap(routeCR bgpv1alphav1.BGPRoute, cfg common.Config, commonLabels map[string]string) (*corev1.ConfigMap, error) {
 	cfgJSON, err := json.MarshalIndent(cfg, "", "  ")
 	if err != nil {
 		return nil, fmt.Errorf("Failed to marshal config to JSON: %w", err)
@@ -105,9 +328,45 @@ func buildAgentClusterRole(routeCR bgpv1alphav1.BGPRoute, serviceAccount *corev1
 	return clusterRole, clusterRoleBinding
 }
 
-func buildAgentDaemonSet(routeCR bgpv1alphav1.BGPRoute, configMap *corev1.ConfigMap, serviceAccount *corev1.ServiceAccount, commonLabels map[string]string) *appsv1.DaemonSet {
+func buildAgentDaemonSet(routeCR bgpv1alphav1.BGPRoute, cfg common.Config, configMap *corev1.ConfigMap, serviceAccount *corev1.ServiceAccount, commonLabels map[string]string) *appsv1.DaemonSet {
 	image := fmt.Sprintf("%s:%s", routeCR.Spec.Agent.Image, routeCR.Spec.Agent.Version)
 	configMapHash := calculateCMapHash(configMap.Data)
+	terminationGracePeriod := int64(routeCR.Spec.Agent.DrainIntervalSeconds) + TerminationGracePeriodBufferSeconds
+
+	volumeMounts := []corev1.VolumeMount{
+		{
+			Name:      DaemonSetVolumeMountName,
+			MountPath: common.ConfigMapPath,
+			ReadOnly:  true,
+		},
+	}
+	// Mount the ConfigMap as a volume so that it can be accessed by the agent
+	volumes := []corev1.Volume{
+		{
+			Name: DaemonSetVolumeMountName,
+			VolumeSource: corev1.VolumeSource{
+				ConfigMap: &corev1.ConfigMapVolumeSource{
+					LocalObjectReference: corev1.LocalObjectReference{
+						Name: configMap.Name,
+					},
+				},
+			},
+		},
+	}
+
+	// Passwords are projected from their secrets instead of being copied to the ConfigMap
+	peers := cfg.Peers
+	for _, nodeName := range slices.Sorted(maps.Keys(cfg.Nodes)) {
+		peers = append(peers, cfg.Nodes[nodeName].Peers...)
+	}
+	if passwordsVolume := buildPeerPasswordsVolume(peers); passwordsVolume != nil {
+		volumeMounts = append(volumeMounts, corev1.VolumeMount{
+			Name:      DaemonSetPasswordsVolumeName,
+			MountPath: common.PeerPasswordsPath,
+			ReadOnly:  true,
+		})
+		volumes = append(volumes, *passwordsVolume)
+	}
 
 	dsName := fmt.Sprintf("routebird-agent-%s", routeCR.Name)
 	labels := withExtraLabels(commonLabels, map[string]string{
@@ -116,10 +375,9 @@ func buildAgentDaemonSet(routeCR bgpv1alphav1.BGPRoute, configMap *corev1.Config
 
 	return &appsv1.DaemonSet{
 		ObjectMeta: metav1.ObjectMeta{
-			Name:        dsName,
-			Namespace:   routeCR.Namespace,
-			Labels:      commonLabels,
-			Annotations: map[string]string{ConfigMapHashAnnotationKey: configMapHash},
+			Name:      dsName,
+			Namespace: routeCR.Namespace,
+			Labels:    commonLabels,
 		},
 		Spec: appsv1.DaemonSetSpec{
 			Selector: &metav1.LabelSelector{
@@ -128,42 +386,37 @@ func buildAgentDaemonSet(routeCR bgpv1alphav1.BGPRoute, configMap *corev1.Config
 			Template: corev1.PodTemplateSpec{
 				ObjectMeta: metav1.ObjectMeta{
 					Labels: labels,
+					// Changes of the ConfigMap roll out the agents, so that every setting applies to them
+					Annotations: map[string]string{ConfigMapHashAnnotationKey: configMapHash},
 				},
 				Spec: corev1.PodSpec{
 					// HostNetwork must be true in order to bind to the host's network
 					HostNetwork:        true,
 					ServiceAccountName: serviceAccount.Name,
+					// The agent withdraws its routes and waits for the drain interval before exiting on SIGTERM
+					TerminationGracePeriodSeconds: &terminationGracePeriod,
 					Containers: []corev1.Container{
 						{
 							Name:  "routebird-agent",
 							Image: image,
 							Args:  []string{"--config", fmt.Sprintf("%s/%s", common.ConfigMapPath, common.ConfigMapFilename)},
-							VolumeMounts: []corev1.VolumeMount{
+							Env: []corev1.EnvVar{
 								{
-									Name:      DaemonSetVolumeMountName,
-									MountPath: common.ConfigMapPath,
-									ReadOnly:  true,
+									// Expose the node name through the downward API so that the agent only considers local endpoints
+									Name: common.NodeNameEnvVar,
+									ValueFrom: &corev1.EnvVarSource{
+										FieldRef: &corev1.ObjectFieldSelector{FieldPath: "spec.nodeName"},
+									},
 								},
 							},
+							VolumeMounts: volumeMounts,
 							Ports: []corev1.ContainerPort{
 								{ContainerPort: routeCR.Spec.BGPLocalPort, Name: "bgp", Protocol: corev1.ProtocolTCP},
 							},
 							ImagePullPolicy: routeCR.Spec.Agent.ImagePullPolicy,
 						},
 					},
-					// Mount the ConfigMap as a volume so that it can be accessed by the agent
-					Volumes: []corev1.Volume{
-						{
-							Name: DaemonSetVolumeMountName,
-							VolumeSource: corev1.VolumeSource{
-								ConfigMap: &corev1.ConfigMapVolumeSource{
-									LocalObjectReference: corev1.LocalObjectReference{
-										Name: configMap.Name,
-									},
-								},
-							},
-						},
-					},
+					Volumes: volumes,
 					// Filter in which nodes the agent will run
 					NodeSelector: routeCR.Spec.NodeSelector,
 					Tolerations:  routeCR.Spec.Tolerations,
@@ -172,3 +425,42 @@ func buildAgentDaemonSet(routeCR bgpv1alphav1.BGPRoute, configMap *corev1.Config
 		},
 	}
 }
+
+// buildPeerPasswordsVolume returns a volume projecting the TCP MD5 password of every peer referencing one into a file
+// named after its secret key, or nil if no peer uses a password. Secret keys referenced by several peers are projected
+// once
+func buildPeerPasswordsVolume(peers []bgpv1alphav1.BGPPeer) *corev1.Volume {
+	var sources []corev1.VolumeProjection
+	projected := make(map[string]bool)
+	for _, peer := range peers {
+		if peer.PasswordSecretRef == nil {
+			continue
+		}
+		filename := common.PeerPasswordFilename(*peer.PasswordSecretRef)
+		if projected[filename] {
+			continue
+		}
+		projected[filename] = true
+
+		sources = append(sources, corev1.VolumeProjection{
+			Secret: &corev1.SecretProjection{
+				LocalObjectReference: peer.PasswordSecretRef.LocalObjectReference,
+				Items: []corev1.KeyToPath{
+					{Key: peer.PasswordSecretRef.Key, Path: filename},
+				},
+				Optional: peer.PasswordSecretRef.Optional,
+			},
+		})
+	}
+
+	if len(sources) == 0 {
+		return nil
+	}
+
+	return &corev1.Volume{
+		Name: DaemonSetPasswordsVolumeName,
+		VolumeSource: corev1.VolumeSource{
+			Projected: &corev1.ProjectedVolumeSource{Sources: sources},
+		},
+	}
+}
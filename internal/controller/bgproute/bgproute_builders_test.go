@@ -0,0 +1,389 @@
+package controller
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/go-logr/logr"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	bgpv1alphav1 "github.com/yago-123/routebird/api/v1alphav1"
+	"github.com/yago-123/routebird/internal/common"
+)
+
+const peersAnnotation = "routebird.dev/peers"
+
+func TestBuildNodeConfigs(t *testing.T) {
+	routeCR := bgpv1alphav1.BGPRoute{
+		Spec: bgpv1alphav1.BGPRouteSpec{
+			NodeSelector: map[string]string{"bgp": "true"},
+			NodePeers: []bgpv1alphav1.NodePeerGroup{{
+				NodeSelector: metav1.LabelSelector{MatchLabels: map[string]string{"rack": "a"}},
+				Peers:        []bgpv1alphav1.BGPPeer{{Address: "10.0.0.1", ASN: 65010}},
+			}},
+		},
+	}
+	peers := []bgpv1alphav1.BGPPeer{{AddressFrom: &bgpv1alphav1.NodeMetadataSource{Annotation: peersAnnotation}, ASN: 65020}}
+
+	nodes := []corev1.Node{
+		{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:        "node-a",
+				Labels:      map[string]string{"bgp": "true", "rack": "a"},
+				Annotations: map[string]string{peersAnnotation: "192.0.2.1, 192.0.2.2"},
+			},
+			Status: corev1.NodeStatus{Addresses: []corev1.NodeAddress{
+				{Type: corev1.NodeInternalIP, Address: "2001:db8::1"},
+				{Type: corev1.NodeInternalIP, Address: "10.1.0.1"},
+			}},
+		},
+		{
+			// Matches the agents but has neither peers nor addresses, so it is left out
+			ObjectMeta: metav1.ObjectMeta{Name: "node-b", Labels: map[string]string{"bgp": "true"}},
+		},
+		{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:        "node-c",
+				Labels:      map[string]string{"bgp": "true"},
+				Annotations: map[string]string{peersAnnotation: "192.0.2.3"},
+			},
+		},
+		{
+			// Does not run an agent, even though it matches the node peer group
+			ObjectMeta: metav1.ObjectMeta{
+				Name:        "node-d",
+				Labels:      map[string]string{"rack": "a"},
+				Annotations: map[string]string{peersAnnotation: "192.0.2.4"},
+			},
+			Status: corev1.NodeStatus{Addresses: []corev1.NodeAddress{{Type: corev1.NodeInternalIP, Address: "10.1.0.4"}}},
+		},
+	}
+
+	nodeConfigs, err := buildNodeConfigs(routeCR, peers, nodes, logr.Discard())
+	if err != nil {
+		t.Fatalf("failed to build node configs: %v", err)
+	}
+
+	expected := map[string]common.NodeConfig{
+		"node-a": {
+			RouterID: "10.1.0.1",
+			Peers: []bgpv1alphav1.BGPPeer{
+				{Address: "192.0.2.1", ASN: 65020},
+				{Address: "192.0.2.2", ASN: 65020},
+				{Address: "10.0.0.1", ASN: 65010},
+			},
+		},
+		"node-c": {
+			Peers: []bgpv1alphav1.BGPPeer{{Address: "192.0.2.3", ASN: 65020}},
+		},
+	}
+	if !reflect.DeepEqual(nodeConfigs, expected) {
+		t.Fatalf("unexpected node configs:\n got: %+v\nwant: %+v", nodeConfigs, expected)
+	}
+}
+
+func TestBuildNodeConfigsInvalidSelector(t *testing.T) {
+	routeCR := bgpv1alphav1.BGPRoute{
+		Spec: bgpv1alphav1.BGPRouteSpec{
+			NodePeers: []bgpv1alphav1.NodePeerGroup{{
+				NodeSelector: metav1.LabelSelector{MatchExpressions: []metav1.LabelSelectorRequirement{
+					{Key: "rack", Operator: "Unknown"},
+				}},
+			}},
+		},
+	}
+
+	if _, err := buildNodeConfigs(routeCR, nil, nil, logr.Discard()); err == nil {
+		t.Fatalf("expected invalid node selector to fail")
+	}
+}
+
+func TestResolvePeerAddresses(t *testing.T) {
+	node := corev1.Node{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:        "node",
+			Labels:      map[string]string{"peer": "192.0.2.1"},
+			Annotations: map[string]string{peersAnnotation: " 192.0.2.2,,invalid, 2001:db8::2 "},
+		},
+	}
+
+	tests := []struct {
+		name     string
+		peer     bgpv1alphav1.BGPPeer
+		expected []bgpv1alphav1.BGPPeer
+	}{
+		{
+			name:     "static address",
+			peer:     bgpv1alphav1.BGPPeer{Address: "10.0.0.1", ASN: 65001},
+			expected: []bgpv1alphav1.BGPPeer{{Address: "10.0.0.1", ASN: 65001}},
+		},
+		{
+			name:     "address from label",
+			peer:     bgpv1alphav1.BGPPeer{AddressFrom: &bgpv1alphav1.NodeMetadataSource{Label: "peer"}, ASN: 65001},
+			expected: []bgpv1alphav1.BGPPeer{{Address: "192.0.2.1", ASN: 65001}},
+		},
+		{
+			name: "addresses from annotation skipping invalid ones",
+			peer: bgpv1alphav1.BGPPeer{AddressFrom: &bgpv1alphav1.NodeMetadataSource{Annotation: peersAnnotation}, ASN: 65001},
+			expected: []bgpv1alphav1.BGPPeer{
+				{Address: "192.0.2.2", ASN: 65001},
+				{Address: "2001:db8::2", ASN: 65001},
+			},
+		},
+		{
+			name: "missing label",
+			peer: bgpv1alphav1.BGPPeer{AddressFrom: &bgpv1alphav1.NodeMetadataSource{Label: "missing"}, ASN: 65001},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			peers := resolvePeerAddresses(tt.peer, node, logr.Discard())
+			if !reflect.DeepEqual(peers, tt.expected) {
+				t.Fatalf("unexpected peers:\n got: %+v\nwant: %+v", peers, tt.expected)
+			}
+		})
+	}
+}
+
+const asnAnnotation = "routebird.dev/asn"
+
+// testNode returns a node running an agent, with the given local ASN annotation unless empty
+func testNode(name, asn string) corev1.Node {
+	node := corev1.Node{ObjectMeta: metav1.ObjectMeta{Name: name, Labels: map[string]string{"bgp": "true"}}}
+	if asn != "" {
+		node.Annotations = map[string]string{asnAnnotation: asn}
+	}
+	return node
+}
+
+func TestAllocateNodeASNs(t *testing.T) {
+	tests := []struct {
+		name     string
+		asnRange *bgpv1alphav1.ASNRange
+		status   map[string]uint32
+		nodes    []corev1.Node
+		expected map[string]uint32
+	}{
+		{
+			name:  "no range",
+			nodes: []corev1.Node{testNode("node-a", "")},
+		},
+		{
+			name:     "allocated in name order",
+			asnRange: &bgpv1alphav1.ASNRange{First: 65000, Last: 65010},
+			nodes:    []corev1.Node{testNode("node-b", ""), testNode("node-a", "")},
+			expected: map[string]uint32{"node-a": 65000, "node-b": 65001},
+		},
+		{
+			name:     "allocations kept from status",
+			asnRange: &bgpv1alphav1.ASNRange{First: 65000, Last: 65010},
+			status:   map[string]uint32{"node-b": 65005},
+			nodes:    []corev1.Node{testNode("node-a", ""), testNode("node-b", "")},
+			expected: map[string]uint32{"node-a": 65000, "node-b": 65005},
+		},
+		{
+			name:     "allocation outside of range replaced",
+			asnRange: &bgpv1alphav1.ASNRange{First: 65000, Last: 65010},
+			status:   map[string]uint32{"node-a": 64512},
+			nodes:    []corev1.Node{testNode("node-a", "")},
+			expected: map[string]uint32{"node-a": 65000},
+		},
+		{
+			name:     "colliding allocations",
+			asnRange: &bgpv1alphav1.ASNRange{First: 65000, Last: 65010},
+			status:   map[string]uint32{"node-a": 65003, "node-b": 65003},
+			nodes:    []corev1.Node{testNode("node-a", ""), testNode("node-b", "")},
+			expected: map[string]uint32{"node-a": 65003, "node-b": 65000},
+		},
+		{
+			name:     "annotation overrides range",
+			asnRange: &bgpv1alphav1.ASNRange{First: 65000, Last: 65010},
+			nodes:    []corev1.Node{testNode("node-a", "64512"), testNode("node-b", "")},
+			expected: map[string]uint32{"node-b": 65000},
+		},
+		{
+			name:     "invalid annotation falls back to range",
+			asnRange: &bgpv1alphav1.ASNRange{First: 65000, Last: 65010},
+			nodes:    []corev1.Node{testNode("node-a", "23456")},
+			expected: map[string]uint32{"node-a": 65000},
+		},
+		{
+			name:     "reserved ASNs skipped",
+			asnRange: &bgpv1alphav1.ASNRange{First: 65535, Last: 65536},
+			status:   map[string]uint32{"node-b": 65535},
+			nodes:    []corev1.Node{testNode("node-a", ""), testNode("node-b", "")},
+			expected: map[string]uint32{"node-a": 65536},
+		},
+		{
+			name:     "range exhausted",
+			asnRange: &bgpv1alphav1.ASNRange{First: 65000, Last: 65001},
+			nodes:    []corev1.Node{testNode("node-c", ""), testNode("node-b", ""), testNode("node-a", "")},
+			expected: map[string]uint32{"node-a": 65000, "node-b": 65001},
+		},
+		{
+			name:     "nodes without agent skipped",
+			asnRange: &bgpv1alphav1.ASNRange{First: 65000, Last: 65010},
+			nodes:    []corev1.Node{{ObjectMeta: metav1.ObjectMeta{Name: "node-a"}}, testNode("node-b", "")},
+			expected: map[string]uint32{"node-b": 65000},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			routeCR := bgpv1alphav1.BGPRoute{
+				Spec: bgpv1alphav1.BGPRouteSpec{
+					NodeSelector:  map[string]string{"bgp": "true"},
+					LocalASNFrom:  &bgpv1alphav1.NodeMetadataSource{Annotation: asnAnnotation},
+					LocalASNRange: tt.asnRange,
+				},
+				Status: bgpv1alphav1.BGPRouteStatus{NodeASNs: tt.status},
+			}
+
+			if allocated := allocateNodeASNs(routeCR, tt.nodes, logr.Discard()); !reflect.DeepEqual(allocated, tt.expected) {
+				t.Fatalf("expected %v, got %v", tt.expected, allocated)
+			}
+		})
+	}
+}
+
+func TestNodeLocalASN(t *testing.T) {
+	tests := []struct {
+		value    string
+		expected uint32
+		ok       bool
+	}{
+		{value: ""},
+		{value: "65001", expected: 65001, ok: true},
+		{value: " 4200000001 ", expected: 4200000001, ok: true},
+		{value: "0"},
+		{value: "23456"},
+		{value: "65535"},
+		{value: "4294967295"},
+		{value: "4294967296"},
+		{value: "AS65001"},
+	}
+
+	routeCR := bgpv1alphav1.BGPRoute{
+		Spec: bgpv1alphav1.BGPRouteSpec{LocalASNFrom: &bgpv1alphav1.NodeMetadataSource{Annotation: asnAnnotation}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.value, func(t *testing.T) {
+			asn, ok := nodeLocalASN(routeCR, testNode("node", tt.value), logr.Discard())
+			if asn != tt.expected || ok != tt.ok {
+				t.Fatalf("expected %d, %v, got %d, %v", tt.expected, tt.ok, asn, ok)
+			}
+		})
+	}
+}
+
+func TestNodeRouterID(t *testing.T) {
+	addresses := []corev1.NodeAddress{
+		{Type: corev1.NodeExternalIP, Address: "203.0.113.1"},
+		{Type: corev1.NodeInternalIP, Address: "2001:db8::1"},
+		{Type: corev1.NodeInternalIP, Address: "10.1.0.1"},
+	}
+
+	tests := []struct {
+		name        string
+		source      *bgpv1alphav1.NodeMetadataSource
+		labels      map[string]string
+		annotations map[string]string
+		addresses   []corev1.NodeAddress
+		expected    string
+	}{
+		{
+			name:      "first IPv4 InternalIP",
+			addresses: addresses,
+			expected:  "10.1.0.1",
+		},
+		{
+			name:     "no IPv4 InternalIP",
+			source:   &bgpv1alphav1.NodeMetadataSource{Label: "router-id"},
+			expected: "",
+			addresses: []corev1.NodeAddress{
+				{Type: corev1.NodeExternalIP, Address: "203.0.113.1"},
+				{Type: corev1.NodeInternalIP, Address: "2001:db8::1"},
+			},
+		},
+		{
+			name:      "label overrides addresses",
+			source:    &bgpv1alphav1.NodeMetadataSource{Label: "router-id"},
+			labels:    map[string]string{"router-id": "192.0.2.1"},
+			addresses: addresses,
+			expected:  "192.0.2.1",
+		},
+		{
+			name:        "annotation overrides addresses",
+			source:      &bgpv1alphav1.NodeMetadataSource{Annotation: "routebird.dev/router-id"},
+			annotations: map[string]string{"routebird.dev/router-id": "192.0.2.2"},
+			addresses:   addresses,
+			expected:    "192.0.2.2",
+		},
+		{
+			name:        "IPv6 annotation falls back to addresses",
+			source:      &bgpv1alphav1.NodeMetadataSource{Annotation: "routebird.dev/router-id"},
+			annotations: map[string]string{"routebird.dev/router-id": "2001:db8::2"},
+			addresses:   addresses,
+			expected:    "10.1.0.1",
+		},
+		{
+			name:        "unspecified annotation falls back to addresses",
+			source:      &bgpv1alphav1.NodeMetadataSource{Annotation: "routebird.dev/router-id"},
+			annotations: map[string]string{"routebird.dev/router-id": "0.0.0.0"},
+			addresses:   addresses,
+			expected:    "10.1.0.1",
+		},
+		{
+			name:        "invalid annotation without addresses",
+			source:      &bgpv1alphav1.NodeMetadataSource{Annotation: "routebird.dev/router-id"},
+			annotations: map[string]string{"routebird.dev/router-id": "router-1"},
+			expected:    "",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			routeCR := bgpv1alphav1.BGPRoute{Spec: bgpv1alphav1.BGPRouteSpec{RouterIDFrom: tt.source}}
+			node := corev1.Node{
+				ObjectMeta: metav1.ObjectMeta{Name: "node", Labels: tt.labels, Annotations: tt.annotations},
+				Status:     corev1.NodeStatus{Addresses: tt.addresses},
+			}
+
+			if routerID := nodeRouterID(routeCR, node, logr.Discard()); routerID != tt.expected {
+				t.Fatalf("expected router ID %q, got %q", tt.expected, routerID)
+			}
+		})
+	}
+}
+
+func TestBuildPeerPasswordsVolume(t *testing.T) {
+	secretKey := func(name, key string) *corev1.SecretKeySelector {
+		return &corev1.SecretKeySelector{LocalObjectReference: corev1.LocalObjectReference{Name: name}, Key: key}
+	}
+
+	// Peers of different racks share their address while referencing different secrets
+	volume := buildPeerPasswordsVolume([]bgpv1alphav1.BGPPeer{
+		{Address: "192.0.2.1", ASN: 65001, PasswordSecretRef: secretKey("rack-a", "tor")},
+		{Address: "192.0.2.1", ASN: 65001, PasswordSecretRef: secretKey("rack-b", "tor")},
+		{Address: "192.0.2.2", ASN: 65001, PasswordSecretRef: secretKey("rack-a", "tor")},
+		{Address: "192.0.2.3", ASN: 65001},
+	})
+	if volume == nil {
+		t.Fatalf("expected passwords volume")
+	}
+
+	var items []corev1.KeyToPath
+	for _, source := range volume.Projected.Sources {
+		items = append(items, source.Secret.Items...)
+	}
+	expected := []corev1.KeyToPath{{Key: "tor", Path: "rack-a_tor"}, {Key: "tor", Path: "rack-b_tor"}}
+	if !reflect.DeepEqual(items, expected) {
+		t.Fatalf("expected projected passwords %+v, got %+v", expected, items)
+	}
+
+	if volume = buildPeerPasswordsVolume([]bgpv1alphav1.BGPPeer{{Address: "192.0.2.1", ASN: 65001}}); volume != nil {
+		t.Fatalf("expected no passwords volume, got %+v", volume)
+	}
+}
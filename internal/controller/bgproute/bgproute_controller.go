@@ -19,13 +19,20 @@ package controller
 import (
 	"context"
 	"fmt"
+	"maps"
+	"slices"
 
 	appsv1 "k8s.io/api/apps/v1"
 	corev1 "k8s.io/api/core/v1"
 	"k8s.io/apimachinery/pkg/runtime"
 	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/builder"
 	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/event"
+	"sigs.k8s.io/controller-runtime/pkg/handler"
 	"sigs.k8s.io/controller-runtime/pkg/log"
+	"sigs.k8s.io/controller-runtime/pkg/predicate"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
 
 	bgpv1alphav1 "github.com/yago-123/routebird/api/v1alphav1"
 )
@@ -36,7 +43,10 @@ import (
 // +kubebuilder:rbac:groups="",resources=configmaps,verbs=get;create;update;list;watch
 
 // Permissions for managing ConfigMaps
-// +kubebuilder:rbac:groups=apps,resources=daemonsets,verbs=get;create;list;watch
+// +kubebuilder:rbac:groups=apps,resources=daemonsets,verbs=get;create;update;list;watch
+
+// Permissions for rendering the settings of each node
+// +kubebuilder:rbac:groups="",resources=nodes,verbs=get;list;watch
 
 type BGPRouteReconciler struct {
 	client.Client
@@ -62,10 +72,29 @@ func (r *BGPRouteReconciler) Reconcile(ctx context.Context, req ctrl.Request) (c
 		"route": routeCR.Name,
 	}
 
+	/*
+		Allocate the ASNs of the nodes and render the configuration of the agents, including the settings of each node
+	*/
+	var nodes corev1.NodeList
+	if err := r.List(ctx, &nodes); err != nil {
+		return ctrl.Result{}, fmt.Errorf("failed to list nodes: %w", err)
+	}
+	if nodeASNs := allocateNodeASNs(routeCR, nodes.Items, logger); !maps.Equal(nodeASNs, routeCR.Status.NodeASNs) {
+		routeCR.Status.NodeASNs = nodeASNs
+		if err := r.Status().Update(ctx, &routeCR); err != nil {
+			return ctrl.Result{}, fmt.Errorf("failed to update ASNs allocated to nodes: %w", err)
+		}
+		logger.Info("Updated ASNs allocated to nodes", "nodes", len(nodeASNs))
+	}
+	agentCfg, err := buildAgentConfig(routeCR, nodes.Items, logger)
+	if err != nil {
+		return ctrl.Result{}, fmt.Errorf("Error generating agent configuration: %w", err)
+	}
+
 	/*
 		Create, set up owner reference and create config map for routebird-agent
 	*/
-	desiredCMap, err := buildAgentConfigMap(routeCR, commonLabels)
+	desiredCMap, err := buildAgentConfigMap(routeCR, agentCfg, commonLabels)
 	if err != nil {
 		return ctrl.Result{}, fmt.Errorf("Error generating ConfigMap object: %w", err)
 	}
@@ -103,7 +132,7 @@ func (r *BGPRouteReconciler) Reconcile(ctx context.Context, req ctrl.Request) (c
 	/*
 		Create, set up owner reference and create daemon set for routebird-agent
 	*/
-	desiredDSet := buildAgentDaemonSet(routeCR, desiredCMap, desiredSAccount, commonLabels)
+	desiredDSet := buildAgentDaemonSet(routeCR, agentCfg, desiredCMap, desiredSAccount, commonLabels)
 	if err = ctrl.SetControllerReference(&routeCR, desiredDSet, r.Scheme); err != nil {
 		logger.Error(err, "Failed to set owner reference for DaemonSet", "DaemonSet.Name", desiredDSet.Name)
 		return ctrl.Result{}, err
@@ -121,6 +150,55 @@ func (r *BGPRouteReconciler) SetupWithManager(mgr ctrl.Manager) error {
 		For(&bgpv1alphav1.BGPRoute{}).
 		Owns(&corev1.ConfigMap{}).
 		Owns(&appsv1.DaemonSet{}).
+		// The settings of each node are rendered from its labels, annotations and addresses
+		Watches(
+			&corev1.Node{},
+			handler.EnqueueRequestsFromMapFunc(r.routesForNode),
+			builder.WithPredicates(nodeChangedPredicate()),
+		).
 		Named("routebird").
 		Complete(r)
 }
+
+// routesForNode returns a reconciliation request for every BGPRoute, as any of them may render settings for the node
+func (r *BGPRouteReconciler) routesForNode(ctx context.Context, _ client.Object) []reconcile.Request {
+	var routes bgpv1alphav1.BGPRouteList
+	if err := r.List(ctx, &routes); err != nil {
+		log.FromContext(ctx).Error(err, "Failed to list BGPRoutes")
+		return nil
+	}
+
+	requests := make([]reconcile.Request, 0, len(routes.Items))
+	for _, route := range routes.Items {
+		requests = append(requests, reconcile.Request{NamespacedName: client.ObjectKeyFromObject(&route)})
+	}
+	return requests
+}
+
+// nodeChangedPredicate filters the updates of nodes that change any of the labels, annotations or addresses from which
+// the settings of the node are rendered
+func nodeChangedPredicate() predicate.Predicate {
+	return predicate.Or(
+		predicate.LabelChangedPredicate{},
+		predicate.AnnotationChangedPredicate{},
+		nodeAddressesChangedPredicate(),
+	)
+}
+
+// nodeAddressesChangedPredicate filters the updates of nodes that change their addresses, from which the router IDs are
+// derived
+func nodeAddressesChangedPredicate() predicate.Funcs {
+	return predicate.Funcs{
+		UpdateFunc: func(e event.UpdateEvent) bool {
+			oldNode, ok := e.ObjectOld.(*corev1.Node)
+			if !ok {
+				return false
+			}
+			newNode, ok := e.ObjectNew.(*corev1.Node)
+			if !ok {
+				return false
+			}
+			return !slices.Equal(oldNode.Status.Addresses, newNode.Status.Addresses)
+		},
+	}
+}
@@ -0,0 +1,76 @@
+package controller
+
+import (
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sigs.k8s.io/controller-runtime/pkg/event"
+)
+
+func TestNodeChangedPredicate(t *testing.T) {
+	node := &corev1.Node{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:        "node",
+			Labels:      map[string]string{"rack": "a"},
+			Annotations: map[string]string{"routebird.dev/asn": "65001"},
+		},
+		Status: corev1.NodeStatus{
+			Addresses: []corev1.NodeAddress{{Type: corev1.NodeInternalIP, Address: "10.1.0.1"}},
+		},
+	}
+
+	tests := []struct {
+		name     string
+		update   func(node *corev1.Node)
+		expected bool
+	}{
+		{
+			name:     "no change",
+			update:   func(*corev1.Node) {},
+			expected: false,
+		},
+		{
+			name:     "label changed",
+			update:   func(node *corev1.Node) { node.Labels["rack"] = "b" },
+			expected: true,
+		},
+		{
+			name:     "annotation changed",
+			update:   func(node *corev1.Node) { node.Annotations["routebird.dev/asn"] = "65002" },
+			expected: true,
+		},
+		{
+			name: "address changed",
+			update: func(node *corev1.Node) {
+				node.Status.Addresses[0].Address = "10.1.0.2"
+			},
+			expected: true,
+		},
+		{
+			name: "address added",
+			update: func(node *corev1.Node) {
+				node.Status.Addresses = append(node.Status.Addresses, corev1.NodeAddress{Type: corev1.NodeHostName, Address: "node"})
+			},
+			expected: true,
+		},
+		{
+			name: "unrelated status changed",
+			update: func(node *corev1.Node) {
+				node.Status.Conditions = []corev1.NodeCondition{{Type: corev1.NodeReady, Status: corev1.ConditionTrue}}
+			},
+			expected: false,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			updated := node.DeepCopy()
+			tt.update(updated)
+
+			if got := nodeChangedPredicate().Update(event.UpdateEvent{ObjectOld: node, ObjectNew: updated}); got != tt.expected {
+				t.Fatalf("expected %v, got %v", tt.expected, got)
+			}
+		})
+	}
+}
@@ -6,6 +6,7 @@ import (
 	"reflect"
 
 	rbacv1 "k8s.io/api/rbac/v1"
+	"k8s.io/apimachinery/pkg/api/equality"
 
 	"sigs.k8s.io/controller-runtime/pkg/log"
 
@@ -54,10 +55,23 @@ func (r *BGPRouteReconciler) reconcileAgentClusterRoles(ctx context.Context, des
 }
 
 func (r *BGPRouteReconciler) reconcileAgentDaemonSet(ctx context.Context, desiredDSet *appsv1.DaemonSet) error {
-	// todo() use genericReconciliationWithDiff so that DaemonSet is updated if spec changes
-	if _, err := r.genericReconciliation(ctx, desiredDSet); err != nil {
+	if err := r.genericReconciliationWithDiff(ctx, desiredDSet, func(existing, desired client.Object) bool {
+		existingDS := existing.(*appsv1.DaemonSet)
+		desiredDS := desired.(*appsv1.DaemonSet)
+
+		// Fields left unset in the desired pod template are defaulted by the API server, so they are not compared.
+		// Only the annotations set by the controller are compared, such as the hash of the ConfigMap
+		if equality.Semantic.DeepDerivative(desiredDS.Spec.Template, existingDS.Spec.Template) {
+			return false // No update needed
+		}
+
+		// Updating the pod template rolls out the agents with the new volumes, grace period and settings
+		existingDS.Spec.Template = desiredDS.Spec.Template
+		return true // Signal that an update should happen
+	}); err != nil {
 		return err
 	}
+
 	return nil
 }
 
@@ -0,0 +1,80 @@
+package controller
+
+import (
+	"context"
+	"testing"
+
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+
+	bgpv1alphav1 "github.com/yago-123/routebird/api/v1alphav1"
+	"github.com/yago-123/routebird/internal/common"
+)
+
+func TestReconcileAgentDaemonSetUpdatesExisting(t *testing.T) {
+	ctx := context.Background()
+
+	routeCR := bgpv1alphav1.BGPRoute{ObjectMeta: metav1.ObjectMeta{Name: "route", Namespace: "default"}}
+	configMap := &corev1.ConfigMap{ObjectMeta: metav1.ObjectMeta{Name: "routebird-agent-config"}}
+	serviceAccount := &corev1.ServiceAccount{ObjectMeta: metav1.ObjectMeta{Name: "routebird-agent"}}
+
+	// The DaemonSet was created before any peer referenced a password
+	existing := buildAgentDaemonSet(routeCR, common.Config{}, configMap, serviceAccount, nil)
+	r := &BGPRouteReconciler{Client: fake.NewClientBuilder().WithObjects(existing).Build()}
+
+	cfg := common.Config{
+		Peers: []bgpv1alphav1.BGPPeer{{
+			Address: "192.0.2.1",
+			ASN:     65001,
+			PasswordSecretRef: &corev1.SecretKeySelector{
+				LocalObjectReference: corev1.LocalObjectReference{Name: "bgp-passwords"},
+				Key:                  "peer",
+			},
+		}},
+	}
+	if err := r.reconcileAgentDaemonSet(ctx, buildAgentDaemonSet(routeCR, cfg, configMap, serviceAccount, nil)); err != nil {
+		t.Fatalf("failed to reconcile DaemonSet: %v", err)
+	}
+
+	updated := &appsv1.DaemonSet{}
+	if err := r.Get(ctx, client.ObjectKeyFromObject(existing), updated); err != nil {
+		t.Fatalf("failed to get DaemonSet: %v", err)
+	}
+
+	var found bool
+	for _, volume := range updated.Spec.Template.Spec.Volumes {
+		found = found || volume.Name == DaemonSetPasswordsVolumeName
+	}
+	if !found {
+		t.Fatalf("expected passwords volume in existing DaemonSet, got %+v", updated.Spec.Template.Spec.Volumes)
+	}
+
+	// Reconciling the same DaemonSet again leaves it untouched
+	if err := r.reconcileAgentDaemonSet(ctx, buildAgentDaemonSet(routeCR, cfg, configMap, serviceAccount, nil)); err != nil {
+		t.Fatalf("failed to reconcile DaemonSet: %v", err)
+	}
+	unchanged := &appsv1.DaemonSet{}
+	if err := r.Get(ctx, client.ObjectKeyFromObject(existing), unchanged); err != nil {
+		t.Fatalf("failed to get DaemonSet: %v", err)
+	}
+	if unchanged.ResourceVersion != updated.ResourceVersion {
+		t.Fatalf("expected DaemonSet not to be updated, resource version changed from %s to %s",
+			updated.ResourceVersion, unchanged.ResourceVersion)
+	}
+
+	// Changes of the ConfigMap roll out the agents
+	configMap.Data = map[string]string{common.ConfigMapFilename: "{}"}
+	if err := r.reconcileAgentDaemonSet(ctx, buildAgentDaemonSet(routeCR, cfg, configMap, serviceAccount, nil)); err != nil {
+		t.Fatalf("failed to reconcile DaemonSet: %v", err)
+	}
+	rolledOut := &appsv1.DaemonSet{}
+	if err := r.Get(ctx, client.ObjectKeyFromObject(existing), rolledOut); err != nil {
+		t.Fatalf("failed to get DaemonSet: %v", err)
+	}
+	if hash := rolledOut.Spec.Template.Annotations[ConfigMapHashAnnotationKey]; hash != calculateCMapHash(configMap.Data) {
+		t.Fatalf("expected pod template to be annotated with the hash of the ConfigMap, got %q", hash)
+	}
+}